@@ -3,8 +3,8 @@ package cmd
 import (
 	"github.com/fbufler/ssh-tunnel-setup/config"
 	"github.com/fbufler/ssh-tunnel-setup/internal"
+	"github.com/fbufler/ssh-tunnel-setup/package/state"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 func ClientCmd() *cobra.Command {
@@ -13,7 +13,21 @@ func ClientCmd() *cobra.Command {
 		Short: "Setup client",
 		Long:  "Setting up the client side of the tunnel",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return internal.ClientSetup(config.Client())
+			return runSetup(cmd, func() error {
+				if err := readEnrollToken(cmd); err != nil {
+					return err
+				}
+				defer config.AppConfig.Client.EnrollToken.Zero()
+				if err := readServerPass(cmd); err != nil {
+					return err
+				}
+				defer config.AppConfig.Client.ServerPass.Zero()
+				if err := readPKCS11PIN(cmd); err != nil {
+					return err
+				}
+				defer config.AppConfig.Client.PKCS11PIN.Zero()
+				return setupClient()
+			})
 		},
 	}
 
@@ -21,25 +35,60 @@ func ClientCmd() *cobra.Command {
 	cmd.Flags().StringP("key-name", "k", "", "Key name")
 	cmd.Flags().StringP("key-directory", "d", "", "Key directory")
 	cmd.Flags().StringP("key-user", "u", "", "Key user")
+	cmd.Flags().String("key-type", "", "Type of the generated key (rsa or ed25519)")
+	cmd.Flags().String("import-key", "", "Adopt the existing private key at this path instead of generating one")
+	cmd.Flags().Bool("force", false, "Replace a key pair that already exists at the key path")
+	cmd.Flags().String("key-source", "", "Where the private key is kept (file, agent or pkcs11)")
+	cmd.Flags().String("pkcs11-module", "", "PKCS #11 library of the token, e.g. /usr/lib/softhsm/libsofthsm2.so")
+	cmd.Flags().String("pkcs11-token", "", "Label of the token holding the key")
+	cmd.Flags().String("pkcs11-key-label", "", "Label of the key on the token")
+	addPKCS11PINFlags(cmd)
 	cmd.Flags().StringP("server-name", "s", "", "Server name")
 	cmd.Flags().IntP("server-port", "p", 22, "Server port")
 	cmd.Flags().StringP("server-user", "U", "", "Server user")
 	cmd.Flags().StringP("server-pass", "P", "", "Server password")
+	addSecretFlags(cmd, "server-pass", "server password")
 	cmd.Flags().StringP("server-key-name", "K", "", "Server key name")
+	cmd.Flags().StringSlice("auth-methods", nil, "Methods to log in to the server with, in order (publickey, password, keyboard-interactive)")
+	addEnrollTokenFlags(cmd)
+	cmd.Flags().String("enroll-user", "", "Account on the server to enroll the key with")
 	cmd.Flags().StringP("server-key-directory", "D", "", "Server key directory")
 	cmd.Flags().Bool("debug", false, "Debug")
+	addDryRunFlag(cmd)
 
-	viper.BindPFlag("client.name", cmd.Flags().Lookup("name"))
-	viper.BindPFlag("client.key_name", cmd.Flags().Lookup("key-name"))
-	viper.BindPFlag("client.key_directory", cmd.Flags().Lookup("key-directory"))
-	viper.BindPFlag("client.key_user", cmd.Flags().Lookup("key-user"))
-	viper.BindPFlag("client.server_name", cmd.Flags().Lookup("server-name"))
-	viper.BindPFlag("client.server_port", cmd.Flags().Lookup("server-port"))
-	viper.BindPFlag("client.server_user", cmd.Flags().Lookup("server-user"))
-	viper.BindPFlag("client.server_pass", cmd.Flags().Lookup("server-pass"))
-	viper.BindPFlag("client.server_key_name", cmd.Flags().Lookup("server-key-name"))
-	viper.BindPFlag("client.server_key_directory", cmd.Flags().Lookup("server-key-directory"))
-	viper.BindPFlag("debug", cmd.Flags().Lookup("debug"))
+	bindFlag(cmd, "client.name", "name")
+	bindFlag(cmd, "client.key-name", "key-name")
+	bindFlag(cmd, "client.key-directory", "key-directory")
+	bindFlag(cmd, "client.key-user", "key-user")
+	bindFlag(cmd, "client.key-type", "key-type")
+	bindFlag(cmd, "client.import-key", "import-key")
+	bindFlag(cmd, "client.force", "force")
+	bindFlag(cmd, "client.key-source", "key-source")
+	bindFlag(cmd, "client.pkcs11-module", "pkcs11-module")
+	bindFlag(cmd, "client.pkcs11-token", "pkcs11-token")
+	bindFlag(cmd, "client.pkcs11-key-label", "pkcs11-key-label")
+	bindFlag(cmd, "client.server-name", "server-name")
+	bindFlag(cmd, "client.server-port", "server-port")
+	bindFlag(cmd, "client.server-user", "server-user")
+	bindFlag(cmd, "client.server-pass", "server-pass")
+	bindFlag(cmd, "client.server-key-name", "server-key-name")
+	bindFlag(cmd, "client.auth-methods", "auth-methods")
+	bindFlag(cmd, "client.enroll-user", "enroll-user")
+	bindFlag(cmd, "client.server-key-directory", "server-key-directory")
+	bindFlag(cmd, "debug", "debug")
 
 	return cmd
 }
+
+// setupClient runs the client setup with the loaded config, the server password has to be read already
+func setupClient() error {
+	manifest, err := state.Load(state.RoleClient)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.Client()
+	if err != nil {
+		return err
+	}
+	return internal.ClientSetup(cfg, manifest)
+}
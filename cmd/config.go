@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+	"github.com/spf13/cobra"
+)
+
+// roleSections are the config sections a role needs
+var roleSections = map[string][]string{
+	"server": {"server"},
+	"client": {"client"},
+	"target": {"client", "tunnel"},
+	"rotate": {"rotate"},
+}
+
+func ConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+		Long:  "Validating, showing and migrating the configuration read from the config files and flags",
+	}
+	cmd.AddCommand(configValidateCmd())
+	cmd.AddCommand(configShowCmd())
+	cmd.AddCommand(configMigrateCmd())
+	return cmd
+}
+
+func configValidateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Validate the configuration",
+		Long:  "Validating the configuration of a role, without --role every configured section is validated",
+		// the invalid settings are already listed
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			role, err := cmd.Flags().GetString("role")
+			if err != nil {
+				return err
+			}
+			sections := []string{}
+			if role != "" {
+				var ok bool
+				if sections, ok = roleSections[role]; !ok {
+					return fmt.Errorf("unknown role %q, expected server, client, target or rotate", role)
+				}
+			} else {
+				for _, section := range config.Sections {
+					if config.Configured(section) {
+						sections = append(sections, section)
+					}
+				}
+			}
+			if len(sections) == 0 {
+				return fmt.Errorf("nothing configured in %v, use --role to validate the defaults", config.SearchPaths())
+			}
+
+			invalid := false
+			for _, section := range sections {
+				err := config.ValidateSection(section)
+				var validationErr *config.ValidationError
+				switch {
+				case err == nil:
+					fmt.Fprintf(cmd.OutOrStdout(), "%s: valid\n", section)
+				case errors.As(err, &validationErr):
+					invalid = true
+					fmt.Fprintf(cmd.OutOrStdout(), "%s: invalid\n", section)
+					for _, field := range validationErr.Fields {
+						source, origin := config.SourceOf(field.Key)
+						if origin != "" {
+							source = config.Source(fmt.Sprintf("%s %s", source, origin))
+						}
+						fmt.Fprintf(cmd.OutOrStdout(), "  %s (%s)\n", field, source)
+					}
+				default:
+					return err
+				}
+			}
+			if invalid {
+				return fmt.Errorf("invalid configuration")
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringP("role", "r", "", "Role to validate (server, client, target or rotate)")
+	cmd.Flags().Bool("debug", false, "Debug")
+	bindFlag(cmd, "debug", "debug")
+
+	return cmd
+}
+
+func configShowCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "show",
+		Short: "Show the configuration",
+		Long:  "Showing the config files in order of precedence, with --effective every setting with its value and source",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			effective, err := cmd.Flags().GetBool("effective")
+			if err != nil {
+				return err
+			}
+			if effective {
+				for _, setting := range config.Effective() {
+					fmt.Fprintln(cmd.OutOrStdout(), setting)
+				}
+				return nil
+			}
+
+			files := config.FilesUsed()
+			if len(files) == 0 {
+				fmt.Fprintf(cmd.OutOrStdout(), "No config file found in %v\n", config.SearchPaths())
+				return nil
+			}
+			for _, file := range files {
+				data, err := system.Files().ReadFile(file)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "# %s\n%s\n", file, data)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool("effective", false, "Show the effective value and source (flag, env, file, default) of every setting")
+	cmd.Flags().Bool("debug", false, "Debug")
+	bindFlag(cmd, "debug", "debug")
+
+	return cmd
+}
+
+func configMigrateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Migrate the config files to the current version",
+		Long:  fmt.Sprintf("Upgrading the config files to version %d, the old files are kept as <file>.v<version>.bak", config.CurrentVersion),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dryRun, err := cmd.Flags().GetBool("dry-run")
+			if err != nil {
+				return err
+			}
+			files := config.FilesUsed()
+			if len(files) == 0 {
+				fmt.Fprintf(cmd.OutOrStdout(), "No config file found in %v\n", config.SearchPaths())
+				return nil
+			}
+			for _, file := range files {
+				migration, err := config.MigrateFile(file, dryRun)
+				if err != nil {
+					return err
+				}
+				if len(migration.Applied) == 0 {
+					fmt.Fprintf(cmd.OutOrStdout(), "%s: up to date (version %d)\n", file, config.CurrentVersion)
+					continue
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s:\n", file)
+				for _, applied := range migration.Applied {
+					fmt.Fprintf(cmd.OutOrStdout(), "  %s\n", applied)
+				}
+				if dryRun {
+					fmt.Fprint(cmd.OutOrStdout(), system.UnifiedDiff(file, file+" (migrated)", migration.Before, migration.After))
+					continue
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "  old file kept as %s\n", migration.Backup)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool("dry-run", false, "Print the changes instead of migrating the files")
+	cmd.Flags().Bool("debug", false, "Debug")
+	bindFlag(cmd, "debug", "debug")
+
+	return cmd
+}
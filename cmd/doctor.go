@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/fbufler/ssh-tunnel-setup/internal"
+	"github.com/spf13/cobra"
+)
+
+func DoctorCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check the machine before a setup",
+		Long:  "Checking the OS, privileges, required binaries, the effective sshd settings, the relay and the keys a setup of the role needs, with hints for the failed checks",
+		// the failed checks are already listed
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			role, err := cmd.Flags().GetString("role")
+			if err != nil {
+				return err
+			}
+			if !slices.Contains(internal.DoctorRoles, role) {
+				return fmt.Errorf("unknown role %q, expected %s", role, strings.Join(internal.DoctorRoles, ", "))
+			}
+			checks := internal.Doctor(role, roleSections[role])
+			for _, check := range checks {
+				fmt.Fprintf(cmd.OutOrStdout(), "%s  %-28s %s\n", check.Status, check.Name, check.Detail)
+				if check.Hint != "" {
+					fmt.Fprintf(cmd.OutOrStdout(), "      %-28s hint: %s\n", "", check.Hint)
+				}
+			}
+			if failed := internal.Failed(checks); failed > 0 {
+				return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "All checks passed\n")
+			return nil
+		},
+	}
+
+	cmd.Flags().StringP("role", "r", "", "Role to check the machine for (server, client or target)")
+	cmd.MarkFlagRequired("role")
+	cmd.Flags().Bool("debug", false, "Debug")
+	bindFlag(cmd, "debug", "debug")
+
+	return cmd
+}
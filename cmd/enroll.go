@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/fbufler/ssh-tunnel-setup/internal"
+	"github.com/fbufler/ssh-tunnel-setup/package/enroll"
+	"github.com/spf13/cobra"
+)
+
+func serverTokenCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "token",
+		Short: "Manage enrollment tokens",
+		Long:  "Issuing, listing and revoking the single-use tokens clients enroll their key with",
+	}
+	cmd.AddCommand(serverTokenCreateCmd())
+	cmd.AddCommand(serverTokenListCmd())
+	cmd.AddCommand(serverTokenRevokeCmd())
+	return cmd
+}
+
+func serverTokenCreateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "create",
+		Short: "Issue an enrollment token",
+		Long:  "Issuing a single-use enrollment token, the token is only shown once",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			role, err := cmd.Flags().GetString("role")
+			if err != nil {
+				return err
+			}
+			ttl, err := cmd.Flags().GetDuration("ttl")
+			if err != nil {
+				return err
+			}
+			token, issued, err := enroll.Create(role, ttl)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), token)
+			fmt.Fprintf(cmd.ErrOrStderr(), "Token %s for a %s, valid until %s\n", issued.ID, issued.Role, issued.Expires.Format(time.RFC3339))
+			return nil
+		},
+	}
+
+	cmd.Flags().StringP("role", "r", "target", "Role the token enrolls (client or target)")
+	cmd.Flags().Duration("ttl", time.Hour, "Time the token is valid")
+	cmd.Flags().Bool("debug", false, "Debug")
+	bindFlag(cmd, "debug", "debug")
+
+	return cmd
+}
+
+func serverTokenListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List enrollment tokens",
+		Long:  "Listing the issued enrollment tokens with their state and the fingerprint of the enrolled key",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tokens, err := enroll.List()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tROLE\tSTATUS\tEXPIRES\tKEY")
+			for _, token := range tokens {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", token.ID, token.Role, token.Status(), token.Expires.Format(time.RFC3339), token.Key)
+			}
+			return w.Flush()
+		},
+	}
+
+	cmd.Flags().Bool("debug", false, "Debug")
+	bindFlag(cmd, "debug", "debug")
+
+	return cmd
+}
+
+func serverTokenRevokeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "revoke <id>",
+		Short: "Revoke an enrollment token",
+		Long:  "Revoking an unused enrollment token by the id shown by `server token list`",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return enroll.Revoke(args[0])
+		},
+	}
+
+	cmd.Flags().Bool("debug", false, "Debug")
+	bindFlag(cmd, "debug", "debug")
+
+	return cmd
+}
+
+// serverEnrollCmd is the command forced for the keys of the enroll account
+// The request of the client is read from SSH_ORIGINAL_COMMAND, the key it logged in with is passed as arguments
+// The response, the certificate of the key with user-ca, is written to stdout
+func serverEnrollCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "enroll <key-type> <key>",
+		Short:        "Enroll a key (run by sshd for the enroll account)",
+		Hidden:       true,
+		Args:         cobra.ExactArgs(2),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg := &config.AppConfig.Server
+			response, err := internal.Enroll(cfg, args[0], args[1], os.Getenv("SSH_ORIGINAL_COMMAND"))
+			if err != nil {
+				return err
+			}
+			fmt.Fprint(cmd.OutOrStdout(), response)
+			return nil
+		},
+	}
+	return cmd
+}
+
+// serverEnrollKeysCmd is the AuthorizedKeysCommand of the enroll account
+func serverEnrollKeysCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:    "enroll-keys <key-type> <key>",
+		Short:  "Print the authorized key of the enroll account (run by sshd)",
+		Hidden: true,
+		Args:   cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			line, err := internal.EnrollKeysLine(&config.AppConfig.Server, args[0], args[1])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), line)
+			return nil
+		},
+	}
+	return cmd
+}
@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// configKeyAnnotation marks flags that set a config key
+const configKeyAnnotation = "config-key"
+
+// bindFlag makes the flag set the config key, the binding is only made for the command that runs,
+// so commands sharing a key do not override each other
+func bindFlag(cmd *cobra.Command, key, name string) {
+	cmd.Flags().SetAnnotation(name, configKeyAnnotation, []string{key})
+}
+
+// bindFlags binds the annotated flags of cmd to their config keys
+func bindFlags(cmd *cobra.Command) error {
+	var err error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		keys, ok := flag.Annotations[configKeyAnnotation]
+		if !ok || err != nil {
+			return
+		}
+		err = config.BindFlag(keys[0], flag)
+	})
+	return err
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/fbufler/ssh-tunnel-setup/internal"
+	"github.com/spf13/cobra"
+)
+
+// serverGatewayCmd runs the gateway in the foreground, the service installed by `server --gateway` runs it
+func serverGatewayCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "gateway",
+		Short:        "Run the gateway, which forwards SSH carried in TLS or WebSocket connections to sshd",
+		Long:         "Accepting TLS connections carrying SSH, raw or in a WebSocket, and forwarding them to the local sshd until interrupted",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg := &config.AppConfig.Server
+			server, err := internal.NewGateway(cfg)
+			if err != nil {
+				return err
+			}
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			defer signal.Stop(signals)
+			go func() {
+				if _, ok := <-signals; ok {
+					slog.Info("Stopping gateway")
+					server.Close()
+				}
+			}()
+			if err := server.ListenAndServe(cfg.GatewayListen); err != nil {
+				return fmt.Errorf("failed to run gateway: %v", err)
+			}
+			return nil
+		},
+	}
+
+	addGatewayFlags(cmd)
+	cmd.Flags().Bool("debug", false, "Debug")
+	bindFlag(cmd, "debug", "debug")
+
+	return cmd
+}
+
+// addGatewayFlags adds the flags of the gateway settings to cmd
+func addGatewayFlags(cmd *cobra.Command) {
+	cmd.Flags().String("gateway-listen", "", "Address the gateway listens on")
+	cmd.Flags().String("gateway-path", "", "Path the gateway accepts WebSocket connections on")
+	cmd.Flags().String("gateway-upstream", "", "Address of the sshd the gateway forwards to")
+	cmd.Flags().String("gateway-cert", "", "TLS certificate of the gateway, a self-signed one is generated by the setup if it does not exist")
+	cmd.Flags().String("gateway-key", "", "TLS key of the gateway")
+
+	bindFlag(cmd, "server.gateway-listen", "gateway-listen")
+	bindFlag(cmd, "server.gateway-path", "gateway-path")
+	bindFlag(cmd, "server.gateway-upstream", "gateway-upstream")
+	bindFlag(cmd, "server.gateway-cert", "gateway-cert")
+	bindFlag(cmd, "server.gateway-key", "gateway-key")
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/fbufler/ssh-tunnel-setup/internal"
+	"github.com/spf13/cobra"
+)
+
+func InitCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "init",
+		Short: "Set up a machine interactively",
+		Long: "Asking for the role, relay, credentials, key type and ports, probing the relay, showing the resulting config and running the setup of the role\n" +
+			"With --answers the answers are read from a file instead, for automation",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			answersFile, err := cmd.Flags().GetString("answers")
+			if err != nil {
+				return err
+			}
+			yes, err := cmd.Flags().GetBool("yes")
+			if err != nil {
+				return err
+			}
+
+			// shared by the questions and the confirmation, so no buffered answer is lost
+			in := bufio.NewReader(cmd.InOrStdin())
+			var answers *internal.Answers
+			if answersFile != "" {
+				answers, err = internal.ReadAnswers(answersFile)
+			} else {
+				answers, err = internal.AskAnswers(in, cmd.OutOrStdout())
+			}
+			if err != nil {
+				return err
+			}
+			defer answers.Zero()
+			if err := answers.Apply(); err != nil {
+				return err
+			}
+			defer config.AppConfig.Client.ServerPass.Zero()
+			defer config.AppConfig.Server.TunnelPass.Zero()
+
+			dryRun, err := cmd.Flags().GetBool("dry-run")
+			if err != nil {
+				return err
+			}
+			if answers.Role != "server" {
+				if err := config.AppConfig.Client.Validate(); err != nil {
+					return err
+				}
+				if dryRun {
+					slog.Info("Dry run, not probing the relay")
+				} else if err := internal.Probe(&config.AppConfig.Client); err != nil {
+					return err
+				}
+			}
+
+			summary, err := internal.Summary(answers.Role)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "The %s is set up with:\n%s", answers.Role, summary)
+			if answersFile == "" && !yes {
+				ok, err := internal.Confirm(in, cmd.OutOrStdout(), fmt.Sprintf("Run the %s setup", answers.Role))
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return fmt.Errorf("setup cancelled")
+				}
+			}
+
+			return runSetup(cmd, func() error {
+				switch answers.Role {
+				case "server":
+					// the server setup stores the server config itself
+					return setupServer()
+				case "client":
+					if err := config.StoreClientConfig(&config.AppConfig.Client); err != nil {
+						return err
+					}
+					return setupClient()
+				default:
+					if err := config.StoreClientConfig(&config.AppConfig.Client); err != nil {
+						return err
+					}
+					return setupTarget()
+				}
+			})
+		},
+	}
+
+	cmd.Flags().String("answers", "", "Read the answers from a YAML file instead of asking")
+	cmd.Flags().BoolP("yes", "y", false, "Run the setup without confirmation")
+	cmd.Flags().Bool("debug", false, "Debug")
+	addDryRunFlag(cmd)
+	bindFlag(cmd, "debug", "debug")
+
+	return cmd
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/fbufler/ssh-tunnel-setup/internal"
+	"github.com/spf13/cobra"
+)
+
+func KeysCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "keys",
+		Short: "Manage the rotated key pairs",
+		Long:  "Inspecting the key pair, listing the key pairs archived by rotations and rolling back to one of them",
+	}
+	cmd.AddCommand(keysShowCmd())
+	cmd.AddCommand(keysListCmd())
+	cmd.AddCommand(keysRollbackCmd())
+	return cmd
+}
+
+// addKeyFlags adds the flags locating the key pair and its archive
+func addKeyFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("key-name", "k", "", "Key name")
+	cmd.Flags().StringP("key-directory", "d", "", "Key directory")
+	cmd.Flags().String("archive-directory", "", "Directory of the rotated key pairs (default archive in the key directory)")
+	cmd.Flags().Bool("debug", false, "Debug")
+
+	bindFlag(cmd, "rotate.key-name", "key-name")
+	bindFlag(cmd, "rotate.key-directory", "key-directory")
+	bindFlag(cmd, "rotate.archive-directory", "archive-directory")
+	bindFlag(cmd, "debug", "debug")
+}
+
+func keysShowCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "show",
+		Short: "Show the key pair",
+		Long: `Showing the fingerprints, type, size, comment, permissions and age of the key pair
+
+The private and public key are checked to match and, unless --skip-server is set, the key is checked to log in on the server.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.Rotate()
+			if err != nil {
+				return err
+			}
+			info, err := internal.InspectKey(cfg)
+			if err != nil {
+				return err
+			}
+			skipServer, err := cmd.Flags().GetBool("skip-server")
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintf(w, "Key:\t%s\n", info.Path)
+			fmt.Fprintf(w, "Type:\t%s (%d bit)\n", info.Type, info.Bits)
+			fmt.Fprintf(w, "Comment:\t%s\n", info.Comment)
+			fmt.Fprintf(w, "Fingerprint:\t%s\n", info.SHA256)
+			fmt.Fprintf(w, "\t%s\n", info.MD5)
+			fmt.Fprintf(w, "Permissions:\tprivate %04o, public %04o\n", info.PrivateMode, info.PublicMode)
+			if age, known := internal.KeyAge(cfg); known {
+				fmt.Fprintf(w, "Age:\t%s (rotated %s)\n", age, cfg.Rotated.Format(time.RFC3339))
+			} else if !info.Modified.IsZero() {
+				fmt.Fprintf(w, "Age:\tunknown (modified %s)\n", info.Modified.Format(time.RFC3339))
+			}
+			if info.Certificate != nil {
+				fmt.Fprintf(w, "Certificate:\t%s, valid until %s\n", info.Certificate.KeyId, time.Unix(int64(info.Certificate.ValidBefore), 0).UTC().Format(time.RFC3339))
+			}
+			var problems []string
+			if info.Match {
+				fmt.Fprintln(w, "Match:\tprivate and public key match")
+			} else {
+				fmt.Fprintln(w, "Match:\tprivate key does NOT belong to the public key")
+				problems = append(problems, "private and public key do not match")
+			}
+			if info.PrivateMode&0077 != 0 {
+				problems = append(problems, fmt.Sprintf("private key is accessible by other users (%04o)", info.PrivateMode))
+			}
+			if !skipServer {
+				if err := internal.CheckKeyAuthorized(cfg); err != nil {
+					fmt.Fprintf(w, "Server:\tNOT authorized for %s@%s (%v)\n", cfg.ServerUser, cfg.ServerName, err)
+					problems = append(problems, "key is not authorized on the server")
+				} else {
+					fmt.Fprintf(w, "Server:\tauthorized for %s@%s\n", cfg.ServerUser, cfg.ServerName)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			if len(problems) > 0 {
+				return fmt.Errorf("key %s: %s", info.Path, strings.Join(problems, "; "))
+			}
+			return nil
+		},
+	}
+	addKeyFlags(cmd)
+	cmd.Flags().StringP("server-name", "s", "", "Server name")
+	cmd.Flags().IntP("server-port", "p", 22, "Server port")
+	cmd.Flags().StringP("server-user", "U", "", "Server user")
+	cmd.Flags().Bool("skip-server", false, "Do not check that the key logs in on the server")
+
+	bindFlag(cmd, "rotate.server-name", "server-name")
+	bindFlag(cmd, "rotate.server-port", "server-port")
+	bindFlag(cmd, "rotate.server-user", "server-user")
+
+	return cmd
+}
+
+func keysListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the archived key pairs",
+		Long:  "Listing the key pairs archived by rotations with their fingerprints and the time they were archived",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			keys, err := internal.ArchivedKeys(&config.AppConfig.Rotate)
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tARCHIVED\tFINGERPRINT\tCOMMENT\tENCRYPTED")
+			for _, key := range keys {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\n", key.ID, key.Archived.Format(time.RFC3339), key.Fingerprint, key.Comment, key.Encrypted)
+			}
+			return w.Flush()
+		},
+	}
+	addKeyFlags(cmd)
+	return cmd
+}
+
+func keysRollbackCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rollback <id>",
+		Short: "Roll back to an archived key pair",
+		Long: `Rolling back to the archived key pair id shown by ` + "`keys list`" + `
+
+The archived key is authorized on the server again, or certified by the relay, before it replaces the key pair.
+The replaced key pair is archived and removed from the server, like by a rotation.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.Rotate()
+			if err != nil {
+				return err
+			}
+			if err := readArchivePassphrase(cmd, cfg, args[0]); err != nil {
+				return err
+			}
+			defer cfg.ArchivePassphrase.Zero()
+			return internal.Rollback(cfg, args[0])
+		},
+	}
+	addKeyFlags(cmd)
+	cmd.Flags().StringP("server-name", "s", "", "Server name")
+	cmd.Flags().IntP("server-port", "p", 22, "Server port")
+	cmd.Flags().StringP("server-user", "U", "", "Server user")
+	addArchivePassphraseFlags(cmd)
+
+	bindFlag(cmd, "rotate.server-name", "server-name")
+	bindFlag(cmd, "rotate.server-port", "server-port")
+	bindFlag(cmd, "rotate.server-user", "server-user")
+
+	return cmd
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/ssh"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+	"github.com/spf13/cobra"
+)
+
+func addDryRunFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("dry-run", false, "Print the planned changes instead of applying them")
+}
+
+// runSetup runs setup, with --dry-run it runs against a plan and prints the plan instead of changing the system
+func runSetup(cmd *cobra.Command, setup func() error) error {
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+	if !dryRun {
+		return setup()
+	}
+
+	plan := system.NewPlan(system.Files(), system.Users())
+	plan.Activate()
+	ssh.SetRemoteRunner(ssh.PlannedRemoteRunner{Plan: plan})
+
+	setupErr := setup()
+	if setupErr != nil {
+		fmt.Fprintf(cmd.OutOrStdout(), "Plan (incomplete, setup would fail: %v):\n", setupErr)
+	} else {
+		fmt.Fprintln(cmd.OutOrStdout(), "Plan:")
+	}
+	if err := plan.Write(cmd.OutOrStdout()); err != nil {
+		return err
+	}
+	return setupErr
+}
@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"net"
+	"os"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/ssh"
+	"github.com/spf13/cobra"
+)
+
+// ProxyConnectCmd is the ProxyCommand of the tunnel's ssh, it connects to the relay through the proxy and the gateway
+func ProxyConnectCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "proxy-connect <host> <port>",
+		Short:        "Connect stdin and stdout to host and port through the proxy and the gateway (run by ssh as ProxyCommand)",
+		Hidden:       true,
+		Args:         cobra.ExactArgs(2),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return ssh.ProxyConnect(net.JoinHostPort(args[0], args[1]), os.Stdin, os.Stdout)
+		},
+	}
+	return cmd
+}
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"strings"
 
 	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/fbufler/ssh-tunnel-setup/package/ssh"
 	"github.com/spf13/cobra"
 )
 
@@ -13,6 +15,16 @@ var rootCmd = &cobra.Command{
 	Use:   "ssh-tunnel-setup",
 	Short: "ssh-tunnel-setup is a CLI application for setting up an SSH tunnel",
 	Long:  `ssh-tunnel-setup is a CLI application for setting up an SSH tunnel`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := bindFlags(cmd); err != nil {
+			return err
+		}
+		if err := checkStdinSecrets(cmd); err != nil {
+			return err
+		}
+		initConfig(cmd)
+		return initConnections()
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		slog.Info("ssh-tunnel-setup is a CLI application for setting up an SSH tunnel")
 	},
@@ -27,13 +39,34 @@ func Execute() {
 
 func init() {
 	// Define flags and configuration settings here
-	config.LoadConfig()
+	rootCmd.PersistentFlags().String("config", "", "Config file, replaces the lookup in $XDG_CONFIG_HOME/ssh-tunnel-setup, /etc/ssh-tunnel-setup and the working directory")
+	rootCmd.PersistentFlags().StringSlice("jump-host", nil, "Host the relay is reached through, [user@]host[:port] (repeatable, in order)")
+	rootCmd.PersistentFlags().SetAnnotation("jump-host", configKeyAnnotation, []string{"jump-hosts"})
+	rootCmd.PersistentFlags().String("proxy", "", "HTTP CONNECT or SOCKS5 proxy to reach the relay through, e.g. http://proxy:3128 or socks5://proxy:1080")
+	rootCmd.PersistentFlags().SetAnnotation("proxy", configKeyAnnotation, []string{"proxy"})
+	rootCmd.PersistentFlags().String("gateway-url", "", "Gateway of the relay to carry SSH to in TLS or a WebSocket, tls://host[:port] or wss://host[:port]/path")
+	rootCmd.PersistentFlags().SetAnnotation("gateway-url", configKeyAnnotation, []string{"gateway-url"})
+	rootCmd.PersistentFlags().String("gateway-ca", "", "Certificates the gateway is trusted by, instead of the system roots")
+	rootCmd.PersistentFlags().SetAnnotation("gateway-ca", configKeyAnnotation, []string{"gateway-ca"})
 
 	// Add subcommands
 	rootCmd.AddCommand(ClientCmd())
 	rootCmd.AddCommand(ServerCmd())
 	rootCmd.AddCommand(TargetCmd())
 	rootCmd.AddCommand(RotateCmd())
+	rootCmd.AddCommand(KeysCmd())
+	rootCmd.AddCommand(UninstallCmd())
+	rootCmd.AddCommand(ConfigCmd())
+	rootCmd.AddCommand(InitCmd())
+	rootCmd.AddCommand(DoctorCmd())
+	rootCmd.AddCommand(ProxyConnectCmd())
+}
+
+// initConfig loads the config once the flags of the command are parsed and bound
+func initConfig(cmd *cobra.Command) {
+	configFile, _ := cmd.Flags().GetString("config")
+	config.SetConfigFile(configFile)
+	config.LoadConfig()
 
 	// Configure slog
 	opts := &slog.HandlerOptions{}
@@ -44,4 +77,29 @@ func init() {
 	}
 	logger := slog.New(slog.NewTextHandler(os.Stdout, opts))
 	slog.SetDefault(logger)
+
+	if files := config.FilesUsed(); len(files) > 0 {
+		slog.Debug(fmt.Sprintf("Using config files %v", files))
+	} else {
+		slog.Debug(fmt.Sprintf("No config file found in %v, using defaults", config.SearchPaths()))
+	}
+}
+
+// initConnections makes all remote operations reach the relay through the configured jump hosts, proxy and gateway
+func initConnections() error {
+	hosts, err := ssh.ParseJumpHosts(config.JumpHosts())
+	if err != nil {
+		return fmt.Errorf("invalid jump-hosts: %v", err)
+	}
+	if len(hosts) > 0 {
+		slog.Debug(fmt.Sprintf("Reaching the relay through %s", strings.Join(config.JumpHosts(), ", ")))
+	}
+	ssh.SetJumpHosts(hosts, config.TrustedJumpHostKey())
+	if err := ssh.SetProxy(config.Proxy(), config.ProxyPass()); err != nil {
+		return fmt.Errorf("invalid proxy: %v", err)
+	}
+	if err := ssh.SetGateway(config.GatewayURL(), config.GatewayCA()); err != nil {
+		return fmt.Errorf("invalid gateway-url: %v", err)
+	}
+	return nil
 }
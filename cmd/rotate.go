@@ -1,19 +1,55 @@
 package cmd
 
 import (
+	"fmt"
+	"os/user"
+
 	"github.com/fbufler/ssh-tunnel-setup/config"
 	"github.com/fbufler/ssh-tunnel-setup/internal"
+	"github.com/fbufler/ssh-tunnel-setup/package/state"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 func RotateCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "rotate",
 		Short: "Rotate key pair on client or target",
-		Long:  "Rotating the key pair on the client or target side",
+		Long: `Rotating the key pair on the client or target side
+
+With --schedule the rotation runs every rotate.interval as the current user, from a systemd timer or a cron job.
+With --check the age of the key is checked against rotate.max-age, the refuse policy fails for a stale key.
+With --resume an interrupted rotation is completed from its journal.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return internal.Rotate(config.Rotate())
+			cfg, err := config.Rotate()
+			if err != nil {
+				return err
+			}
+			check, err := cmd.Flags().GetBool("check")
+			if err != nil {
+				return err
+			}
+			if check {
+				return checkKeyAge(cmd, cfg)
+			}
+			schedule, err := cmd.Flags().GetBool("schedule")
+			if err != nil {
+				return err
+			}
+			if schedule {
+				return scheduleRotation(cfg)
+			}
+			resume, err := cmd.Flags().GetBool("resume")
+			if err != nil {
+				return err
+			}
+			if err := readArchivePassphrase(cmd, cfg, ""); err != nil {
+				return err
+			}
+			defer cfg.ArchivePassphrase.Zero()
+			if resume {
+				return internal.ResumeRotation(cfg)
+			}
+			return internal.Rotate(cfg)
 		},
 	}
 
@@ -23,15 +59,54 @@ func RotateCmd() *cobra.Command {
 	cmd.Flags().StringP("server-name", "s", "", "Server name")
 	cmd.Flags().IntP("server-port", "p", 22, "Server port")
 	cmd.Flags().StringP("server-user", "U", "", "Server user")
+	cmd.Flags().Bool("schedule", false, "Install a systemd timer or cron job rotating the key every interval")
+	cmd.Flags().Bool("check", false, "Check the age of the key against max-age instead of rotating it")
+	cmd.Flags().Bool("resume", false, "Complete an interrupted rotation")
+	cmd.Flags().Duration("interval", 0, fmt.Sprintf("Time between scheduled rotations (default %s)", config.DefaultRotateInterval))
+	cmd.Flags().Duration("max-age", 0, "Age after which the key is stale")
+	cmd.Flags().String("max-age-policy", "", "What happens to tunnels with a stale key (warn or refuse)")
+	cmd.Flags().String("archive-directory", "", "Directory of the rotated key pairs (default archive in the key directory)")
+	addArchivePassphraseFlags(cmd)
 	cmd.Flags().Bool("debug", false, "Debug")
+	cmd.MarkFlagsMutuallyExclusive("schedule", "check", "resume")
 
-	viper.BindPFlag("rotate.key_name", cmd.Flags().Lookup("key-name"))
-	viper.BindPFlag("rotate.key_directory", cmd.Flags().Lookup("key-directory"))
-	viper.BindPFlag("rotate.key_user", cmd.Flags().Lookup("key-user"))
-	viper.BindPFlag("rotate.server_name", cmd.Flags().Lookup("server-name"))
-	viper.BindPFlag("rotate.server_port", cmd.Flags().Lookup("server-port"))
-	viper.BindPFlag("rotate.server_user", cmd.Flags().Lookup("server-user"))
-	viper.BindPFlag("debug", cmd.Flags().Lookup("debug"))
+	bindFlag(cmd, "rotate.key-name", "key-name")
+	bindFlag(cmd, "rotate.key-directory", "key-directory")
+	bindFlag(cmd, "rotate.key-user", "key-user")
+	bindFlag(cmd, "rotate.server-name", "server-name")
+	bindFlag(cmd, "rotate.server-port", "server-port")
+	bindFlag(cmd, "rotate.server-user", "server-user")
+	bindFlag(cmd, "rotate.interval", "interval")
+	bindFlag(cmd, "rotate.max-age", "max-age")
+	bindFlag(cmd, "rotate.max-age-policy", "max-age-policy")
+	bindFlag(cmd, "rotate.archive-directory", "archive-directory")
+	bindFlag(cmd, "debug", "debug")
 
 	return cmd
 }
+
+// scheduleRotation stores the rotation settings and installs the schedule, running as the current user
+func scheduleRotation(cfg *config.RotateConfig) error {
+	current, err := user.Current()
+	if err != nil {
+		return fmt.Errorf("failed to determine current user: %v", err)
+	}
+	if err := config.StoreRotationConfig(cfg); err != nil {
+		return err
+	}
+	manifest, err := state.Load(internal.RotationRole())
+	if err != nil {
+		return err
+	}
+	return internal.ScheduleRotation(cfg, current.Username, manifest)
+}
+
+// checkKeyAge prints the age of the key and applies the max-age policy
+func checkKeyAge(cmd *cobra.Command, cfg *config.RotateConfig) error {
+	if age, known := internal.KeyAge(cfg); known {
+		fmt.Fprintf(cmd.OutOrStdout(), "Key %s/%s rotated %s ago\n", cfg.KeyDirectory, cfg.KeyName, age)
+	} else {
+		fmt.Fprintf(cmd.OutOrStdout(), "Key %s/%s has no rotation time\n", cfg.KeyDirectory, cfg.KeyName)
+	}
+	return internal.CheckKeyAge(cfg)
+}
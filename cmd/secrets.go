@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/fbufler/ssh-tunnel-setup/internal"
+	"github.com/fbufler/ssh-tunnel-setup/package/secret"
+	"github.com/fbufler/ssh-tunnel-setup/package/ssh"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// addSecretFlags adds --<name>-file and --<name>-stdin, the plain --<name> flag is deprecated
+// as its value is visible in the process list
+func addSecretFlags(cmd *cobra.Command, name, description string) {
+	cmd.Flags().String(name+"-file", "", fmt.Sprintf("File containing the %s", description))
+	cmd.Flags().Bool(name+"-stdin", false, fmt.Sprintf("Read the %s from the first line of stdin", description))
+	cmd.Flags().MarkDeprecated(name, fmt.Sprintf("it is visible in the process list, use --%s-file, --%s-stdin, the env variable or the prompt instead", name, name))
+}
+
+// checkStdinSecrets rejects reading more than one secret from stdin, it holds only one
+func checkStdinSecrets(cmd *cobra.Command) error {
+	var names []string
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if strings.HasSuffix(flag.Name, "-stdin") && flag.Value.String() == "true" {
+			names = append(names, "--"+flag.Name)
+		}
+	})
+	if len(names) > 1 {
+		return fmt.Errorf("only one secret can be read from stdin, got %s, use --<name>-file for the others", strings.Join(names, " and "))
+	}
+	return nil
+}
+
+// readSecret reads the secret of the flag name from --<name>-file, --<name>-stdin,
+// the config (deprecated flag, env variable or config file) or, if prompt is set, a no-echo prompt
+func readSecret(cmd *cobra.Command, name, key string, value secret.Secret, prompt string) (secret.Secret, error) {
+	file, err := cmd.Flags().GetString(name + "-file")
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := cmd.Flags().GetBool(name + "-stdin")
+	if err != nil {
+		return nil, err
+	}
+	if source, origin := config.SourceOf(key); source == config.SourceFile && file == "" && !stdin {
+		slog.Warn(fmt.Sprintf("%s is stored in plain text in %s, use --%s-file, --%s-stdin, the env variable or the prompt instead", key, origin, name, name))
+	}
+	return secret.Read(secret.Source{File: file, Stdin: stdin, Value: value, Prompt: prompt})
+}
+
+// addEnrollTokenFlags adds --enroll-token-file and --enroll-token-stdin, the token is not accepted as a plain flag
+func addEnrollTokenFlags(cmd *cobra.Command) {
+	cmd.Flags().String("enroll-token-file", "", "File containing the enrollment token issued by `server token create`")
+	cmd.Flags().Bool("enroll-token-stdin", false, "Read the enrollment token from the first line of stdin")
+}
+
+// readEnrollToken reads the enrollment token of the client, it is never prompted for
+func readEnrollToken(cmd *cobra.Command) error {
+	cfg := &config.AppConfig.Client
+	token, err := readSecret(cmd, "enroll-token", "client.enroll-token", cfg.EnrollToken, "")
+	if err != nil {
+		return err
+	}
+	cfg.EnrollToken = token
+	return nil
+}
+
+// readServerPass reads the password of the client for the server
+// It is only prompted for without server key or enrollment token, or if auth-methods requires it
+func readServerPass(cmd *cobra.Command) error {
+	cfg := &config.AppConfig.Client
+	prompt := ""
+	if cfg.ServerKeyName == "" && cfg.EnrollToken.Empty() && !slices.Contains(cfg.AuthMethods, config.AuthKeyboardInteractive) || slices.Contains(cfg.AuthMethods, config.AuthPassword) {
+		prompt = fmt.Sprintf("Password of %s@%s", cfg.ServerUser, cfg.ServerName)
+	}
+	password, err := readSecret(cmd, "server-pass", "client.server-pass", cfg.ServerPass, prompt)
+	if err != nil {
+		return err
+	}
+	cfg.ServerPass = password
+	return nil
+}
+
+// addPKCS11PINFlags adds --pkcs11-pin-file and --pkcs11-pin-stdin
+func addPKCS11PINFlags(cmd *cobra.Command) {
+	cmd.Flags().String("pkcs11-pin-file", "", "File containing the PIN of the token")
+	cmd.Flags().Bool("pkcs11-pin-stdin", false, "Read the PIN of the token from the first line of stdin")
+}
+
+// readPKCS11PIN reads the PIN of the token, it is only prompted for with key-source pkcs11
+func readPKCS11PIN(cmd *cobra.Command) error {
+	cfg := &config.AppConfig.Client
+	prompt := ""
+	if cfg.KeySource == config.KeySourcePKCS11 {
+		// fail before asking for a PIN the binary can't use
+		if !ssh.PKCS11Supported {
+			return ssh.ErrPKCS11Unsupported
+		}
+		prompt = fmt.Sprintf("PIN of token %s", cfg.PKCS11Token)
+	}
+	pin, err := readSecret(cmd, "pkcs11-pin", "client.pkcs11-pin", cfg.PKCS11PIN, prompt)
+	if err != nil {
+		return err
+	}
+	cfg.PKCS11PIN = pin
+	return nil
+}
+
+// readTunnelPass reads the password of the tunnel user, without one the account is locked for password logins
+func readTunnelPass(cmd *cobra.Command) error {
+	cfg := &config.AppConfig.Server
+	password, err := readSecret(cmd, "tunnel-pass", "server.tunnel-pass", cfg.TunnelPass, "")
+	if err != nil {
+		return err
+	}
+	cfg.TunnelPass = password
+	return nil
+}
+
+// addArchivePassphraseFlags adds --archive-passphrase-file and --archive-passphrase-stdin
+func addArchivePassphraseFlags(cmd *cobra.Command) {
+	cmd.Flags().String("archive-passphrase-file", "", "File containing the passphrase of the key archive")
+	cmd.Flags().Bool("archive-passphrase-stdin", false, "Read the passphrase of the key archive from the first line of stdin")
+}
+
+// readArchivePassphrase reads the passphrase the key archive is encrypted with
+// It is only prompted for to restore the archived key pair id, if that is encrypted
+func readArchivePassphrase(cmd *cobra.Command, cfg *config.RotateConfig, id string) error {
+	prompt := ""
+	if id != "" {
+		key, err := internal.ArchivedKey(cfg, id)
+		if err != nil {
+			return err
+		}
+		if key.Encrypted {
+			prompt = fmt.Sprintf("Passphrase of the archived key pair %s", id)
+		}
+	}
+	passphrase, err := readSecret(cmd, "archive-passphrase", "rotate.archive-passphrase", cfg.ArchivePassphrase, prompt)
+	if err != nil {
+		return err
+	}
+	cfg.ArchivePassphrase = passphrase
+	return nil
+}
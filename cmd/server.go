@@ -3,8 +3,8 @@ package cmd
 import (
 	"github.com/fbufler/ssh-tunnel-setup/config"
 	"github.com/fbufler/ssh-tunnel-setup/internal"
+	"github.com/fbufler/ssh-tunnel-setup/package/state"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 func ServerCmd() *cobra.Command {
@@ -13,23 +13,68 @@ func ServerCmd() *cobra.Command {
 		Short: "Setup server",
 		Long:  "Setting up the server side of the tunnel",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return internal.ServerSetup(config.Server())
+			return runSetup(cmd, func() error {
+				if err := readTunnelPass(cmd); err != nil {
+					return err
+				}
+				defer config.AppConfig.Server.TunnelPass.Zero()
+				return setupServer()
+			})
 		},
 	}
 
 	cmd.Flags().StringP("name", "n", "", "Server name")
 	cmd.Flags().StringP("tunnel-user", "u", "", "Tunnel user")
 	cmd.Flags().StringP("tunnel-pass", "p", "", "Tunnel password")
+	addSecretFlags(cmd, "tunnel-pass", "tunnel user password")
 	cmd.Flags().StringP("sshd-config-path", "c", "", "Path to sshd config")
 	cmd.Flags().StringP("sshd-config-backup-path", "b", "", "Path to sshd config backup")
+	cmd.Flags().Bool("enrollment", false, "Set up the enroll account, so clients enroll their key with a token of `server token create`")
+	cmd.Flags().String("enroll-user", "", "Enroll account")
+	cmd.Flags().Bool("user-ca", false, "Act as SSH certificate authority, the enroll account signs the keys of clients instead of authorizing them")
+	cmd.Flags().Duration("user-cert-validity", 0, "Validity of the issued user certificates")
+	cmd.Flags().Bool("host-ca", false, "Sign the host keys of sshd with a host certificate authority clients trust")
+	cmd.Flags().StringSlice("host-name", nil, "Name clients connect to the relay with, the principals of the host certificates (repeatable)")
+	cmd.Flags().Duration("host-cert-validity", 0, "Validity of the host certificates")
+	cmd.Flags().Bool("gateway", false, "Install the gateway, which accepts SSH carried in TLS or WebSocket connections for networks that only let HTTPS out")
+	addGatewayFlags(cmd)
+	cmd.Flags().String("gateway-user", "", "Account the gateway runs as")
 	cmd.Flags().Bool("debug", false, "Debug")
+	addDryRunFlag(cmd)
 
-	viper.BindPFlag("server.name", cmd.Flags().Lookup("name"))
-	viper.BindPFlag("server.tunnel_user", cmd.Flags().Lookup("tunnel-user"))
-	viper.BindPFlag("server.tunnel_pass", cmd.Flags().Lookup("tunnel-pass"))
-	viper.BindPFlag("server.sshd_config_path", cmd.Flags().Lookup("sshd-config-path"))
-	viper.BindPFlag("server.sshd_config_backup_path", cmd.Flags().Lookup("sshd-config-backup-path"))
-	viper.BindPFlag("debug", cmd.Flags().Lookup("debug"))
+	bindFlag(cmd, "server.name", "name")
+	bindFlag(cmd, "server.tunnel-user", "tunnel-user")
+	bindFlag(cmd, "server.tunnel-pass", "tunnel-pass")
+	bindFlag(cmd, "server.sshd-config-path", "sshd-config-path")
+	bindFlag(cmd, "server.sshd-config-backup-path", "sshd-config-backup-path")
+	bindFlag(cmd, "server.enrollment", "enrollment")
+	bindFlag(cmd, "server.enroll-user", "enroll-user")
+	bindFlag(cmd, "server.user-ca", "user-ca")
+	bindFlag(cmd, "server.user-cert-validity", "user-cert-validity")
+	bindFlag(cmd, "server.host-ca", "host-ca")
+	bindFlag(cmd, "server.host-names", "host-name")
+	bindFlag(cmd, "server.host-cert-validity", "host-cert-validity")
+	bindFlag(cmd, "server.gateway", "gateway")
+	bindFlag(cmd, "server.gateway-user", "gateway-user")
+	bindFlag(cmd, "debug", "debug")
+
+	cmd.AddCommand(serverTokenCmd())
+	cmd.AddCommand(serverEnrollCmd())
+	cmd.AddCommand(serverEnrollKeysCmd())
+	cmd.AddCommand(serverGatewayCmd())
 
 	return cmd
 }
+
+// setupServer runs the server setup with the loaded config, the tunnel password has to be read already
+func setupServer() error {
+	manifest, err := state.Load(state.RoleServer)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.Server()
+	if err != nil {
+		return err
+	}
+	return internal.ServerSetup(cfg, manifest)
+}
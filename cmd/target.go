@@ -1,28 +1,33 @@
 package cmd
 
 import (
+	"fmt"
 	"log/slog"
 	"os/user"
 
 	"github.com/fbufler/ssh-tunnel-setup/config"
 	"github.com/fbufler/ssh-tunnel-setup/internal"
+	"github.com/fbufler/ssh-tunnel-setup/package/state"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 func TargetCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "client",
-		Short: "Setup client",
-		Long:  "Setting up the client side of the tunnel",
+		Use:   "target",
+		Short: "Setup target",
+		Long:  "Setting up the target side of the tunnel",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			err := internal.ClientSetup(config.Client())
-			if err != nil {
-				return err
-			}
-			storeTunnelConfig(config.Client())
-			internal.SetupTunnel(config.Tunnel())
-			return nil
+			return runSetup(cmd, func() error {
+				if err := readEnrollToken(cmd); err != nil {
+					return err
+				}
+				defer config.AppConfig.Client.EnrollToken.Zero()
+				if err := readServerPass(cmd); err != nil {
+					return err
+				}
+				defer config.AppConfig.Client.ServerPass.Zero()
+				return setupTarget()
+			})
 		},
 	}
 
@@ -30,28 +35,70 @@ func TargetCmd() *cobra.Command {
 	cmd.Flags().StringP("key-name", "k", "", "Key name")
 	cmd.Flags().StringP("key-directory", "d", "", "Key directory")
 	cmd.Flags().StringP("key-user", "u", "", "Key user")
+	cmd.Flags().String("key-type", "", "Type of the generated key (rsa or ed25519)")
+	cmd.Flags().String("import-key", "", "Adopt the existing private key at this path instead of generating one")
+	cmd.Flags().Bool("force", false, "Replace a key pair that already exists at the key path")
 	cmd.Flags().StringP("server-name", "s", "", "Server name")
 	cmd.Flags().IntP("server-port", "p", 22, "Server port")
 	cmd.Flags().StringP("server-user", "U", "", "Server user")
 	cmd.Flags().StringP("server-pass", "P", "", "Server password")
+	addSecretFlags(cmd, "server-pass", "server password")
 	cmd.Flags().StringP("server-key-name", "K", "", "Server key name")
+	cmd.Flags().StringSlice("auth-methods", nil, "Methods to log in to the server with, in order (publickey, password, keyboard-interactive)")
+	addEnrollTokenFlags(cmd)
+	cmd.Flags().String("enroll-user", "", "Account on the server to enroll the key with")
 	cmd.Flags().Bool("debug", false, "Debug")
+	addDryRunFlag(cmd)
 
-	viper.BindPFlag("client.name", cmd.Flags().Lookup("name"))
-	viper.BindPFlag("client.key_name", cmd.Flags().Lookup("key-name"))
-	viper.BindPFlag("client.key_directory", cmd.Flags().Lookup("key-directory"))
-	viper.BindPFlag("client.key_user", cmd.Flags().Lookup("key-user"))
-	viper.BindPFlag("client.server_name", cmd.Flags().Lookup("server-name"))
-	viper.BindPFlag("client.server_port", cmd.Flags().Lookup("server-port"))
-	viper.BindPFlag("client.server_user", cmd.Flags().Lookup("server-user"))
-	viper.BindPFlag("client.server_pass", cmd.Flags().Lookup("server-pass"))
-	viper.BindPFlag("client.server_key_name", cmd.Flags().Lookup("server-key-name"))
-	viper.BindPFlag("debug", cmd.Flags().Lookup("debug"))
+	bindFlag(cmd, "client.name", "name")
+	bindFlag(cmd, "client.key-name", "key-name")
+	bindFlag(cmd, "client.key-directory", "key-directory")
+	bindFlag(cmd, "client.key-user", "key-user")
+	bindFlag(cmd, "client.key-type", "key-type")
+	bindFlag(cmd, "client.import-key", "import-key")
+	bindFlag(cmd, "client.force", "force")
+	bindFlag(cmd, "client.server-name", "server-name")
+	bindFlag(cmd, "client.server-port", "server-port")
+	bindFlag(cmd, "client.server-user", "server-user")
+	bindFlag(cmd, "client.server-pass", "server-pass")
+	bindFlag(cmd, "client.server-key-name", "server-key-name")
+	bindFlag(cmd, "client.auth-methods", "auth-methods")
+	bindFlag(cmd, "client.enroll-user", "enroll-user")
+	bindFlag(cmd, "debug", "debug")
 
 	return cmd
 }
 
-func storeTunnelConfig(cfg *config.ClientConfig) {
+// setupTarget runs the client and tunnel setup of the target with the loaded config, the server password has to be read already
+func setupTarget() error {
+	manifest, err := state.Load(state.RoleTarget)
+	if err != nil {
+		return err
+	}
+	clientCfg, err := config.Client()
+	if err != nil {
+		return err
+	}
+	if !clientCfg.KeyInFile() {
+		// the tunnel service runs ssh with the key file
+		return fmt.Errorf("the key of a target has to be in a file, key-source %s is only supported by the client", clientCfg.KeySource)
+	}
+	err = internal.ClientSetup(clientCfg, manifest)
+	if err != nil {
+		return err
+	}
+	err = storeTunnelConfig(clientCfg)
+	if err != nil {
+		return err
+	}
+	tunnelCfg, err := config.Tunnel()
+	if err != nil {
+		return err
+	}
+	return internal.SetupTunnel(tunnelCfg, manifest)
+}
+
+func storeTunnelConfig(cfg *config.ClientConfig) error {
 	currentTunnel := config.UnsafeTunnel()
 	if currentTunnel == nil {
 		currentTunnel = &config.TunnelConfig{}
@@ -74,10 +121,10 @@ func storeTunnelConfig(cfg *config.ClientConfig) {
 	if currentTunnel.LocalUser == "" {
 		user, err := user.Current()
 		if err != nil {
-			slog.Warn("Could not get current user: %v", err)
+			slog.Warn(fmt.Sprintf("Could not get current user: %v", err))
 		} else {
 			currentTunnel.LocalUser = user.Username
 		}
 	}
-	config.StoreTunnelConfig(currentTunnel)
+	return config.StoreTunnelConfig(currentTunnel)
 }
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"github.com/fbufler/ssh-tunnel-setup/internal"
+	"github.com/fbufler/ssh-tunnel-setup/package/state"
+	"github.com/spf13/cobra"
+)
+
+func UninstallCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "uninstall",
+		Short: "Remove everything created by a setup",
+		Long:  "Reverting all changes recorded in the state manifest of the server, client or target setup",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			roleName, err := cmd.Flags().GetString("role")
+			if err != nil {
+				return err
+			}
+			role, err := state.ParseRole(roleName)
+			if err != nil {
+				return err
+			}
+			manifest, err := state.Load(role)
+			if err != nil {
+				return err
+			}
+			return internal.Uninstall(manifest)
+		},
+	}
+
+	cmd.Flags().StringP("role", "r", "", "Role to uninstall (server, client or target)")
+	cmd.Flags().Bool("debug", false, "Debug")
+	cmd.MarkFlagRequired("role")
+
+	bindFlag(cmd, "debug", "debug")
+
+	return cmd
+}
@@ -3,176 +3,193 @@ package config
 import (
 	"fmt"
 	"log/slog"
+	"reflect"
+	"strings"
+	"time"
 
+	"github.com/fbufler/ssh-tunnel-setup/package/secret"
 	"github.com/fbufler/ssh-tunnel-setup/package/system"
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 )
 
 const TunnelUser = "tunneluser"
 
+// EnrollUser is the account on the relay clients enroll their key with
+const EnrollUser = "tunnelenroll"
+
+// GatewayUser is the account on the relay the gateway runs as
+const GatewayUser = "tunnelgateway"
+
 type ClientConfig struct {
-	Name          string `mapstructure:"name"`
-	KeyName       string `mapstructure:"key-name"`
-	KeyDirectory  string `mapstructure:"key-directory"`
-	KeyUser       string `mapstructure:"key-user"`
-	ServerName    string `mapstructure:"server-name"`
-	ServerPort    int    `mapstructure:"server-port"`
-	ServerUser    string `mapstructure:"server-user"`
-	ServerPass    string `mapstructure:"server-pass"`
-	ServerKeyName string `mapstructure:"server-key-name"`
+	Name          string        `mapstructure:"name" yaml:"name"`
+	KeyName       string        `mapstructure:"key-name" yaml:"key-name"`
+	KeyDirectory  string        `mapstructure:"key-directory" yaml:"key-directory"`
+	KeyUser       string        `mapstructure:"key-user" yaml:"key-user"`
+	KeyType       string        `mapstructure:"key-type" yaml:"key-type"`
+	ServerName    string        `mapstructure:"server-name" yaml:"server-name"`
+	ServerPort    int           `mapstructure:"server-port" yaml:"server-port"`
+	ServerUser    string        `mapstructure:"server-user" yaml:"server-user"`
+	ServerPass    secret.Secret `mapstructure:"server-pass" yaml:"server-pass,omitempty"`
+	ServerKeyName string        `mapstructure:"server-key-name" yaml:"server-key-name"`
+	EnrollUser    string        `mapstructure:"enroll-user" yaml:"enroll-user"`
+	EnrollToken   secret.Secret `mapstructure:"enroll-token" yaml:"enroll-token,omitempty"`
+	// ImportKey is an existing private key adopted as key pair instead of generating one
+	ImportKey string `mapstructure:"import-key" yaml:"import-key,omitempty"`
+	// Force replaces a key pair that already exists at the key path
+	Force bool `mapstructure:"force" yaml:"force,omitempty"`
+	// KeySource is where the private key is kept, see KeySources, only its public key is in the key directory unless it is file
+	KeySource string `mapstructure:"key-source" yaml:"key-source,omitempty"`
+	// PKCS11Module, PKCS11Token and PKCS11KeyLabel select the key on a token with key-source pkcs11
+	PKCS11Module   string `mapstructure:"pkcs11-module" yaml:"pkcs11-module,omitempty"`
+	PKCS11Token    string `mapstructure:"pkcs11-token" yaml:"pkcs11-token,omitempty"`
+	PKCS11KeyLabel string `mapstructure:"pkcs11-key-label" yaml:"pkcs11-key-label,omitempty"`
+	// PKCS11PIN logs in to the token
+	PKCS11PIN secret.Secret `mapstructure:"pkcs11-pin" yaml:"pkcs11-pin,omitempty"`
+	// AuthMethods are the methods to log in to server-user with in order, see AuthMethods, all methods of the credentials if empty
+	AuthMethods []string `mapstructure:"auth-methods" yaml:"auth-methods,omitempty"`
 }
 
-func (c *ClientConfig) required() error {
-	// KeyName KeyDirectory KeyUser ServerName ServerPort ServerUser ServerPass or ServerKeyName
-	missingFields := []string{}
-	if c.KeyName == "" {
-		missingFields = append(missingFields, "KeyName")
-	}
-	if c.KeyDirectory == "" {
-		missingFields = append(missingFields, "KeyDirectory")
-	}
-	if c.KeyUser == "" {
-		missingFields = append(missingFields, "KeyUser")
-	}
-	if c.ServerName == "" {
-		missingFields = append(missingFields, "ServerName")
-	}
-	if c.ServerPort == 0 {
-		missingFields = append(missingFields, "ServerPort")
-	}
-	if c.ServerUser == "" {
-		missingFields = append(missingFields, "ServerUser")
-	}
-	if c.ServerPass == "" && c.ServerKeyName == "" {
-		missingFields = append(missingFields, "ServerPass or ServerKeyName")
-	}
-	if len(missingFields) > 0 {
-		return fmt.Errorf("missing required parameters: %v", missingFields)
-	}
-	return nil
+// The supported values of client.key-source
+const (
+	KeySourceFile   = "file"
+	KeySourceAgent  = "agent"
+	KeySourcePKCS11 = "pkcs11"
+)
+
+// KeySources are the supported values of client.key-source, an empty key source is file
+var KeySources = []string{KeySourceFile, KeySourceAgent, KeySourcePKCS11}
+
+// The supported values of client.auth-methods, named like in sshd's AuthenticationMethods
+const (
+	AuthPublicKey           = "publickey"
+	AuthPassword            = "password"
+	AuthKeyboardInteractive = "keyboard-interactive"
+)
+
+// AuthMethods are the supported values of client.auth-methods
+var AuthMethods = []string{AuthPublicKey, AuthPassword, AuthKeyboardInteractive}
+
+// KeyInFile checks if the private key is kept in the key directory
+func (c *ClientConfig) KeyInFile() bool {
+	return c.KeySource == "" || c.KeySource == KeySourceFile
 }
 
 type RotateConfig struct {
-	KeyName      string `mapstructure:"key-name"`
-	KeyDirectory string `mapstructure:"key-directory"`
-	KeyUser      string `mapstructure:"key-user"`
-	ServerName   string `mapstructure:"server-name"`
-	ServerPort   int    `mapstructure:"server-port"`
-	ServerUser   string `mapstructure:"server-user"`
+	KeyName      string `mapstructure:"key-name" yaml:"key-name"`
+	KeyDirectory string `mapstructure:"key-directory" yaml:"key-directory"`
+	KeyUser      string `mapstructure:"key-user" yaml:"key-user"`
+	KeyType      string `mapstructure:"key-type" yaml:"key-type,omitempty"`
+	ServerName   string `mapstructure:"server-name" yaml:"server-name"`
+	ServerPort   int    `mapstructure:"server-port" yaml:"server-port"`
+	ServerUser   string `mapstructure:"server-user" yaml:"server-user"`
+	// EnrollUser renews the certificate of the key, if the relay acts as certificate authority
+	EnrollUser string `mapstructure:"enroll-user" yaml:"enroll-user,omitempty"`
+	// Rotated is the time the key was created or last rotated
+	Rotated time.Time `mapstructure:"rotated" yaml:"rotated,omitempty"`
+	// Interval is the time between scheduled rotations, see DefaultRotateInterval
+	Interval time.Duration `mapstructure:"interval" yaml:"interval,omitempty"`
+	// MaxAge is the age after which the key is stale, MaxAgePolicy decides if tunnels with a stale key start
+	MaxAge       time.Duration `mapstructure:"max-age" yaml:"max-age,omitempty"`
+	MaxAgePolicy string        `mapstructure:"max-age-policy" yaml:"max-age-policy,omitempty"`
+	// ArchiveDirectory keeps the rotated key pairs, see KeyArchiveDirectory
+	ArchiveDirectory string `mapstructure:"archive-directory" yaml:"archive-directory,omitempty"`
+	// ArchivePassphrase encrypts the private keys in the archive
+	ArchivePassphrase secret.Secret `mapstructure:"archive-passphrase" yaml:"archive-passphrase,omitempty"`
 }
 
-func (c *RotateConfig) required() error {
-	// KeyName KeyDirectory KeyUser ServerName ServerPort ServerUser
-	missingFields := []string{}
-	if c.KeyName == "" {
-		missingFields = append(missingFields, "KeyName")
-	}
-	if c.KeyDirectory == "" {
-		missingFields = append(missingFields, "KeyDirectory")
-	}
-	if c.KeyUser == "" {
-		missingFields = append(missingFields, "KeyUser")
-	}
-	if c.ServerName == "" {
-		missingFields = append(missingFields, "ServerName")
-	}
-	if c.ServerPort == 0 {
-		missingFields = append(missingFields, "ServerPort")
-	}
-	if c.ServerUser == "" {
-		missingFields = append(missingFields, "ServerUser")
-	}
-	if len(missingFields) > 0 {
-		return fmt.Errorf("missing required parameters: %v", missingFields)
-	}
-	return nil
-}
+// DefaultRotateInterval is the time between scheduled rotations if rotate.interval is not set
+const DefaultRotateInterval = 30 * 24 * time.Hour
 
-type ServerConfig struct {
-	Name                 string `mapstructure:"name"`
-	TunnelUser           string `mapstructure:"tunnel-user"`
-	TunnelPass           string `mapstructure:"tunnel-pass"`
-	SSHDConfigPath       string `mapstructure:"sshd-config-path"`
-	SSHDConfigBackupPath string `mapstructure:"sshd-config-backup-path"`
-}
+const (
+	// MaxAgeWarn logs a warning if the key is stale
+	MaxAgeWarn = "warn"
+	// MaxAgeRefuse refuses to start the tunnel if the key is stale
+	MaxAgeRefuse = "refuse"
+)
 
-func (c *ServerConfig) required() error {
-	// TunnelUser SSHDConfigPath SSHDConfigBackupPath
-	missingFields := []string{}
-	if c.TunnelUser == "" {
-		missingFields = append(missingFields, "TunnelUser")
-	}
-	if c.SSHDConfigPath == "" {
-		missingFields = append(missingFields, "SSHDConfigPath")
-	}
-	if c.SSHDConfigBackupPath == "" {
-		missingFields = append(missingFields, "SSHDConfigBackupPath")
+// MaxAgePolicies are the supported values of rotate.max-age-policy
+var MaxAgePolicies = []string{MaxAgeWarn, MaxAgeRefuse}
+
+// KeyArchiveDirectory returns the directory of the rotated key pairs, archive in the key directory if archive-directory is not set
+func (c *RotateConfig) KeyArchiveDirectory() string {
+	if c.ArchiveDirectory == "" {
+		return c.KeyDirectory + "/archive"
 	}
-	if len(missingFields) > 0 {
-		return fmt.Errorf("missing required parameters: %v", missingFields)
+	return c.ArchiveDirectory
+}
+
+// RotationInterval returns the time between scheduled rotations
+func (c *RotateConfig) RotationInterval() time.Duration {
+	if c.Interval == 0 {
+		return DefaultRotateInterval
 	}
-	return nil
+	return c.Interval
 }
 
-type TunnelConfig struct {
-	HostIdentifier string `mapstructure:"host-identifier"`
-	SSHConfigPath  string `mapstructure:"ssh-config-path"`
-	KeyDirectory   string `mapstructure:"key-directory"`
-	ServerKeyName  string `mapstructure:"server-key-name"`
-	LocalUser      string `mapstructure:"local-user"`
-	LocalHost      string `mapstructure:"local-host"`
-	LocalPort      int    `mapstructure:"local-port"`
-	ServerUser     string `mapstructure:"server-user"`
-	ServerName     string `mapstructure:"server-name"`
-	ServerPort     int    `mapstructure:"server-port"`
+type ServerConfig struct {
+	Name                 string        `mapstructure:"name" yaml:"name"`
+	TunnelUser           string        `mapstructure:"tunnel-user" yaml:"tunnel-user"`
+	TunnelPass           secret.Secret `mapstructure:"tunnel-pass" yaml:"tunnel-pass,omitempty"`
+	SSHDConfigPath       string        `mapstructure:"sshd-config-path" yaml:"sshd-config-path"`
+	SSHDConfigBackupPath string        `mapstructure:"sshd-config-backup-path" yaml:"sshd-config-backup-path"`
+	Enrollment           bool          `mapstructure:"enrollment" yaml:"enrollment"`
+	EnrollUser           string        `mapstructure:"enroll-user" yaml:"enroll-user"`
+	UserCA               bool          `mapstructure:"user-ca" yaml:"user-ca"`
+	UserCertValidity     time.Duration `mapstructure:"user-cert-validity" yaml:"user-cert-validity"`
+	HostCA               bool          `mapstructure:"host-ca" yaml:"host-ca"`
+	// HostNames are the names clients connect to the relay with, the principals of the host certificates
+	HostNames        []string      `mapstructure:"host-names" yaml:"host-names"`
+	HostCertValidity time.Duration `mapstructure:"host-cert-validity" yaml:"host-cert-validity"`
+	// Gateway installs the gateway, which accepts SSH carried in TLS or WebSocket connections and forwards it to sshd
+	Gateway bool `mapstructure:"gateway" yaml:"gateway,omitempty"`
+	// GatewayListen is the address the gateway listens on
+	GatewayListen string `mapstructure:"gateway-listen" yaml:"gateway-listen,omitempty"`
+	// GatewayPath is the path the gateway accepts WebSocket connections on
+	GatewayPath string `mapstructure:"gateway-path" yaml:"gateway-path,omitempty"`
+	// GatewayUpstream is the address of the sshd the gateway forwards to
+	GatewayUpstream string `mapstructure:"gateway-upstream" yaml:"gateway-upstream,omitempty"`
+	// GatewayCert and GatewayKey are the TLS certificate and key of the gateway, a self-signed certificate is generated if they do not exist
+	GatewayCert string `mapstructure:"gateway-cert" yaml:"gateway-cert,omitempty"`
+	GatewayKey  string `mapstructure:"gateway-key" yaml:"gateway-key,omitempty"`
+	// GatewayUser is the account the gateway runs as, its group reads GatewayKey
+	GatewayUser string `mapstructure:"gateway-user" yaml:"gateway-user,omitempty"`
 }
 
-func (c *TunnelConfig) required() error {
-	// SSHConfigPath HostIdentifier ServerName LocalUser KeyDirectory ServerKeyName LocalHost LocalPort RemotePort
-	missingFields := []string{}
-	if c.SSHConfigPath == "" {
-		missingFields = append(missingFields, "SSHConfigPath")
-	}
-	if c.HostIdentifier == "" {
-		missingFields = append(missingFields, "HostIdentifier")
-	}
-	if c.ServerName == "" {
-		missingFields = append(missingFields, "ServerName")
-	}
-	if c.LocalUser == "" {
-		missingFields = append(missingFields, "LocalUser")
-	}
-	if c.KeyDirectory == "" {
-		missingFields = append(missingFields, "KeyDirectory")
-	}
-	if c.ServerKeyName == "" {
-		missingFields = append(missingFields, "ServerKeyName")
-	}
-	if c.LocalHost == "" {
-		missingFields = append(missingFields, "LocalHost")
-	}
-	if c.LocalPort == 0 {
-		missingFields = append(missingFields, "LocalPort")
-	}
-	if c.ServerUser == "" {
-		missingFields = append(missingFields, "ServerUser")
-	}
-	if c.ServerPort == 0 {
-		missingFields = append(missingFields, "ServerPort")
-	}
-	if len(missingFields) > 0 {
-		return fmt.Errorf("missing required parameters: %v", missingFields)
-	}
-	return nil
+type TunnelConfig struct {
+	HostIdentifier string `mapstructure:"host-identifier" yaml:"host-identifier"`
+	SSHConfigPath  string `mapstructure:"ssh-config-path" yaml:"ssh-config-path"`
+	KeyDirectory   string `mapstructure:"key-directory" yaml:"key-directory"`
+	ServerKeyName  string `mapstructure:"server-key-name" yaml:"server-key-name"`
+	LocalUser      string `mapstructure:"local-user" yaml:"local-user"`
+	LocalHost      string `mapstructure:"local-host" yaml:"local-host"`
+	LocalPort      int    `mapstructure:"local-port" yaml:"local-port"`
+	ServerUser     string `mapstructure:"server-user" yaml:"server-user"`
+	ServerName     string `mapstructure:"server-name" yaml:"server-name"`
+	ServerPort     int    `mapstructure:"server-port" yaml:"server-port"`
 }
 
 type Config struct {
-	Client         ClientConfig `mapstructure:"client"`
-	Server         ServerConfig `mapstructure:"server"`
-	Rotate         RotateConfig `mapstructure:"rotate"`
-	Tunnel         TunnelConfig `mapstructure:"tunnel"`
-	Debug          bool         `mapstructure:"debug"`
-	TrustedHostKey string       `mapstructure:"trusted-host-key"`
+	Client         ClientConfig `mapstructure:"client" yaml:"client"`
+	Server         ServerConfig `mapstructure:"server" yaml:"server"`
+	Rotate         RotateConfig `mapstructure:"rotate" yaml:"rotate"`
+	Tunnel         TunnelConfig `mapstructure:"tunnel" yaml:"tunnel"`
+	Debug          bool         `mapstructure:"debug" yaml:"debug"`
+	TrustedHostKey string       `mapstructure:"trusted-host-key" yaml:"trusted-host-key"`
+	// TrustedHostCA is the public key of the host certificate authority of the relay, see ServerConfig.HostCA
+	TrustedHostCA string `mapstructure:"trusted-host-ca" yaml:"trusted-host-ca,omitempty"`
+	// JumpHosts is the chain of hosts the relay is reached through, in the format [user@]host[:port] of ssh's ProxyJump
+	JumpHosts []string `mapstructure:"jump-hosts" yaml:"jump-hosts,omitempty"`
+	// TrustedJumpHostKey are the host keys of the jump hosts, in the format of trusted-host-key
+	TrustedJumpHostKey string `mapstructure:"trusted-jump-host-key" yaml:"trusted-jump-host-key,omitempty"`
+	// Proxy is the HTTP CONNECT or SOCKS5 proxy the relay is connected to through, HTTPS_PROXY or ALL_PROXY if it is empty
+	Proxy string `mapstructure:"proxy" yaml:"proxy,omitempty"`
+	// ProxyPass is the password of the proxy user, it replaces a password in the proxy URL
+	ProxyPass secret.Secret `mapstructure:"proxy-pass" yaml:"proxy-pass,omitempty"`
+	// GatewayURL is the gateway of the relay SSH is carried to in TLS or a WebSocket, tls://host[:port] or wss://host[:port]/path
+	GatewayURL string `mapstructure:"gateway-url" yaml:"gateway-url,omitempty"`
+	// GatewayCA is the file of the certificates the gateway is trusted by, the system roots if it is empty
+	GatewayCA string `mapstructure:"gateway-ca" yaml:"gateway-ca,omitempty"`
 }
 
 var AppConfig Config
@@ -183,101 +200,200 @@ func setDefaults() {
 		slog.Warn("Home directory not found, using current directory")
 		homeDir = "."
 	}
-	viper.SetDefault("client.name", "default-client")
-	viper.SetDefault("client.key_name", "default-key")
-	viper.SetDefault("client.key_directory", fmt.Sprint(homeDir, "/.ssh"))
-	viper.SetDefault("client.key_user", "default-client-user")
-	viper.SetDefault("client.user", "default-user")
-	viper.SetDefault("client.server_name", "localhost")
-	viper.SetDefault("client.server_port", 8080)
-
-	viper.SetDefault("server.name", "default-server")
-	viper.SetDefault("server.tunnel_user", TunnelUser)
-	viper.SetDefault("server.sshd_config_path", "/etc/ssh/sshd_config")
-	viper.SetDefault("server.sshd_config_backup_path", "/etc/ssh/sshd_config.bak")
-
-	viper.SetDefault("tunnel.ssh_config_path", fmt.Sprint(homeDir, "/.ssh/config"))
-	viper.SetDefault("tunnel.host_identifier", "default-host")
-	viper.SetDefault("tunnel.key_directory", fmt.Sprint(homeDir, "/.ssh"))
-	viper.SetDefault("tunnel.server_key_name", "default-key")
-	viper.SetDefault("tunnel.local_host", "localhost")
-	viper.SetDefault("tunnel.local_port", 3306)
-	viper.SetDefault("tunnel.remote_port", 3306)
+	setDefault("client.name", "default-client")
+	setDefault("client.key-name", "default-key")
+	setDefault("client.key-directory", fmt.Sprint(homeDir, "/.ssh"))
+	setDefault("client.key-user", "default-client-user")
+	setDefault("client.key-type", "rsa")
+	setDefault("client.server-name", "localhost")
+	setDefault("client.server-port", 8080)
+	setDefault("client.enroll-user", EnrollUser)
+
+	setDefault("server.name", "default-server")
+	setDefault("server.tunnel-user", TunnelUser)
+	setDefault("server.sshd-config-path", "/etc/ssh/sshd_config")
+	setDefault("server.sshd-config-backup-path", "/etc/ssh/sshd_config.bak")
+	setDefault("server.enroll-user", EnrollUser)
+	setDefault("server.user-cert-validity", "168h")
+	setDefault("server.host-cert-validity", "8760h")
+	setDefault("server.gateway-listen", ":443")
+	setDefault("server.gateway-path", "/ssh")
+	setDefault("server.gateway-upstream", "127.0.0.1:22")
+	setDefault("server.gateway-cert", "/etc/ssh-tunnel-setup/gateway.crt")
+	setDefault("server.gateway-key", "/etc/ssh-tunnel-setup/gateway.key")
+	setDefault("server.gateway-user", GatewayUser)
+
+	setDefault("tunnel.ssh-config-path", fmt.Sprint(homeDir, "/.ssh/config"))
+	setDefault("tunnel.host-identifier", "default-host")
+	setDefault("tunnel.key-directory", fmt.Sprint(homeDir, "/.ssh"))
+	setDefault("tunnel.server-key-name", "default-key")
+	setDefault("tunnel.local-host", "localhost")
+	setDefault("tunnel.local-port", 3306)
 }
 
+// decodeHook extends the decode hooks of viper by the conversion of strings to secrets
+var decodeHook = mapstructure.ComposeDecodeHookFunc(
+	func(from, to reflect.Type, data any) (any, error) {
+		if from.Kind() != reflect.String || to != reflect.TypeOf(secret.Secret{}) {
+			return data, nil
+		}
+		return secret.Secret(data.(string)), nil
+	},
+	mapstructure.StringToTimeDurationHookFunc(),
+	mapstructure.StringToTimeHookFunc(time.RFC3339),
+	mapstructure.StringToSliceHookFunc(","),
+)
+
+// filesUsed holds the config files read by LoadConfig, in order of precedence
+var filesUsed []string
+
+// FilesUsed returns the config files read by LoadConfig, in order of precedence
+func FilesUsed() []string {
+	return filesUsed
+}
+
+// LoadConfig reads the config files, see SearchPaths, and the SSH_TUNNEL_SETUP_* env variables
 func LoadConfig() {
-	viper.SetConfigName("config") // name of config file (without extension)
-	viper.SetConfigType("yaml")   // or viper.SetConfigType("json")
-	viper.AddConfigPath(".")      // optionally look for config in the working directory
+	viper.SetConfigType("yaml")
 
 	setDefaults()
 
-	if err := viper.ReadInConfig(); err != nil {
+	found, err := readConfigFiles()
+	if err != nil {
 		slog.Error(fmt.Sprintf("Error reading config file, %s", err))
+	}
+	filesUsed = found
 
+	if err := bindEnv(); err != nil {
+		slog.Error(fmt.Sprintf("Error binding env variables, %s", err))
+	}
+	if err := readSecretFiles(); err != nil {
+		slog.Error(fmt.Sprintf("Error reading secret files, %s", err))
 	}
 
-	if err := viper.Unmarshal(&AppConfig); err != nil {
+	if err := viper.Unmarshal(&AppConfig, viper.DecodeHook(decodeHook)); err != nil {
 		slog.Error(fmt.Sprintf("Error unmarshalling config, %s", err))
 	}
 }
 
-func Server() *ServerConfig {
+// Server returns the validated server config
+func Server() (*ServerConfig, error) {
 	serverCfg := &AppConfig.Server
-	if serverCfg.required() != nil {
-		slog.Error(fmt.Sprintf("Error reading server config, %s", serverCfg.required()))
-		panic("Required server config missing")
+	if err := serverCfg.Validate(); err != nil {
+		return nil, err
 	}
-	return serverCfg
+	return serverCfg, nil
 }
 
-func Client() *ClientConfig {
+// Client returns the validated client config
+func Client() (*ClientConfig, error) {
 	clientCfg := &AppConfig.Client
-	if clientCfg.required() != nil {
-		slog.Error(fmt.Sprintf("Error reading client config, %s", clientCfg.required()))
-		panic("Required client config missing")
+	if err := clientCfg.Validate(); err != nil {
+		return nil, err
 	}
-	return clientCfg
+	return clientCfg, nil
 }
 
-func Rotate() *RotateConfig {
+// Rotate returns the validated rotate config
+func Rotate() (*RotateConfig, error) {
 	rotateCfg := &AppConfig.Rotate
-	if rotateCfg.required() != nil {
-		slog.Error(fmt.Sprintf("Error reading rotate config, %s", rotateCfg.required()))
-		panic("Required rotate config missing")
+	if err := rotateCfg.Validate(); err != nil {
+		return nil, err
 	}
-	return rotateCfg
+	return rotateCfg, nil
 }
 
-func Tunnel() *TunnelConfig {
+// Tunnel returns the validated tunnel config
+func Tunnel() (*TunnelConfig, error) {
 	tunnelCfg := &AppConfig.Tunnel
-	if tunnelCfg.required() != nil {
-		slog.Error(fmt.Sprintf("Error reading tunnel config, %s", tunnelCfg.required()))
-		panic("Required tunnel config missing")
+	if err := tunnelCfg.Validate(); err != nil {
+		return nil, err
 	}
-	return tunnelCfg
+	return tunnelCfg, nil
 }
 
 func UnsafeTunnel() *TunnelConfig {
 	return &AppConfig.Tunnel
 }
 
+// StoreRotationConfig stores the rotate settings in the user scope, the archive passphrase is not stored
 func StoreRotationConfig(cfg *RotateConfig) error {
 	AppConfig.Rotate = *cfg
-	viper.Set("rotate", AppConfig.Rotate)
-	return viper.WriteConfig()
+	stored := *cfg
+	stored.ArchivePassphrase = nil
+	return storeSection(ScopeUser, "rotate", stored)
 }
 
+// StoreTunnelConfig stores the tunnel settings in the system scope
 func StoreTunnelConfig(cfg *TunnelConfig) error {
 	AppConfig.Tunnel = *cfg
-	viper.Set("tunnel", AppConfig.Tunnel)
-	return viper.WriteConfig()
+	return storeSection(ScopeSystem, "tunnel", AppConfig.Tunnel)
+}
+
+// StoreClientConfig stores the client settings in the user scope, the secrets, import-key and force are not stored
+func StoreClientConfig(cfg *ClientConfig) error {
+	AppConfig.Client = *cfg
+	stored := *cfg
+	stored.ServerPass = nil
+	stored.EnrollToken = nil
+	stored.PKCS11PIN = nil
+	// importing and replacing keys apply to a single setup
+	stored.ImportKey = ""
+	stored.Force = false
+	return storeSection(ScopeUser, "client", stored)
+}
+
+// StoreServerConfig stores the server settings in the system scope, the tunnel password is not stored
+func StoreServerConfig(cfg *ServerConfig) error {
+	AppConfig.Server = *cfg
+	stored := *cfg
+	stored.TunnelPass = nil
+	return storeSection(ScopeSystem, "server", stored)
 }
 
 func Debug() bool {
 	return AppConfig.Debug
 }
 
+// TrustedHostKey returns the host keys the relay is trusted by, trusted-host-ca is added as @cert-authority line
 func TrustedHostKey() string {
-	return AppConfig.TrustedHostKey
+	if AppConfig.TrustedHostCA == "" {
+		return AppConfig.TrustedHostKey
+	}
+	return strings.TrimSpace(AppConfig.TrustedHostKey + "\n@cert-authority " + AppConfig.TrustedHostCA)
+}
+
+// JumpHosts returns the chain of hosts the relay is reached through, it is empty if the relay is reached directly
+func JumpHosts() []string {
+	return AppConfig.JumpHosts
+}
+
+// TrustedJumpHostKey returns the host keys the jump hosts are trusted by
+func TrustedJumpHostKey() string {
+	return AppConfig.TrustedJumpHostKey
+}
+
+// Proxy returns the proxy the relay is connected to through, it is empty to use the proxy of the environment
+func Proxy() string {
+	return AppConfig.Proxy
+}
+
+// ProxyPass returns the password of the proxy user
+func ProxyPass() secret.Secret {
+	return AppConfig.ProxyPass
+}
+
+// GatewayURL returns the gateway SSH is carried to, it is empty if the relay is connected to directly
+func GatewayURL() string {
+	return AppConfig.GatewayURL
+}
+
+// GatewayCA returns the file of the certificates the gateway is trusted by
+func GatewayCA() string {
+	return AppConfig.GatewayCA
+}
+
+// TrustedHostCA returns the public key of the host certificate authority of the relay
+func TrustedHostCA() string {
+	return AppConfig.TrustedHostCA
 }
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+	"github.com/spf13/viper"
+)
+
+// EnvPrefix is the prefix of all env variables setting config keys
+const EnvPrefix = "SSH_TUNNEL_SETUP"
+
+// envFileSuffix marks env variables holding the path of a file containing a secret
+const envFileSuffix = "_FILE"
+
+var envKeyReplacer = strings.NewReplacer(".", "_", "-", "_")
+
+// EnvName returns the env variable of key, e.g. SSH_TUNNEL_SETUP_CLIENT_SERVER_PASS for client.server-pass
+func EnvName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(envKeyReplacer.Replace(key))
+}
+
+// EnvNames returns the env variables of key, including the _FILE variant of secrets
+func EnvNames(key string) []string {
+	if secretKeys[key] {
+		return []string{EnvName(key), EnvName(key) + envFileSuffix}
+	}
+	return []string{EnvName(key)}
+}
+
+// bindEnv binds every config key to its env variable
+func bindEnv() error {
+	for _, key := range Keys() {
+		if err := viper.BindEnv(key, EnvName(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSecretFiles reads the secrets set by _FILE env variables
+// They take precedence over config files, the plain env variable must not be set as well
+func readSecretFiles() error {
+	secrets := map[string]any{}
+	for key := range secretKeys {
+		name := EnvName(key) + envFileSuffix
+		path := os.Getenv(name)
+		if path == "" {
+			continue
+		}
+		if os.Getenv(EnvName(key)) != "" {
+			return fmt.Errorf("both %s and %s are set", EnvName(key), name)
+		}
+		data, err := system.Files().ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", name, err)
+		}
+		value := strings.TrimRight(string(data), "\r\n")
+		section, field, nested := strings.Cut(key, ".")
+		if !nested {
+			secrets[key] = value
+			continue
+		}
+		if secrets[section] == nil {
+			secrets[section] = map[string]any{}
+		}
+		secrets[section].(map[string]any)[field] = value
+	}
+	if len(secrets) == 0 {
+		return nil
+	}
+	return viper.MergeConfigMap(secrets)
+}
@@ -0,0 +1,37 @@
+package config
+
+import "testing"
+
+func TestEnv(t *testing.T) {
+	host := setup(t)
+	host.FS.Seed("/etc/ssh-tunnel-setup/config.yaml", []byte("client:\n    server-name: from-file\n"), 0644)
+	host.FS.Seed("/run/secrets/tunnel-pass", []byte("Tunnel-Password-2024!\n"), 0600)
+	t.Setenv("SSH_TUNNEL_SETUP_CLIENT_SERVER_NAME", "relay.example.com")
+	t.Setenv("SSH_TUNNEL_SETUP_TUNNEL_LOCAL_PORT", "2222")
+	t.Setenv("SSH_TUNNEL_SETUP_TRUSTED_HOST_KEY", "ssh-ed25519 AAAA")
+	t.Setenv("SSH_TUNNEL_SETUP_SERVER_TUNNEL_PASS_FILE", "/run/secrets/tunnel-pass")
+	host.FS.Seed("/run/secrets/proxy-pass", []byte("Proxy-Password\n"), 0600)
+	t.Setenv("SSH_TUNNEL_SETUP_PROXY_PASS_FILE", "/run/secrets/proxy-pass")
+	t.Setenv("SSH_TUNNEL_SETUP_JUMP_HOSTS", "bastion.example.com,ops@inner.example.com:2222")
+
+	LoadConfig()
+
+	if AppConfig.Client.ServerName != "relay.example.com" {
+		t.Errorf("env does not take precedence over the config file, got %q", AppConfig.Client.ServerName)
+	}
+	if AppConfig.Tunnel.LocalPort != 2222 || AppConfig.TrustedHostKey != "ssh-ed25519 AAAA" {
+		t.Errorf("env not applied: %+v %q", AppConfig.Tunnel, AppConfig.TrustedHostKey)
+	}
+	if string(AppConfig.Server.TunnelPass) != "Tunnel-Password-2024!" {
+		t.Errorf("secret file not applied, got %q", AppConfig.Server.TunnelPass)
+	}
+	if string(AppConfig.ProxyPass) != "Proxy-Password" {
+		t.Errorf("secret file of a top-level key not applied, got %q", AppConfig.ProxyPass)
+	}
+	if len(AppConfig.JumpHosts) != 2 || AppConfig.JumpHosts[1] != "ops@inner.example.com:2222" {
+		t.Errorf("env list not applied, got %q", AppConfig.JumpHosts)
+	}
+	if source, origin := SourceOf("server.tunnel-pass"); source != SourceEnv || origin != "SSH_TUNNEL_SETUP_SERVER_TUNNEL_PASS_FILE" {
+		t.Errorf("unexpected source %s %s", source, origin)
+	}
+}
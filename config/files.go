@@ -0,0 +1,158 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+const appName = "ssh-tunnel-setup"
+const configFileName = "config.yaml"
+
+// SystemConfigDir holds the config of the system scope
+const SystemConfigDir = "/etc/" + appName
+
+// Scope selects the config file settings are stored in
+type Scope string
+
+const (
+	// ScopeSystem holds the server and tunnel settings, shared by all users of the machine
+	ScopeSystem Scope = "system"
+	// ScopeUser holds the client and rotation settings of the current user
+	ScopeUser Scope = "user"
+)
+
+// configFile is the file set by --config, it replaces the search and both scopes
+var configFile string
+
+// SetConfigFile makes path the only config file read and written, an empty path restores the search
+func SetConfigFile(path string) {
+	configFile = path
+}
+
+// UserConfigDir returns $XDG_CONFIG_HOME/ssh-tunnel-setup, defaulting to ~/.config/ssh-tunnel-setup
+func UserConfigDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, appName)
+	}
+	homeDir, err := system.HomeDir()
+	if err != nil || homeDir == "" {
+		return filepath.Join(".config", appName)
+	}
+	return filepath.Join(homeDir, ".config", appName)
+}
+
+// ScopePath returns the config file settings of scope are stored in
+func ScopePath(scope Scope) string {
+	if configFile != "" {
+		return configFile
+	}
+	if scope == ScopeSystem {
+		return filepath.Join(SystemConfigDir, configFileName)
+	}
+	return filepath.Join(UserConfigDir(), configFileName)
+}
+
+// SearchPaths returns the config files in the order they are looked up, earlier files take precedence
+func SearchPaths() []string {
+	if configFile != "" {
+		return []string{configFile}
+	}
+	return []string{
+		filepath.Join(UserConfigDir(), configFileName),
+		filepath.Join(SystemConfigDir, configFileName),
+		configFileName,
+	}
+}
+
+// readConfigFiles merges all existing config files into viper, migrating files of older versions in memory
+// A file that can not be read is skipped, the others are still merged
+func readConfigFiles() ([]string, error) {
+	paths := SearchPaths()
+	found := []string{}
+	files = nil
+	var errs []error
+	for i := len(paths) - 1; i >= 0; i-- {
+		settings, err := readConfigFile(paths[i])
+		if os.IsNotExist(err) {
+			if configFile == "" {
+				continue
+			}
+			err = fmt.Errorf("failed to read config file %s: %v", paths[i], err)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := viper.MergeConfigMap(settings); err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse config file %s: %v", paths[i], err))
+			continue
+		}
+		found = append([]string{paths[i]}, found...)
+		files = append([]fileSettings{{path: paths[i], settings: settings}}, files...)
+	}
+	return found, errors.Join(errs...)
+}
+
+// readConfigFile returns the settings of the config file at path, migrated to CurrentVersion
+func readConfigFile(path string) (map[string]any, error) {
+	data, err := system.Files().ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+	settings := map[string]any{}
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	if settings == nil {
+		settings = map[string]any{}
+	}
+	if err := migrateLoaded(path, settings); err != nil {
+		return nil, fmt.Errorf("failed to migrate config file %s: %v", path, err)
+	}
+	return settings, nil
+}
+
+// storeSection replaces the top level key of the config file of scope with value
+// The file and its directory are created if they do not exist, other settings in the file are kept
+func storeSection(scope Scope, key string, value any) error {
+	path := ScopePath(scope)
+	settings := map[string]any{}
+	data, err := system.Files().ReadFile(path)
+	switch {
+	case err == nil:
+		if err := yaml.Unmarshal(data, &settings); err != nil {
+			return fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+		if settings == nil {
+			settings = map[string]any{}
+		}
+	case os.IsNotExist(err):
+		slog.Info(fmt.Sprintf("Creating config file %s", path))
+		if err := system.Files().MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create config directory: %v", err)
+		}
+	default:
+		return fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+
+	if _, err := migrate(settings); err != nil {
+		return fmt.Errorf("failed to migrate config file %s: %v", path, err)
+	}
+	settings[key] = value
+	data, err = yaml.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %v", err)
+	}
+	slog.Debug(fmt.Sprintf("Storing %s config in %s", key, path))
+	return system.Files().WriteFile(path, data, 0644)
+}
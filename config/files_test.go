@@ -0,0 +1,97 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/system/systemtest"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+func setup(t *testing.T) *systemtest.Host {
+	t.Helper()
+	host := systemtest.Install(t)
+	t.Setenv("XDG_CONFIG_HOME", "/home/alice/.config")
+	viper.Reset()
+	AppConfig = Config{}
+	t.Cleanup(func() {
+		viper.Reset()
+		SetConfigFile("")
+		flags = map[string]*pflag.Flag{}
+	})
+	return host
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	host := setup(t)
+	host.FS.Seed("/home/alice/.config/ssh-tunnel-setup/config.yaml", []byte("client:\n    name: user\n"), 0644)
+	host.FS.Seed("/etc/ssh-tunnel-setup/config.yaml", []byte("client:\n    name: system\n    key-user: system\nserver:\n    name: relay\n"), 0644)
+
+	LoadConfig()
+
+	if AppConfig.Client.Name != "user" {
+		t.Errorf("user config does not take precedence, got client name %q", AppConfig.Client.Name)
+	}
+	if AppConfig.Client.KeyUser != "system" || AppConfig.Server.Name != "relay" {
+		t.Errorf("system config not merged, got %+v %+v", AppConfig.Client, AppConfig.Server)
+	}
+	if files := FilesUsed(); len(files) != 2 {
+		t.Errorf("expected two config files, got %v", files)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	host := setup(t)
+	host.FS.Seed("/etc/ssh-tunnel-setup/config.yaml", []byte("server:\n    name: relay\n"), 0644)
+	host.FS.Seed("/tmp/custom.yaml", []byte("server:\n    name: custom\n"), 0644)
+	SetConfigFile("/tmp/custom.yaml")
+
+	LoadConfig()
+
+	if AppConfig.Server.Name != "custom" {
+		t.Errorf("--config not used exclusively, got server name %q", AppConfig.Server.Name)
+	}
+}
+
+func TestStoreScopes(t *testing.T) {
+	host := setup(t)
+	host.FS.Seed("/etc/ssh-tunnel-setup/config.yaml", []byte("server:\n    name: relay\n"), 0644)
+
+	if err := StoreRotationConfig(&RotateConfig{KeyName: "tunnel-key"}); err != nil {
+		t.Fatalf("StoreRotationConfig: %v", err)
+	}
+	if err := StoreTunnelConfig(&TunnelConfig{HostIdentifier: "relay"}); err != nil {
+		t.Fatalf("StoreTunnelConfig: %v", err)
+	}
+
+	user, err := host.FS.ReadFile("/home/alice/.config/ssh-tunnel-setup/config.yaml")
+	if err != nil {
+		t.Fatalf("user config not created: %v", err)
+	}
+	if !strings.Contains(string(user), "key-name: tunnel-key") || strings.Contains(string(user), "tunnel:") {
+		t.Errorf("unexpected user config:\n%s", user)
+	}
+	system, _ := host.FS.ReadFile("/etc/ssh-tunnel-setup/config.yaml")
+	if !strings.Contains(string(system), "name: relay") || !strings.Contains(string(system), "host-identifier: relay") || strings.Contains(string(system), "rotate:") {
+		t.Errorf("unexpected system config:\n%s", system)
+	}
+}
+
+func TestStoreRotationTime(t *testing.T) {
+	host := setup(t)
+	host.FS.Seed("/etc/ssh-tunnel-setup/config.yaml", []byte("debug: false\n"), 0644)
+	rotated := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	if err := StoreRotationConfig(&RotateConfig{KeyName: "tunnel-key", Rotated: rotated, MaxAge: 90 * 24 * time.Hour}); err != nil {
+		t.Fatalf("StoreRotationConfig: %v", err)
+	}
+	viper.Reset()
+	AppConfig = Config{}
+	LoadConfig()
+
+	if !AppConfig.Rotate.Rotated.Equal(rotated) || AppConfig.Rotate.MaxAge != 90*24*time.Hour {
+		t.Errorf("rotation settings not restored, got %+v", AppConfig.Rotate)
+	}
+}
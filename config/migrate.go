@@ -0,0 +1,190 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+	"gopkg.in/yaml.v3"
+)
+
+// CurrentVersion is the version of the config layout this tool reads and writes
+const CurrentVersion = 1
+
+const versionKey = "version"
+
+// migration upgrades the settings of a config file by one version
+type migration struct {
+	description string
+	apply       func(settings map[string]any)
+}
+
+// migrations[i] upgrades a config file from version i to i+1
+var migrations = []migration{
+	{
+		description: "rename underscore and lowercased field keys to the hyphenated keys, drop the unused client.user, client.server-key-directory and tunnel.remote-port",
+		apply:       migrateKeyNames,
+	},
+}
+
+func version(settings map[string]any) (int, error) {
+	value, ok := settings[versionKey]
+	if !ok {
+		return 0, nil
+	}
+	version, ok := value.(int)
+	if !ok || version < 0 {
+		return 0, fmt.Errorf("invalid version %v", value)
+	}
+	return version, nil
+}
+
+// migrate upgrades settings to CurrentVersion and returns the descriptions of the applied migrations
+func migrate(settings map[string]any) ([]string, error) {
+	from, err := version(settings)
+	if err != nil {
+		return nil, err
+	}
+	if from > CurrentVersion {
+		return nil, fmt.Errorf("version %d is newer than the supported version %d, please upgrade ssh-tunnel-setup", from, CurrentVersion)
+	}
+	applied := []string{}
+	for v := from; v < CurrentVersion; v++ {
+		migrations[v].apply(settings)
+		applied = append(applied, fmt.Sprintf("version %d to %d: %s", v, v+1, migrations[v].description))
+	}
+	settings[versionKey] = CurrentVersion
+	return applied, nil
+}
+
+// Migration is the result of migrating a config file
+type Migration struct {
+	Path    string
+	Applied []string
+	Before  []byte
+	After   []byte
+	// Backup is the copy of the old file, if it was written
+	Backup string
+}
+
+// MigrateFile upgrades the config file at path to CurrentVersion
+// Unless dryRun is set the old file is kept as backup next to it
+func MigrateFile(path string, dryRun bool) (*Migration, error) {
+	data, err := system.Files().ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+	settings := map[string]any{}
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	if settings == nil {
+		settings = map[string]any{}
+	}
+	applied, err := migrate(settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate config file %s: %v", path, err)
+	}
+	result := &Migration{Path: path, Applied: applied, Before: data, After: data}
+	if len(applied) == 0 {
+		return result, nil
+	}
+	if result.After, err = yaml.Marshal(settings); err != nil {
+		return nil, fmt.Errorf("failed to encode config: %v", err)
+	}
+	if dryRun {
+		return result, nil
+	}
+	if result.Backup, err = backupConfig(path, data); err != nil {
+		return nil, err
+	}
+	if err := system.Files().WriteFile(path, result.After, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write migrated config file %s: %v", path, err)
+	}
+	return result, nil
+}
+
+// backupConfig writes data to the first free of path.v<version>.bak, path.v<version>.1.bak, ...
+func backupConfig(path string, data []byte) (string, error) {
+	settings := map[string]any{}
+	yaml.Unmarshal(data, &settings)
+	from, _ := version(settings)
+	backup := fmt.Sprintf("%s.v%d.bak", path, from)
+	for i := 1; ; i++ {
+		if _, err := system.Files().Stat(backup); os.IsNotExist(err) {
+			break
+		}
+		backup = fmt.Sprintf("%s.v%d.%d.bak", path, from, i)
+	}
+	info, err := system.Files().Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to back up config file %s: %v", path, err)
+	}
+	if err := system.Files().WriteFile(backup, data, info.Mode().Perm()); err != nil {
+		return "", fmt.Errorf("failed to back up config file %s: %v", path, err)
+	}
+	return backup, nil
+}
+
+// migrateLoaded migrates the settings read from path in memory, the file is only upgraded by `config migrate`
+func migrateLoaded(path string, settings map[string]any) error {
+	before, err := version(settings)
+	if err != nil {
+		return err
+	}
+	if before == CurrentVersion {
+		return nil
+	}
+	if _, err := migrate(settings); err != nil {
+		return err
+	}
+	slog.Warn(fmt.Sprintf("Config file %s uses version %d, run `ssh-tunnel-setup config migrate` to upgrade it", path, before))
+	return nil
+}
+
+// obsoleteKeys were written by older versions but are not read by any
+var obsoleteKeys = map[string][]string{
+	"client": {"user", "server-key-directory"},
+	"tunnel": {"remote-port"},
+}
+
+// migrateKeyNames renames the keys older versions wrote, like key_name (viper defaults)
+// or keyname (sections stored without yaml tags), to their hyphenated names
+// Stored sections take precedence over the defaults written next to them
+func migrateKeyNames(settings map[string]any) {
+	sections := reflect.TypeOf(Config{})
+	for i := 0; i < sections.NumField(); i++ {
+		field := sections.Field(i)
+		section, ok := settings[field.Tag.Get("mapstructure")].(map[string]any)
+		if !ok || field.Type.Kind() != reflect.Struct {
+			continue
+		}
+		for j := 0; j < field.Type.NumField(); j++ {
+			key := field.Type.Field(j)
+			name := key.Tag.Get("mapstructure")
+			for _, alias := range []string{strings.ToLower(key.Name), strings.ReplaceAll(name, "-", "_")} {
+				value, ok := section[alias]
+				if !ok || alias == name {
+					continue
+				}
+				if _, ok := section[name]; !ok {
+					section[name] = value
+				}
+				delete(section, alias)
+			}
+		}
+		for _, name := range obsoleteKeys[field.Tag.Get("mapstructure")] {
+			delete(section, name)
+			delete(section, strings.ReplaceAll(name, "-", "_"))
+		}
+	}
+	if value, ok := settings["trusted_host_key"]; ok {
+		if _, ok := settings["trusted-host-key"]; !ok {
+			settings["trusted-host-key"] = value
+		}
+		delete(settings, "trusted_host_key")
+	}
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+const legacyConfig = `client:
+    key_name: default-key
+    keyname: client-key
+    user: default-user
+rotate:
+    keyname: tunnel-key
+    keydirectory: /home/alice/.ssh
+    serverport: 2222
+trusted_host_key: ssh-ed25519 AAAA
+`
+
+func TestLoadConfigMigratesInMemory(t *testing.T) {
+	host := setup(t)
+	path := "/etc/ssh-tunnel-setup/config.yaml"
+	host.FS.Seed(path, []byte(legacyConfig), 0644)
+
+	LoadConfig()
+
+	if AppConfig.Client.KeyName != "client-key" || AppConfig.Rotate.KeyName != "tunnel-key" ||
+		AppConfig.Rotate.KeyDirectory != "/home/alice/.ssh" || AppConfig.Rotate.ServerPort != 2222 {
+		t.Errorf("legacy keys not migrated: %+v %+v", AppConfig.Client, AppConfig.Rotate)
+	}
+	if AppConfig.TrustedHostKey != "ssh-ed25519 AAAA" {
+		t.Errorf("trusted_host_key not migrated: %q", AppConfig.TrustedHostKey)
+	}
+	data, _ := host.FS.ReadFile(path)
+	if string(data) != legacyConfig {
+		t.Errorf("config file changed:\n%s", data)
+	}
+	if _, err := host.FS.Stat(path + ".v0.bak"); err == nil {
+		t.Error("backup written")
+	}
+}
+
+func TestLoadConfigSkipsBrokenFiles(t *testing.T) {
+	host := setup(t)
+	host.FS.Seed("/etc/ssh-tunnel-setup/config.yaml", []byte("version: 2\n"), 0644)
+	host.FS.Seed("/home/alice/.config/ssh-tunnel-setup/config.yaml", []byte(legacyConfig), 0600)
+
+	found, err := readConfigFiles()
+	if err == nil || !strings.Contains(err.Error(), "/etc/ssh-tunnel-setup/config.yaml") {
+		t.Errorf("expected the error of the system config, got %v", err)
+	}
+	if len(found) != 1 || found[0] != "/home/alice/.config/ssh-tunnel-setup/config.yaml" {
+		t.Errorf("user config not loaded after the system config failed: %v", found)
+	}
+}
+
+func TestMigrateFile(t *testing.T) {
+	host := setup(t)
+	host.FS.Seed("/tmp/current.yaml", []byte("version: 1\nclient:\n    key-name: tunnel-key\n"), 0644)
+	host.FS.Seed("/tmp/newer.yaml", []byte("version: 2\n"), 0644)
+	host.FS.Seed("/tmp/legacy.yaml", []byte(legacyConfig), 0644)
+	host.FS.Seed("/tmp/legacy.yaml.v0.bak", []byte("older backup"), 0644)
+
+	if migration, err := MigrateFile("/tmp/current.yaml", false); err != nil || len(migration.Applied) != 0 {
+		t.Errorf("current file migrated: %v %v", migration, err)
+	}
+	if _, err := MigrateFile("/tmp/newer.yaml", false); err == nil {
+		t.Error("newer version not rejected")
+	}
+
+	migration, err := MigrateFile("/tmp/legacy.yaml", true)
+	if err != nil || len(migration.Applied) != 1 {
+		t.Fatalf("dry run: %v %v", migration, err)
+	}
+	if data, _ := host.FS.ReadFile("/tmp/legacy.yaml"); string(data) != legacyConfig {
+		t.Error("dry run changed the file")
+	}
+
+	migration, err = MigrateFile("/tmp/legacy.yaml", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated, _ := host.FS.ReadFile("/tmp/legacy.yaml")
+	for _, expected := range []string{"version: 1", "key-name: tunnel-key", "server-port: 2222"} {
+		if !strings.Contains(string(migrated), expected) {
+			t.Errorf("%q missing in migrated file:\n%s", expected, migrated)
+		}
+	}
+	if strings.Contains(string(migrated), "user: default-user") || strings.Contains(string(migrated), "keyname") {
+		t.Errorf("legacy keys left in migrated file:\n%s", migrated)
+	}
+	if migration.Backup != "/tmp/legacy.yaml.v0.1.bak" {
+		t.Errorf("existing backup not kept, backup written to %s", migration.Backup)
+	}
+}
@@ -0,0 +1,182 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Source is where the effective value of a setting comes from
+type Source string
+
+const (
+	SourceFlag    Source = "flag"
+	SourceEnv     Source = "env"
+	SourceFile    Source = "file"
+	SourceDefault Source = "default"
+	SourceUnset   Source = "unset"
+)
+
+// Setting is the effective value of a config key
+type Setting struct {
+	Key    string
+	Value  any
+	Source Source
+	// Origin is the config file or env variable the value was read from
+	Origin string
+}
+
+func (s Setting) String() string {
+	source := string(s.Source)
+	if s.Origin != "" {
+		source = fmt.Sprintf("%s %s", s.Source, s.Origin)
+	}
+	value := s.Value
+	if value == nil {
+		value = ""
+	}
+	return fmt.Sprintf("%s = %v (%s)", s.Key, value, source)
+}
+
+// secretKeys are masked in Effective
+var secretKeys = map[string]bool{
+	"client.server-pass":        true,
+	"client.enroll-token":       true,
+	"client.pkcs11-pin":         true,
+	"server.tunnel-pass":        true,
+	"rotate.archive-passphrase": true,
+	"proxy-pass":                true,
+}
+
+var (
+	flags    = map[string]*pflag.Flag{}
+	defaults = map[string]bool{}
+	// files holds the settings of every config file read, in order of precedence
+	files []fileSettings
+)
+
+type fileSettings struct {
+	path     string
+	settings map[string]any
+}
+
+// BindFlag makes flag the value of key when it is set on the command line
+func BindFlag(key string, flag *pflag.Flag) error {
+	flags[key] = flag
+	return viper.BindPFlag(key, flag)
+}
+
+func setDefault(key string, value any) {
+	defaults[key] = true
+	viper.SetDefault(key, value)
+}
+
+// Keys returns all config keys in lexical order
+func Keys() []string {
+	keys := configKeys(reflect.TypeOf(Config{}), "")
+	sort.Strings(keys)
+	return keys
+}
+
+func configKeys(t reflect.Type, prefix string) []string {
+	keys := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := prefix + field.Tag.Get("mapstructure")
+		if isSection(field.Type) {
+			keys = append(keys, configKeys(field.Type, key+".")...)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// isSection checks if t is a section of keys, a struct with mapstructure tags
+// Other structs like time.Time are values of a single key
+func isSection(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("mapstructure") != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// SourceOf returns where the effective value of key comes from and the env variable or file it was read from
+// It follows the precedence of viper: flags, env variables, config files, defaults
+func SourceOf(key string) (Source, string) {
+	if flag, ok := flags[key]; ok && flag.Changed {
+		return SourceFlag, ""
+	}
+	if os.Getenv(EnvName(key)) != "" {
+		return SourceEnv, EnvName(key)
+	}
+	if secretKeys[key] && os.Getenv(EnvName(key)+envFileSuffix) != "" {
+		return SourceEnv, EnvName(key) + envFileSuffix
+	}
+	for _, file := range files {
+		if lookup(file.settings, key) {
+			return SourceFile, file.path
+		}
+	}
+	if defaults[key] {
+		return SourceDefault, ""
+	}
+	if _, ok := flags[key]; ok {
+		return SourceDefault, ""
+	}
+	return SourceUnset, ""
+}
+
+func lookup(settings map[string]any, key string) bool {
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		value, ok := settings[part]
+		if !ok {
+			return false
+		}
+		if i == len(parts)-1 {
+			return true
+		}
+		if settings, ok = value.(map[string]any); !ok {
+			return false
+		}
+	}
+	return false
+}
+
+// Effective returns the effective value and source of every config key, secrets are masked
+func Effective() []Setting {
+	settings := []Setting{}
+	for _, key := range Keys() {
+		source, origin := SourceOf(key)
+		value := viper.Get(key)
+		if secretKeys[key] && value != nil && value != "" {
+			value = "********"
+		}
+		settings = append(settings, Setting{Key: key, Value: value, Source: source, Origin: origin})
+	}
+	return settings
+}
+
+// Configured checks if any key of section is set by a flag, env variable or config file
+func Configured(section string) bool {
+	for _, key := range Keys() {
+		if !strings.HasPrefix(key, section+".") {
+			continue
+		}
+		if source, _ := SourceOf(key); source == SourceFlag || source == SourceEnv || source == SourceFile {
+			return true
+		}
+	}
+	return false
+}
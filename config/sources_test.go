@@ -0,0 +1,39 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeys(t *testing.T) {
+	keys := Keys()
+	for _, expected := range []string{"client.server-name", "rotate.rotated", "server.gateway-listen", "trusted-host-key"} {
+		if !slices.Contains(keys, expected) {
+			t.Errorf("key %s missing in %v", expected, keys)
+		}
+	}
+	for i, key := range keys {
+		if key == "" || strings.HasSuffix(key, ".") || strings.HasPrefix(key, "rotate.rotated.") {
+			t.Errorf("invalid key %q", key)
+		}
+		if i > 0 && keys[i-1] == key {
+			t.Errorf("key %s listed twice", key)
+		}
+	}
+}
+
+func TestTimeFromEnv(t *testing.T) {
+	setup(t)
+	t.Setenv("SSH_TUNNEL_SETUP_ROTATE_ROTATED", "2024-05-01T12:00:00Z")
+
+	LoadConfig()
+
+	if expected := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC); !AppConfig.Rotate.Rotated.Equal(expected) {
+		t.Errorf("expected rotate.rotated %s, got %s", expected, AppConfig.Rotate.Rotated)
+	}
+	if source, origin := SourceOf("rotate.rotated"); source != SourceEnv || origin != "SSH_TUNNEL_SETUP_ROTATE_ROTATED" {
+		t.Errorf("unexpected source %s %s", source, origin)
+	}
+}
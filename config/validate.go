@@ -0,0 +1,279 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/ssh"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+)
+
+// FieldError describes an invalid setting
+type FieldError struct {
+	Key     string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Key, e.Message)
+}
+
+// ValidationError holds every invalid setting of a config section
+type ValidationError struct {
+	Section string
+	Fields  []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		messages = append(messages, field.Error())
+	}
+	return fmt.Sprintf("invalid %s config: %s", e.Section, strings.Join(messages, "; "))
+}
+
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// validator collects the field errors of a section
+type validator struct {
+	section string
+	fields  []FieldError
+}
+
+func (v *validator) fail(key, format string, args ...any) {
+	v.fields = append(v.fields, FieldError{Key: v.section + "." + key, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns a *ValidationError if any check failed
+func (v *validator) err() error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+	return &ValidationError{Section: v.section, Fields: v.fields}
+}
+
+func (v *validator) required(key, value string) bool {
+	if value == "" {
+		v.fail(key, "required")
+		return false
+	}
+	return true
+}
+
+func (v *validator) port(key string, value int) {
+	switch {
+	case value == 0:
+		v.fail(key, "required")
+	case value < 1 || value > 65535:
+		v.fail(key, "port %d out of range 1-65535", value)
+	}
+}
+
+func (v *validator) hostname(key, value string) {
+	if !v.required(key, value) {
+		return
+	}
+	if net.ParseIP(value) == nil && !hostnamePattern.MatchString(value) {
+		v.fail(key, "%q is not a valid hostname or IP address", value)
+	}
+}
+
+func (v *validator) path(key, value string) {
+	if !v.required(key, value) {
+		return
+	}
+	if !filepath.IsAbs(value) {
+		v.fail(key, "%q is not an absolute path", value)
+	}
+}
+
+// fileName checks that value is a plain file name, like the name of a key in the key directory
+func (v *validator) fileName(key, value string) {
+	if !v.required(key, value) {
+		return
+	}
+	if strings.ContainsRune(value, filepath.Separator) || value == "." || value == ".." {
+		v.fail(key, "%q is not a file name", value)
+	}
+}
+
+// oneOf checks that value is one of values, an empty value is accepted
+func (v *validator) oneOf(key, value string, values []string) {
+	if value != "" && !slices.Contains(values, value) {
+		v.fail(key, "%q is not one of %s", value, strings.Join(values, ", "))
+	}
+}
+
+func (v *validator) exists(key, path string) {
+	if _, err := system.Files().Stat(path); err != nil {
+		v.fail(key, "%s does not exist", path)
+	}
+}
+
+// Validate checks the client settings
+func (c *ClientConfig) Validate() error {
+	v := &validator{section: "client"}
+	v.fileName("key-name", c.KeyName)
+	v.path("key-directory", c.KeyDirectory)
+	v.required("key-user", c.KeyUser)
+	v.oneOf("key-type", c.KeyType, KeyTypes)
+	v.hostname("server-name", c.ServerName)
+	v.port("server-port", c.ServerPort)
+	if c.EnrollToken.Empty() {
+		v.required("server-user", c.ServerUser)
+	} else {
+		v.required("enroll-user", c.EnrollUser)
+	}
+	// keyboard-interactive asks for the password itself
+	if c.ServerPass.Empty() && c.ServerKeyName == "" && c.EnrollToken.Empty() && !slices.Contains(c.AuthMethods, AuthKeyboardInteractive) {
+		v.fail("server-pass", "server-pass, server-key-name or enroll-token required")
+	}
+	for _, method := range c.AuthMethods {
+		v.oneOf("auth-methods", method, AuthMethods)
+	}
+	if slices.Contains(c.AuthMethods, AuthPublicKey) && c.ServerKeyName == "" {
+		v.fail("auth-methods", "publickey requires server-key-name")
+	}
+	if c.ServerKeyName != "" {
+		v.fileName("server-key-name", c.ServerKeyName)
+		v.exists("server-key-name", filepath.Join(c.KeyDirectory, c.ServerKeyName))
+	}
+	if c.ImportKey != "" {
+		v.path("import-key", c.ImportKey)
+		v.exists("import-key", c.ImportKey)
+	}
+	v.oneOf("key-source", c.KeySource, KeySources)
+	if !c.KeyInFile() && c.ImportKey != "" {
+		v.fail("import-key", "keys from key-source %s can not be imported", c.KeySource)
+	}
+	if c.KeySource == KeySourcePKCS11 {
+		if !ssh.PKCS11Supported {
+			v.fail("key-source", "%v", ssh.ErrPKCS11Unsupported)
+		}
+		v.path("pkcs11-module", c.PKCS11Module)
+		if filepath.IsAbs(c.PKCS11Module) {
+			v.exists("pkcs11-module", c.PKCS11Module)
+		}
+		v.required("pkcs11-token", c.PKCS11Token)
+		v.required("pkcs11-key-label", c.PKCS11KeyLabel)
+	}
+	return v.err()
+}
+
+// Validate checks the rotate settings, the key to rotate has to exist
+func (c *RotateConfig) Validate() error {
+	v := &validator{section: "rotate"}
+	v.fileName("key-name", c.KeyName)
+	v.path("key-directory", c.KeyDirectory)
+	if c.KeyName != "" && c.KeyDirectory != "" {
+		v.exists("key-name", filepath.Join(c.KeyDirectory, c.KeyName))
+	}
+	v.required("key-user", c.KeyUser)
+	v.oneOf("key-type", c.KeyType, KeyTypes)
+	v.hostname("server-name", c.ServerName)
+	v.port("server-port", c.ServerPort)
+	v.required("server-user", c.ServerUser)
+	if c.Interval != 0 && c.Interval < time.Hour {
+		v.fail("interval", "%s is shorter than an hour", c.Interval)
+	}
+	if c.MaxAge != 0 && c.MaxAge < c.RotationInterval() {
+		v.fail("max-age", "%s is shorter than the rotation interval %s", c.MaxAge, c.RotationInterval())
+	}
+	v.oneOf("max-age-policy", c.MaxAgePolicy, MaxAgePolicies)
+	if c.ArchiveDirectory != "" {
+		v.path("archive-directory", c.ArchiveDirectory)
+	}
+	return v.err()
+}
+
+// Validate checks the server settings, the sshd config has to exist
+func (c *ServerConfig) Validate() error {
+	v := &validator{section: "server"}
+	v.required("tunnel-user", c.TunnelUser)
+	v.path("sshd-config-path", c.SSHDConfigPath)
+	if filepath.IsAbs(c.SSHDConfigPath) {
+		v.exists("sshd-config-path", c.SSHDConfigPath)
+	}
+	v.path("sshd-config-backup-path", c.SSHDConfigBackupPath)
+	if c.Enrollment {
+		v.required("enroll-user", c.EnrollUser)
+		if c.EnrollUser == c.TunnelUser {
+			v.fail("enroll-user", "must differ from tunnel-user")
+		}
+	}
+	if c.UserCA {
+		if !c.Enrollment {
+			v.fail("user-ca", "requires enrollment, certificates are issued by the enroll account")
+		}
+		if c.UserCertValidity < time.Minute {
+			v.fail("user-cert-validity", "%s is shorter than a minute", c.UserCertValidity)
+		}
+	}
+	if c.HostCA {
+		if len(c.HostNames) == 0 {
+			v.fail("host-names", "required, the names clients connect to the relay with")
+		}
+		for _, name := range c.HostNames {
+			v.hostname("host-names", name)
+		}
+		if c.HostCertValidity < HostCertRenewal {
+			v.fail("host-cert-validity", "%s is shorter than %s, certificates are renewed when they expire within it", c.HostCertValidity, HostCertRenewal)
+		}
+	}
+	if c.Gateway {
+		v.required("gateway-listen", c.GatewayListen)
+		v.required("gateway-upstream", c.GatewayUpstream)
+		if !strings.HasPrefix(c.GatewayPath, "/") {
+			v.fail("gateway-path", "%q does not start with /", c.GatewayPath)
+		}
+		v.path("gateway-cert", c.GatewayCert)
+		v.path("gateway-key", c.GatewayKey)
+	}
+	return v.err()
+}
+
+// Validate checks the tunnel settings
+// The key is not required to exist, it is created by the target setup
+func (c *TunnelConfig) Validate() error {
+	v := &validator{section: "tunnel"}
+	v.path("ssh-config-path", c.SSHConfigPath)
+	v.required("host-identifier", c.HostIdentifier)
+	v.hostname("server-name", c.ServerName)
+	v.required("local-user", c.LocalUser)
+	v.path("key-directory", c.KeyDirectory)
+	v.fileName("server-key-name", c.ServerKeyName)
+	v.hostname("local-host", c.LocalHost)
+	v.port("local-port", c.LocalPort)
+	v.required("server-user", c.ServerUser)
+	v.port("server-port", c.ServerPort)
+	return v.err()
+}
+
+// HostCertRenewal is the time before their expiry host certificates are renewed by the server setup
+const HostCertRenewal = 30 * 24 * time.Hour
+
+// KeyTypes are the supported types of generated keys, an empty key type is rsa
+var KeyTypes = []string{"rsa", "ed25519"}
+
+// Sections are the config sections that can be validated
+var Sections = []string{"server", "client", "rotate", "tunnel"}
+
+// ValidateSection validates the loaded settings of section
+func ValidateSection(section string) error {
+	switch section {
+	case "server":
+		return AppConfig.Server.Validate()
+	case "client":
+		return AppConfig.Client.Validate()
+	case "rotate":
+		return AppConfig.Rotate.Validate()
+	case "tunnel":
+		return AppConfig.Tunnel.Validate()
+	}
+	return fmt.Errorf("unknown config section %q, expected one of %v", section, Sections)
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/ssh"
+	"github.com/spf13/pflag"
+)
+
+func TestValidateCollectsAllFields(t *testing.T) {
+	setup(t)
+	cfg := &ClientConfig{
+		KeyName:      "keys/tunnel",
+		KeyDirectory: ".ssh",
+		ServerName:   "bad host",
+		ServerPort:   70000,
+		KeySource:    KeySourcePKCS11,
+		AuthMethods:  []string{AuthPublicKey, "totp"},
+	}
+
+	err := cfg.Validate()
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected a *ValidationError, got %v", err)
+	}
+	got := map[string]bool{}
+	for _, field := range validationErr.Fields {
+		got[field.Key] = true
+	}
+	for _, key := range []string{
+		"client.key-name", "client.key-directory", "client.key-user", "client.server-name",
+		"client.server-port", "client.server-user", "client.server-pass",
+		"client.pkcs11-module", "client.pkcs11-token", "client.pkcs11-key-label", "client.auth-methods",
+	} {
+		if !got[key] {
+			t.Errorf("%s not reported in %v", key, err)
+		}
+	}
+	// binaries without cgo reject pkcs11 up front instead of failing on the first login
+	if got["client.key-source"] == ssh.PKCS11Supported {
+		t.Errorf("client.key-source reported %v with PKCS11Supported %v", got["client.key-source"], ssh.PKCS11Supported)
+	}
+}
+
+func TestValidateKeyExistence(t *testing.T) {
+	host := setup(t)
+	cfg := &RotateConfig{
+		KeyName:      "tunnel-key",
+		KeyDirectory: "/home/alice/.ssh",
+		KeyUser:      "alice@target-1",
+		ServerName:   "relay.example.com",
+		ServerPort:   22,
+		ServerUser:   TunnelUser,
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Error("missing key not reported")
+	}
+
+	host.FS.Seed("/home/alice/.ssh/tunnel-key", []byte("key"), 0600)
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("valid config rejected: %v", err)
+	}
+}
+
+func TestSourceOf(t *testing.T) {
+	host := setup(t)
+	host.FS.Seed("/etc/ssh-tunnel-setup/config.yaml", []byte("client:\n    key-name: from-file\n"), 0644)
+	flags := pflag.NewFlagSet("client", pflag.ContinueOnError)
+	flags.String("server-name", "", "")
+	flags.String("key-user", "", "")
+	if err := BindFlag("client.server-name", flags.Lookup("server-name")); err != nil {
+		t.Fatal(err)
+	}
+	if err := BindFlag("client.key-user", flags.Lookup("key-user")); err != nil {
+		t.Fatal(err)
+	}
+	if err := flags.Parse([]string{"--server-name", "relay.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	LoadConfig()
+
+	for key, expected := range map[string]Source{
+		"client.server-name":     SourceFlag,
+		"client.key-name":        SourceFile,
+		"client.key-user":        SourceDefault,
+		"client.server-key-name": SourceUnset,
+	} {
+		if source, _ := SourceOf(key); source != expected {
+			t.Errorf("%s: expected source %s, got %s", key, expected, source)
+		}
+	}
+	if AppConfig.Client.ServerName != "relay.example.com" || AppConfig.Client.KeyName != "from-file" {
+		t.Errorf("flag or file value not applied: %+v", AppConfig.Client)
+	}
+}
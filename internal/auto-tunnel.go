@@ -3,10 +3,14 @@ package internal
 import (
 	"fmt"
 	"log/slog"
+	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/fbufler/ssh-tunnel-setup/config"
 	"github.com/fbufler/ssh-tunnel-setup/package/ssh"
+	"github.com/fbufler/ssh-tunnel-setup/package/state"
 	"github.com/fbufler/ssh-tunnel-setup/package/system"
 )
 
@@ -14,30 +18,162 @@ const serviceName = "managed-tunnel"
 const serviceDescription = "Managed SSH tunnel"
 const monitorInterval = 60 * time.Second
 
-func SetupTunnel(cfg *config.TunnelConfig) error {
+func SetupTunnel(cfg *config.TunnelConfig, manifest *state.Manifest) error {
 	slog.Debug("Setting up managed tunnel")
 
+	steps := []step{
+		{
+			name:  "ssh-config",
+			paths: []string{cfg.SSHConfigPath},
+			run:   func() error { return configureTunnelHost(cfg, manifest) },
+		},
+		{
+			name:  "systemd-unit",
+			paths: []string{system.SystemdServicePath(serviceName)},
+			run:   func() error { return installTunnelService(cfg, manifest) },
+		},
+		{
+			name:  "systemd-enable",
+			after: []string{"systemd-unit"},
+			run:   func() error { return system.EnableSystemdService(serviceName) },
+		},
+		{
+			name:  "cron-monitor",
+			paths: []string{system.MonitorScriptPath(serviceName)},
+			check: func() bool {
+				return system.CronEntryExists(system.CronPath(cfg.LocalUser), system.CronMonitorEntry(serviceName, monitorInterval))
+			},
+			run: func() error { return installTunnelMonitor(cfg, manifest) },
+		},
+	}
+	if ca := config.TrustedHostCA(); ca != "" {
+		knownHostsPath := cfg.KeyDirectory + "/known_hosts"
+		patterns := ssh.KnownHostPatterns(cfg.ServerName)
+		// the tunnel's ssh accepts the host certificates of the relay
+		steps = append(steps, step{
+			name:  "known-host-ca",
+			check: func() bool { return ssh.HostCATrusted(knownHostsPath, patterns, ca) },
+			run: func() error {
+				if err := ssh.TrustHostCA(knownHostsPath, patterns, ca); err != nil {
+					return fmt.Errorf("failed to trust host certificate authority: %v", err)
+				}
+				return manifest.Record(state.Artifact{Kind: state.KindKnownHostCA, Path: knownHostsPath, Name: patterns})
+			},
+		})
+	}
+
+	return runSteps(manifest, steps)
+}
+
+func configureTunnelHost(cfg *config.TunnelConfig, manifest *state.Manifest) error {
 	serverKeyPath := cfg.KeyDirectory + "/" + cfg.ServerKeyName
-	err := ssh.ConfigureTunnel(cfg.SSHConfigPath, cfg.HostIdentifier, cfg.ServerName, cfg.ServerUser, serverKeyPath, cfg.LocalHost, cfg.LocalPort, cfg.ServerPort)
+	configured, err := ssh.TunnelConfigured(cfg.SSHConfigPath, cfg.HostIdentifier)
+	if err != nil {
+		return err
+	}
+	proxyCommand, err := tunnelProxyCommand(cfg)
+	if err != nil {
+		return err
+	}
+	err = ssh.ConfigureTunnel(cfg.SSHConfigPath, cfg.HostIdentifier, cfg.ServerName, relaySSHPort(), cfg.ServerUser, serverKeyPath, cfg.LocalHost, cfg.LocalPort, cfg.ServerPort, proxyCommand)
 	if err != nil {
 		return err
 	}
+	if configured {
+		return nil
+	}
+	return manifest.Record(state.Artifact{Kind: state.KindSSHConfigHost, Path: cfg.SSHConfigPath, Name: cfg.HostIdentifier})
+}
 
-	execStart := fmt.Sprintf("/usr/bin/ssh -N -R %d:%s:%d %s@%s", cfg.ServerPort, cfg.LocalHost, cfg.LocalPort, cfg.ServerUser, cfg.ServerName)
+func installTunnelService(cfg *config.TunnelConfig, manifest *state.Manifest) error {
+	options := ""
+	if port := relaySSHPort(); port != 22 {
+		options = fmt.Sprintf("-p %d ", port)
+	}
+	if hosts := ssh.JumpHosts(); len(hosts) > 0 {
+		options += fmt.Sprintf("-J %s ", ssh.ProxyJump(hosts, cfg.ServerUser))
+	}
+	proxyCommand, err := tunnelProxyCommand(cfg)
+	if err != nil {
+		return err
+	}
+	if proxyCommand != "" {
+		// % starts a specifier in unit files
+		options += fmt.Sprintf("-o \"ProxyCommand=%s\" ", strings.ReplaceAll(proxyCommand, "%", "%%"))
+	}
+	execStart := fmt.Sprintf("/usr/bin/ssh -N %s-R %d:%s:%d %s@%s", options, cfg.ServerPort, cfg.LocalHost, cfg.LocalPort, cfg.ServerUser, cfg.ServerName)
 	err = system.CreateSystemdService(serviceName, serviceDescription, execStart, cfg.LocalUser)
 	if err != nil {
 		return err
 	}
+	return manifest.Record(state.Artifact{Kind: state.KindSystemdUnit, Path: system.SystemdServicePath(serviceName), Name: serviceName})
+}
 
-	err = system.EnableSystemdService(serviceName)
+// tunnelProxyCommand returns the ProxyCommand the tunnel's ssh connects to the relay through the proxy and the gateway with,
+// it is empty without either
+// The proxy is resolved at setup, as the service does not see the environment of the setup; a proxy that needs a password
+// is refused, as the password would have to be written where the service can read it
+func tunnelProxyCommand(cfg *config.TunnelConfig) (string, error) {
+	address := net.JoinHostPort(cfg.ServerName, strconv.Itoa(relaySSHPort()))
+	hosts := ssh.JumpHosts()
+	gatewayURL, gatewayCA := ssh.Gateway()
+	switch {
+	case gatewayURL != nil:
+		// the proxy is used for the gateway, which forwards to sshd
+		address = gatewayURL.Host
+	case len(hosts) > 0:
+		// the proxy is used for the first host connected to
+		address = hosts[0].Address
+	}
+	proxyURL, err := ssh.ProxyFor(address, true)
+	if err != nil || (proxyURL == nil && gatewayURL == nil) {
+		return "", err
+	}
+	if proxyURL != nil {
+		if _, ok := proxyURL.User.Password(); ok {
+			return "", fmt.Errorf("the tunnel service can not authenticate to the proxy %s with a password, use a proxy without password for %s or exclude it with NO_PROXY", proxyURL.Host, address)
+		}
+	}
+	if len(hosts) > 0 {
+		if gatewayURL != nil {
+			return "", fmt.Errorf("the tunnel service can not combine jump hosts with a gateway")
+		}
+		return "", fmt.Errorf("the tunnel service can not combine jump hosts with a proxy, exclude %s from the proxy with NO_PROXY", hosts[0].Address)
+	}
+	path, err := executable()
 	if err != nil {
-		return err
+		return "", fmt.Errorf("failed to determine executable: %v", err)
+	}
+	command := path + " proxy-connect"
+	if proxyURL != nil {
+		command += " --proxy " + proxyURL.String()
+	}
+	if gatewayURL != nil {
+		command += " --gateway-url " + gatewayURL.String()
+		if gatewayCA != "" {
+			command += " --gateway-ca " + gatewayCA
+		}
 	}
+	return command + " %h %p", nil
+}
+
+// relaySSHPort is the port of sshd on the relay, client.server-port or 22 when it is not set
+func relaySSHPort() int {
+	if port := config.AppConfig.Client.ServerPort; port != 0 {
+		return port
+	}
+	return 22
+}
 
-	err = system.CreateCronMonitor(serviceName, cfg.LocalUser, cfg.LocalPort, monitorInterval)
+func installTunnelMonitor(cfg *config.TunnelConfig, manifest *state.Manifest) error {
+	err := system.CreateCronMonitor(serviceName, cfg.LocalUser, cfg.LocalPort, monitorInterval)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	err = manifest.Record(state.Artifact{Kind: state.KindFile, Path: system.MonitorScriptPath(serviceName)})
+	if err != nil {
+		return err
+	}
+	// only the monitor line is removed on uninstall, other cron jobs of the user are kept
+	return manifest.Record(state.Artifact{Kind: state.KindCronEntry, Path: system.CronPath(cfg.LocalUser), Name: system.CronMonitorEntry(serviceName, monitorInterval)})
 }
@@ -0,0 +1,307 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	tunnelssh "github.com/fbufler/ssh-tunnel-setup/package/ssh"
+	"github.com/fbufler/ssh-tunnel-setup/package/sshd"
+	"github.com/fbufler/ssh-tunnel-setup/package/state"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+	"golang.org/x/crypto/ssh"
+)
+
+// userCAPath is the private key of the user certificate authority of the relay, its public key is trusted by sshd
+const userCAPath = "/etc/ssh-tunnel-setup/user_ca"
+
+// revokedKeysPath lists the keys sshd refuses the certificates of, clients revoke keys of failed rotations there
+const revokedKeysPath = "/etc/ssh-tunnel-setup/revoked_keys"
+
+// userCASteps create the user certificate authority the enroll account signs the keys of clients with
+// and the list of revoked keys, which sshd requires to exist
+func userCASteps(cfg *config.ServerConfig, manifest *state.Manifest) []step {
+	return []step{
+		{
+			name:  "user-ca",
+			paths: []string{userCAPath + ".pub"},
+			check: func() bool { return tunnelssh.KeyPairExists(userCAPath) },
+			run: func() error {
+				if tunnelssh.KeyPairExists(userCAPath) {
+					slog.Info(fmt.Sprintf("User certificate authority %s already exists, keeping it", userCAPath))
+					return nil
+				}
+				if err := tunnelssh.MakeCertificateAuthority(userCAPath, fmt.Sprintf("user-ca@%s", cfg.Name)); err != nil {
+					return fmt.Errorf("failed to create user certificate authority: %v", err)
+				}
+				return manifest.Record(state.Artifact{Kind: state.KindKeyPair, Path: userCAPath})
+			},
+		},
+		{
+			name: "revoked-keys",
+			check: func() bool {
+				_, err := system.Files().Stat(revokedKeysPath)
+				return err == nil
+			},
+			run: func() error {
+				if _, err := system.Files().Stat(revokedKeysPath); err == nil {
+					return nil
+				}
+				if err := system.Files().WriteFile(revokedKeysPath, nil, 0644); err != nil {
+					return fmt.Errorf("failed to create revoked keys: %v", err)
+				}
+				return manifest.Record(state.Artifact{Kind: state.KindFile, Path: revokedKeysPath})
+			},
+		},
+	}
+}
+
+// signUserKey returns the certificate of key for the tunnel user in authorized_keys format
+func signUserKey(cfg *config.ServerConfig, key ssh.PublicKey, keyID string) (string, error) {
+	cert, err := tunnelssh.SignUserKey(userCAPath, key, keyID, []string{cfg.TunnelUser}, cfg.UserCertValidity)
+	if err != nil {
+		return "", err
+	}
+	slog.Info(fmt.Sprintf("Issued certificate %q for key %s, valid for %s", keyID, ssh.FingerprintSHA256(key), cfg.UserCertValidity))
+	return string(ssh.MarshalAuthorizedKey(cert)), nil
+}
+
+// renewCertificate signs the new key of keyType for the holder of cert, keeping the key id of cert
+func renewCertificate(cfg *config.ServerConfig, login ssh.PublicKey, keyType, key string) (string, error) {
+	if !cfg.UserCA {
+		return "", fmt.Errorf("renewing certificates requires user-ca")
+	}
+	cert, ok := login.(*ssh.Certificate)
+	if !ok {
+		return "", fmt.Errorf("renewing requires a login with the current certificate")
+	}
+	ca, err := tunnelssh.ReadPublicKey(userCAPath + ".pub")
+	if err != nil {
+		return "", fmt.Errorf("failed to read user certificate authority: %v", err)
+	}
+	if err := tunnelssh.CheckUserCertificate(ca, cert, cfg.TunnelUser); err != nil {
+		slog.Warn(fmt.Sprintf("Renewal of certificate %q rejected: %v", cert.KeyId, err))
+		return "", err
+	}
+	// sshd refuses revoked keys for the tunnel user only, the enroll account has to check them itself
+	if keyRevoked(cert.Key) {
+		slog.Warn(fmt.Sprintf("Renewal of certificate %q rejected, its key is revoked", cert.KeyId))
+		return "", fmt.Errorf("key revoked")
+	}
+	publicKey, err := parsePublicKey(keyType, key)
+	if err != nil {
+		return "", err
+	}
+	if _, isCert := publicKey.(*ssh.Certificate); isCert {
+		return "", fmt.Errorf("renew a key instead of a certificate")
+	}
+	return signUserKey(cfg, publicKey, cert.KeyId)
+}
+
+// revokeCertificate revokes the key of cert, the certificate the client logged in with, so a client only revokes its own keys
+func revokeCertificate(cfg *config.ServerConfig, login ssh.PublicKey) (string, error) {
+	if !cfg.UserCA {
+		return "", fmt.Errorf("revoking certificates requires user-ca")
+	}
+	cert, ok := login.(*ssh.Certificate)
+	if !ok {
+		return "", fmt.Errorf("revoking requires a login with the certificate to revoke")
+	}
+	ca, err := tunnelssh.ReadPublicKey(userCAPath + ".pub")
+	if err != nil {
+		return "", fmt.Errorf("failed to read user certificate authority: %v", err)
+	}
+	if err := tunnelssh.CheckUserCertificate(ca, cert, cfg.TunnelUser); err != nil {
+		slog.Warn(fmt.Sprintf("Revocation of certificate %q rejected: %v", cert.KeyId, err))
+		return "", err
+	}
+	if keyRevoked(cert.Key) {
+		return "", nil
+	}
+	line := ssh.MarshalAuthorizedKey(cert.Key)
+	if err := system.Files().AppendLine(revokedKeysPath, line); err != nil {
+		return "", fmt.Errorf("failed to revoke key: %v", err)
+	}
+	slog.Info(fmt.Sprintf("Revoked key %s of certificate %q", ssh.FingerprintSHA256(cert.Key), cert.KeyId))
+	return "", nil
+}
+
+// keyRevoked checks if key is in the revoked keys
+func keyRevoked(key ssh.PublicKey) bool {
+	data, err := system.Files().ReadFile(revokedKeysPath)
+	if err != nil {
+		return false
+	}
+	for len(data) > 0 {
+		revoked, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return false
+		}
+		if bytes.Equal(revoked.Marshal(), key.Marshal()) {
+			return true
+		}
+		data = rest
+	}
+	return false
+}
+
+// userCATrusted checks that the sshd config trusts the user certificate authority if and only if user-ca is enabled
+func userCATrusted(cfg *config.ServerConfig) bool {
+	sshdConfig, err := system.Files().ReadFile(cfg.SSHDConfigPath)
+	if err != nil {
+		return false
+	}
+	expected := ""
+	if cfg.UserCA {
+		expected = cfg.TunnelUser
+		if !bytes.Contains(sshdConfig, []byte("RevokedKeys "+revokedKeysPath+"\n")) {
+			return false
+		}
+	}
+	return sshd.TrustedUser(sshdConfig) == expected
+}
+
+// hostCAPath is the private key of the host certificate authority of the relay, clients trust its public key
+const hostCAPath = "/etc/ssh-tunnel-setup/host_ca"
+
+const hostKeyDirectory = "/etc/ssh"
+
+var hostKeyPattern = regexp.MustCompile(`^ssh_host_[a-z0-9]+_key\.pub$`)
+
+// hostKeys returns the paths of the private host keys of sshd
+func hostKeys() ([]string, error) {
+	names, err := system.Files().ReadDir(hostKeyDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list host keys: %v", err)
+	}
+	keys := []string{}
+	for _, name := range names {
+		if hostKeyPattern.MatchString(name) {
+			keys = append(keys, filepath.Join(hostKeyDirectory, strings.TrimSuffix(name, ".pub")))
+		}
+	}
+	return keys, nil
+}
+
+// hostCertificatePaths returns the certificates of the host keys if host-ca is enabled
+func hostCertificatePaths(cfg *config.ServerConfig) []string {
+	if !cfg.HostCA {
+		return nil
+	}
+	keys, err := hostKeys()
+	if err != nil {
+		return nil
+	}
+	paths := []string{}
+	for _, key := range keys {
+		paths = append(paths, tunnelssh.CertificatePath(key))
+	}
+	return paths
+}
+
+// hostCASteps create the host certificate authority and sign the host keys of sshd with it
+func hostCASteps(cfg *config.ServerConfig, manifest *state.Manifest) []step {
+	return []step{
+		{
+			name:  "host-ca",
+			paths: []string{hostCAPath + ".pub"},
+			check: func() bool { return tunnelssh.KeyPairExists(hostCAPath) },
+			run: func() error {
+				if tunnelssh.KeyPairExists(hostCAPath) {
+					slog.Info(fmt.Sprintf("Host certificate authority %s already exists, keeping it", hostCAPath))
+					return nil
+				}
+				if err := tunnelssh.MakeCertificateAuthority(hostCAPath, fmt.Sprintf("host-ca@%s", cfg.Name)); err != nil {
+					return fmt.Errorf("failed to create host certificate authority: %v", err)
+				}
+				return manifest.Record(state.Artifact{Kind: state.KindKeyPair, Path: hostCAPath})
+			},
+		},
+		{
+			name:  "host-certificates",
+			after: []string{"host-ca"},
+			check: func() bool { return hostCertificatesValid(cfg) },
+			run:   func() error { return signHostKeys(cfg, manifest) },
+		},
+	}
+}
+
+// hostCertificatesValid checks that every host key has a certificate of the host certificate authority
+// for the host names, which does not expire within config.HostCertRenewal
+func hostCertificatesValid(cfg *config.ServerConfig) bool {
+	ca, err := tunnelssh.ReadPublicKey(hostCAPath + ".pub")
+	if err != nil {
+		return false
+	}
+	keys, err := hostKeys()
+	if err != nil || len(keys) == 0 {
+		return false
+	}
+	renewal := uint64(time.Now().Add(config.HostCertRenewal).Unix())
+	for _, key := range keys {
+		publicKey, err := tunnelssh.ReadPublicKey(tunnelssh.CertificatePath(key))
+		if err != nil {
+			return false
+		}
+		cert, ok := publicKey.(*ssh.Certificate)
+		if !ok || cert.CertType != ssh.HostCert || !bytes.Equal(cert.SignatureKey.Marshal(), ca.Marshal()) ||
+			!slices.Equal(cert.ValidPrincipals, cfg.HostNames) || cert.ValidBefore < renewal {
+			return false
+		}
+	}
+	return true
+}
+
+// signHostKeys writes a certificate of the host certificate authority next to every host key
+func signHostKeys(cfg *config.ServerConfig, manifest *state.Manifest) error {
+	keys, err := hostKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no host keys in %s", hostKeyDirectory)
+	}
+	for _, key := range keys {
+		publicKey, err := tunnelssh.ReadPublicKey(key + ".pub")
+		if err != nil {
+			return err
+		}
+		cert, err := tunnelssh.SignHostKey(hostCAPath, publicKey, fmt.Sprintf("%s:%s", cfg.Name, filepath.Base(key)), cfg.HostNames, cfg.HostCertValidity)
+		if err != nil {
+			return err
+		}
+		path := tunnelssh.CertificatePath(key)
+		if err := system.Files().WriteFile(path, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+			return fmt.Errorf("failed to write host certificate: %v", err)
+		}
+		if err := manifest.Record(state.Artifact{Kind: state.KindFile, Path: path}); err != nil {
+			return err
+		}
+		slog.Info(fmt.Sprintf("Signed host key %s for %s", key, strings.Join(cfg.HostNames, ", ")))
+	}
+	ca, err := system.Files().ReadFile(hostCAPath + ".pub")
+	if err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("Clients trust the relay with trusted-host-ca: %q", strings.TrimSpace(string(ca))))
+	return nil
+}
+
+// hostCertificatesConfigured checks that the sshd config lists exactly the host certificates of hostCertificatePaths
+func hostCertificatesConfigured(cfg *config.ServerConfig) bool {
+	sshdConfig, err := system.Files().ReadFile(cfg.SSHDConfigPath)
+	if err != nil {
+		return false
+	}
+	expected := hostCertificatePaths(cfg)
+	if expected == nil {
+		expected = []string{}
+	}
+	return slices.Equal(sshd.ConfiguredHostCertificates(sshdConfig), expected)
+}
@@ -0,0 +1,346 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/fbufler/ssh-tunnel-setup/package/ssh"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+)
+
+// The results of a check of Doctor
+const (
+	CheckPass = "PASS"
+	CheckFail = "FAIL"
+	// CheckSkip is a check that does not apply or can not be made
+	CheckSkip = "SKIP"
+)
+
+// Check is the result of a single check of Doctor
+type Check struct {
+	Name   string
+	Status string
+	// Detail is what the check found
+	Detail string
+	// Hint tells how to fix a failed check
+	Hint string
+}
+
+// DoctorRoles are the roles Doctor checks a machine for
+var DoctorRoles = []string{"server", "client", "target"}
+
+var (
+	goos     = runtime.GOOS
+	lookPath = exec.LookPath
+)
+
+// sshdPath is where sshd is installed outside the PATH of unprivileged users
+const sshdPath = "/usr/sbin/sshd"
+
+// Doctor checks that the machine can run the setup of role with the loaded config, sections are the config sections of role
+// The checks only read, nothing is changed
+func Doctor(role string, sections []string) []Check {
+	checks := []Check{checkOS()}
+	for _, section := range sections {
+		checks = append(checks, checkConfig(section))
+	}
+	switch role {
+	case "server":
+		cfg := &config.AppConfig.Server
+		binaries := []string{"sudo", "useradd", "usermod", "passwd", "chpasswd", "systemctl", "sshd"}
+		if cfg.Enrollment {
+			binaries = append(binaries, "visudo")
+		}
+		checks = append(checks, checkPrivileges())
+		checks = append(checks, checkBinaries(binaries)...)
+		checks = append(checks, checkSSHD(cfg)...)
+		if cfg.Gateway {
+			checks = append(checks, checkGatewayPort(cfg))
+		}
+	case "client":
+		cfg := &config.AppConfig.Client
+		checks = append(checks, checkRelay(cfg.ServerName, cfg.ServerPort)...)
+		if cfg.KeyInFile() {
+			checks = append(checks, checkKeyPermissions(cfg.KeyDirectory, cfg.KeyName))
+		}
+	case "target":
+		client, tunnel := &config.AppConfig.Client, &config.AppConfig.Tunnel
+		checks = append(checks, checkPrivileges())
+		checks = append(checks, checkBinaries([]string{"ssh", "systemctl"})...)
+		checks = append(checks, checkRelay(client.ServerName, client.ServerPort)...)
+		checks = append(checks, checkKeyPermissions(tunnel.KeyDirectory, tunnel.ServerKeyName))
+		checks = append(checks, checkRemotePort(client.ServerName, tunnel.ServerPort), checkLocalService(tunnel))
+	}
+	return checks
+}
+
+// Failed counts the failed checks
+func Failed(checks []Check) int {
+	failed := 0
+	for _, check := range checks {
+		if check.Status == CheckFail {
+			failed++
+		}
+	}
+	return failed
+}
+
+func pass(name, format string, args ...any) Check {
+	return Check{Name: name, Status: CheckPass, Detail: fmt.Sprintf(format, args...)}
+}
+
+func skip(name, format string, args ...any) Check {
+	return Check{Name: name, Status: CheckSkip, Detail: fmt.Sprintf(format, args...)}
+}
+
+func fail(name, detail, hint string) Check {
+	return Check{Name: name, Status: CheckFail, Detail: detail, Hint: hint}
+}
+
+func checkOS() Check {
+	if goos != "linux" {
+		return fail("os", goos, "the setup manages users, sshd and systemd units of Linux, run it on a Linux machine")
+	}
+	return pass("os", "%s/%s", goos, runtime.GOARCH)
+}
+
+func checkConfig(section string) Check {
+	name := "config " + section
+	err := config.ValidateSection(section)
+	var validationErr *config.ValidationError
+	switch {
+	case err == nil:
+		return pass(name, "valid")
+	case errors.As(err, &validationErr):
+		fields := make([]string, 0, len(validationErr.Fields))
+		for _, field := range validationErr.Fields {
+			fields = append(fields, field.Error())
+		}
+		return fail(name, strings.Join(fields, "; "), "fix the settings, `config show` lists where they are set")
+	default:
+		return fail(name, err.Error(), "fix the config files listed by `config show`")
+	}
+}
+
+func checkPrivileges() Check {
+	if !system.Users().IsPrivileged() {
+		return fail("privileges", "neither root nor member of the sudo group", "run the setup as root or as a member of the sudo group")
+	}
+	return pass("privileges", "root or member of the sudo group")
+}
+
+// binaryPackages name the packages of binaries that are often missing in minimal images
+var binaryPackages = map[string]string{
+	"sudo":      "sudo",
+	"useradd":   "passwd or shadow-utils",
+	"usermod":   "passwd or shadow-utils",
+	"passwd":    "passwd",
+	"chpasswd":  "passwd or shadow-utils",
+	"systemctl": "systemd",
+	"sshd":      "openssh-server",
+	"ssh":       "openssh-client",
+	"visudo":    "sudo",
+}
+
+func checkBinaries(binaries []string) []Check {
+	checks := make([]Check, 0, len(binaries))
+	for _, binary := range binaries {
+		name := "binary " + binary
+		path, err := findBinary(binary)
+		if err != nil {
+			checks = append(checks, fail(name, "not found", fmt.Sprintf("install %s", binaryPackages[binary])))
+			continue
+		}
+		checks = append(checks, pass(name, "%s", path))
+	}
+	return checks
+}
+
+// findBinary looks up binary in the PATH, sshd also in /usr/sbin
+func findBinary(binary string) (string, error) {
+	path, err := lookPath(binary)
+	if err == nil {
+		return path, nil
+	}
+	if binary == "sshd" {
+		if _, statErr := system.Files().Stat(sshdPath); statErr == nil {
+			return sshdPath, nil
+		}
+	}
+	return "", err
+}
+
+// sshdSettings are the effective settings of sshd the tunnel needs, with the values that satisfy it
+var sshdSettings = []struct {
+	keyword string
+	values  []string
+	hint    string
+}{
+	{"AllowTcpForwarding", []string{"yes", "all", "remote"}, "the server setup sets AllowTcpForwarding yes; a Match block or an Include may override it for the tunnel user"},
+	{"GatewayPorts", []string{"yes", "clientspecified"}, "the server setup sets GatewayPorts yes; a setting after a Match line only applies to that block, move it before the first Match"},
+	{"PubkeyAuthentication", []string{"yes"}, "set PubkeyAuthentication yes, the tunnel logs in with its key"},
+}
+
+// checkSSHD checks the effective sshd settings for the tunnel user with `sshd -T`, which also fails for a config sshd does not start with
+func checkSSHD(cfg *config.ServerConfig) []Check {
+	path, err := findBinary("sshd")
+	if err != nil {
+		return []Check{skip("sshd config", "sshd not found")}
+	}
+	if _, err := system.Files().Stat(cfg.SSHDConfigPath); err != nil {
+		return []Check{fail("sshd config", fmt.Sprintf("%s does not exist", cfg.SSHDConfigPath), "install openssh-server or set server.sshd-config-path")}
+	}
+	connection := fmt.Sprintf("user=%s,host=localhost,addr=127.0.0.1", cfg.TunnelUser)
+	output, err := system.Commands().Run(nil, "sudo", path, "-T", "-f", cfg.SSHDConfigPath, "-C", connection)
+	if err != nil {
+		detail := strings.TrimSpace(string(output))
+		if detail == "" {
+			detail = err.Error()
+		}
+		return []Check{fail("sshd config", detail, fmt.Sprintf("sshd does not start with %s, fix the reported line or restore %s", cfg.SSHDConfigPath, cfg.SSHDConfigBackupPath))}
+	}
+	effective := map[string]string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		if keyword, value, found := strings.Cut(strings.TrimSpace(line), " "); found {
+			effective[strings.ToLower(keyword)] = strings.TrimSpace(value)
+		}
+	}
+	checks := []Check{pass("sshd config", "%s is valid", cfg.SSHDConfigPath)}
+	for _, setting := range sshdSettings {
+		name := "sshd " + setting.keyword
+		value := effective[strings.ToLower(setting.keyword)]
+		if !slices.Contains(setting.values, value) {
+			checks = append(checks, fail(name, fmt.Sprintf("%s for %s", orUnset(value), cfg.TunnelUser), setting.hint))
+			continue
+		}
+		checks = append(checks, pass(name, "%s for %s", value, cfg.TunnelUser))
+	}
+	return checks
+}
+
+func orUnset(value string) string {
+	if value == "" {
+		return "unset"
+	}
+	return value
+}
+
+// checkGatewayPort checks that the gateway can listen, unless its service already does
+func checkGatewayPort(cfg *config.ServerConfig) Check {
+	name := "port " + cfg.GatewayListen
+	listener, err := net.Listen("tcp", cfg.GatewayListen)
+	if err == nil {
+		listener.Close()
+		return pass(name, "free for the gateway")
+	}
+	if system.SystemdServiceInstalled(gatewayServiceName) {
+		return pass(name, "in use, %s is installed", gatewayServiceName)
+	}
+	return fail(name, err.Error(), "stop the service listening on it or set server.gateway-listen to a free address")
+}
+
+// checkRelay checks the name resolution, the reachability and the host key of the relay
+func checkRelay(host string, port int) []Check {
+	firstHop := ssh.FirstHop(host, port)
+	hostname, _, _ := net.SplitHostPort(firstHop)
+	checks := []Check{}
+	proxyURL, _ := ssh.ProxyFor(firstHop, false)
+	switch {
+	case net.ParseIP(hostname) != nil:
+		checks = append(checks, skip("dns "+hostname, "IP address"))
+	case proxyURL != nil:
+		checks = append(checks, skip("dns "+hostname, "resolved by the proxy %s", proxyURL.Redacted()))
+	default:
+		addresses, err := net.LookupHost(hostname)
+		if err != nil {
+			checks = append(checks, fail("dns "+hostname, err.Error(), "check the host name and the DNS servers in /etc/resolv.conf"))
+		} else {
+			checks = append(checks, pass("dns "+hostname, "%s", strings.Join(addresses, ", ")))
+		}
+	}
+
+	if err := ssh.DiscoverRelay(host, port); err != nil {
+		checks = append(checks, fail("reachability", err.Error(),
+			"check firewalls on the way; behind an egress proxy set proxy, if only HTTPS is let out use the gateway of the relay (gateway-url)"))
+		// the host key can not be read either
+		return append(checks, skip("host key", "relay not reachable"))
+	}
+	checks = append(checks, pass("reachability", "%s accepts connections", firstHop))
+
+	if len(ssh.JumpHosts()) > 0 {
+		return append(checks, skip("host key", "verified at login through the jump hosts"))
+	}
+	trustedHostKey := config.TrustedHostKey()
+	hostKey, err := ssh.CheckHostKey(host, port, trustedHostKey)
+	switch {
+	case hostKey == "":
+		checks = append(checks, fail("host key", err.Error(), "check that sshd runs on the relay and listens on client.server-port"))
+	case strings.TrimSpace(trustedHostKey) == "":
+		checks = append(checks, fail("host key", "trusted-host-key not set, the relay is not verified",
+			fmt.Sprintf("compare with `ssh-keygen -lf` of the host keys on the relay and set trusted-host-key: %q", hostKey)))
+	case err != nil:
+		checks = append(checks, fail("host key", err.Error(),
+			fmt.Sprintf("the relay presents %q; update trusted-host-key if its host keys were replaced, otherwise the connection may be intercepted", hostKey)))
+	default:
+		checks = append(checks, pass("host key", "matches trusted-host-key"))
+	}
+	return checks
+}
+
+// checkKeyPermissions checks that the private key is only readable by its owner and its directory not writable by others
+func checkKeyPermissions(directory, keyName string) Check {
+	path := filepath.Join(directory, keyName)
+	name := "key permissions"
+	info, err := system.Files().Stat(path)
+	if err != nil {
+		return skip(name, "%s does not exist yet", path)
+	}
+	if mode := info.Mode().Perm(); mode&0077 != 0 {
+		return fail(name, fmt.Sprintf("%s has mode %04o", path, mode), fmt.Sprintf("ssh refuses keys readable by others, run chmod 600 %s", path))
+	}
+	if dirInfo, err := system.Files().Stat(directory); err == nil {
+		if mode := dirInfo.Mode().Perm(); mode&0022 != 0 {
+			return fail(name, fmt.Sprintf("%s has mode %04o", directory, mode), fmt.Sprintf("others could replace the key, run chmod go-w %s", directory))
+		}
+	}
+	return pass(name, "%s is only readable by its owner", path)
+}
+
+// checkRemotePort checks that the port the tunnel forwards on the relay is not taken, unless the tunnel already runs
+func checkRemotePort(host string, port int) Check {
+	name := fmt.Sprintf("relay port %d", port)
+	if port == 0 {
+		return skip("relay port", "tunnel.server-port not set")
+	}
+	if u, _ := ssh.Gateway(); u != nil || len(ssh.JumpHosts()) > 0 {
+		return skip(name, "the relay is not directly reachable")
+	}
+	if system.SystemdServiceInstalled(serviceName) {
+		return skip(name, "%s is installed and may hold it", serviceName)
+	}
+	if ssh.DiscoverRemote(host, port) {
+		return fail(name, "already accepts connections", "the tunnel can not forward a taken port, choose another tunnel.server-port")
+	}
+	return pass(name, "not in use or not reachable from here")
+}
+
+// checkLocalService checks that the service the tunnel forwards to accepts connections
+func checkLocalService(cfg *config.TunnelConfig) Check {
+	address := net.JoinHostPort(cfg.LocalHost, strconv.Itoa(cfg.LocalPort))
+	name := "local service " + address
+	conn, err := net.DialTimeout("tcp", address, 2*time.Second)
+	if err != nil {
+		return fail(name, err.Error(), "start the service the tunnel forwards to, or correct tunnel.local-host and tunnel.local-port")
+	}
+	conn.Close()
+	return pass(name, "accepts connections")
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+)
+
+// findCheck returns the check name of checks
+func findCheck(t *testing.T, checks []Check, name string) Check {
+	t.Helper()
+	for _, check := range checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	t.Fatalf("no check %s in %v", name, checks)
+	return Check{}
+}
+
+func TestDoctorServer(t *testing.T) {
+	f := newFixture(t)
+	f.seedServer()
+	f.host.FS.Seed(sshdPath, []byte{}, 0755)
+	lookPath = func(binary string) (string, error) {
+		if binary == "sshd" || binary == "chpasswd" {
+			return "", exec.ErrNotFound
+		}
+		return "/usr/bin/" + binary, nil
+	}
+	t.Cleanup(func() { lookPath = exec.LookPath })
+	config.AppConfig.Server = *serverConfig()
+	// GatewayPorts is only set in a Match block
+	f.host.Runner.Handle = func(name string, args ...string) ([]byte, error) {
+		return []byte("port 22\nallowtcpforwarding yes\ngatewayports no\npubkeyauthentication yes\n"), nil
+	}
+
+	checks := Doctor("server", []string{"server"})
+	for name, status := range map[string]string{
+		"os":                        CheckPass,
+		"config server":             CheckPass,
+		"privileges":                CheckPass,
+		"binary sshd":               CheckPass,
+		"binary chpasswd":           CheckFail,
+		"sshd config":               CheckPass,
+		"sshd AllowTcpForwarding":   CheckPass,
+		"sshd GatewayPorts":         CheckFail,
+		"sshd PubkeyAuthentication": CheckPass,
+	} {
+		if check := findCheck(t, checks, name); check.Status != status {
+			t.Errorf("%s: expected %s, got %+v", name, status, check)
+		}
+	}
+	if hint := findCheck(t, checks, "sshd GatewayPorts").Hint; !strings.Contains(hint, "Match") {
+		t.Errorf("expected a hint about Match blocks, got %q", hint)
+	}
+	if commands := strings.Join(f.host.Runner.Commands, "\n"); commands != "sudo /usr/sbin/sshd -T -f /etc/ssh/sshd_config -C user=tunneluser,host=localhost,addr=127.0.0.1" {
+		t.Errorf("unexpected commands:\n%s", commands)
+	}
+	if failed := Failed(checks); failed != 2 {
+		t.Errorf("expected 2 failed checks, got %d", failed)
+	}
+
+	f.host.Accounts.Privileged = false
+	f.host.Runner.Handle = func(name string, args ...string) ([]byte, error) {
+		return []byte("/etc/ssh/sshd_config line 3: Bad configuration option: GatewayPort\n"), fmt.Errorf("exit status 255")
+	}
+	checks = Doctor("server", nil)
+	if check := findCheck(t, checks, "privileges"); check.Status != CheckFail {
+		t.Errorf("privileges: expected %s, got %+v", CheckFail, check)
+	}
+	if check := findCheck(t, checks, "sshd config"); check.Status != CheckFail || !strings.Contains(check.Detail, "line 3") {
+		t.Errorf("expected the error of sshd -T, got %+v", check)
+	}
+}
+
+func TestIntegrationDoctorClient(t *testing.T) {
+	directConnections(t)
+	server, cfg := newIntegration(t)
+	system.Files().MkdirAll("/home/alice/.ssh", 0700)
+	system.Files().WriteFile("/home/alice/.ssh/tunnel-key", []byte("private key"), 0644)
+	config.AppConfig.Client = *cfg
+
+	checks := Doctor("client", nil)
+	for name, status := range map[string]string{
+		"dns 127.0.0.1":   CheckSkip,
+		"reachability":    CheckPass,
+		"host key":        CheckPass,
+		"key permissions": CheckFail,
+	} {
+		if check := findCheck(t, checks, name); check.Status != status {
+			t.Errorf("%s: expected %s, got %+v", name, status, check)
+		}
+	}
+	if hint := findCheck(t, checks, "key permissions").Hint; hint != "ssh refuses keys readable by others, run chmod 600 /home/alice/.ssh/tunnel-key" {
+		t.Errorf("unexpected hint %q", hint)
+	}
+
+	config.AppConfig.TrustedHostKey = ""
+	check := findCheck(t, Doctor("client", nil), "host key")
+	if check.Status != CheckFail || !strings.Contains(check.Hint, server.TrustedHostKey()) {
+		t.Errorf("expected the host key of the relay in the hint, got %+v", check)
+	}
+	config.AppConfig.TrustedHostKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+	if check := findCheck(t, Doctor("client", nil), "host key"); check.Status != CheckFail {
+		t.Errorf("expected an untrusted host key to fail, got %+v", check)
+	}
+
+	server.Close()
+	if check := findCheck(t, Doctor("client", nil), "reachability"); check.Status != CheckFail {
+		t.Errorf("expected an unreachable relay to fail, got %+v", check)
+	}
+}
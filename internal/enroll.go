@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/fbufler/ssh-tunnel-setup/package/enroll"
+	tunnelssh "github.com/fbufler/ssh-tunnel-setup/package/ssh"
+	"github.com/fbufler/ssh-tunnel-setup/package/state"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+	"golang.org/x/crypto/ssh"
+)
+
+// enrolledKeyOptions restrict the keys installed by an enrollment to port forwarding
+const enrolledKeyOptions = "restrict,port-forwarding"
+
+const enrollSudoersPath = "/etc/sudoers.d/ssh-tunnel-setup-enroll"
+
+var clientNamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+// executable returns the path of this binary, it is called by sshd for the enroll account
+var executable = os.Executable
+
+// enrollCommand returns the command forced for the keys of the enroll account
+func enrollCommand(keyType, key string) (string, error) {
+	path, err := executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine executable: %v", err)
+	}
+	return fmt.Sprintf("sudo -n %s server enroll %s %s", path, keyType, key), nil
+}
+
+// EnrollKeysLine returns the authorized_keys line of the enroll account for the key of keyType
+// Every key is accepted, but it only runs the enroll command, which requires a token
+// A certificate is only accepted if the relay acts as certificate authority and it is issued for the tunnel user
+func EnrollKeysLine(cfg *config.ServerConfig, keyType, key string) (string, error) {
+	publicKey, err := parsePublicKey(keyType, key)
+	if err != nil {
+		return "", err
+	}
+	command, err := enrollCommand(publicKey.Type(), key)
+	if err != nil {
+		return "", err
+	}
+	if _, isCert := publicKey.(*ssh.Certificate); isCert {
+		if !cfg.UserCA {
+			return "", fmt.Errorf("certificates are not accepted without user-ca")
+		}
+		ca, err := tunnelssh.ReadPublicKey(userCAPath + ".pub")
+		if err != nil {
+			return "", fmt.Errorf("failed to read user certificate authority: %v", err)
+		}
+		caLine := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca)))
+		return fmt.Sprintf(`cert-authority,principals="%s",restrict,command="%s" %s`, cfg.TunnelUser, command, caLine), nil
+	}
+	return fmt.Sprintf(`restrict,command="%s" %s %s`, command, publicKey.Type(), key), nil
+}
+
+func parsePublicKey(keyType, key string) (ssh.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	publicKey, err := ssh.ParsePublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	if publicKey.Type() != keyType {
+		return nil, fmt.Errorf("public key of type %s instead of %s", publicKey.Type(), keyType)
+	}
+	return publicKey, nil
+}
+
+// Enroll handles request, the command a client sent to the enroll account after logging in with the key of keyType
+// enroll <token> [name] redeems the token and authorizes the key for the tunnel user
+// renew <key-type> <key> signs a new key, if the client logged in with a valid certificate
+// revoke revokes the key of the valid certificate the client logged in with
+// With user-ca the certificate of the key is returned, otherwise the response is empty
+func Enroll(cfg *config.ServerConfig, keyType, key, request string) (string, error) {
+	publicKey, err := parsePublicKey(keyType, key)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(request)
+	if len(fields) == 3 && fields[0] == "renew" {
+		return renewCertificate(cfg, publicKey, fields[1], fields[2])
+	}
+	if len(fields) == 1 && fields[0] == "revoke" {
+		return revokeCertificate(cfg, publicKey)
+	}
+	if len(fields) < 2 || len(fields) > 3 || fields[0] != "enroll" {
+		return "", fmt.Errorf("invalid request, expected: enroll <token> [name]")
+	}
+	if _, isCert := publicKey.(*ssh.Certificate); isCert {
+		return "", fmt.Errorf("enroll with the key instead of its certificate")
+	}
+	name := "unnamed"
+	if len(fields) == 3 {
+		if !clientNamePattern.MatchString(fields[2]) {
+			return "", fmt.Errorf("invalid client name %q", fields[2])
+		}
+		name = fields[2]
+	}
+	fingerprint := ssh.FingerprintSHA256(publicKey)
+
+	token, err := enroll.Redeem(fields[1], fingerprint)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Enrollment of %s key %s rejected: %v", name, fingerprint, err))
+		return "", err
+	}
+	keyID := fmt.Sprintf("enrolled-%s:%s", token.Role, name)
+	if cfg.UserCA {
+		slog.Info(fmt.Sprintf("Enrolled %s %s with key %s using token %s", token.Role, name, fingerprint, token.ID))
+		return signUserKey(cfg, publicKey, keyID)
+	}
+
+	authorizedKeysPath := fmt.Sprintf("/home/%s/.ssh/authorized_keys", cfg.TunnelUser)
+	line := fmt.Sprintf("%s %s %s %s\n", enrolledKeyOptions, publicKey.Type(), key, keyID)
+	// concurrent enrollments append under a lock of the file instead of rewriting it
+	if err := system.Files().AppendLine(authorizedKeysPath, []byte(line)); err != nil {
+		return "", fmt.Errorf("failed to add key to authorized_keys of %s: %v", cfg.TunnelUser, err)
+	}
+	slog.Info(fmt.Sprintf("Enrolled %s %s with key %s using token %s", token.Role, name, fingerprint, token.ID))
+	return "", nil
+}
+
+// enrollSteps set up the enroll account, see EnrollKeysLine
+func enrollSteps(cfg *config.ServerConfig, manifest *state.Manifest) []step {
+	return []step{
+		{
+			name:  "enroll-user",
+			check: func() bool { return system.UserExists(cfg.EnrollUser) },
+			run: func() error {
+				if err := system.CreateUser(cfg.EnrollUser, nil); err != nil {
+					return fmt.Errorf("failed to create enroll user: %v", err)
+				}
+				return manifest.Record(state.Artifact{Kind: state.KindUser, Name: cfg.EnrollUser})
+			},
+		},
+		{
+			name:  "enroll-sudoers",
+			paths: []string{enrollSudoersPath},
+			run:   func() error { return installEnrollSudoers(cfg, manifest) },
+		},
+	}
+}
+
+// installEnrollSudoers allows the enroll account to run the enroll command as root, with the request of the client
+func installEnrollSudoers(cfg *config.ServerConfig, manifest *state.Manifest) error {
+	path, err := executable()
+	if err != nil {
+		return fmt.Errorf("failed to determine executable: %v", err)
+	}
+	sudoers := fmt.Sprintf(`Defaults:%s env_keep += "SSH_ORIGINAL_COMMAND"
+%s ALL=(root) NOPASSWD: %s server enroll *
+`, cfg.EnrollUser, cfg.EnrollUser, path)
+	if err := system.Files().WriteFile(enrollSudoersPath, []byte(sudoers), 0440); err != nil {
+		return fmt.Errorf("failed to write sudoers: %v", err)
+	}
+	if output, err := system.Commands().Run(nil, "visudo", "-cf", enrollSudoersPath); err != nil {
+		system.Files().Remove(enrollSudoersPath)
+		return fmt.Errorf("invalid sudoers file: %v: %s", err, output)
+	}
+	return manifest.Record(state.Artifact{Kind: state.KindFile, Path: enrollSudoersPath})
+}
+
+// enrollKeysCommand returns the AuthorizedKeysCommand of the enroll account
+func enrollKeysCommand() (string, error) {
+	path, err := executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine executable: %v", err)
+	}
+	return fmt.Sprintf("%s server enroll-keys %%t %%k", path), nil
+}
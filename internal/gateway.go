@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/fbufler/ssh-tunnel-setup/package/gateway"
+	"github.com/fbufler/ssh-tunnel-setup/package/state"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+)
+
+const gatewayServiceName = "tunnel-gateway"
+const gatewayServiceDescription = "SSH tunnel gateway"
+
+// gatewayKeyMode lets the group of the gateway user read the key, see gatewayKeyAccess
+const gatewayKeyMode = 0640
+
+// gatewaySteps install the gateway as systemd service of its own user, with a self-signed certificate unless it has one
+func gatewaySteps(cfg *config.ServerConfig, manifest *state.Manifest) []step {
+	return []step{
+		{
+			name:  "gateway-user",
+			check: func() bool { return system.UserExists(cfg.GatewayUser) },
+			run: func() error {
+				if err := system.CreateUser(cfg.GatewayUser, nil); err != nil {
+					return fmt.Errorf("failed to create gateway user: %v", err)
+				}
+				return manifest.Record(state.Artifact{Kind: state.KindUser, Name: cfg.GatewayUser})
+			},
+		},
+		{
+			name:  "gateway-certificate",
+			check: func() bool { return gatewayCertificateInPlace(cfg) },
+			run:   func() error { return createGatewayCertificate(cfg, manifest) },
+		},
+		{
+			name:  "gateway-key-access",
+			check: func() bool { return gatewayKeyReadable(cfg) },
+			after: []string{"gateway-user", "gateway-certificate"},
+			run:   func() error { return gatewayKeyAccess(cfg) },
+		},
+		{
+			name:  "gateway-unit",
+			paths: []string{system.SystemdServicePath(gatewayServiceName)},
+			after: []string{"gateway-key-access"},
+			run:   func() error { return installGatewayService(cfg, manifest) },
+		},
+		{
+			name:  "gateway-enable",
+			after: []string{"gateway-unit"},
+			run:   func() error { return system.EnableSystemdService(gatewayServiceName) },
+		},
+	}
+}
+
+func gatewayCertificateInPlace(cfg *config.ServerConfig) bool {
+	for _, path := range []string{cfg.GatewayCert, cfg.GatewayKey} {
+		if _, err := system.Files().Stat(path); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// createGatewayCertificate generates a self-signed certificate for the host names of the relay, an existing certificate is kept
+func createGatewayCertificate(cfg *config.ServerConfig, manifest *state.Manifest) error {
+	if gatewayCertificateInPlace(cfg) {
+		slog.Info(fmt.Sprintf("Gateway certificate %s already exists, keeping it", cfg.GatewayCert))
+		return nil
+	}
+	names := cfg.HostNames
+	if len(names) == 0 {
+		names = []string{cfg.Name}
+	}
+	for _, path := range []string{cfg.GatewayCert, cfg.GatewayKey} {
+		if err := system.Files().MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create directory: %v", err)
+		}
+	}
+	if err := gateway.SelfSignedCertificate(cfg.GatewayCert, cfg.GatewayKey, names); err != nil {
+		return err
+	}
+	for _, path := range []string{cfg.GatewayCert, cfg.GatewayKey} {
+		if err := manifest.Record(state.Artifact{Kind: state.KindFile, Path: path}); err != nil {
+			return err
+		}
+	}
+	slog.Info(fmt.Sprintf("Generated self-signed gateway certificate for %v, clients trust it with a copy of %s as gateway-ca", names, cfg.GatewayCert))
+	return nil
+}
+
+// gatewayKeyReadable checks that the key has the mode gatewayKeyAccess gives it
+func gatewayKeyReadable(cfg *config.ServerConfig) bool {
+	info, err := system.Files().Stat(cfg.GatewayKey)
+	return err == nil && info.Mode().Perm() == gatewayKeyMode
+}
+
+// gatewayKeyAccess hands the key to the group of the gateway user, root keeps owning it
+func gatewayKeyAccess(cfg *config.ServerConfig) error {
+	if _, err := system.Commands().Run(nil, "chown", "root:"+cfg.GatewayUser, cfg.GatewayKey); err != nil {
+		return fmt.Errorf("failed to hand gateway key to %s: %v", cfg.GatewayUser, err)
+	}
+	if err := system.Files().Chmod(cfg.GatewayKey, gatewayKeyMode); err != nil {
+		return fmt.Errorf("failed to chmod gateway key: %v", err)
+	}
+	return nil
+}
+
+// installGatewayService runs the gateway as the gateway user, only allowed to listen on privileged ports
+func installGatewayService(cfg *config.ServerConfig, manifest *state.Manifest) error {
+	path, err := executable()
+	if err != nil {
+		return fmt.Errorf("failed to determine executable: %v", err)
+	}
+	execStart := fmt.Sprintf("%s server gateway --gateway-listen %s --gateway-path %s --gateway-upstream %s --gateway-cert %s --gateway-key %s",
+		path, cfg.GatewayListen, cfg.GatewayPath, cfg.GatewayUpstream, cfg.GatewayCert, cfg.GatewayKey)
+	if err := system.CreateSystemdDaemon(gatewayServiceName, gatewayServiceDescription, execStart, cfg.GatewayUser, "CAP_NET_BIND_SERVICE"); err != nil {
+		return err
+	}
+	return manifest.Record(state.Artifact{Kind: state.KindSystemdUnit, Path: system.SystemdServicePath(gatewayServiceName), Name: gatewayServiceName})
+}
+
+// NewGateway returns the gateway of the relay with the certificate of cfg, see config.ServerConfig.Gateway
+func NewGateway(cfg *config.ServerConfig) (*gateway.Server, error) {
+	tlsConfig, err := gateway.LoadCertificate(cfg.GatewayCert, cfg.GatewayKey)
+	if err != nil {
+		return nil, err
+	}
+	return &gateway.Server{Upstream: cfg.GatewayUpstream, Path: cfg.GatewayPath, TLS: tlsConfig}, nil
+}
@@ -1,14 +1,20 @@
 package internal
 
 import (
+	"bytes"
 	"fmt"
 	"log/slog"
+	"path/filepath"
+	"slices"
+	"time"
 
 	"github.com/fbufler/ssh-tunnel-setup/config"
 	"github.com/fbufler/ssh-tunnel-setup/package/ssh"
+	"github.com/fbufler/ssh-tunnel-setup/package/state"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
 )
 
-func ClientSetup(cfg *config.ClientConfig) error {
+func ClientSetup(cfg *config.ClientConfig, manifest *state.Manifest) error {
 	slog.Info("Setting up client")
 
 	err := ssh.PrepareKeyDirectory(cfg.KeyDirectory)
@@ -17,44 +23,210 @@ func ClientSetup(cfg *config.ClientConfig) error {
 		return err
 	}
 
+	privateKeyPath := fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName)
+	provider := keySigners(cfg)
+	if provider != nil {
+		ssh.RegisterSigners(privateKeyPath, provider)
+		defer ssh.RegisterSigners(privateKeyPath, nil)
+	}
+	steps := []step{
+		{
+			name:  "key-pair",
+			check: func() bool { return !cfg.Force && keyPairInPlace(cfg) },
+			run:   func() error { return setUpKeyPair(cfg, provider, manifest) },
+		},
+		{
+			name:  "authorized-key",
+			after: []string{"key-pair"},
+			check: func() bool { return keyAuthorized(cfg) },
+			run:   func() error { return authorizeKeyPair(cfg, manifest) },
+		},
+	}
+	err = runSteps(manifest, steps)
+	if err != nil {
+		return err
+	}
+
+	if !cfg.KeyInFile() {
+		slog.Info(fmt.Sprintf("Key from %s is not rotated, skipping rotation config", cfg.KeySource))
+		return nil
+	}
+	slog.Info("Add Rotation Config")
+	err = addRotationConfig(cfg)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error adding rotation config: %s", err))
+		return err
+	}
+
+	return nil
+}
+
+// keySigners returns the provider of the key of key-source agent or pkcs11, nil for keys in files
+func keySigners(cfg *config.ClientConfig) ssh.SignerProvider {
+	privateKeyPath := fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName)
+	switch cfg.KeySource {
+	case config.KeySourceAgent:
+		return &ssh.AgentSigners{KeyPath: privateKeyPath}
+	case config.KeySourcePKCS11:
+		return &ssh.PKCS11Signers{Module: cfg.PKCS11Module, Token: cfg.PKCS11Token, KeyLabel: cfg.PKCS11KeyLabel, PIN: cfg.PKCS11PIN, KeyPath: privateKeyPath}
+	}
+	return nil
+}
+
+// keyPairInPlace checks that the key pair is set up, only the public key of keys outside of files
+func keyPairInPlace(cfg *config.ClientConfig) bool {
+	privateKeyPath := fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName)
+	if !cfg.KeyInFile() {
+		_, err := system.Files().Stat(privateKeyPath + ".pub")
+		return err == nil
+	}
+	return ssh.KeyPairExists(privateKeyPath) && importedKeyInPlace(cfg)
+}
+
+// setUpKeyPair imports, generates or, for keys outside of files, exports the public key of the key pair
+// An existing key pair is only replaced with force
+func setUpKeyPair(cfg *config.ClientConfig, provider ssh.SignerProvider, manifest *state.Manifest) error {
+	privateKeyPath := fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName)
+	if cfg.ImportKey != "" && filepath.Clean(cfg.ImportKey) == filepath.Clean(privateKeyPath) {
+		// the key is adopted where it is, it is not recorded so uninstall keeps it
+		slog.Info(fmt.Sprintf("Adopting key pair %s", privateKeyPath))
+		return ssh.ImportKeyPair(cfg.ImportKey, privateKeyPath, cfg.KeyUser)
+	}
+	keyPair := state.Artifact{Kind: state.KindKeyPair, Path: privateKeyPath}
+	// only key pairs the tool created are recorded, uninstall keeps the replacement of a key pair it found
+	created := !ssh.KeyFileExists(privateKeyPath) || manifest.Contains(keyPair)
+	if ssh.KeyFileExists(privateKeyPath) {
+		if !cfg.Force && provider != nil {
+			return fmt.Errorf("key pair %s already exists, replace it with --force", privateKeyPath)
+		}
+		if !cfg.Force {
+			return fmt.Errorf("key pair %s already exists, adopt it with --import-key %s or replace it with --force", privateKeyPath, privateKeyPath)
+		}
+		slog.Warn(fmt.Sprintf("Replacing existing key pair %s", privateKeyPath))
+		if err := ssh.RemoveKeyPair(privateKeyPath); err != nil {
+			return fmt.Errorf("failed to remove existing key pair: %v", err)
+		}
+	}
+	var err error
+	switch {
+	case provider != nil:
+		err = exportPublicKey(cfg, provider)
+	case cfg.ImportKey != "":
+		err = importKeyPair(cfg)
+	default:
+		err = generateKeyPair(cfg)
+	}
+	if err != nil || !created {
+		return err
+	}
+	err = manifest.Record(keyPair)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error recording key pair: %s", err))
+		return err
+	}
+	return nil
+}
+
+func exportPublicKey(cfg *config.ClientConfig, provider ssh.SignerProvider) error {
+	privateKeyPath := fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName)
+	slog.Info(fmt.Sprintf("Exporting public key from %s", cfg.KeySource))
+	err := ssh.ExportPublicKey(provider, privateKeyPath, cfg.KeyUser)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error exporting public key: %s", err))
+		return err
+	}
+	slog.Info(fmt.Sprintf("Public key exported to %s.pub", privateKeyPath))
+	return nil
+}
+
+// importedKeyInPlace checks that the key pair is the one to import, so a changed import-key runs the key-pair step again
+func importedKeyInPlace(cfg *config.ClientConfig) bool {
+	if cfg.ImportKey == "" {
+		return true
+	}
+	privateKeyPath := fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName)
+	imported, err := system.Files().ReadFile(cfg.ImportKey)
+	if err != nil {
+		return false
+	}
+	current, err := system.Files().ReadFile(privateKeyPath)
+	return err == nil && bytes.Equal(imported, current)
+}
+
+func importKeyPair(cfg *config.ClientConfig) error {
+	privateKeyPath := fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName)
+	slog.Info(fmt.Sprintf("Importing key pair %s", cfg.ImportKey))
+	err := ssh.ImportKeyPair(cfg.ImportKey, privateKeyPath, cfg.KeyUser)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error importing key pair: %s", err))
+		return err
+	}
+	if ssh.KeyPairType(privateKeyPath) == "" {
+		slog.Warn(fmt.Sprintf("Rotations can not generate keys of the type of %s, rotated keys are of key-type %s", cfg.ImportKey, cfg.KeyType))
+	}
+	slog.Info(fmt.Sprintf("Key pair imported at %s", privateKeyPath))
+	return nil
+}
+
+func generateKeyPair(cfg *config.ClientConfig) error {
+	privateKeyPath := fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName)
+	if ssh.KeyFileExists(privateKeyPath) {
+		// an existing key pair is only replaced after setUpKeyPair removed it
+		return fmt.Errorf("key pair %s already exists, refusing to overwrite it", privateKeyPath)
+	}
 	slog.Info("Generating key pair")
-	err = ssh.MakeKeyPair(cfg.KeyDirectory, cfg.KeyName, cfg.KeyUser)
+	err := ssh.MakeKeyPair(cfg.KeyDirectory, cfg.KeyName, cfg.KeyUser, cfg.KeyType)
 	if err != nil {
 		slog.Error(fmt.Sprintf("Error generating key pair: %s", err))
 		return err
 	}
 	slog.Info(fmt.Sprintf("Key pair generated at %s/%s", cfg.KeyDirectory, cfg.KeyName))
+	return nil
+}
 
+func authorizeKeyPair(cfg *config.ClientConfig, manifest *state.Manifest) error {
 	serverAddr := fmt.Sprintf("%s:%d", cfg.ServerName, cfg.ServerPort)
+	privateKeyPath := fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName)
 
-	slog.Info(fmt.Sprintf("Authorizing public key on remote: %s", serverAddr))
-	remoteAuth := ssh.RemoteAuth{
-		User: cfg.ServerUser,
-	}
-	if cfg.ServerPass != "" {
-		remoteAuth.Password = cfg.ServerPass
+	if !cfg.EnrollToken.Empty() {
+		slog.Info(fmt.Sprintf("Enrolling public key on remote: %s", serverAddr))
+		err := ssh.EnrollPublicKey(privateKeyPath, serverAddr, cfg.EnrollUser, config.TunnelUser, cfg.EnrollToken, cfg.Name, config.TrustedHostKey())
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error enrolling public key on remote: %s", err))
+			return err
+		}
+		slog.Info("Public key enrolled on remote")
+		return recordAuthorizedKey(manifest, privateKeyPath, serverAddr)
 	}
 
-	if cfg.ServerKeyName != "" {
-		remoteAuth.KeyPath = fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.ServerKeyName)
-	}
-
-	err = ssh.AuthorizePublicKeyOnRemote(fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName), serverAddr, config.TunnelUser, remoteAuth)
+	slog.Info(fmt.Sprintf("Authorizing public key on remote: %s", serverAddr))
+	err := ssh.AuthorizePublicKeyOnRemote(privateKeyPath, serverAddr, config.TunnelUser, serverAuth(cfg))
 	if err != nil {
 		slog.Error(fmt.Sprintf("Error authorizing public key on remote: %s", err))
 		return err
 	}
 	slog.Info("Public key authorized on remote")
+	return recordAuthorizedKey(manifest, privateKeyPath, serverAddr)
+}
 
-	// TODO: Add automatic tunnel setup
+// keyAuthorized checks that the relay still accepts the key pair for the tunnel user
+func keyAuthorized(cfg *config.ClientConfig) bool {
+	serverAddr := fmt.Sprintf("%s:%d", cfg.ServerName, cfg.ServerPort)
+	privateKeyPath := fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName)
+	err := ssh.CheckLogin(serverAddr, ssh.NewRemoteAuth(config.TunnelUser, nil, privateKeyPath, config.TrustedHostKey()))
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Login with %s failed: %s", privateKeyPath, err))
+		return false
+	}
+	return true
+}
 
-	slog.Info("Add Rotation Config")
-	err = addRotationConfig(cfg)
+func recordAuthorizedKey(manifest *state.Manifest, privateKeyPath, serverAddr string) error {
+	err := manifest.Record(state.Artifact{Kind: state.KindAuthorizedKey, Path: privateKeyPath, Remote: serverAddr, RemoteUser: config.TunnelUser})
 	if err != nil {
-		slog.Error(fmt.Sprintf("Error adding rotation config: %s", err))
+		slog.Error(fmt.Sprintf("Error recording authorized key: %s", err))
 		return err
 	}
-
 	return nil
 }
 
@@ -63,10 +235,50 @@ func addRotationConfig(cfg *config.ClientConfig) error {
 		KeyName:      cfg.KeyName,
 		KeyDirectory: cfg.KeyDirectory,
 		KeyUser:      cfg.KeyUser,
+		KeyType:      rotationKeyType(cfg),
 		ServerName:   cfg.ServerName,
 		ServerPort:   cfg.ServerPort,
 		ServerUser:   config.TunnelUser,
 	}
+	if !cfg.EnrollToken.Empty() {
+		newRotationConfig.EnrollUser = cfg.EnrollUser
+	}
+	// the rotation settings and the age of the key survive a rerun of the setup
+	current := config.AppConfig.Rotate
+	newRotationConfig.Interval = current.Interval
+	newRotationConfig.MaxAge = current.MaxAge
+	newRotationConfig.MaxAgePolicy = current.MaxAgePolicy
+	newRotationConfig.Rotated = now().UTC().Truncate(time.Second)
+	if current.KeyDirectory == cfg.KeyDirectory && current.KeyName == cfg.KeyName && !current.Rotated.IsZero() {
+		newRotationConfig.Rotated = current.Rotated
+	}
 
 	return config.StoreRotationConfig(&newRotationConfig)
 }
+
+// rotationKeyType returns the type of the key pair, so rotations keep the type of an imported key
+func rotationKeyType(cfg *config.ClientConfig) string {
+	if keyType := ssh.KeyPairType(fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName)); keyType != "" {
+		return keyType
+	}
+	return cfg.KeyType
+}
+
+// challenge answers the keyboard-interactive questions of the relay, it is replaced in tests
+var challenge = ssh.TerminalChallenge
+
+// serverAuth returns how cfg logs in to the relay as server-user, with the methods of auth-methods in their order
+func serverAuth(cfg *config.ClientConfig) ssh.RemoteAuth {
+	remoteAuth := ssh.RemoteAuth{
+		User:     cfg.ServerUser,
+		Password: cfg.ServerPass,
+		Methods:  cfg.AuthMethods,
+	}
+	if cfg.ServerKeyName != "" {
+		remoteAuth.KeyPath = fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.ServerKeyName)
+	}
+	if slices.Contains(cfg.AuthMethods, config.AuthKeyboardInteractive) {
+		remoteAuth.Challenge = challenge(cfg.ServerPass)
+	}
+	return remoteAuth
+}
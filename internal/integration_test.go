@@ -0,0 +1,684 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/fbufler/ssh-tunnel-setup/package/enroll"
+	"github.com/fbufler/ssh-tunnel-setup/package/secret"
+	"github.com/fbufler/ssh-tunnel-setup/package/ssh"
+	"github.com/fbufler/ssh-tunnel-setup/package/ssh/sshtest"
+	"github.com/fbufler/ssh-tunnel-setup/package/state"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+	"github.com/fbufler/ssh-tunnel-setup/package/system/systemtest"
+	"github.com/spf13/viper"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// newIntegration runs the flows against a fake machine and a real SSH server on the loopback interface
+func newIntegration(t *testing.T) (*sshtest.Server, *config.ClientConfig) {
+	t.Helper()
+	host := systemtest.Install(t)
+	server := sshtest.NewServer(t)
+	server.SetPassword("admin", "admin-password")
+
+	viper.Reset()
+	config.AppConfig = config.Config{TrustedHostKey: server.TrustedHostKey()}
+	t.Cleanup(viper.Reset)
+	host.FS.Seed(configPath, []byte("debug: false\n"), 0644)
+	config.SetConfigFile(configPath)
+	t.Cleanup(func() { config.SetConfigFile("") })
+
+	name, port, err := net.SplitHostPort(server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := clientConfig()
+	cfg.ServerName = name
+	cfg.ServerPort, _ = strconv.Atoi(port)
+	return server, cfg
+}
+
+func TestIntegrationClientSetupAndRotate(t *testing.T) {
+	server, cfg := newIntegration(t)
+	manifest, err := state.LoadFile("/var/lib/ssh-tunnel-setup/client.json", state.RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ClientSetup(cfg, manifest); err != nil {
+		t.Fatalf("ClientSetup: %v", err)
+	}
+	setupKeys := server.AuthorizedKeys(config.TunnelUser)
+	if len(setupKeys) != 1 {
+		t.Fatalf("expected one authorized key after setup, got %v", setupKeys)
+	}
+
+	if err := Rotate(&config.AppConfig.Rotate); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	rotatedKeys := server.AuthorizedKeys(config.TunnelUser)
+	if len(rotatedKeys) != 1 || rotatedKeys[0] == setupKeys[0] {
+		t.Fatalf("expected only the rotated key to be authorized, got %v", rotatedKeys)
+	}
+
+	auth := ssh.NewRemoteAuth(config.TunnelUser, nil, cfg.KeyDirectory+"/"+cfg.KeyName, server.TrustedHostKey())
+	if err := (ssh.SSHRemoteRunner{}).Test(server.Addr(), auth); err != nil {
+		t.Errorf("rotated key does not log in: %v", err)
+	}
+}
+
+func TestIntegrationTunnel(t *testing.T) {
+	server, cfg := newIntegration(t)
+	manifest, err := state.LoadFile("/var/lib/ssh-tunnel-setup/target.json", state.RoleTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ClientSetup(cfg, manifest); err != nil {
+		t.Fatalf("ClientSetup: %v", err)
+	}
+
+	local := echoServer(t)
+	auth := ssh.NewRemoteAuth(config.TunnelUser, nil, cfg.KeyDirectory+"/"+cfg.KeyName, server.TrustedHostKey())
+	tunnel, err := ssh.OpenTunnel(server.Addr(), auth, 0, local)
+	if err != nil {
+		t.Fatalf("OpenTunnel: %v", err)
+	}
+	defer tunnel.Close()
+
+	_, port, _ := net.SplitHostPort(tunnel.Addr().String())
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("connecting to forwarded port: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, "ping")
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || reply != "ping\n" {
+		t.Errorf("expected echo through the tunnel, got %q (%v)", reply, err)
+	}
+}
+
+// echoServer stands in for the local sshd the tunnel exposes
+func echoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err == nil {
+					conn.Write([]byte(line))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// enrollmentRelay makes server behave like a relay set up with enrollment
+// The enroll account accepts every key with the forced enroll command, keys enrolled into authorized_keys are authorized on server
+func enrollmentRelay(t *testing.T, server *sshtest.Server, serverCfg *config.ServerConfig) {
+	t.Helper()
+	executable = func() (string, error) { return "/usr/local/bin/ssh-tunnel-setup", nil }
+	t.Cleanup(func() { executable = os.Executable })
+	authorizedKeysPath := "/home/" + serverCfg.TunnelUser + "/.ssh/authorized_keys"
+	system.Files().MkdirAll("/home/"+serverCfg.TunnelUser+"/.ssh", 0700)
+	system.Files().WriteFile(authorizedKeysPath, nil, 0600)
+
+	server.AuthorizedKeysCommand = func(user string, key gossh.PublicKey) []string {
+		if user != serverCfg.EnrollUser {
+			return nil
+		}
+		line, err := EnrollKeysLine(serverCfg, key.Type(), base64.StdEncoding.EncodeToString(key.Marshal()))
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		return []string{line}
+	}
+	server.ForcedCommand = func(user, command, originalCommand string) (string, int) {
+		before, _ := system.Files().ReadFile(authorizedKeysPath)
+		fields := strings.Fields(command)
+		response, err := Enroll(serverCfg, fields[len(fields)-2], fields[len(fields)-1], originalCommand)
+		if err != nil {
+			return err.Error() + "\n", 1
+		}
+		if after, _ := system.Files().ReadFile(authorizedKeysPath); len(after) > len(before) {
+			server.Authorize(serverCfg.TunnelUser, strings.TrimSpace(string(after[len(before):])))
+		}
+		return response, 0
+	}
+}
+
+func TestIntegrationEnrollment(t *testing.T) {
+	server, cfg := newIntegration(t)
+	enrollmentRelay(t, server, &config.ServerConfig{TunnelUser: config.TunnelUser, EnrollUser: config.EnrollUser})
+
+	token, _, err := enroll.Create("target", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ServerUser, cfg.ServerPass = "", nil
+	cfg.EnrollUser, cfg.EnrollToken = config.EnrollUser, secret.Secret(token)
+	manifest, err := state.LoadFile("/var/lib/ssh-tunnel-setup/target.json", state.RoleTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ClientSetup(cfg, manifest); err != nil {
+		t.Fatalf("ClientSetup: %v", err)
+	}
+	keys := server.AuthorizedKeys(config.TunnelUser)
+	if len(keys) != 1 || !strings.HasPrefix(keys[0], "restrict,port-forwarding ") || !strings.HasSuffix(keys[0], " enrolled-target:target-1") {
+		t.Fatalf("unexpected authorized keys after enrollment %v", keys)
+	}
+
+	privateKeyPath := cfg.KeyDirectory + "/" + cfg.KeyName
+	err = ssh.EnrollPublicKey(privateKeyPath, server.Addr(), config.EnrollUser, config.TunnelUser, secret.Secret(token), "again", server.TrustedHostKey())
+	if err == nil || !strings.Contains(err.Error(), "token already used") {
+		t.Errorf("token redeemed twice: %v", err)
+	}
+}
+
+func TestIntegrationUserCA(t *testing.T) {
+	server, cfg := newIntegration(t)
+	serverCfg := &config.ServerConfig{TunnelUser: config.TunnelUser, EnrollUser: config.EnrollUser, Enrollment: true, UserCA: true, UserCertValidity: time.Hour}
+	enrollmentRelay(t, server, serverCfg)
+	if err := ssh.MakeCertificateAuthority(userCAPath, "user-ca"); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.ReadPublicKey(userCAPath + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TrustUserCA(ca)
+	if err := system.Files().WriteFile(revokedKeysPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	token, _, err := enroll.Create("target", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ServerUser, cfg.ServerPass = "", nil
+	cfg.EnrollUser, cfg.EnrollToken = config.EnrollUser, secret.Secret(token)
+	manifest, err := state.LoadFile("/var/lib/ssh-tunnel-setup/target.json", state.RoleTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ClientSetup(cfg, manifest); err != nil {
+		t.Fatalf("ClientSetup: %v", err)
+	}
+	if keys := server.AuthorizedKeys(config.TunnelUser); len(keys) != 0 {
+		t.Errorf("authorized_keys edited with user-ca: %v", keys)
+	}
+	privateKeyPath := cfg.KeyDirectory + "/" + cfg.KeyName
+	enrolled, err := ssh.ReadPublicKey(ssh.CertificatePath(privateKeyPath))
+	if err != nil {
+		t.Fatalf("no certificate after enrollment: %v", err)
+	}
+	if cert := enrolled.(*gossh.Certificate); cert.KeyId != "enrolled-target:target-1" || cert.ValidPrincipals[0] != config.TunnelUser {
+		t.Errorf("unexpected certificate %q for %v", cert.KeyId, cert.ValidPrincipals)
+	}
+
+	if err := Rotate(&config.AppConfig.Rotate); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	renewed, err := ssh.ReadPublicKey(ssh.CertificatePath(privateKeyPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert := renewed.(*gossh.Certificate); cert.KeyId != "enrolled-target:target-1" || bytes.Equal(cert.Key.Marshal(), enrolled.(*gossh.Certificate).Key.Marshal()) {
+		t.Errorf("certificate of the new key not renewed: %q", cert.KeyId)
+	}
+	auth := ssh.NewRemoteAuth(config.TunnelUser, nil, privateKeyPath, server.TrustedHostKey())
+	if err := (ssh.SSHRemoteRunner{}).Test(server.Addr(), auth); err != nil {
+		t.Errorf("renewed certificate does not log in: %v", err)
+	}
+
+	// a rotation failing after the renewal revokes the key of the new certificate
+	host := system.Files().(*systemtest.FS)
+	system.SetFS(failingRenameFS{FS: host, path: privateKeyPath + ".new.pub"})
+	t.Cleanup(func() { system.SetFS(host) })
+	if err := Rotate(&config.AppConfig.Rotate); err == nil {
+		t.Fatal("Rotate succeeded without installing the new key pair")
+	}
+	revoked, _ := system.Files().ReadFile(revokedKeysPath)
+	if keys := strings.Split(strings.TrimSpace(string(revoked)), "\n"); len(keys) != 1 || keys[0] == "" {
+		t.Fatalf("expected the new key to be revoked, got %q", revoked)
+	}
+	if strings.Contains(string(revoked), strings.Fields(string(gossh.MarshalAuthorizedKey(renewed.(*gossh.Certificate).Key)))[1]) {
+		t.Error("old key revoked")
+	}
+	if err := (ssh.SSHRemoteRunner{}).Test(server.Addr(), auth); err != nil {
+		t.Errorf("old certificate does not log in after the rollback: %v", err)
+	}
+}
+
+func TestIntegrationHostCA(t *testing.T) {
+	server, cfg := newIntegration(t)
+	if err := ssh.MakeCertificateAuthority(hostCAPath, "host-ca"); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := system.Files().ReadFile(hostCAPath + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ssh.SignHostKey(hostCAPath, server.HostKey(), "relay", []string{cfg.ServerName}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetHostCertificate(cert); err != nil {
+		t.Fatal(err)
+	}
+	config.AppConfig.TrustedHostKey, config.AppConfig.TrustedHostCA = "", strings.TrimSpace(string(ca))
+
+	if err := Probe(cfg); err != nil {
+		t.Errorf("host certificate not accepted: %v", err)
+	}
+
+	other, err := ssh.SignHostKey(hostCAPath, server.HostKey(), "relay", []string{"relay.example.com"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetHostCertificate(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := Probe(cfg); err == nil {
+		t.Error("host certificate for another host name accepted")
+	}
+}
+
+// agentWith serves a fresh ssh-agent holding a new Ed25519 key on a unix socket and points SSH_AUTH_SOCK at it
+func agentWith(t *testing.T) gossh.PublicKey {
+	t.Helper()
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: privateKey}); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", socket)
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer.PublicKey()
+}
+
+func TestIntegrationAgentKey(t *testing.T) {
+	server, cfg := newIntegration(t)
+	agentKey := agentWith(t)
+	cfg.KeySource = config.KeySourceAgent
+	manifest, err := state.LoadFile("/var/lib/ssh-tunnel-setup/client.json", state.RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ClientSetup(cfg, manifest); err != nil {
+		t.Fatalf("ClientSetup: %v", err)
+	}
+
+	privateKeyPath := cfg.KeyDirectory + "/" + cfg.KeyName
+	if _, err := system.Files().Stat(privateKeyPath); err == nil {
+		t.Error("private key file written for an agent key")
+	}
+	exported, err := ssh.ReadPublicKey(privateKeyPath + ".pub")
+	if err != nil || !bytes.Equal(exported.Marshal(), agentKey.Marshal()) {
+		t.Fatalf("expected the public key of the agent key, got %v (%v)", exported, err)
+	}
+	if keys := server.AuthorizedKeys(config.TunnelUser); len(keys) != 1 {
+		t.Fatalf("expected the agent key to be authorized, got %v", keys)
+	}
+	auth := ssh.RemoteAuth{User: config.TunnelUser, Signers: &ssh.AgentSigners{KeyPath: privateKeyPath}, TrustedHostKey: server.TrustedHostKey()}
+	if err := (ssh.SSHRemoteRunner{}).Test(server.Addr(), auth); err != nil {
+		t.Errorf("agent key does not log in: %v", err)
+	}
+}
+
+func TestIntegrationMultiFactorAuth(t *testing.T) {
+	server, cfg := newIntegration(t)
+	system.Files().MkdirAll(cfg.KeyDirectory, 0700)
+	if err := ssh.MakeKeyPair(cfg.KeyDirectory, "admin-key", "admin@target-1", ssh.KeyTypeEd25519); err != nil {
+		t.Fatal(err)
+	}
+	adminKey, _ := system.Files().ReadFile(cfg.KeyDirectory + "/admin-key.pub")
+	server.Authorize("admin", string(adminKey))
+	server.SetVerificationCode("admin", "424242")
+	server.RequireMethods("admin", ssh.MethodPublicKey, ssh.MethodKeyboardInteractive)
+	cfg.ServerKeyName = "admin-key"
+	cfg.AuthMethods = []string{config.AuthPublicKey, config.AuthKeyboardInteractive}
+	code := "000000"
+	var questions []string
+	challenge = func(password secret.Secret) gossh.KeyboardInteractiveChallenge {
+		return func(name, instruction string, qs []string, echos []bool) ([]string, error) {
+			questions = append(questions, qs...)
+			answers := make([]string, len(qs))
+			for i, question := range qs {
+				answers[i] = string(password)
+				if strings.Contains(question, "code") {
+					answers[i] = code
+				}
+			}
+			return answers, nil
+		}
+	}
+	t.Cleanup(func() { challenge = ssh.TerminalChallenge })
+	manifest, err := state.LoadFile("/var/lib/ssh-tunnel-setup/client.json", state.RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ClientSetup(cfg, manifest); err == nil {
+		t.Fatal("logged in with a wrong verification code")
+	}
+	if keys := server.AuthorizedKeys(config.TunnelUser); len(keys) != 0 {
+		t.Fatalf("key authorized without second factor: %v", keys)
+	}
+
+	code = "424242"
+	if err := ClientSetup(cfg, manifest); err != nil {
+		t.Fatalf("ClientSetup: %v", err)
+	}
+	if keys := server.AuthorizedKeys(config.TunnelUser); len(keys) != 1 {
+		t.Fatalf("expected the key to be authorized after both factors, got %v", keys)
+	}
+	if len(questions) == 0 {
+		t.Error("verification code not asked for")
+	}
+
+	// the key alone is not enough
+	cfg.AuthMethods = []string{config.AuthPublicKey}
+	if err := Probe(cfg); err == nil {
+		t.Error("probe logged in with the key alone")
+	}
+}
+
+func TestIntegrationJumpHosts(t *testing.T) {
+	server, cfg := newIntegration(t)
+	bastion := sshtest.NewServer(t)
+	// the bastion accepts the keys of the relay, like with a shared directory, and the admin's agent key
+	// it knows the password of the admin to catch it being sent
+	bastion.SetPassword("admin", "admin-password")
+	bastion.AuthorizedKeysCommand = func(user string, _ gossh.PublicKey) []string {
+		return server.AuthorizedKeys(user)
+	}
+	bastion.Authorize("admin", string(gossh.MarshalAuthorizedKey(agentWith(t))))
+	hosts, err := ssh.ParseJumpHosts([]string{bastion.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssh.SetJumpHosts(hosts, bastion.TrustedHostKey())
+	t.Cleanup(func() { ssh.SetJumpHosts(nil, "") })
+	manifest, err := state.LoadFile("/var/lib/ssh-tunnel-setup/client.json", state.RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ClientSetup(cfg, manifest); err != nil {
+		t.Fatalf("ClientSetup: %v", err)
+	}
+	if keys := server.AuthorizedKeys(config.TunnelUser); len(keys) != 1 {
+		t.Fatalf("expected the key to be authorized through the jump host, got %v", keys)
+	}
+	if dialed := bastion.Dialed(); len(dialed) == 0 || dialed[0] != server.Addr() {
+		t.Errorf("relay not reached through the jump host, dialed %v", dialed)
+	}
+
+	if err := CheckKeyAuthorized(&config.AppConfig.Rotate); err != nil {
+		t.Errorf("key check through the jump host: %v", err)
+	}
+
+	ssh.SetJumpHosts(hosts, "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl")
+	if err := Probe(cfg); err == nil {
+		t.Error("jump host with an unknown host key trusted")
+	}
+	ssh.SetJumpHosts(hosts, "")
+	if err := Probe(cfg); err == nil || !strings.Contains(err.Error(), "trusted-jump-host-key") {
+		t.Errorf("expected jump hosts without trusted host key to be refused, got %v", err)
+	}
+
+	// without key the admin can not log in to the jump host, the password is only sent to the relay
+	t.Setenv("SSH_AUTH_SOCK", "")
+	ssh.SetJumpHosts(hosts, bastion.TrustedHostKey())
+	if err := Probe(cfg); err == nil {
+		t.Error("jump host logged in to without key")
+	}
+}
+
+// directConnections keeps the proxy of the environment from the test
+func directConnections(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy", "NO_PROXY", "no_proxy"} {
+		t.Setenv(name, "")
+	}
+	t.Cleanup(func() { ssh.SetProxy("", nil) })
+}
+
+func TestIntegrationHTTPProxy(t *testing.T) {
+	directConnections(t)
+	server, cfg := newIntegration(t)
+	proxy := sshtest.NewHTTPProxy(t, "alice", "proxy-password")
+	manifest, err := state.LoadFile("/var/lib/ssh-tunnel-setup/client.json", state.RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ssh.SetProxy(strings.Replace(proxy.URL(), "://", "://alice:wrong@", 1), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ClientSetup(cfg, manifest); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("expected the proxy to refuse a wrong password, got %v", err)
+	}
+
+	// the proxy password replaces the one of the URL
+	if err := ssh.SetProxy(strings.Replace(proxy.URL(), "://", "://alice:wrong@", 1), secret.Secret("proxy-password")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ClientSetup(cfg, manifest); err != nil {
+		t.Fatalf("ClientSetup: %v", err)
+	}
+	if keys := server.AuthorizedKeys(config.TunnelUser); len(keys) != 1 {
+		t.Fatalf("expected the key to be authorized through the proxy, got %v", keys)
+	}
+	if connected := proxy.Connected(); len(connected) == 0 || connected[0] != server.Addr() {
+		t.Errorf("relay not connected to through the proxy, connected %v", connected)
+	}
+	if err := Probe(cfg); err != nil {
+		t.Errorf("Probe through the proxy: %v", err)
+	}
+
+	// the tunnel's ssh reads the banner of the relay through proxy-connect
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	go ssh.ProxyConnect(server.Addr(), stdinReader, stdoutWriter)
+	banner, err := bufio.NewReader(stdoutReader).ReadString('\n')
+	if err != nil || !strings.HasPrefix(banner, "SSH-2.0-") {
+		t.Errorf("expected the SSH banner through proxy-connect, got %q (%v)", banner, err)
+	}
+	stdinWriter.Close()
+}
+
+func TestIntegrationSOCKS5ProxyFromEnvironment(t *testing.T) {
+	directConnections(t)
+	server, cfg := newIntegration(t)
+	proxy := sshtest.NewSOCKS5Proxy(t, "", "")
+	t.Setenv("ALL_PROXY", proxy.URL())
+	manifest, err := state.LoadFile("/var/lib/ssh-tunnel-setup/client.json", state.RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ClientSetup(cfg, manifest); err != nil {
+		t.Fatalf("ClientSetup: %v", err)
+	}
+	if connected := proxy.Connected(); len(connected) == 0 || connected[0] != server.Addr() {
+		t.Errorf("relay not connected to through ALL_PROXY, connected %v", connected)
+	}
+
+	t.Setenv("NO_PROXY", "localhost,127.0.0.0/8")
+	before := len(proxy.Connected())
+	if err := CheckKeyAuthorized(&config.AppConfig.Rotate); err != nil {
+		t.Fatalf("CheckKeyAuthorized: %v", err)
+	}
+	if len(proxy.Connected()) != before {
+		t.Error("NO_PROXY not honored")
+	}
+}
+
+func TestIntegrationSOCKS5ProxyResolution(t *testing.T) {
+	directConnections(t)
+	server, _ := newIntegration(t)
+	proxy := sshtest.NewSOCKS5Proxy(t, "", "")
+	_, port, _ := net.SplitHostPort(server.Addr())
+	address := net.JoinHostPort("localhost", port)
+
+	for _, test := range []struct {
+		scheme    string
+		connected string
+	}{
+		// socks5 resolves the host name locally, socks5h leaves it to the proxy
+		{"socks5", server.Addr()},
+		{"socks5h", address},
+	} {
+		if err := ssh.SetProxy(strings.Replace(proxy.URL(), "socks5", test.scheme, 1), nil); err != nil {
+			t.Fatal(err)
+		}
+		stdinReader, stdinWriter := io.Pipe()
+		stdoutReader, stdoutWriter := io.Pipe()
+		go ssh.ProxyConnect(address, stdinReader, stdoutWriter)
+		if banner, err := bufio.NewReader(stdoutReader).ReadString('\n'); err != nil || !strings.HasPrefix(banner, "SSH-2.0-") {
+			t.Errorf("%s: expected the SSH banner, got %q (%v)", test.scheme, banner, err)
+		}
+		stdinWriter.Close()
+		if connected := proxy.Connected(); len(connected) == 0 || connected[len(connected)-1] != test.connected {
+			t.Errorf("%s: expected the proxy to connect to %s, connected %v", test.scheme, test.connected, connected)
+		}
+	}
+}
+
+// startGateway runs a gateway in front of server with a self-signed certificate for 127.0.0.1, it returns the path of the certificate
+func startGateway(t *testing.T, server *sshtest.Server) (string, string) {
+	t.Helper()
+	cfg := &config.ServerConfig{
+		Name:            "relay",
+		HostNames:       []string{"127.0.0.1"},
+		GatewayPath:     "/ssh",
+		GatewayUpstream: server.Addr(),
+		GatewayCert:     "/etc/ssh-tunnel-setup/gateway.crt",
+		GatewayKey:      "/etc/ssh-tunnel-setup/gateway.key",
+	}
+	manifest, err := state.LoadFile("/var/lib/ssh-tunnel-setup/server.json", state.RoleServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createGatewayCertificate(cfg, manifest); err != nil {
+		t.Fatalf("createGatewayCertificate: %v", err)
+	}
+	gatewayServer, err := NewGateway(cfg)
+	if err != nil {
+		t.Fatalf("NewGateway: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gatewayServer.Serve(listener)
+	t.Cleanup(func() {
+		gatewayServer.Close()
+		ssh.SetGateway("", "")
+	})
+	return listener.Addr().String(), cfg.GatewayCert
+}
+
+func TestIntegrationGateway(t *testing.T) {
+	for _, scheme := range []string{"tls", "wss"} {
+		t.Run(scheme, func(t *testing.T) {
+			directConnections(t)
+			server, cfg := newIntegration(t)
+			address, certPath := startGateway(t, server)
+			// the relay is only reachable through the gateway
+			cfg.ServerName, cfg.ServerPort = "relay.invalid", 22
+			manifest, err := state.LoadFile("/var/lib/ssh-tunnel-setup/client.json", state.RoleClient)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gatewayURL := scheme + "://" + address + "/ssh"
+			if err := ssh.SetGateway(gatewayURL, ""); err != nil {
+				t.Fatal(err)
+			}
+			if err := ClientSetup(cfg, manifest); err == nil || !strings.Contains(err.Error(), "certificate") {
+				t.Fatalf("expected the self-signed certificate to be rejected without gateway-ca, got %v", err)
+			}
+
+			if err := ssh.SetGateway(gatewayURL, certPath); err != nil {
+				t.Fatal(err)
+			}
+			if err := ClientSetup(cfg, manifest); err != nil {
+				t.Fatalf("ClientSetup: %v", err)
+			}
+			if keys := server.AuthorizedKeys(config.TunnelUser); len(keys) != 1 {
+				t.Fatalf("expected the key to be authorized through the gateway, got %v", keys)
+			}
+			if err := Probe(cfg); err != nil {
+				t.Errorf("Probe through the gateway: %v", err)
+			}
+
+			// the tunnel's ssh reads the banner of the relay through proxy-connect
+			stdinReader, stdinWriter := io.Pipe()
+			stdoutReader, stdoutWriter := io.Pipe()
+			go ssh.ProxyConnect(net.JoinHostPort(cfg.ServerName, "22"), stdinReader, stdoutWriter)
+			// like ssh, the client sends its version first, the gateway detects raw connections by it
+			go io.WriteString(stdinWriter, "SSH-2.0-OpenSSH_9.6\r\n")
+			banner, err := bufio.NewReader(stdoutReader).ReadString('\n')
+			if err != nil || !strings.HasPrefix(banner, "SSH-2.0-") {
+				t.Errorf("expected the SSH banner through proxy-connect, got %q (%v)", banner, err)
+			}
+			stdinWriter.Close()
+		})
+	}
+}
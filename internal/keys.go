@@ -0,0 +1,21 @@
+package internal
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/fbufler/ssh-tunnel-setup/package/ssh"
+)
+
+// InspectKey reads the key pair of the rotate config, see ssh.InspectKeyPair
+func InspectKey(cfg *config.RotateConfig) (ssh.KeyInfo, error) {
+	return ssh.InspectKeyPair(fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName))
+}
+
+// CheckKeyAuthorized checks that the key pair of the rotate config logs in on the server
+func CheckKeyAuthorized(cfg *config.RotateConfig) error {
+	serverAdress := fmt.Sprintf("%s:%d", cfg.ServerName, cfg.ServerPort)
+	slog.Debug(fmt.Sprintf("Checking key on %s@%s", cfg.ServerUser, serverAdress))
+	return ssh.CheckAuthorized(fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName), serverAdress, cfg.ServerUser, config.TrustedHostKey())
+}
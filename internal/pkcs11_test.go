@@ -0,0 +1,99 @@
+//go:build cgo
+
+package internal
+
+import (
+	"crypto/elliptic"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/fbufler/ssh-tunnel-setup/package/secret"
+	"github.com/fbufler/ssh-tunnel-setup/package/ssh"
+	"github.com/fbufler/ssh-tunnel-setup/package/state"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+)
+
+// softHSMModules are the usual install locations of the SoftHSM library, SOFTHSM2_MODULE takes precedence
+var softHSMModules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+}
+
+// softHSMToken initializes a SoftHSM token labelled tunnel with an ECDSA key labelled tunnel-key and returns the module
+// The test is skipped without SoftHSM
+func softHSMToken(t *testing.T, pin string) string {
+	t.Helper()
+	module := os.Getenv("SOFTHSM2_MODULE")
+	for _, path := range softHSMModules {
+		if _, err := os.Stat(path); module == "" && err == nil {
+			module = path
+		}
+	}
+	if _, err := exec.LookPath("softhsm2-util"); module == "" || err != nil {
+		t.Skip("SoftHSM not installed")
+	}
+
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err := os.Mkdir(filepath.Join(dir, "tokens"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(conf, []byte("directories.tokendir = "+filepath.Join(dir, "tokens")+"\nobjectstore.backend = file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+	init := exec.Command("softhsm2-util", "--init-token", "--free", "--label", "tunnel", "--pin", pin, "--so-pin", "so-"+pin)
+	if output, err := init.CombinedOutput(); err != nil {
+		t.Fatalf("initializing token: %v: %s", err, output)
+	}
+
+	ctx, err := crypto11.Configure(&crypto11.Config{Path: module, TokenLabel: "tunnel", Pin: pin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Close()
+	if _, err := ctx.GenerateECDSAKeyPairWithLabel([]byte{1}, []byte("tunnel-key"), elliptic.P256()); err != nil {
+		t.Fatal(err)
+	}
+	return module
+}
+
+func TestIntegrationPKCS11Key(t *testing.T) {
+	module := softHSMToken(t, "1234")
+	server, cfg := newIntegration(t)
+	cfg.KeySource = config.KeySourcePKCS11
+	cfg.PKCS11Module, cfg.PKCS11Token, cfg.PKCS11KeyLabel = module, "tunnel", "tunnel-key"
+	cfg.PKCS11PIN = secret.Secret("1234")
+	manifest, err := state.LoadFile("/var/lib/ssh-tunnel-setup/client.json", state.RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ClientSetup(cfg, manifest); err != nil {
+		t.Fatalf("ClientSetup: %v", err)
+	}
+
+	privateKeyPath := cfg.KeyDirectory + "/" + cfg.KeyName
+	if _, err := system.Files().Stat(privateKeyPath); err == nil {
+		t.Error("private key file written for a token key")
+	}
+	if keys := server.AuthorizedKeys(config.TunnelUser); len(keys) != 1 {
+		t.Fatalf("expected the token key to be authorized, got %v", keys)
+	}
+	signers := &ssh.PKCS11Signers{Module: module, Token: "tunnel", KeyLabel: "tunnel-key", PIN: secret.Secret("1234"), KeyPath: privateKeyPath}
+	auth := ssh.RemoteAuth{User: config.TunnelUser, Signers: signers, TrustedHostKey: server.TrustedHostKey()}
+	if err := (ssh.SSHRemoteRunner{}).Test(server.Addr(), auth); err != nil {
+		t.Errorf("token key does not log in: %v", err)
+	}
+
+	signers.PIN = secret.Secret("4321")
+	if err := (ssh.SSHRemoteRunner{}).Test(server.Addr(), auth); err == nil {
+		t.Error("token opened with a wrong PIN")
+	}
+}
@@ -3,27 +3,114 @@ package internal
 import (
 	"fmt"
 	"log/slog"
+	"time"
 
 	"github.com/fbufler/ssh-tunnel-setup/config"
 	"github.com/fbufler/ssh-tunnel-setup/package/ssh"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
 )
 
+// Rotate replaces the key pair, authorized or certified on the relay, and records the rotation time
 func Rotate(cfg *config.RotateConfig) error {
 	slog.Info("Rotating key pair")
 	serverAdress := fmt.Sprintf("%s:%d", cfg.ServerName, cfg.ServerPort)
-	err := ssh.RotateKeyPair(cfg.ServerUser, serverAdress, cfg.KeyDirectory, cfg.KeyName, cfg.KeyUser, config.TrustedHostKey())
+	keyPath := fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName)
+	if ssh.RotationPending(keyPath) {
+		return fmt.Errorf("rotation of %s was interrupted, run rotate --resume to complete it", keyPath)
+	}
+	var err error
+	if ssh.CertificateExists(keyPath) {
+		// the relay acts as certificate authority, the new key is signed instead of authorized
+		err = ssh.RenewKeyPair(rotationEnrollUser(cfg), cfg.ServerUser, serverAdress, cfg.KeyDirectory, cfg.KeyName, cfg.KeyUser, cfg.KeyType, config.TrustedHostKey(), keyArchive(cfg))
+	} else {
+		err = ssh.RotateKeyPair(cfg.ServerUser, serverAdress, cfg.KeyDirectory, cfg.KeyName, cfg.KeyUser, cfg.KeyType, config.TrustedHostKey(), keyArchive(cfg))
+	}
 	if err != nil {
 		slog.Error(fmt.Sprintf("Error rotating key pair: %s", err))
 		return err
 	}
 	slog.Info("Key pair rotated")
+	return completeRotation(cfg)
+}
+
+// ResumeRotation completes an interrupted rotation of the key from the journal, see ssh.ResumeRotation
+func ResumeRotation(cfg *config.RotateConfig) error {
+	keyPath := fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName)
+	if err := ssh.ResumeRotation(keyPath, config.TrustedHostKey(), keyArchive(cfg)); err != nil {
+		slog.Error(fmt.Sprintf("Error resuming rotation: %s", err))
+		return err
+	}
+	slog.Info("Key pair rotated")
+	return completeRotation(cfg)
+}
+
+// Rollback replaces the key pair by the archived key pair id, which is authorized on the server again
+// The replaced key pair is archived, so a rollback can be undone by another one
+func Rollback(cfg *config.RotateConfig, id string) error {
+	slog.Info(fmt.Sprintf("Rolling back key pair to %s", id))
+	serverAdress := fmt.Sprintf("%s:%d", cfg.ServerName, cfg.ServerPort)
+	keyPath := fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName)
+	if ssh.RotationPending(keyPath) {
+		return fmt.Errorf("rotation of %s was interrupted, run rotate --resume to complete it", keyPath)
+	}
+	enrollUser := ""
+	if ssh.CertificateExists(keyPath) {
+		enrollUser = rotationEnrollUser(cfg)
+	}
+	err := ssh.RollbackKeyPair(id, enrollUser, cfg.ServerUser, serverAdress, cfg.KeyDirectory, cfg.KeyName, config.TrustedHostKey(), keyArchive(cfg))
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error rolling back key pair: %s", err))
+		return err
+	}
+	slog.Info("Key pair rolled back")
+	return completeRotation(cfg)
+}
+
+// ArchivedKeys returns the key pairs in the archive of the key, the oldest first
+func ArchivedKeys(cfg *config.RotateConfig) ([]ssh.ArchivedKey, error) {
+	return keyArchive(cfg).List(cfg.KeyName)
+}
+
+// ArchivedKey returns the archived key pair id of the key
+func ArchivedKey(cfg *config.RotateConfig, id string) (ssh.ArchivedKey, error) {
+	return keyArchive(cfg).Find(cfg.KeyName, id)
+}
+
+func keyArchive(cfg *config.RotateConfig) ssh.KeyArchive {
+	return ssh.KeyArchive{Directory: cfg.KeyArchiveDirectory(), Passphrase: cfg.ArchivePassphrase}
+}
+
+// rotationEnrollUser returns the account renewing the certificate of the key
+func rotationEnrollUser(cfg *config.RotateConfig) string {
+	if cfg.EnrollUser == "" {
+		return config.EnrollUser
+	}
+	return cfg.EnrollUser
+}
+
+// completeRotation records the rotation time and restarts the tunnel with the rotated key
+func completeRotation(cfg *config.RotateConfig) error {
+	cfg.Rotated = now().UTC().Truncate(time.Second)
 
 	slog.Info("Update Rotation Config")
-	err = config.StoreRotationConfig(cfg)
+	err := config.StoreRotationConfig(cfg)
 	if err != nil {
 		slog.Error(fmt.Sprintf("Error adding rotation config: %s", err))
 		return err
 	}
 
+	restartTunnel()
 	return nil
 }
+
+// restartTunnel restarts the managed tunnel, if it is installed, so it connects with the rotated key
+// The rotation is complete without it, a failed restart is only logged
+func restartTunnel() {
+	if !system.SystemdServiceInstalled(serviceName) {
+		return
+	}
+	slog.Info(fmt.Sprintf("Restarting %s with the rotated key", serviceName))
+	if err := system.RestartSystemdService(serviceName); err != nil {
+		slog.Warn(fmt.Sprintf("Error restarting %s, restart it to use the rotated key: %s", serviceName, err))
+	}
+}
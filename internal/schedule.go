@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/fbufler/ssh-tunnel-setup/package/ssh"
+	"github.com/fbufler/ssh-tunnel-setup/package/state"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+)
+
+const rotateServiceName = "managed-tunnel-rotate"
+const rotateServiceDescription = "Rotate the key of the managed SSH tunnel"
+
+// keyAgeDropIn makes the managed tunnel check the age of its key before it starts
+const keyAgeDropIn = "key-age"
+
+// now returns the current time, it is replaced in tests
+var now = time.Now
+
+// RotationRole returns the role whose manifest records the rotation schedule, target if the managed tunnel is installed
+func RotationRole() state.Role {
+	if system.SystemdServiceInstalled(serviceName) {
+		return state.RoleTarget
+	}
+	return state.RoleClient
+}
+
+// ScheduleRotation installs a systemd timer, or a cron job without systemd, running the rotation as user every rotation interval
+// With max-age the managed tunnel checks the age of its key before it starts, see CheckKeyAge
+func ScheduleRotation(cfg *config.RotateConfig, user string, manifest *state.Manifest) error {
+	interval, err := rotationInterval(cfg)
+	if err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("Scheduling key rotation every %s", interval))
+	path, err := executable()
+	if err != nil {
+		return fmt.Errorf("failed to determine executable: %v", err)
+	}
+	rotateCommand := path + " rotate"
+
+	var steps []step
+	if system.SystemdAvailable() {
+		steps = []step{
+			{
+				name:  "rotate-service",
+				paths: []string{system.SystemdServicePath(rotateServiceName), system.SystemdTimerPath(rotateServiceName)},
+				run:   func() error { return installRotateTimer(interval, rotateCommand, user, manifest) },
+			},
+			{
+				name:  "rotate-timer-enable",
+				after: []string{"rotate-service"},
+				run:   func() error { return system.EnableSystemdTimer(rotateServiceName) },
+			},
+		}
+	} else {
+		slog.Warn("systemd not available, scheduling the rotation with cron")
+		steps = []step{
+			{
+				name:  "rotate-cron",
+				paths: []string{system.CronJobPath(rotateServiceName)},
+				run: func() error {
+					if err := system.CreateCronJob(rotateServiceName, user, interval, rotateCommand); err != nil {
+						return err
+					}
+					return manifest.Record(state.Artifact{Kind: state.KindFile, Path: system.CronJobPath(rotateServiceName)})
+				},
+			},
+		}
+	}
+	if cfg.MaxAge != 0 && system.SystemdServiceInstalled(serviceName) {
+		dropInPath := system.SystemdDropInPath(serviceName, keyAgeDropIn)
+		steps = append(steps, step{
+			name:  "tunnel-key-age",
+			paths: []string{dropInPath},
+			run: func() error {
+				// a failing check keeps the tunnel from starting, the warn policy never fails it
+				settings := fmt.Sprintf("ExecStartPre=%s rotate --check\n", path)
+				if err := system.CreateSystemdDropIn(serviceName, keyAgeDropIn, settings); err != nil {
+					return err
+				}
+				return manifest.Record(state.Artifact{Kind: state.KindFile, Path: dropInPath})
+			},
+		})
+	}
+
+	if err := runSteps(manifest, steps); err != nil {
+		return err
+	}
+	slog.Info("Key rotation scheduled")
+	return nil
+}
+
+// rotationInterval returns the time between scheduled rotations
+// A certificate of the relay is only renewed while it is valid, so the interval has to be shorter than its validity;
+// without rotate.interval the certificate is renewed at about half its validity
+func rotationInterval(cfg *config.RotateConfig) (time.Duration, error) {
+	keyPath := fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName)
+	if !ssh.CertificateExists(keyPath) {
+		return cfg.RotationInterval(), nil
+	}
+	validity, err := ssh.CertificateValidity(keyPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read certificate: %v", err)
+	}
+	switch {
+	case validity == 0:
+		return cfg.RotationInterval(), nil
+	case cfg.Interval == 0:
+		return renewalInterval(validity), nil
+	case cfg.Interval >= validity:
+		return 0, fmt.Errorf("rotate.interval %s is not shorter than the validity %s of the certificate of %s, the certificate could not be renewed once it expired", cfg.Interval, validity, keyPath)
+	}
+	return cfg.Interval, nil
+}
+
+// renewalInterval returns half of validity in whole days or hours, which cron can repeat as well
+func renewalInterval(validity time.Duration) time.Duration {
+	half := validity / 2
+	switch {
+	case half >= 24*time.Hour:
+		return half.Truncate(24 * time.Hour)
+	case half >= time.Hour:
+		return half.Truncate(time.Hour)
+	}
+	return half
+}
+
+func installRotateTimer(interval time.Duration, rotateCommand, user string, manifest *state.Manifest) error {
+	err := system.CreateSystemdOneshot(rotateServiceName, rotateServiceDescription, rotateCommand, user)
+	if err != nil {
+		return err
+	}
+	err = system.CreateSystemdTimer(rotateServiceName, rotateServiceDescription, interval)
+	if err != nil {
+		return err
+	}
+	// the timer is recorded last, so uninstall disables it before the service it starts is removed
+	err = manifest.Record(state.Artifact{Kind: state.KindSystemdUnit, Path: system.SystemdServicePath(rotateServiceName), Name: rotateServiceName})
+	if err != nil {
+		return err
+	}
+	timer := rotateServiceName + ".timer"
+	return manifest.Record(state.Artifact{Kind: state.KindSystemdUnit, Path: system.SystemdTimerPath(rotateServiceName), Name: timer})
+}
+
+// KeyAge returns the age of the rotated key, it is unknown for keys set up before the age was tracked
+func KeyAge(cfg *config.RotateConfig) (time.Duration, bool) {
+	if cfg.Rotated.IsZero() {
+		return 0, false
+	}
+	return now().Sub(cfg.Rotated).Truncate(time.Second), true
+}
+
+// CheckKeyAge applies the max-age policy to the key, a stale key is an error with the refuse policy
+// Without max-age every key is accepted
+func CheckKeyAge(cfg *config.RotateConfig) error {
+	if cfg.MaxAge == 0 {
+		return nil
+	}
+	keyPath := fmt.Sprintf("%s/%s", cfg.KeyDirectory, cfg.KeyName)
+	age, known := KeyAge(cfg)
+	if known && age <= cfg.MaxAge {
+		slog.Debug(fmt.Sprintf("Key %s is %s old, within max-age %s", keyPath, age, cfg.MaxAge))
+		return nil
+	}
+	var err error
+	if known {
+		err = fmt.Errorf("key %s is %s old, older than max-age %s", keyPath, age, cfg.MaxAge)
+	} else {
+		err = fmt.Errorf("key %s has no rotation time, rotate it to track its age", keyPath)
+	}
+	if cfg.MaxAgePolicy == config.MaxAgeRefuse {
+		return err
+	}
+	slog.Warn(fmt.Sprintf("Stale key: %s", err))
+	return nil
+}
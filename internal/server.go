@@ -4,52 +4,121 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
-	"os/exec"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/fbufler/ssh-tunnel-setup/config"
 	"github.com/fbufler/ssh-tunnel-setup/package/sshd"
+	"github.com/fbufler/ssh-tunnel-setup/package/state"
 	"github.com/fbufler/ssh-tunnel-setup/package/system"
 )
 
 const minimalPasswordLength = 16
+const tunnelGroup = "tunnel"
 
-func ServerSetup(cfg *config.ServerConfig) error {
+func ServerSetup(cfg *config.ServerConfig, manifest *state.Manifest) error {
 	slog.Info("Setting up server")
-	err := setupUser(cfg)
-	if err != nil {
-		slog.Error(fmt.Sprintf("failed to setup user: %v", err))
-		return fmt.Errorf("failed to setup user: %v", err)
+	steps := []step{
+		{
+			name:  "user",
+			check: func() bool { return system.UserExists(cfg.TunnelUser) },
+			run: func() error {
+				err := setupUser(cfg, manifest)
+				if err != nil {
+					slog.Error(fmt.Sprintf("failed to setup user: %v", err))
+					return fmt.Errorf("failed to setup user: %v", err)
+				}
+				return nil
+			},
+		},
+		{
+			name:  "group",
+			check: func() bool { return system.UserInGroup(cfg.TunnelUser, tunnelGroup) },
+			after: []string{"user"},
+			run: func() error {
+				err := joinTunnelGroup(cfg, manifest)
+				if err != nil {
+					slog.Error(fmt.Sprintf("failed to add user to group: %v", err))
+					return fmt.Errorf("failed to add user to group: %v", err)
+				}
+				return nil
+			},
+		},
+		{
+			name:  "ssh-environment",
+			check: func() bool { return userSSHEnvironmentPrepared(cfg.TunnelUser) },
+			after: []string{"user"},
+			run: func() error {
+				err := prepareUserSSHEnvironment(cfg.TunnelUser)
+				if err != nil {
+					slog.Error(fmt.Sprintf("failed to prepare user's SSH environment: %v", err))
+					return fmt.Errorf("failed to prepare user's SSH environment: %v", err)
+				}
+				return nil
+			},
+		},
+	}
+	if cfg.Enrollment {
+		steps = append(steps, enrollSteps(cfg, manifest)...)
+	}
+	if cfg.UserCA {
+		steps = append(steps, userCASteps(cfg, manifest)...)
+	}
+	if cfg.HostCA {
+		steps = append(steps, hostCASteps(cfg, manifest)...)
 	}
+	steps = append(steps,
+		step{
+			name: "sshd-config",
+			// sshd is restarted when the host certificates are renewed
+			paths: append([]string{cfg.SSHDConfigPath}, hostCertificatePaths(cfg)...),
+			check: func() bool {
+				return enrollAccountConfigured(cfg) && userCATrusted(cfg) && hostCertificatesConfigured(cfg)
+			},
+			run: func() error {
+				err := setupSSHDConfig(cfg, manifest)
+				if err != nil {
+					slog.Error(fmt.Sprintf("failed to setup sshd: %v", err))
+					return fmt.Errorf("failed to setup sshd: %v", err)
+				}
 
-	err = prepareUserSSHEnvironment(cfg.TunnelUser)
-	if err != nil {
-		slog.Error(fmt.Sprintf("failed to prepare user's SSH environment: %v", err))
-		return fmt.Errorf("failed to prepare user's SSH environment: %v", err)
+				err = sshd.Restart()
+				if err != nil {
+					slog.Error(fmt.Sprintf("failed to restart sshd: %v", err))
+					return fmt.Errorf("failed to restart sshd: %v", err)
+				}
+				return nil
+			},
+		},
+	)
+	if cfg.Gateway {
+		steps = append(steps, gatewaySteps(cfg, manifest)...)
 	}
 
-	err = setupSSHDConfig(cfg)
+	err := runSteps(manifest, steps)
 	if err != nil {
-		slog.Error(fmt.Sprintf("failed to setup sshd: %v", err))
-		return fmt.Errorf("failed to setup sshd: %v", err)
+		return err
 	}
-
-	err = restartSSHD()
+	// the enroll account runs under sshd later and only sees the settings of the config files
+	slog.Info("Storing server config")
+	err = config.StoreServerConfig(cfg)
 	if err != nil {
-		slog.Error(fmt.Sprintf("failed to restart sshd: %v", err))
-		return fmt.Errorf("failed to restart sshd: %v", err)
+		slog.Error(fmt.Sprintf("Error storing server config: %s", err))
+		return err
 	}
-
-	return fmt.Errorf("not implemented")
+	return nil
 }
 
-func setupUser(cfg *config.ServerConfig) error {
+func setupUser(cfg *config.ServerConfig, manifest *state.Manifest) error {
 	slog.Debug("Setting up user")
 	if system.UserExists(cfg.TunnelUser) {
-		return fmt.Errorf("user already exists, assuming setup was done already")
+		slog.Info(fmt.Sprintf("User %s already exists, keeping it", cfg.TunnelUser))
+		return nil
 	}
 
-	if !isPasswordComplex(cfg.TunnelPass) {
+	if cfg.TunnelPass.Empty() {
+		slog.Info(fmt.Sprintf("No tunnel password set, locking the password of %s, only key logins are possible", cfg.TunnelUser))
+	} else if !isPasswordComplex(cfg.TunnelPass) {
 		return fmt.Errorf("password does not meet complexity requirements")
 	}
 
@@ -57,15 +126,32 @@ func setupUser(cfg *config.ServerConfig) error {
 	if err != nil {
 		return fmt.Errorf("failed to create user: %v", err)
 	}
+	err = manifest.Record(state.Artifact{Kind: state.KindUser, Name: cfg.TunnelUser})
+	if err != nil {
+		return fmt.Errorf("failed to record user: %v", err)
+	}
+	return nil
+}
+
+func joinTunnelGroup(cfg *config.ServerConfig, manifest *state.Manifest) error {
+	slog.Debug("Adding user to tunnel group")
+	if system.UserInGroup(cfg.TunnelUser, tunnelGroup) {
+		slog.Debug(fmt.Sprintf("User %s already in group %s", cfg.TunnelUser, tunnelGroup))
+		return nil
+	}
 
-	err = system.AddUserToGroup(cfg.TunnelUser, "tunnel")
+	err := system.AddUserToGroup(cfg.TunnelUser, tunnelGroup)
 	if err != nil {
-		return fmt.Errorf("failed to add user to group: %v", err)
+		return err
+	}
+	err = manifest.Record(state.Artifact{Kind: state.KindGroupMember, Name: cfg.TunnelUser, Group: tunnelGroup})
+	if err != nil {
+		return fmt.Errorf("failed to record group membership: %v", err)
 	}
 	return nil
 }
 
-func isPasswordComplex(password string) bool {
+func isPasswordComplex(password []byte) bool {
 	var (
 		hasMinLen  = false
 		hasUpper   = false
@@ -77,7 +163,9 @@ func isPasswordComplex(password string) bool {
 	if len(password) >= minimalPasswordLength {
 		hasMinLen = true
 	}
-	for _, char := range password {
+	for i := 0; i < len(password); {
+		char, size := utf8.DecodeRune(password[i:])
+		i += size
 		switch {
 		case unicode.IsUpper(char):
 			hasUpper = true
@@ -93,25 +181,34 @@ func isPasswordComplex(password string) bool {
 	return hasMinLen && hasUpper && hasLower && hasNumber && hasSpecial
 }
 
+func userSSHEnvironmentPrepared(user string) bool {
+	_, err := system.Files().Stat(fmt.Sprintf("/home/%s/.ssh/authorized_keys", user))
+	return err == nil
+}
+
 func prepareUserSSHEnvironment(user string) error {
 	slog.Debug("Preparing user's SSH environment")
+	files := system.Files()
 
 	slog.Debug("Creating .ssh directory")
-	err := os.Mkdir(fmt.Sprintf("/home/%s/.ssh", user), 0700)
+	err := files.MkdirAll(fmt.Sprintf("/home/%s/.ssh", user), 0700)
 	if err != nil {
 		return fmt.Errorf("failed to create .ssh directory: %v", err)
 	}
-	err = os.Chmod(fmt.Sprintf("/home/%s/.ssh", user), 0700)
+	err = files.Chmod(fmt.Sprintf("/home/%s/.ssh", user), 0700)
 	if err != nil {
 		return fmt.Errorf("failed to chmod .ssh directory: %v", err)
 	}
 
 	slog.Debug("Creating authorized_keys file")
-	_, err = os.Create(fmt.Sprintf("/home/%s/.ssh/authorized_keys", user))
-	if err != nil {
-		return fmt.Errorf("failed to create authorized_keys file: %v", err)
+	authorizedKeysPath := fmt.Sprintf("/home/%s/.ssh/authorized_keys", user)
+	if _, err := files.Stat(authorizedKeysPath); os.IsNotExist(err) {
+		err = files.WriteFile(authorizedKeysPath, nil, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to create authorized_keys file: %v", err)
+		}
 	}
-	err = os.Chmod(fmt.Sprintf("/home/%s/.ssh/authorized_keys", user), 0600)
+	err = files.Chmod(authorizedKeysPath, 0600)
 	if err != nil {
 		return fmt.Errorf("failed to chmod authorized_keys file: %v", err)
 	}
@@ -119,26 +216,46 @@ func prepareUserSSHEnvironment(user string) error {
 	return nil
 }
 
-func setupSSHDConfig(cfg *config.ServerConfig) error {
+func setupSSHDConfig(cfg *config.ServerConfig, manifest *state.Manifest) error {
 	slog.Debug("Setting up sshd configuration")
-	sshdConfig, err := os.ReadFile(cfg.SSHDConfigPath)
-	if err != nil {
-		return fmt.Errorf("failed to read sshd config: %v", err)
+	edited := state.Artifact{Kind: state.KindSSHDConfig, Path: cfg.SSHDConfigPath, Backup: cfg.SSHDConfigBackupPath}
+	if !manifest.Contains(edited) {
+		err := sshd.Backup(cfg.SSHDConfigPath, cfg.SSHDConfigBackupPath)
+		if err != nil {
+			return err
+		}
+		err = manifest.Record(edited)
+		if err != nil {
+			return fmt.Errorf("failed to record sshd config: %v", err)
+		}
 	}
 
-	sshd.AllowGatewayPorts(&sshdConfig)
-	sshd.AllowTcpForwarding(&sshdConfig)
-	return os.WriteFile(cfg.SSHDConfigPath, sshdConfig, 0644)
+	enrollUser, keysCommand := "", ""
+	if cfg.Enrollment {
+		var err error
+		if keysCommand, err = enrollKeysCommand(); err != nil {
+			return err
+		}
+		enrollUser = cfg.EnrollUser
+	}
+	trustedUser := ""
+	if cfg.UserCA {
+		trustedUser = cfg.TunnelUser
+	}
+	return sshd.Update(cfg.SSHDConfigPath, sshd.AllowGatewayPorts, sshd.AllowTcpForwarding,
+		sshd.EnrollAccount(enrollUser, keysCommand), sshd.TrustUserCA(trustedUser, userCAPath+".pub", revokedKeysPath),
+		sshd.HostCertificates(hostCertificatePaths(cfg)))
 }
 
-func restartSSHD() error {
-	slog.Debug("Restarting sshd")
-	cmd := exec.Command("sudo", "systemctl", "restart", "sshd")
-	err := cmd.Run()
-
+// enrollAccountConfigured checks that the sshd config has the enroll account block if and only if enrollment is enabled
+func enrollAccountConfigured(cfg *config.ServerConfig) bool {
+	sshdConfig, err := system.Files().ReadFile(cfg.SSHDConfigPath)
 	if err != nil {
-		return fmt.Errorf("failed to restart sshd: %v", err)
+		return false
 	}
-	slog.Debug("sshd restarted")
-	return nil
+	expected := ""
+	if cfg.Enrollment {
+		expected = cfg.EnrollUser
+	}
+	return sshd.EnrolledUser(sshdConfig) == expected
 }
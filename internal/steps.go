@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/state"
+)
+
+// step is a single idempotent part of a setup flow
+type step struct {
+	name string
+	// paths are the files the step produces, their checksums detect drift
+	paths []string
+	// check verifies the result of the step is still in place
+	check func() bool
+	// after names steps that force this step to run again when they ran
+	after []string
+	run   func() error
+}
+
+// runSteps runs the steps in order, skipping steps the manifest records as completed
+// unless their files drifted, their check fails or a step they depend on ran
+func runSteps(manifest *state.Manifest, steps []step) error {
+	ran := map[string]bool{}
+	for _, s := range steps {
+		if !s.required(manifest, ran) {
+			slog.Info(fmt.Sprintf("Step %s already done, skipping", s.name))
+			continue
+		}
+		slog.Debug(fmt.Sprintf("Running step %s", s.name))
+		if err := s.run(); err != nil {
+			return err
+		}
+		ran[s.name] = true
+		if err := manifest.CompleteStep(s.name, s.paths...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s step) required(manifest *state.Manifest, ran map[string]bool) bool {
+	completed, ok := manifest.Step(s.name)
+	if !ok {
+		return true
+	}
+	for _, path := range s.paths {
+		if _, ok := completed.Checksums[path]; !ok {
+			slog.Info(fmt.Sprintf("Step %s now produces %s, running again", s.name, path))
+			return true
+		}
+	}
+	for _, dependency := range s.after {
+		if ran[dependency] {
+			slog.Info(fmt.Sprintf("Step %s depends on %s, running again", s.name, dependency))
+			return true
+		}
+	}
+	if drifted := completed.Drifted(); len(drifted) > 0 {
+		slog.Warn(fmt.Sprintf("Step %s drifted (%v changed), repairing", s.name, drifted))
+		return true
+	}
+	if s.check != nil && !s.check() {
+		slog.Warn(fmt.Sprintf("Step %s is no longer in place, repairing", s.name))
+		return true
+	}
+	return false
+}
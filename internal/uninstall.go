@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/fbufler/ssh-tunnel-setup/package/ssh"
+	"github.com/fbufler/ssh-tunnel-setup/package/sshd"
+	"github.com/fbufler/ssh-tunnel-setup/package/state"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+)
+
+// Uninstall reverts all artifacts recorded in the manifest in reverse order of their creation
+// Artifacts that could not be reverted stay in the manifest, so uninstall can be retried
+func Uninstall(manifest *state.Manifest) error {
+	slog.Info(fmt.Sprintf("Uninstalling %s", manifest.Role))
+	if len(manifest.Artifacts) == 0 {
+		slog.Info("Nothing to uninstall")
+		return manifest.ResetSteps()
+	}
+
+	// reverted or not, the recorded steps no longer describe the system
+	if err := manifest.ResetSteps(); err != nil {
+		return err
+	}
+
+	artifacts := append([]state.Artifact{}, manifest.Artifacts...)
+	var errs []error
+	for i := len(artifacts) - 1; i >= 0; i-- {
+		artifact := artifacts[i]
+		slog.Info(fmt.Sprintf("Reverting %s", artifact))
+		if err := revert(artifact); err != nil {
+			slog.Error(fmt.Sprintf("Error reverting %s: %s", artifact, err))
+			errs = append(errs, fmt.Errorf("failed to revert %s: %v", artifact, err))
+			continue
+		}
+		if err := manifest.Forget(artifact); err != nil {
+			return err
+		}
+	}
+
+	if len(errs) > 0 {
+		slog.Warn(fmt.Sprintf("Remaining artifacts are kept in %s", manifest.Path()))
+		return errors.Join(errs...)
+	}
+	slog.Info("Uninstall complete")
+	return nil
+}
+
+func revert(artifact state.Artifact) error {
+	switch artifact.Kind {
+	case state.KindFile:
+		return removeFile(artifact.Path)
+	case state.KindKeyPair:
+		return ssh.RemoveKeyPair(artifact.Path)
+	case state.KindAuthorizedKey:
+		return ssh.RevokePublicKeyOnRemote(artifact.Path, artifact.Remote, artifact.RemoteUser, config.TrustedHostKey())
+	case state.KindSSHConfigHost:
+		return ssh.RemoveTunnelConfiguration(artifact.Path, artifact.Name)
+	case state.KindKnownHostCA:
+		return ssh.RemoveHostCA(artifact.Path, artifact.Name)
+	case state.KindCronEntry:
+		return system.RemoveCronEntry(artifact.Path, artifact.Name)
+	case state.KindSystemdUnit:
+		return system.RemoveSystemdService(artifact.Name)
+	case state.KindUser:
+		return system.RemoveUser(artifact.Name)
+	case state.KindGroupMember:
+		return system.RemoveUserFromGroup(artifact.Name, artifact.Group)
+	case state.KindSSHDConfig:
+		return restoreSSHDConfig(artifact.Path, artifact.Backup)
+	}
+	return fmt.Errorf("unknown artifact kind %q", artifact.Kind)
+}
+
+func removeFile(path string) error {
+	err := system.Files().Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func restoreSSHDConfig(path, backupPath string) error {
+	err := sshd.Restore(path, backupPath)
+	if err != nil {
+		return err
+	}
+	// the backup may be older than the installed sshd, it must not stop sshd on restart
+	err = sshd.Validate(path)
+	if err != nil {
+		return err
+	}
+	err = sshd.Restart()
+	if err != nil {
+		return err
+	}
+	return removeFile(backupPath)
+}
@@ -0,0 +1,330 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/fbufler/ssh-tunnel-setup/package/secret"
+	"github.com/fbufler/ssh-tunnel-setup/package/ssh"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+	"gopkg.in/yaml.v3"
+)
+
+// Roles are the roles the init wizard sets up
+var Roles = []string{"server", "client", "target"}
+
+// Answers are the answers to the init wizard, asked interactively or read from an answers file
+// Unset answers keep the configured value
+type Answers struct {
+	Role string `yaml:"role"`
+	Name string `yaml:"name"`
+
+	// relay of client and target
+	ServerName     string `yaml:"server-name"`
+	ServerPort     int    `yaml:"server-port"`
+	ServerUser     string `yaml:"server-user"`
+	ServerPassFile string `yaml:"server-pass-file"`
+	ServerKeyName  string `yaml:"server-key-name"`
+	KeyName        string `yaml:"key-name"`
+	KeyDirectory   string `yaml:"key-directory"`
+	KeyUser        string `yaml:"key-user"`
+	KeyType        string `yaml:"key-type"`
+
+	// forwarded service of the target
+	HostIdentifier string `yaml:"host-identifier"`
+	LocalHost      string `yaml:"local-host"`
+	LocalPort      int    `yaml:"local-port"`
+	// TunnelPort is the port the relay forwards to the service, tunnel.server-port
+	TunnelPort int `yaml:"tunnel-port"`
+
+	// server
+	TunnelUser     string `yaml:"tunnel-user"`
+	TunnelPassFile string `yaml:"tunnel-pass-file"`
+	SSHDConfigPath string `yaml:"sshd-config-path"`
+
+	// passwords entered at the prompt
+	serverPass secret.Secret
+	tunnelPass secret.Secret
+}
+
+// ReadAnswers reads the answers file at path, unknown keys are rejected
+// Passwords are not part of the file, they are read from server-pass-file and tunnel-pass-file
+func ReadAnswers(path string) (*Answers, error) {
+	data, err := system.Files().ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read answers file: %v", err)
+	}
+	answers := &Answers{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(answers); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to parse answers file %s: %v", path, err)
+	}
+	if !slices.Contains(Roles, answers.Role) {
+		return nil, fmt.Errorf("invalid role %q in %s, expected one of %s", answers.Role, path, strings.Join(Roles, ", "))
+	}
+	return answers, nil
+}
+
+// prompter asks questions on out and reads the answers line by line from in
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask asks question, an empty answer keeps current
+func (p *prompter) ask(question, current string) (string, error) {
+	if current != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, current)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	line, err := p.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("failed to read answer to %q: %v", question, err)
+	}
+	if answer := strings.TrimSpace(line); answer != "" {
+		return answer, nil
+	}
+	return current, nil
+}
+
+// choose asks question until one of options is answered
+func (p *prompter) choose(question string, options []string, current string) (string, error) {
+	for {
+		answer, err := p.ask(fmt.Sprintf("%s (%s)", question, strings.Join(options, "/")), current)
+		if err != nil {
+			return "", err
+		}
+		for _, option := range options {
+			if answer == option {
+				return answer, nil
+			}
+		}
+		fmt.Fprintf(p.out, "Please answer one of %s\n", strings.Join(options, ", "))
+	}
+}
+
+// askPort asks question until a port is answered
+func (p *prompter) askPort(question string, current int) (int, error) {
+	for {
+		answer, err := p.ask(question, strconv.Itoa(current))
+		if err != nil {
+			return 0, err
+		}
+		port, err := strconv.Atoi(answer)
+		if err == nil && port > 0 && port <= 65535 {
+			return port, nil
+		}
+		fmt.Fprintln(p.out, "Please answer a port between 1 and 65535")
+	}
+}
+
+// Confirm asks question on out and reads a yes or no from in, an empty answer is yes
+// in should be the *bufio.Reader the answers were read from, it is used as is
+func Confirm(in io.Reader, out io.Writer, question string) (bool, error) {
+	p := &prompter{in: bufio.NewReader(in), out: out}
+	answer, err := p.choose(question, []string{"y", "n"}, "y")
+	return answer == "y", err
+}
+
+// AskAnswers asks the questions of the wizard, the configured values are offered as defaults
+func AskAnswers(in io.Reader, out io.Writer) (*Answers, error) {
+	p := &prompter{in: bufio.NewReader(in), out: out}
+	a := &Answers{}
+	var err error
+	if a.Role, err = p.choose("Role of this machine", Roles, "target"); err != nil {
+		return nil, err
+	}
+	if a.Role == "server" {
+		return a, a.askServer(p)
+	}
+	if err := a.askClient(p); err != nil {
+		return nil, err
+	}
+	if a.Role == "target" {
+		return a, a.askTarget(p)
+	}
+	return a, nil
+}
+
+func (a *Answers) askServer(p *prompter) error {
+	cfg := config.AppConfig.Server
+	var err error
+	if a.Name, err = p.ask("Server name", cfg.Name); err != nil {
+		return err
+	}
+	if a.TunnelUser, err = p.ask("Tunnel user", cfg.TunnelUser); err != nil {
+		return err
+	}
+	if a.SSHDConfigPath, err = p.ask("sshd config", cfg.SSHDConfigPath); err != nil {
+		return err
+	}
+	a.tunnelPass, err = secret.Read(secret.Source{Prompt: "Tunnel user password (empty for key logins only)"})
+	return err
+}
+
+func (a *Answers) askClient(p *prompter) error {
+	cfg := config.AppConfig.Client
+	var err error
+	if a.Name, err = p.ask("Client name", cfg.Name); err != nil {
+		return err
+	}
+	if a.ServerName, err = p.ask("Relay host", cfg.ServerName); err != nil {
+		return err
+	}
+	if a.ServerPort, err = p.askPort("Relay SSH port", cfg.ServerPort); err != nil {
+		return err
+	}
+	if a.ServerUser, err = p.ask("Relay user for the setup", cfg.ServerUser); err != nil {
+		return err
+	}
+	login := "password"
+	if cfg.ServerKeyName != "" {
+		login = "key"
+	}
+	if login, err = p.choose("Log in to the relay with", []string{"password", "key"}, login); err != nil {
+		return err
+	}
+	if login == "key" {
+		if a.ServerKeyName, err = p.ask("Key of the relay user (in the key directory)", cfg.ServerKeyName); err != nil {
+			return err
+		}
+	} else {
+		prompt := fmt.Sprintf("Password of %s@%s", a.ServerUser, a.ServerName)
+		if a.serverPass, err = secret.Read(secret.Source{Prompt: prompt}); err != nil {
+			return err
+		}
+	}
+	if a.KeyDirectory, err = p.ask("Key directory", cfg.KeyDirectory); err != nil {
+		return err
+	}
+	if a.KeyName, err = p.ask("Name of the tunnel key", cfg.KeyName); err != nil {
+		return err
+	}
+	if a.KeyType, err = p.choose("Type of the tunnel key", config.KeyTypes, cfg.KeyType); err != nil {
+		return err
+	}
+	a.KeyUser, err = p.ask("Comment of the tunnel key", cfg.KeyUser)
+	return err
+}
+
+func (a *Answers) askTarget(p *prompter) error {
+	cfg := config.AppConfig.Tunnel
+	var err error
+	if a.HostIdentifier, err = p.ask("Host alias of the tunnel in the ssh config", cfg.HostIdentifier); err != nil {
+		return err
+	}
+	if a.LocalHost, err = p.ask("Host of the forwarded service", cfg.LocalHost); err != nil {
+		return err
+	}
+	if a.LocalPort, err = p.askPort("Port of the forwarded service", cfg.LocalPort); err != nil {
+		return err
+	}
+	a.TunnelPort, err = p.askPort("Port of the tunnel on the relay", cfg.ServerPort)
+	return err
+}
+
+// Apply sets the answers in the loaded config and reads the password files
+func (a *Answers) Apply() error {
+	set := func(target *string, value string) {
+		if value != "" {
+			*target = value
+		}
+	}
+	setPort := func(target *int, value int) {
+		if value != 0 {
+			*target = value
+		}
+	}
+	readPass := func(target *secret.Secret, file string, entered secret.Secret) error {
+		if file != "" {
+			password, err := secret.Read(secret.Source{File: file})
+			if err != nil {
+				return err
+			}
+			entered = password
+		}
+		if !entered.Empty() {
+			*target = entered
+		}
+		return nil
+	}
+
+	if a.Role == "server" {
+		server := &config.AppConfig.Server
+		set(&server.Name, a.Name)
+		set(&server.TunnelUser, a.TunnelUser)
+		set(&server.SSHDConfigPath, a.SSHDConfigPath)
+		return readPass(&server.TunnelPass, a.TunnelPassFile, a.tunnelPass)
+	}
+
+	client := &config.AppConfig.Client
+	set(&client.Name, a.Name)
+	set(&client.ServerName, a.ServerName)
+	setPort(&client.ServerPort, a.ServerPort)
+	set(&client.ServerUser, a.ServerUser)
+	set(&client.ServerKeyName, a.ServerKeyName)
+	set(&client.KeyName, a.KeyName)
+	set(&client.KeyDirectory, a.KeyDirectory)
+	set(&client.KeyUser, a.KeyUser)
+	set(&client.KeyType, a.KeyType)
+	if a.Role == "target" {
+		tunnel := &config.AppConfig.Tunnel
+		set(&tunnel.HostIdentifier, a.HostIdentifier)
+		set(&tunnel.ServerName, a.ServerName)
+		set(&tunnel.LocalHost, a.LocalHost)
+		setPort(&tunnel.LocalPort, a.LocalPort)
+		setPort(&tunnel.ServerPort, a.TunnelPort)
+	}
+	return readPass(&client.ServerPass, a.ServerPassFile, a.serverPass)
+}
+
+// Probe checks that the relay of cfg is reachable and that the setup is able to log in
+func Probe(cfg *config.ClientConfig) error {
+	slog.Info(fmt.Sprintf("Probing relay %s:%d", cfg.ServerName, cfg.ServerPort))
+	if err := ssh.DiscoverRelay(cfg.ServerName, cfg.ServerPort); err != nil {
+		return err
+	}
+	auth := serverAuth(cfg)
+	auth.TrustedHostKey = config.TrustedHostKey()
+	if err := ssh.CheckLogin(fmt.Sprintf("%s:%d", cfg.ServerName, cfg.ServerPort), auth); err != nil {
+		return fmt.Errorf("failed to log in to the relay as %s: %v", cfg.ServerUser, err)
+	}
+	slog.Info("Relay reachable, login succeeded")
+	return nil
+}
+
+// Summary returns the config sections role is set up with, passwords are left out
+func Summary(role string) ([]byte, error) {
+	sections := map[string]any{}
+	switch role {
+	case "server":
+		server := config.AppConfig.Server
+		server.TunnelPass = nil
+		sections["server"] = server
+	default:
+		client := config.AppConfig.Client
+		client.ServerPass = nil
+		client.EnrollToken = nil
+		client.PKCS11PIN = nil
+		sections["client"] = client
+		if role == "target" {
+			sections["tunnel"] = config.AppConfig.Tunnel
+		}
+	}
+	return yaml.Marshal(sections)
+}
+
+// Zero overwrites the passwords entered at the prompt
+func (a *Answers) Zero() {
+	a.serverPass.Zero()
+	a.tunnelPass.Zero()
+}
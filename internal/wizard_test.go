@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fbufler/ssh-tunnel-setup/config"
+	"github.com/fbufler/ssh-tunnel-setup/package/ssh/sshtest"
+	"github.com/fbufler/ssh-tunnel-setup/package/system/systemtest"
+)
+
+func TestAskAnswers(t *testing.T) {
+	systemtest.Install(t)
+	config.AppConfig = config.Config{Client: config.ClientConfig{KeyType: "rsa", ServerPort: 22, KeyDirectory: "/home/alice/.ssh"}}
+	input := strings.Join([]string{
+		"relay",             // invalid role, asked again
+		"target",            // role
+		"target-1",          // client name
+		"relay.example.com", // relay host
+		"70000",             // invalid port, asked again
+		"",                  // keep port 22
+		"admin",             // relay user
+		"key",               // login
+		"admin-key",         // relay user key
+		"",                  // keep key directory
+		"tunnel-key",        // key name
+		"ed25519",           // key type
+		"alice@target-1",    // key comment
+		"db",                // host alias
+		"",                  // keep local host
+		"5432",              // local port
+		"",                  // no tunnel port configured, asked again
+		"2201",              // tunnel port
+	}, "\n") + "\n"
+	var out bytes.Buffer
+
+	answers, err := AskAnswers(strings.NewReader(input), &out)
+	if err != nil {
+		t.Fatalf("AskAnswers: %v\n%s", err, out.String())
+	}
+	if err := answers.Apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	client, tunnel := config.AppConfig.Client, config.AppConfig.Tunnel
+	if client.ServerName != "relay.example.com" || client.ServerPort != 22 || client.ServerKeyName != "admin-key" ||
+		client.KeyDirectory != "/home/alice/.ssh" || client.KeyType != "ed25519" || client.KeyUser != "alice@target-1" {
+		t.Errorf("unexpected client config %+v", client)
+	}
+	if tunnel.HostIdentifier != "db" || tunnel.LocalPort != 5432 || tunnel.ServerPort != 2201 || tunnel.ServerName != "relay.example.com" {
+		t.Errorf("unexpected tunnel config %+v", tunnel)
+	}
+	if !strings.Contains(out.String(), "Please answer one of server, client, target") ||
+		!strings.Contains(out.String(), "Please answer a port between 1 and 65535") {
+		t.Errorf("invalid answers not rejected:\n%s", out.String())
+	}
+}
+
+func TestReadAnswers(t *testing.T) {
+	host := systemtest.Install(t)
+	config.AppConfig = config.Config{}
+	host.FS.Seed("/etc/answers.yaml", []byte("role: server\ntunnel-user: tunnel\ntunnel-pass-file: /run/secrets/tunnel-pass\n"), 0600)
+	host.FS.Seed("/run/secrets/tunnel-pass", []byte("s3cret-Pass!\n"), 0600)
+	host.FS.Seed("/etc/typo.yaml", []byte("role: server\ntunnel-usr: tunnel\n"), 0600)
+	host.FS.Seed("/etc/no-role.yaml", []byte("tunnel-user: tunnel\n"), 0600)
+
+	answers, err := ReadAnswers("/etc/answers.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := answers.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if config.AppConfig.Server.TunnelUser != "tunnel" || string(config.AppConfig.Server.TunnelPass) != "s3cret-Pass!" {
+		t.Errorf("answers not applied: %+v", config.AppConfig.Server)
+	}
+	summary, err := Summary("server")
+	if err != nil || strings.Contains(string(summary), "s3cret") {
+		t.Errorf("password in summary or summary failed: %v\n%s", err, summary)
+	}
+
+	for _, path := range []string{"/etc/typo.yaml", "/etc/no-role.yaml"} {
+		if _, err := ReadAnswers(path); err == nil {
+			t.Errorf("%s not rejected", path)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	systemtest.Install(t)
+	server := sshtest.NewServer(t)
+	server.SetPassword("admin", "admin-password")
+	config.AppConfig = config.Config{TrustedHostKey: server.TrustedHostKey()}
+	name, port, err := net.SplitHostPort(server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.ClientConfig{ServerName: name, ServerUser: "admin", ServerPass: []byte("admin-password")}
+	cfg.ServerPort, _ = strconv.Atoi(port)
+
+	if err := Probe(cfg); err != nil {
+		t.Errorf("Probe: %v", err)
+	}
+	cfg.ServerPass = []byte("wrong")
+	if err := Probe(cfg); err == nil || !strings.Contains(err.Error(), "log in") {
+		t.Errorf("wrong password not reported: %v", err)
+	}
+	server.Close()
+	if err := Probe(cfg); err == nil || !strings.Contains(err.Error(), "not reachable") {
+		t.Errorf("unreachable relay not reported: %v", err)
+	}
+}
+
+func TestSummaryLeavesOutSecrets(t *testing.T) {
+	config.AppConfig = config.Config{Client: config.ClientConfig{
+		ServerName:  "relay.example.com",
+		ServerPass:  []byte("admin-password"),
+		EnrollToken: []byte("token"),
+		PKCS11PIN:   []byte("123456"),
+	}}
+
+	summary, err := Summary("target")
+	if err != nil {
+		t.Fatalf("Summary: %v", err)
+	}
+	if !strings.Contains(string(summary), "relay.example.com") || strings.Contains(string(summary), "123456") {
+		t.Errorf("unexpected summary:\n%s", summary)
+	}
+}
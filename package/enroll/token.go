@@ -0,0 +1,189 @@
+// Package enroll issues single-use enrollment tokens, so clients install their key on the relay
+// without the password of a privileged account
+package enroll
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/state"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+)
+
+// TokenPrefix starts every token, so tokens are recognizable in logs and secret scanners
+const TokenPrefix = "ste_"
+
+const (
+	activeSuffix = ".json"
+	usedSuffix   = ".used.json"
+	// idLength is the length of the id of a token, a prefix of the hash of the token
+	idLength = 12
+)
+
+// Roles are the roles a token may enroll
+var Roles = []string{string(state.RoleClient), string(state.RoleTarget)}
+
+var now = time.Now
+
+// Token is an issued enrollment token
+// Only the sha256 hash of the token is stored, the token itself is shown once on creation
+type Token struct {
+	ID      string    `json:"id"`
+	Role    string    `json:"role"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	// Used is set once the token is redeemed, a token is redeemed only once
+	Used *time.Time `json:"used,omitempty"`
+	// Key is the fingerprint of the public key enrolled with the token
+	Key string `json:"key,omitempty"`
+}
+
+// Status returns active, used or expired
+func (t Token) Status() string {
+	switch {
+	case t.Used != nil:
+		return "used"
+	case now().After(t.Expires):
+		return "expired"
+	}
+	return "active"
+}
+
+// Dir is the directory the tokens are stored in
+// It is the system state directory for every user, as tokens are redeemed by the enroll command running as root
+const Dir = "/var/lib/ssh-tunnel-setup/tokens"
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create issues a token for role, valid for ttl
+func Create(role string, ttl time.Duration) (string, *Token, error) {
+	if !slices.Contains(Roles, role) {
+		return "", nil, fmt.Errorf("invalid role %q, expected one of %s", role, strings.Join(Roles, ", "))
+	}
+	if ttl <= 0 {
+		return "", nil, fmt.Errorf("invalid ttl %s", ttl)
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", nil, fmt.Errorf("failed to generate token: %v", err)
+	}
+	token := TokenPrefix + base64.RawURLEncoding.EncodeToString(random)
+	tokenHash := hash(token)
+	created := now().UTC().Truncate(time.Second)
+	issued := &Token{ID: tokenHash[:idLength], Role: role, Created: created, Expires: created.Add(ttl)}
+
+	if err := system.Files().MkdirAll(Dir, 0700); err != nil {
+		return "", nil, fmt.Errorf("failed to create token directory: %v", err)
+	}
+	if err := write(filepath.Join(Dir, tokenHash+activeSuffix), issued); err != nil {
+		return "", nil, err
+	}
+	return token, issued, nil
+}
+
+func write(path string, token *Token) error {
+	data, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode token: %v", err)
+	}
+	if err := system.Files().WriteFile(path, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write token: %v", err)
+	}
+	return nil
+}
+
+func read(path string) (*Token, error) {
+	data, err := system.Files().ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	token := &Token{}
+	if err := json.Unmarshal(data, token); err != nil {
+		return nil, fmt.Errorf("failed to parse token %s: %v", path, err)
+	}
+	return token, nil
+}
+
+// List returns the issued tokens including the used ones, ordered by creation
+func List() ([]Token, error) {
+	names, err := system.Files().ReadDir(Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %v", err)
+	}
+	tokens := []Token{}
+	for _, name := range names {
+		// used tokens end with activeSuffix as well
+		if !strings.HasSuffix(name, activeSuffix) {
+			continue
+		}
+		token, err := read(filepath.Join(Dir, name))
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *token)
+	}
+	sort.SliceStable(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+	return tokens, nil
+}
+
+// Redeem marks token as used by the key with fingerprint and returns it
+// The token file is claimed by renaming it, so a token is redeemed only once even by concurrent enrollments
+func Redeem(token, fingerprint string) (*Token, error) {
+	tokenHash := hash(token)
+	active := filepath.Join(Dir, tokenHash+activeSuffix)
+	used := filepath.Join(Dir, tokenHash+usedSuffix)
+	if err := system.Files().Rename(active, used); err != nil {
+		if _, statErr := system.Files().Stat(used); statErr == nil {
+			return nil, fmt.Errorf("token already used")
+		}
+		return nil, fmt.Errorf("unknown token")
+	}
+
+	redeemed, err := read(used)
+	if err != nil {
+		return nil, err
+	}
+	usedAt := now().UTC().Truncate(time.Second)
+	expired := usedAt.After(redeemed.Expires)
+	redeemed.Used = &usedAt
+	if !expired {
+		redeemed.Key = fingerprint
+	}
+	if err := write(used, redeemed); err != nil {
+		return nil, err
+	}
+	if expired {
+		return nil, fmt.Errorf("token expired at %s", redeemed.Expires.Format(time.RFC3339))
+	}
+	return redeemed, nil
+}
+
+// Revoke removes the unused token with id
+func Revoke(id string) error {
+	names, err := system.Files().ReadDir(Dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to list tokens: %v", err)
+	}
+	for _, name := range names {
+		if len(id) == idLength && strings.HasPrefix(name, id) && !strings.HasSuffix(name, usedSuffix) {
+			return system.Files().Remove(filepath.Join(Dir, name))
+		}
+	}
+	return fmt.Errorf("no unused token with id %s", id)
+}
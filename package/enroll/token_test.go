@@ -0,0 +1,90 @@
+package enroll
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/system/systemtest"
+)
+
+func TestRedeemOnce(t *testing.T) {
+	systemtest.Install(t)
+	token, issued, err := Create("target", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, TokenPrefix) || issued.Status() != "active" {
+		t.Errorf("unexpected token %s %+v", token, issued)
+	}
+
+	redeemed, err := Redeem(token, "SHA256:key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redeemed.ID != issued.ID || redeemed.Key != "SHA256:key" || redeemed.Status() != "used" {
+		t.Errorf("unexpected redeemed token %+v", redeemed)
+	}
+	if _, err := Redeem(token, "SHA256:other"); err == nil || err.Error() != "token already used" {
+		t.Errorf("reuse not rejected: %v", err)
+	}
+	if _, err := Redeem(TokenPrefix+"guessed", "SHA256:other"); err == nil || err.Error() != "unknown token" {
+		t.Errorf("unknown token not rejected: %v", err)
+	}
+}
+
+func TestRedeemExpired(t *testing.T) {
+	systemtest.Install(t)
+	t.Cleanup(func() { now = time.Now })
+	token, _, err := Create("client", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+	if _, err := Redeem(token, "SHA256:key"); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("expired token not rejected: %v", err)
+	}
+	if _, err := Redeem(token, "SHA256:key"); err == nil || err.Error() != "token already used" {
+		t.Errorf("expired token redeemed on retry: %v", err)
+	}
+}
+
+func TestListAndRevoke(t *testing.T) {
+	systemtest.Install(t)
+	if _, _, err := Create("server", time.Hour); err == nil {
+		t.Error("invalid role not rejected")
+	}
+	used, _, err := Create("target", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Redeem(used, "SHA256:key"); err != nil {
+		t.Fatal(err)
+	}
+	_, active, err := Create("client", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 {
+		t.Fatalf("expected 2 tokens, got %+v", tokens)
+	}
+	if err := Revoke(active.ID); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err = List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].Status() != "used" {
+		t.Errorf("unexpected tokens after revoke %+v", tokens)
+	}
+	if err := Revoke(tokens[0].ID); err == nil {
+		t.Error("used token revoked")
+	}
+}
@@ -0,0 +1,310 @@
+// Package gateway carries SSH connections in TLS or WebSocket connections, for networks that only let HTTPS out
+// The gateway on the relay unwraps them and forwards them to the local sshd
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+	"golang.org/x/net/websocket"
+)
+
+// The supported schemes of gateway URLs
+const (
+	SchemeTLS       = "tls"
+	SchemeWebSocket = "wss"
+)
+
+// DefaultPort is the port of gateway URLs without port
+const DefaultPort = "443"
+
+// handshakeTimeout limits the TLS handshake and the detection of the transport of new connections
+const handshakeTimeout = 10 * time.Second
+
+// ParseURL parses a gateway URL, tls://host[:port] or wss://host[:port]/path
+func ParseURL(gatewayURL string) (*url.URL, error) {
+	u, err := url.Parse(gatewayURL)
+	if err != nil || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid gateway URL %q, expected tls://host[:port] or wss://host[:port]/path", gatewayURL)
+	}
+	if u.Scheme != SchemeTLS && u.Scheme != SchemeWebSocket {
+		return nil, fmt.Errorf("unsupported gateway scheme %q, supported are %s and %s", u.Scheme, SchemeTLS, SchemeWebSocket)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), DefaultPort)
+	}
+	return u, nil
+}
+
+// LoadCA reads the PEM certificates at caPath, the gateway certificate is verified with them instead of the system roots
+func LoadCA(caPath string) (*x509.CertPool, error) {
+	data, err := system.Files().ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gateway CA: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate in gateway CA %s", caPath)
+	}
+	return roots, nil
+}
+
+// Wrap carries the connection conn to the gateway at gatewayURL in TLS, and for wss in a WebSocket
+// The certificate of the gateway is verified with roots, the system roots if it is nil
+func Wrap(conn net.Conn, gatewayURL *url.URL, roots *x509.CertPool) (net.Conn, error) {
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: gatewayURL.Hostname(), RootCAs: roots, MinVersion: tls.VersionTLS12})
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with gateway %s failed: %v", gatewayURL.Host, err)
+	}
+	if gatewayURL.Scheme == SchemeTLS {
+		tlsConn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}
+
+	location := *gatewayURL
+	origin := url.URL{Scheme: "https", Host: gatewayURL.Host}
+	config, err := websocket.NewConfig(location.String(), origin.String())
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	ws, err := websocket.NewClient(config, tlsConn)
+	if err != nil {
+		tlsConn.Close()
+		return nil, fmt.Errorf("WebSocket handshake with gateway %s failed: %v", gatewayURL.Host, err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// Server accepts TLS connections, raw or carrying a WebSocket on Path, and forwards them to Upstream
+type Server struct {
+	// Upstream is the address of the local sshd
+	Upstream string
+	// Path is the path WebSocket connections are accepted on
+	Path string
+	// TLS holds the certificate of the gateway
+	TLS *tls.Config
+
+	mu       sync.Mutex
+	listener net.Listener
+	http     *http.Server
+	conns    chan net.Conn
+	// open holds the accepted connections, they are closed with the server
+	open map[net.Conn]bool
+	wg   sync.WaitGroup
+}
+
+// LoadCertificate returns the TLS config of the gateway with the PEM certificate and key at certPath and keyPath
+func LoadCertificate(certPath, keyPath string) (*tls.Config, error) {
+	certPEM, err := system.Files().ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gateway certificate: %v", err)
+	}
+	keyPEM, err := system.Files().ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gateway key: %v", err)
+	}
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load gateway certificate: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// Serve accepts connections on listener until Close, it returns nil once the server is closed
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	s.listener = listener
+	s.conns = make(chan net.Conn)
+	s.open = map[net.Conn]bool{}
+	mux := http.NewServeMux()
+	mux.Handle(s.Path, websocket.Server{
+		// clients are not browsers, they send no meaningful origin
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   s.serveWebSocket,
+	})
+	s.http = &http.Server{Handler: mux, ReadHeaderTimeout: handshakeTimeout}
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		// the HTTP server is handed the connections carrying a request
+		s.http.Serve(&connListener{conns: s.conns, addr: listener.Addr(), done: make(chan struct{})})
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		tracked := &trackedConn{Conn: conn, server: s}
+		s.mu.Lock()
+		s.open[tracked] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(tracked)
+		}()
+	}
+}
+
+// ListenAndServe listens on address and serves until Close
+func (s *Server) ListenAndServe(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", address, err)
+	}
+	slog.Info(fmt.Sprintf("Gateway listening on %s, forwarding to %s", listener.Addr(), s.Upstream))
+	return s.Serve(listener)
+}
+
+// Close stops accepting connections and closes the open ones
+func (s *Server) Close() error {
+	s.mu.Lock()
+	listener, server := s.listener, s.http
+	s.mu.Unlock()
+	if listener == nil {
+		return nil
+	}
+	err := listener.Close()
+	server.Close()
+	s.mu.Lock()
+	open := make([]net.Conn, 0, len(s.open))
+	for conn := range s.open {
+		open = append(open, conn)
+	}
+	s.mu.Unlock()
+	for _, conn := range open {
+		conn.Close()
+	}
+	s.wg.Wait()
+	return err
+}
+
+// handle completes the TLS handshake of conn and forwards it, raw connections start with the SSH version, others with an HTTP request
+func (s *Server) handle(conn net.Conn) {
+	tlsConn := tls.Server(conn, s.TLS)
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		slog.Debug(fmt.Sprintf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err))
+		conn.Close()
+		return
+	}
+	reader := bufio.NewReader(tlsConn)
+	start, err := reader.Peek(4)
+	if err != nil {
+		tlsConn.Close()
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+	buffered := &bufferedConn{Conn: tlsConn, reader: reader}
+	if bytes.Equal(start, []byte("SSH-")) {
+		s.forward(buffered)
+		return
+	}
+	s.mu.Lock()
+	conns := s.conns
+	s.mu.Unlock()
+	select {
+	case conns <- buffered:
+	case <-time.After(handshakeTimeout):
+		buffered.Close()
+	}
+}
+
+func (s *Server) serveWebSocket(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	s.forward(ws)
+}
+
+// forward copies between conn and a new connection to the upstream sshd until either is closed
+func (s *Server) forward(conn net.Conn) {
+	defer conn.Close()
+	upstream, err := net.Dial("tcp", s.Upstream)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error connecting to %s: %v", s.Upstream, err))
+		return
+	}
+	defer upstream.Close()
+	slog.Debug(fmt.Sprintf("Forwarding %s to %s", conn.RemoteAddr(), s.Upstream))
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// trackedConn is an accepted connection, it is forgotten by the server once it is closed
+type trackedConn struct {
+	net.Conn
+	server *Server
+}
+
+func (c *trackedConn) Close() error {
+	c.server.mu.Lock()
+	delete(c.server.open, c)
+	c.server.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// bufferedConn is a connection whose first bytes were already read into reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// connListener hands the HTTP server the connections of conns
+type connListener struct {
+	conns <-chan net.Conn
+	addr  net.Addr
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
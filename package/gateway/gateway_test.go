@@ -0,0 +1,32 @@
+package gateway
+
+import (
+	"testing"
+)
+
+func TestParseURL(t *testing.T) {
+	for _, test := range []struct {
+		url      string
+		expected string
+	}{
+		{"tls://relay.example.com", "tls://relay.example.com:443"},
+		{"wss://relay.example.com/ssh", "wss://relay.example.com:443/ssh"},
+		{"wss://relay.example.com:8443/ssh", "wss://relay.example.com:8443/ssh"},
+		{"tls://[2001:db8::1]", "tls://[2001:db8::1]:443"},
+		{"https://relay.example.com", ""},
+		{"ws://relay.example.com/ssh", ""},
+		{"relay.example.com:443", ""},
+		{"tls://", ""},
+	} {
+		u, err := ParseURL(test.url)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", test.url, u)
+			}
+			continue
+		}
+		if err != nil || u.String() != test.expected {
+			t.Errorf("%s: expected %s, got %v (%v)", test.url, test.expected, u, err)
+		}
+	}
+}
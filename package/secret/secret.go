@@ -0,0 +1,95 @@
+// Package secret keeps passwords off the command line and out of logs and config files
+package secret
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+	"golang.org/x/term"
+)
+
+// Secret is a password kept in a byte slice, so it can be zeroed after use
+// It is printed masked and never written to config files
+type Secret []byte
+
+func (s Secret) String() string {
+	if len(s) == 0 {
+		return ""
+	}
+	return "********"
+}
+
+// MarshalYAML refuses to encode the secret, passwords are not persisted
+func (s Secret) MarshalYAML() (any, error) {
+	return nil, fmt.Errorf("refusing to write a secret to a config file")
+}
+
+// Empty checks if no secret is set
+func (s Secret) Empty() bool {
+	return len(s) == 0
+}
+
+// Zero overwrites the secret in place
+func (s Secret) Zero() {
+	for i := range s {
+		s[i] = 0
+	}
+}
+
+// Source selects where a secret is read from, the first set source is used
+type Source struct {
+	// File is the path of a file holding the secret
+	File string
+	// Stdin reads the secret from the first line of stdin
+	Stdin bool
+	// Value is the secret provided by an env variable or config file
+	Value Secret
+	// Prompt is shown to ask for the secret when stdin is a terminal and no other source is set
+	Prompt string
+}
+
+var (
+	// stdin is shared by all secrets, a reader per secret would buffer the lines of the following ones
+	stdin      = bufio.NewReader(os.Stdin)
+	stdinFd    = int(os.Stdin.Fd())
+	isTerminal = term.IsTerminal
+	readSecret = term.ReadPassword
+)
+
+// Read reads the secret from the first set source of src, an empty secret is returned if none is set
+func Read(src Source) (Secret, error) {
+	switch {
+	case src.File != "":
+		data, err := system.Files().ReadFile(src.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret file: %v", err)
+		}
+		value := Secret(bytes.TrimRight(data, "\r\n"))
+		result := append(Secret{}, value...)
+		Secret(data).Zero()
+		return result, nil
+	case src.Stdin:
+		line, err := stdin.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read secret from stdin: %v", err)
+		}
+		value := append(Secret{}, bytes.TrimRight(line, "\r\n")...)
+		Secret(line).Zero()
+		return value, nil
+	case !src.Value.Empty():
+		return src.Value, nil
+	case src.Prompt != "" && isTerminal(stdinFd):
+		fmt.Fprintf(os.Stderr, "%s: ", src.Prompt)
+		value, err := readSecret(stdinFd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret: %v", err)
+		}
+		return value, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,66 @@
+package secret
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/system/systemtest"
+	"gopkg.in/yaml.v3"
+)
+
+func TestRead(t *testing.T) {
+	host := systemtest.Install(t)
+	host.FS.Seed("/run/secrets/pass", []byte("from-file\n"), 0600)
+	originalStdin, originalIsTerminal, originalReadSecret := stdin, isTerminal, readSecret
+	t.Cleanup(func() {
+		stdin, isTerminal, readSecret = originalStdin, originalIsTerminal, originalReadSecret
+	})
+	stdin = bufio.NewReader(strings.NewReader("from-stdin\nrest\n"))
+	prompted := false
+	isTerminal = func(int) bool { return true }
+	readSecret = func(int) ([]byte, error) {
+		prompted = true
+		return []byte("from-prompt"), nil
+	}
+
+	for _, test := range []struct {
+		name     string
+		src      Source
+		expected string
+	}{
+		{"file before everything", Source{File: "/run/secrets/pass", Stdin: true, Value: Secret("value"), Prompt: "Password"}, "from-file"},
+		{"stdin before value", Source{Stdin: true, Value: Secret("value")}, "from-stdin"},
+		{"next line of stdin", Source{Stdin: true}, "rest"},
+		{"value before prompt", Source{Value: Secret("value"), Prompt: "Password"}, "value"},
+		{"prompt", Source{Prompt: "Password"}, "from-prompt"},
+		{"nothing", Source{}, ""},
+	} {
+		got, err := Read(test.src)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if string(got) != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, got)
+		}
+	}
+	if !prompted {
+		t.Error("no prompt shown")
+	}
+}
+
+func TestSecretIsNotRevealed(t *testing.T) {
+	s := Secret("password")
+	if printed := fmt.Sprint(s); printed != "********" {
+		t.Errorf("secret printed as %q", printed)
+	}
+	if _, err := yaml.Marshal(struct{ Pass Secret }{s}); err == nil {
+		t.Error("secret written to yaml")
+	}
+
+	s.Zero()
+	if strings.Trim(string(s), "\x00") != "" {
+		t.Errorf("secret not zeroed: %q", s)
+	}
+}
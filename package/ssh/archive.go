@@ -0,0 +1,209 @@
+package ssh
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/secret"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+	"golang.org/x/crypto/ssh"
+)
+
+// archiveTimeFormat is the time in the IDs of archived key pairs
+const archiveTimeFormat = "20060102T150405Z"
+
+// KeyArchive holds the key pairs replaced by rotations, private keys are encrypted if Passphrase is set
+// Without Directory replaced key pairs are removed
+type KeyArchive struct {
+	Directory  string
+	Passphrase secret.Secret
+}
+
+// ArchivedKey is a key pair in the archive, its ID is <key name>-<archive time>
+type ArchivedKey struct {
+	ID          string
+	Archived    time.Time
+	Fingerprint string
+	Comment     string
+	Encrypted   bool
+}
+
+func (a KeyArchive) path(id string) string {
+	return fmt.Sprintf("%s/%s", a.Directory, id)
+}
+
+func exists(path string) bool {
+	_, err := system.Files().Stat(path)
+	return err == nil
+}
+
+// store copies the key pair at privateKeyPath, with its certificate if there is one, into the archive as key pair of keyName
+func (a KeyArchive) store(privateKeyPath, keyName string) (string, error) {
+	if err := system.Files().MkdirAll(a.Directory, 0700); err != nil {
+		return "", fmt.Errorf("failed to create key archive: %v", err)
+	}
+	id := fmt.Sprintf("%s-%s", keyName, time.Now().UTC().Format(archiveTimeFormat))
+	for i := 1; exists(a.path(id)); i++ {
+		id = fmt.Sprintf("%s-%s-%d", keyName, time.Now().UTC().Format(archiveTimeFormat), i)
+	}
+	slog.Debug(fmt.Sprintf("Archiving key pair %s as %s", privateKeyPath, id))
+
+	privateKey, err := system.Files().ReadFile(privateKeyPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to archive key pair: %v", err)
+	}
+	if !a.Passphrase.Empty() {
+		// the private key is encrypted before anything is written, the archive never holds it in plain text
+		rawKey, err := ssh.ParseRawPrivateKey(privateKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse key pair %s: %v", privateKeyPath, err)
+		}
+		encrypted, err := ssh.MarshalPrivateKeyWithPassphrase(rawKey, id, []byte(a.Passphrase))
+		if err != nil {
+			return "", fmt.Errorf("failed to encrypt key pair: %v", err)
+		}
+		privateKey = pem.EncodeToMemory(encrypted)
+	}
+	if err := a.write(id, privateKeyPath, privateKey); err != nil {
+		if err := RemoveKeyPair(a.path(id)); err != nil {
+			slog.Error(fmt.Sprintf("Error removing the partly archived key pair %s, please remove manually: %s", a.path(id), err))
+		}
+		return "", fmt.Errorf("failed to archive key pair: %v", err)
+	}
+	return id, nil
+}
+
+// write writes privateKey and the public key and certificate of the key pair at privateKeyPath as archived key pair id
+func (a KeyArchive) write(id, privateKeyPath string, privateKey []byte) error {
+	if err := system.Files().WriteFile(a.path(id), privateKey, 0600); err != nil {
+		return err
+	}
+	targets := keyFiles(a.path(id))
+	for i, path := range keyFiles(privateKeyPath) {
+		if i == 0 {
+			continue
+		}
+		data, err := system.Files().ReadFile(path)
+		if os.IsNotExist(err) && path == CertificatePath(privateKeyPath) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := system.Files().WriteFile(targets[i], data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restore writes the archived key pair id, decrypted, with its certificate if there is one, to privateKeyPath
+func (a KeyArchive) restore(id, privateKeyPath string) error {
+	if !exists(a.path(id)) {
+		return fmt.Errorf("no archived key pair %s in %s", id, a.Directory)
+	}
+	if err := copyKeyPair(a.path(id), privateKeyPath); err != nil {
+		return fmt.Errorf("failed to restore key pair: %v", err)
+	}
+	privateKey, err := system.Files().ReadFile(privateKeyPath)
+	if err != nil {
+		return err
+	}
+	_, err = ssh.ParseRawPrivateKey(privateKey)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return err
+	}
+	if a.Passphrase.Empty() {
+		return fmt.Errorf("archived key pair %s is encrypted, a passphrase is required", id)
+	}
+	rawKey, err := ssh.ParseRawPrivateKeyWithPassphrase(privateKey, []byte(a.Passphrase))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt archived key pair %s: %v", id, err)
+	}
+	decrypted, err := marshalPrivateKey(rawKey)
+	if err != nil {
+		return err
+	}
+	return system.Files().WriteFile(privateKeyPath, decrypted, 0600)
+}
+
+// marshalPrivateKey encodes rawKey like generateKey does, RSA keys as PKCS #1 and others in the OpenSSH format
+func marshalPrivateKey(rawKey any) ([]byte, error) {
+	if rsaKey, ok := rawKey.(*rsa.PrivateKey); ok {
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), nil
+	}
+	block, err := ssh.MarshalPrivateKey(rawKey, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode private key: %v", err)
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// remove removes the archived key pair id, a missing key pair is ignored
+func (a KeyArchive) remove(id string) error {
+	return RemoveKeyPair(a.path(id))
+}
+
+// List returns the archived key pairs of keyName, the oldest first
+func (a KeyArchive) List(keyName string) ([]ArchivedKey, error) {
+	names, err := system.Files().ReadDir(a.Directory)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key archive: %v", err)
+	}
+	keys := []ArchivedKey{}
+	for _, name := range names {
+		stamp, ok := strings.CutPrefix(name, keyName+"-")
+		if !ok || strings.HasSuffix(name, ".pub") || len(stamp) < len(archiveTimeFormat) {
+			continue
+		}
+		archived, err := time.Parse(archiveTimeFormat, stamp[:len(archiveTimeFormat)])
+		if err != nil {
+			continue
+		}
+		key := ArchivedKey{ID: name, Archived: archived}
+		data, err := system.Files().ReadFile(a.path(name) + ".pub")
+		if err != nil {
+			return nil, fmt.Errorf("archived key pair %s has no public key: %v", name, err)
+		}
+		publicKey, comment, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key of archived key pair %s: %v", name, err)
+		}
+		key.Fingerprint = ssh.FingerprintSHA256(publicKey)
+		key.Comment = comment
+		privateKey, err := system.Files().ReadFile(a.path(name))
+		if err != nil {
+			return nil, err
+		}
+		_, err = ssh.ParseRawPrivateKey(privateKey)
+		var missing *ssh.PassphraseMissingError
+		key.Encrypted = errors.As(err, &missing)
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Find returns the archived key pair id
+func (a KeyArchive) Find(keyName, id string) (ArchivedKey, error) {
+	keys, err := a.List(keyName)
+	if err != nil {
+		return ArchivedKey{}, err
+	}
+	for _, key := range keys {
+		if key.ID == id {
+			return key, nil
+		}
+	}
+	return ArchivedKey{}, fmt.Errorf("no archived key pair %s of %s in %s", id, keyName, a.Directory)
+}
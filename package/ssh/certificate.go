@@ -0,0 +1,163 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+	"golang.org/x/crypto/ssh"
+)
+
+// certificateSuffix is appended to the private key path for its certificate, the name ssh looks the certificate up with
+const certificateSuffix = "-cert.pub"
+
+// clockSkew backdates certificates, so hosts with a slightly late clock accept them
+const clockSkew = 5 * time.Minute
+
+// CertificatePath returns the path of the certificate of the private key at privateKeyPath
+func CertificatePath(privateKeyPath string) string {
+	return privateKeyPath + certificateSuffix
+}
+
+// CertificateExists checks if the private key at privateKeyPath has a certificate
+func CertificateExists(privateKeyPath string) bool {
+	_, err := system.Files().Stat(CertificatePath(privateKeyPath))
+	return err == nil
+}
+
+// CertificateValidity returns how long the certificate of the private key at privateKeyPath is valid for,
+// 0 for a certificate that does not expire
+func CertificateValidity(privateKeyPath string) (time.Duration, error) {
+	publicKey, err := ReadPublicKey(CertificatePath(privateKeyPath))
+	if err != nil {
+		return 0, err
+	}
+	cert, ok := publicKey.(*ssh.Certificate)
+	if !ok {
+		return 0, fmt.Errorf("%s is not a certificate", CertificatePath(privateKeyPath))
+	}
+	if cert.ValidBefore == ssh.CertTimeInfinity || cert.ValidBefore <= cert.ValidAfter {
+		return 0, nil
+	}
+	return time.Duration(cert.ValidBefore-cert.ValidAfter) * time.Second, nil
+}
+
+// MakeCertificateAuthority generates the Ed25519 key of a certificate authority at caPath and its public key at caPath.pub
+func MakeCertificateAuthority(caPath, comment string) error {
+	slog.Debug(fmt.Sprintf("Generating certificate authority %s", caPath))
+	if err := system.Files().MkdirAll(filepath.Dir(caPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory of certificate authority: %v", err)
+	}
+	return MakeKeyPair(filepath.Dir(caPath), filepath.Base(caPath), comment, KeyTypeEd25519)
+}
+
+// ReadPublicKey reads the public key or certificate in authorized_keys format at path
+func ReadPublicKey(path string) (ssh.PublicKey, error) {
+	data, err := system.Files().ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return publicKey, nil
+}
+
+// SignUserKey signs key with the certificate authority at caPath for principals, valid for validity
+// The certificate only permits port forwarding
+func SignUserKey(caPath string, key ssh.PublicKey, keyID string, principals []string, validity time.Duration) (*ssh.Certificate, error) {
+	return signKey(caPath, key, ssh.UserCert, keyID, principals, validity, map[string]string{"permit-port-forwarding": ""})
+}
+
+// SignHostKey signs the host key with the certificate authority at caPath for the host names principals, valid for validity
+func SignHostKey(caPath string, key ssh.PublicKey, keyID string, principals []string, validity time.Duration) (*ssh.Certificate, error) {
+	return signKey(caPath, key, ssh.HostCert, keyID, principals, validity, nil)
+}
+
+func signKey(caPath string, key ssh.PublicKey, certType uint32, keyID string, principals []string, validity time.Duration, extensions map[string]string) (*ssh.Certificate, error) {
+	caKey, err := system.Files().ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate authority: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate authority: %v", err)
+	}
+	serial := make([]byte, 8)
+	if _, err := rand.Read(serial); err != nil {
+		return nil, fmt.Errorf("failed to generate serial: %v", err)
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial),
+		CertType:        certType,
+		KeyId:           keyID,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-clockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+		Permissions:     ssh.Permissions{Extensions: extensions},
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		return nil, fmt.Errorf("failed to sign key: %v", err)
+	}
+	return cert, nil
+}
+
+// CheckUserCertificate checks that cert is a valid user certificate of the certificate authority ca for principal
+func CheckUserCertificate(ca ssh.PublicKey, cert *ssh.Certificate, principal string) error {
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool { return keyString(auth) == keyString(ca) },
+	}
+	if cert.CertType != ssh.UserCert {
+		return fmt.Errorf("not a user certificate")
+	}
+	if !checker.IsUserAuthority(cert.SignatureKey) {
+		return fmt.Errorf("certificate %q not signed by the user certificate authority", cert.KeyId)
+	}
+	return checker.CheckCert(principal, cert)
+}
+
+// writeCertificate writes the certificate returned by the relay for the private key at privateKeyPath
+func writeCertificate(privateKeyPath string, response []byte) error {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(response)
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %v", err)
+	}
+	cert, ok := publicKey.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("relay returned a %s key instead of a certificate", publicKey.Type())
+	}
+	slog.Debug(fmt.Sprintf("Writing certificate %q valid until %s", cert.KeyId, time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339)))
+	return system.Files().WriteFile(CertificatePath(privateKeyPath), ssh.MarshalAuthorizedKey(cert), 0644)
+}
+
+// signer returns the signer of the private key at keyPath, with its certificate if there is one
+func signer(keyPath string) (ssh.Signer, error) {
+	key, err := system.Files().ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	certPublicKey, err := ReadPublicKey(CertificatePath(keyPath))
+	if os.IsNotExist(err) {
+		return signer, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := certPublicKey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", CertificatePath(keyPath))
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
@@ -0,0 +1,50 @@
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/secret"
+	"golang.org/x/crypto/ssh"
+)
+
+// promptAnswer asks question on the terminal, it returns an empty answer without terminal
+func promptAnswer(question string) (secret.Secret, error) {
+	return secret.Read(secret.Source{Prompt: question})
+}
+
+// TerminalChallenge answers keyboard-interactive questions for the password with password, if it is set,
+// and asks all others, like a verification code, on the terminal
+func TerminalChallenge(password secret.Secret) ssh.KeyboardInteractiveChallenge {
+	return passwordChallenge(password, promptAnswer)
+}
+
+// passwordChallenge answers password questions with password and asks others with prompt, without prompt they fail
+func passwordChallenge(password secret.Secret, prompt func(question string) (secret.Secret, error)) ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		if instruction != "" && prompt != nil {
+			fmt.Fprintln(os.Stderr, instruction)
+		}
+		answers := make([]string, len(questions))
+		for i, question := range questions {
+			question = strings.TrimSuffix(strings.TrimSpace(question), ":")
+			if !password.Empty() && strings.Contains(strings.ToLower(question), "password") {
+				answers[i] = string(password)
+				continue
+			}
+			if prompt == nil {
+				return nil, fmt.Errorf("keyboard-interactive question %q needs a terminal", question)
+			}
+			answer, err := prompt(question)
+			if err != nil {
+				return nil, err
+			}
+			if answer.Empty() {
+				return nil, fmt.Errorf("no answer to keyboard-interactive question %q, it needs a terminal", question)
+			}
+			answers[i] = string(answer)
+		}
+		return answers, nil
+	}
+}
@@ -1,15 +1,20 @@
 package ssh
 
 import (
+	"fmt"
 	"log/slog"
 	"os"
 	"regexp"
+	"strings"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
 )
 
-// ConfigureTunnel configures an SSH tunnel in the ssh config file
-func ConfigureTunnel(sshConfigPath, hostIdentifier, hostName, user, identityFile, localHost string, localPort, remotePort int) error {
+// ConfigureTunnel configures an SSH tunnel in the ssh config file, through the jump hosts of SetJumpHosts if there are any
+// port is the port of sshd on hostName, proxyCommand, if set, connects to the host, e.g. through a proxy
+func ConfigureTunnel(sshConfigPath, hostIdentifier, hostName string, port int, user, identityFile, localHost string, localPort, remotePort int, proxyCommand string) error {
 	slog.Debug("Configuring tunnel")
-	sshConfig, err := os.ReadFile(sshConfigPath)
+	sshConfig, err := system.Files().ReadFile(sshConfigPath)
 	if err != nil {
 		return err
 	}
@@ -22,13 +27,22 @@ func ConfigureTunnel(sshConfigPath, hostIdentifier, hostName, user, identityFile
 	slog.Debug("Adding host configuration")
 	hostConfig := []byte("\nHost " + hostIdentifier + "\n")
 	hostConfig = append(hostConfig, []byte("    HostName "+hostName+"\n")...)
+	if port != 22 {
+		hostConfig = append(hostConfig, []byte(fmt.Sprintf("    Port %d\n", port))...)
+	}
 	hostConfig = append(hostConfig, []byte("    User "+user+"\n")...)
 	hostConfig = append(hostConfig, []byte("    IdentityFile "+identityFile+"\n")...)
-	hostConfig = append(hostConfig, []byte("    RemoteForward "+localHost+":"+string(localPort)+" localhost:"+string(remotePort)+"\n")...)
+	hostConfig = append(hostConfig, []byte(fmt.Sprintf("    RemoteForward %d %s:%d\n", remotePort, localHost, localPort))...)
+	if hosts := JumpHosts(); len(hosts) > 0 {
+		hostConfig = append(hostConfig, []byte("    ProxyJump "+ProxyJump(hosts, user)+"\n")...)
+	}
+	if proxyCommand != "" {
+		hostConfig = append(hostConfig, []byte("    ProxyCommand "+proxyCommand+"\n")...)
+	}
 	sshConfig = append(sshConfig, hostConfig...)
 
 	slog.Debug("Writing ssh config")
-	err = os.WriteFile(sshConfigPath, sshConfig, 0644)
+	err = system.Files().WriteFile(sshConfigPath, sshConfig, 0644)
 	if err != nil {
 		return err
 	}
@@ -36,7 +50,116 @@ func ConfigureTunnel(sshConfigPath, hostIdentifier, hostName, user, identityFile
 	return nil
 }
 
+// TunnelConfigured checks if the ssh config file already contains a Host block for hostIdentifier
+func TunnelConfigured(sshConfigPath, hostIdentifier string) (bool, error) {
+	sshConfig, err := system.Files().ReadFile(sshConfigPath)
+	if err != nil {
+		return false, err
+	}
+	return hostConfigured(sshConfig, hostIdentifier), nil
+}
+
+// RemoveTunnelConfiguration removes the Host block for hostIdentifier from the ssh config file
+func RemoveTunnelConfiguration(sshConfigPath, hostIdentifier string) error {
+	slog.Debug("Removing tunnel configuration")
+	sshConfig, err := system.Files().ReadFile(sshConfigPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !hostConfigured(sshConfig, hostIdentifier) {
+		slog.Debug("Host is not configured")
+		return nil
+	}
+
+	slog.Debug("Removing host configuration")
+	sshConfig = removeHostBlock(sshConfig, hostIdentifier)
+
+	slog.Debug("Writing ssh config")
+	return system.Files().WriteFile(sshConfigPath, sshConfig, 0644)
+}
+
 func hostConfigured(sshConfig []byte, hostIdentifier string) bool {
-	hostPattern := `(?m)^\s*Host\s+` + hostIdentifier + `\s*$`
+	hostPattern := `(?m)^\s*Host\s+` + regexp.QuoteMeta(hostIdentifier) + `\s*$`
 	return regexp.MustCompile(hostPattern).Match(sshConfig)
 }
+
+// removeHostBlock removes the Host line for hostIdentifier and all following lines
+// up to the next Host or Match line, including the blank line ConfigureTunnel adds in front of it
+func removeHostBlock(sshConfig []byte, hostIdentifier string) []byte {
+	hostPattern := regexp.MustCompile(`^\s*Host\s+` + regexp.QuoteMeta(hostIdentifier) + `\s*$`)
+	blockPattern := regexp.MustCompile(`^\s*(Host|Match)\s`)
+
+	lines := strings.SplitAfter(string(sshConfig), "\n")
+	start := -1
+	end := len(lines)
+	for i, line := range lines {
+		if start == -1 {
+			if hostPattern.MatchString(strings.TrimRight(line, "\n")) {
+				start = i
+			}
+			continue
+		}
+		if blockPattern.MatchString(line) {
+			end = i
+			break
+		}
+	}
+	if start == -1 {
+		return sshConfig
+	}
+	if start > 0 && strings.TrimSpace(lines[start-1]) == "" {
+		start--
+	}
+	return []byte(strings.Join(append(lines[:start:start], lines[end:]...), ""))
+}
+
+// knownHostCAPattern matches the @cert-authority line for hostPatterns in a known_hosts file
+func knownHostCAPattern(hostPatterns string) *regexp.Regexp {
+	return regexp.MustCompile(`(?m)^@cert-authority\s+` + regexp.QuoteMeta(hostPatterns) + `\s.*\n?`)
+}
+
+// KnownHostPatterns returns the known_hosts host patterns of hostName on any port
+func KnownHostPatterns(hostName string) string {
+	return fmt.Sprintf("%s,[%s]:*", hostName, hostName)
+}
+
+// TrustHostCA replaces the @cert-authority line for hostPatterns in the known_hosts file with the certificate authority ca
+func TrustHostCA(knownHostsPath, hostPatterns, ca string) error {
+	slog.Debug(fmt.Sprintf("Trusting host certificate authority for %s", hostPatterns))
+	knownHosts, err := system.Files().ReadFile(knownHostsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	knownHosts = knownHostCAPattern(hostPatterns).ReplaceAll(knownHosts, nil)
+	if len(knownHosts) > 0 && !strings.HasSuffix(string(knownHosts), "\n") {
+		knownHosts = append(knownHosts, '\n')
+	}
+	knownHosts = append(knownHosts, fmt.Sprintf("@cert-authority %s %s\n", hostPatterns, strings.TrimSpace(ca))...)
+	return system.Files().WriteFile(knownHostsPath, knownHosts, 0644)
+}
+
+// HostCATrusted checks if the known_hosts file trusts the certificate authority ca for hostPatterns
+func HostCATrusted(knownHostsPath, hostPatterns, ca string) bool {
+	knownHosts, err := system.Files().ReadFile(knownHostsPath)
+	if err != nil {
+		return false
+	}
+	line := knownHostCAPattern(hostPatterns).Find(knownHosts)
+	return strings.TrimSpace(string(line)) == fmt.Sprintf("@cert-authority %s %s", hostPatterns, strings.TrimSpace(ca))
+}
+
+// RemoveHostCA removes the @cert-authority line for hostPatterns from the known_hosts file
+func RemoveHostCA(knownHostsPath, hostPatterns string) error {
+	knownHosts, err := system.Files().ReadFile(knownHostsPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return system.Files().WriteFile(knownHostsPath, knownHostCAPattern(hostPatterns).ReplaceAll(knownHosts, nil), 0644)
+}
@@ -3,18 +3,97 @@ package ssh
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
-// DiscoverRemote discovers if a remote host is reachable on the provided port
+// DiscoverRemote discovers if a remote host is reachable on the provided port, through the proxy if there is one
 func DiscoverRemote(host string, port int) bool {
-	address := fmt.Sprintf("%s:%d", host, port)
+	return discoverAddress(net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// DiscoverRelay checks if the relay is reachable on the provided port, or the gateway or the first jump host if it is reached through them
+func DiscoverRelay(host string, port int) error {
+	if u, _ := Gateway(); u != nil {
+		if !discoverAddress(u.Host) {
+			return fmt.Errorf("gateway %s is not reachable", u.Host)
+		}
+		return nil
+	}
+	if hosts := JumpHosts(); len(hosts) > 0 {
+		// the relay itself is only reachable through the jump hosts
+		if !discoverAddress(hosts[0].Address) {
+			return fmt.Errorf("jump host %s is not reachable", hosts[0].Address)
+		}
+		return nil
+	}
+	if !DiscoverRemote(host, port) {
+		return fmt.Errorf("relay %s:%d is not reachable", host, port)
+	}
+	return nil
+}
+
+func discoverAddress(address string) bool {
 	timeout := 5 * time.Second
 
-	conn, err := net.DialTimeout("tcp", address, timeout)
+	conn, err := dialTCP(address, timeout)
 	if err != nil {
 		return false
 	}
 	defer conn.Close()
 	return true
 }
+
+// FirstHop returns the address of the first host connected to for the relay, the gateway, the first jump host or the relay itself
+func FirstHop(host string, port int) string {
+	if u, _ := Gateway(); u != nil {
+		return u.Host
+	}
+	if hosts := JumpHosts(); len(hosts) > 0 {
+		return hosts[0].Address
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// CheckHostKey reads the host key of the relay without logging in and checks it against trustedHostKey
+// The host key is returned in authorized_keys format, also if it is not trusted
+func CheckHostKey(host string, port int, trustedHostKey string) (string, error) {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	timeout := 10 * time.Second
+	conn, err := dialFirst(address, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	verify := trustedHostKeyCallback(trustedHostKey)
+	var hostKey string
+	var hostKeyErr error
+	config := &ssh.ClientConfig{
+		User: "ssh-tunnel-setup",
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = keyString(key)
+			if strings.TrimSpace(trustedHostKey) == "" {
+				// unlike a login, nothing is trusted without trusted host key
+				hostKeyErr = fmt.Errorf("no trusted host key")
+			} else {
+				hostKeyErr = verify(hostname, remote, key)
+			}
+			return hostKeyErr
+		},
+		Timeout: timeout,
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	// without authentication methods the handshake ends after the host key is checked
+	c, _, _, err := ssh.NewClientConn(conn, address, config)
+	if c != nil {
+		c.Close()
+	}
+	if hostKey == "" {
+		return "", fmt.Errorf("failed to read host key of %s: %v", address, err)
+	}
+	return hostKey, hostKeyErr
+}
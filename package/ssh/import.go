@@ -0,0 +1,124 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/dsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+	"golang.org/x/crypto/ssh"
+)
+
+// minRSABits is the smallest RSA key that is imported
+const minRSABits = 2048
+
+// generatedKeyTypes maps key algorithms to the key types generateKey supports
+var generatedKeyTypes = map[string]string{
+	ssh.KeyAlgoRSA:     KeyTypeRSA,
+	ssh.KeyAlgoED25519: KeyTypeEd25519,
+}
+
+// KeyFileExists checks if any file of the key pair at privateKeyPath, including its certificate, exists
+func KeyFileExists(privateKeyPath string) bool {
+	for _, path := range keyFiles(privateKeyPath) {
+		if exists(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportKeyPair validates the private key at sourcePath, in the OpenSSH or a PEM format, and adopts it as the key pair at privateKeyPath
+// The public key is read from sourcePath.pub if there is one, otherwise it is derived with userReference as comment, a certificate is copied along
+func ImportKeyPair(sourcePath, privateKeyPath, userReference string) error {
+	slog.Debug(fmt.Sprintf("Importing key pair %s", sourcePath))
+	privateKey, err := system.Files().ReadFile(sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to read key to import: %v", err)
+	}
+	rawKey, err := ssh.ParseRawPrivateKey(privateKey)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return fmt.Errorf("key %s is encrypted, the tunnel can not unlock it, remove the passphrase with ssh-keygen -p", sourcePath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse key %s: %v", sourcePath, err)
+	}
+	switch key := rawKey.(type) {
+	case *dsa.PrivateKey:
+		return fmt.Errorf("key %s is a DSA key, DSA is not supported", sourcePath)
+	case *rsa.PrivateKey:
+		if bits := key.N.BitLen(); bits < minRSABits {
+			return fmt.Errorf("key %s is a %d bit RSA key, at least %d bits are required", sourcePath, bits, minRSABits)
+		}
+	}
+	signer, err := ssh.NewSignerFromKey(rawKey)
+	if err != nil {
+		return fmt.Errorf("failed to parse key %s: %v", sourcePath, err)
+	}
+	publicKey := signer.PublicKey()
+
+	comment := userReference
+	data, err := system.Files().ReadFile(sourcePath + ".pub")
+	switch {
+	case err == nil:
+		sourcePublicKey, sourceComment, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return fmt.Errorf("failed to parse public key %s.pub: %v", sourcePath, err)
+		}
+		if !bytes.Equal(sourcePublicKey.Marshal(), publicKey.Marshal()) {
+			return fmt.Errorf("public key %s.pub does not belong to %s", sourcePath, sourcePath)
+		}
+		if sourceComment != "" {
+			comment = sourceComment
+		}
+	case !os.IsNotExist(err):
+		return fmt.Errorf("failed to read public key %s.pub: %v", sourcePath, err)
+	}
+
+	// a key adopted in place is left as it is
+	inPlace := filepath.Clean(sourcePath) == filepath.Clean(privateKeyPath)
+	if !inPlace {
+		slog.Debug(fmt.Sprintf("Copying private key to %s", privateKeyPath))
+		if err := system.Files().WriteFile(privateKeyPath, privateKey, 0600); err != nil {
+			return err
+		}
+		if err := system.Files().Chmod(privateKeyPath, 0600); err != nil {
+			return err
+		}
+		if CertificateExists(sourcePath) {
+			certificate, err := system.Files().ReadFile(CertificatePath(sourcePath))
+			if err != nil {
+				return err
+			}
+			if err := system.Files().WriteFile(CertificatePath(privateKeyPath), certificate, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	if !inPlace || !exists(privateKeyPath+".pub") {
+		slog.Debug("Writing public key")
+		pubKeyStr := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey)))
+		pubKeyWithComment := strings.TrimSpace(fmt.Sprintf("%s %s", pubKeyStr, comment))
+		if err := system.Files().WriteFile(privateKeyPath+".pub", []byte(pubKeyWithComment), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeyPairType returns the key type rotations of the key pair at privateKeyPath generate, see KeyTypeRSA and KeyTypeEd25519
+// It is empty if the public key can not be read or rotations can not generate keys of its algorithm
+func KeyPairType(privateKeyPath string) string {
+	publicKey, err := ReadPublicKey(privateKeyPath + ".pub")
+	if err != nil {
+		return ""
+	}
+	return generatedKeyTypes[publicKey.Type()]
+}
@@ -0,0 +1,119 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyInfo describes a key pair on disk
+type KeyInfo struct {
+	Path    string
+	Type    string
+	Bits    int
+	Comment string
+	SHA256  string
+	MD5     string
+	// PrivateMode and PublicMode are the permissions of the key files
+	PrivateMode os.FileMode
+	PublicMode  os.FileMode
+	// Modified is the modification time of the private key, it is zero if the filesystem does not track it
+	Modified time.Time
+	// Match is set if the private key belongs to the public key
+	Match bool
+	// Certificate is the certificate of the key pair, if there is one
+	Certificate *ssh.Certificate
+}
+
+// InspectKeyPair reads the key pair at privateKeyPath and checks that its private and public key match
+func InspectKeyPair(privateKeyPath string) (KeyInfo, error) {
+	info := KeyInfo{Path: privateKeyPath}
+	data, err := system.Files().ReadFile(privateKeyPath + ".pub")
+	if err != nil {
+		return info, fmt.Errorf("failed to read public key: %v", err)
+	}
+	publicKey, comment, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return info, fmt.Errorf("failed to parse public key: %v", err)
+	}
+	info.Type = publicKey.Type()
+	info.Bits = keyBits(publicKey)
+	info.Comment = comment
+	info.SHA256 = ssh.FingerprintSHA256(publicKey)
+	info.MD5 = "MD5:" + ssh.FingerprintLegacyMD5(publicKey)
+
+	privateKey, err := system.Files().ReadFile(privateKeyPath)
+	if err != nil {
+		return info, fmt.Errorf("failed to read private key: %v", err)
+	}
+	var privatePublicKey ssh.PublicKey
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	var missing *ssh.PassphraseMissingError
+	switch {
+	case err == nil:
+		privatePublicKey = signer.PublicKey()
+	case errors.As(err, &missing) && missing.PublicKey != nil:
+		// encrypted keys in the OpenSSH format carry their public key
+		privatePublicKey = missing.PublicKey
+	default:
+		return info, fmt.Errorf("failed to parse private key: %v", err)
+	}
+	info.Match = bytes.Equal(privatePublicKey.Marshal(), publicKey.Marshal())
+
+	privateStat, err := system.Files().Stat(privateKeyPath)
+	if err != nil {
+		return info, err
+	}
+	info.PrivateMode = privateStat.Mode().Perm()
+	info.Modified = privateStat.ModTime()
+	publicStat, err := system.Files().Stat(privateKeyPath + ".pub")
+	if err != nil {
+		return info, err
+	}
+	info.PublicMode = publicStat.Mode().Perm()
+
+	if CertificateExists(privateKeyPath) {
+		certificate, err := ReadPublicKey(CertificatePath(privateKeyPath))
+		if err != nil {
+			return info, err
+		}
+		cert, ok := certificate.(*ssh.Certificate)
+		if !ok {
+			return info, fmt.Errorf("%s is not a certificate", CertificatePath(privateKeyPath))
+		}
+		info.Certificate = cert
+	}
+	return info, nil
+}
+
+// keyBits returns the size of publicKey in bits
+func keyBits(publicKey ssh.PublicKey) int {
+	if cryptoKey, ok := publicKey.(ssh.CryptoPublicKey); ok {
+		if rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey); ok {
+			return rsaKey.N.BitLen()
+		}
+	}
+	switch publicKey.Type() {
+	case ssh.KeyAlgoED25519:
+		return 256
+	case ssh.KeyAlgoECDSA256:
+		return 256
+	case ssh.KeyAlgoECDSA384:
+		return 384
+	case ssh.KeyAlgoECDSA521:
+		return 521
+	}
+	return 0
+}
+
+// CheckAuthorized checks that the key pair at privateKeyPath logs in as remoteUser on remote
+// It is authorized by the authorized_keys of remoteUser or, with a certificate, by a certificate authority the remote trusts
+func CheckAuthorized(privateKeyPath, remote, remoteUser, trustedHostKey string) error {
+	return NewRemoteAuth(remoteUser, nil, privateKeyPath, trustedHostKey).test(remote)
+}
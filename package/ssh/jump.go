@@ -0,0 +1,196 @@
+package ssh
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultPort is the port of jump hosts without port
+const defaultPort = "22"
+
+// JumpHost is a host the relay is reached through, like an entry of ssh's ProxyJump
+type JumpHost struct {
+	// User logs in to the jump host, the user of the connection if it is empty
+	User string
+	// Address is the host and port of the jump host
+	Address string
+}
+
+// ParseJumpHost parses a jump host in the format [user@]host[:port] of ssh's ProxyJump
+func ParseJumpHost(spec string) (JumpHost, error) {
+	spec = strings.TrimSpace(spec)
+	user, hostPort, found := strings.Cut(spec, "@")
+	if !found {
+		user, hostPort = "", spec
+	}
+	host, port := hostPort, defaultPort
+	if h, p, err := net.SplitHostPort(hostPort); err == nil {
+		host, port = h, p
+	} else if strings.HasPrefix(hostPort, "[") && strings.HasSuffix(hostPort, "]") {
+		host = strings.Trim(hostPort, "[]")
+	}
+	if host == "" || strings.ContainsAny(host, " /@") || (found && user == "") {
+		return JumpHost{}, fmt.Errorf("invalid jump host %q, expected [user@]host[:port]", spec)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return JumpHost{}, fmt.Errorf("invalid port of jump host %q", spec)
+	}
+	return JumpHost{User: user, Address: net.JoinHostPort(host, port)}, nil
+}
+
+// ParseJumpHosts parses the jump hosts of a chain, the first one is connected to first
+func ParseJumpHosts(specs []string) ([]JumpHost, error) {
+	hosts := make([]JumpHost, 0, len(specs))
+	for _, spec := range specs {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		host, err := ParseJumpHost(spec)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// ProxyJump returns hosts in the format of ssh's ProxyJump and -J, jump hosts without user log in as user
+func ProxyJump(hosts []JumpHost, user string) string {
+	entries := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		hostUser := host.User
+		if hostUser == "" {
+			hostUser = user
+		}
+		address := host.Address
+		if h, port, err := net.SplitHostPort(address); err == nil && port == defaultPort && !strings.Contains(h, ":") {
+			address = h
+		}
+		entries = append(entries, hostUser+"@"+address)
+	}
+	return strings.Join(entries, ",")
+}
+
+var (
+	jumpMu sync.Mutex
+	// jumpHosts is the chain every remote operation reaches the relay through
+	jumpHosts []JumpHost
+	// jumpHostKey are the host keys the jump hosts are trusted by, in the format of trusted-host-key
+	jumpHostKey string
+)
+
+// SetJumpHosts makes all remote operations reach the relay through hosts, the jump hosts are trusted by trustedHostKey
+func SetJumpHosts(hosts []JumpHost, trustedHostKey string) {
+	jumpMu.Lock()
+	defer jumpMu.Unlock()
+	jumpHosts = hosts
+	jumpHostKey = trustedHostKey
+}
+
+// JumpHosts returns the chain the relay is reached through, it is empty if the relay is reached directly
+func JumpHosts() []JumpHost {
+	jumpMu.Lock()
+	defer jumpMu.Unlock()
+	return jumpHosts
+}
+
+// dialChain connects to remote through the jump hosts, authenticated with config on remote
+// The jump hosts are logged in to with the keys of auth and of the ssh-agent only, see jumpAuth
+func dialChain(remote string, auth RemoteAuth, config *ssh.ClientConfig) (*ssh.Client, error) {
+	jumpMu.Lock()
+	hosts, trustedHostKey := jumpHosts, jumpHostKey
+	jumpMu.Unlock()
+	if len(hosts) > 0 && strings.TrimSpace(trustedHostKey) == "" {
+		return nil, fmt.Errorf("no trusted-jump-host-key, refusing to connect through jump hosts whose host keys are not checked")
+	}
+
+	agentKeys := &onceSigners{provider: &AgentSigners{}}
+	defer agentKeys.Close()
+	var jump *ssh.Client
+	for _, host := range hosts {
+		slog.Debug(fmt.Sprintf("Connecting to jump host %s", host.Address))
+		hopConfig := &ssh.ClientConfig{
+			User:            config.User,
+			Auth:            []ssh.AuthMethod{jumpAuth(auth, agentKeys)},
+			HostKeyCallback: trustedHostKeyCallback(trustedHostKey),
+			Timeout:         config.Timeout,
+		}
+		if host.User != "" {
+			hopConfig.User = host.User
+		}
+		client, err := dialVia(jump, host.Address, hopConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to jump host %s: %v", host.Address, err)
+		}
+		jump = client
+	}
+	return dialVia(jump, remote, config)
+}
+
+// jumpAuth authenticates with the key of auth and the keys of agentKeys, the ssh-agent of SSH_AUTH_SOCK
+// The jump hosts are never sent the password or the keyboard-interactive answers of the relay
+func jumpAuth(auth RemoteAuth, agentKeys SignerProvider) ssh.AuthMethod {
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		var signers []ssh.Signer
+		if provider := auth.Provider(); provider != nil {
+			keys, err := provider.Signers()
+			if err != nil {
+				slog.Debug(fmt.Sprintf("Key %s not used for the jump host: %v", auth.KeyPath, err))
+			}
+			signers = append(signers, keys...)
+		}
+		if os.Getenv("SSH_AUTH_SOCK") != "" {
+			keys, err := agentKeys.Signers()
+			if err != nil {
+				slog.Debug(fmt.Sprintf("ssh-agent not used for the jump host: %v", err))
+			}
+			signers = append(signers, keys...)
+		}
+		if len(signers) == 0 {
+			return nil, fmt.Errorf("no key or ssh-agent to log in to the jump host with, jump hosts are not sent the password")
+		}
+		return signers, nil
+	})
+}
+
+// dialVia connects to address through the connection to jump, see dialFirst without jump
+// jump is closed with the returned connection or if it fails
+func dialVia(jump *ssh.Client, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if jump == nil {
+		// the first host is connected to through the gateway and the proxy, if there are any
+		conn, err := dialFirst(address, config.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		c, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return ssh.NewClient(c, chans, reqs), nil
+	}
+	conn, err := jump.Dial("tcp", address)
+	if err != nil {
+		jump.Close()
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		jump.Close()
+		return nil, err
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	go func() {
+		client.Wait()
+		jump.Close()
+	}()
+	return client, nil
+}
@@ -1,6 +1,8 @@
 package ssh
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -12,51 +14,92 @@ import (
 	"os"
 	"strings"
 
+	"github.com/fbufler/ssh-tunnel-setup/package/secret"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
 	"golang.org/x/crypto/ssh"
 )
 
 const keySize = 4096
 const newSuffix = ".new"
 
-// MakeKeyPair generates a new RSA key pair and writes the public key to pubKeyPath and the private key to privateKeyPath
-func MakeKeyPair(keyPath, keyName, userReference string) error {
-	slog.Debug("Generating key pair")
+const (
+	// KeyTypeRSA generates 4096 bit RSA keys, it is used if no key type is set
+	KeyTypeRSA = "rsa"
+	// KeyTypeEd25519 generates Ed25519 keys
+	KeyTypeEd25519 = "ed25519"
+)
+
+// generateKey generates a private key of keyType and returns it PEM encoded together with its public key
+func generateKey(keyType string) ([]byte, ssh.PublicKey, error) {
+	switch keyType {
+	case "", KeyTypeRSA:
+		privateKey, err := rsa.GenerateKey(rand.Reader, keySize)
+		if err != nil {
+			return nil, nil, err
+		}
+		pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		privateKeyPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
+		return pem.EncodeToMemory(privateKeyPEM), pub, nil
+	case KeyTypeEd25519:
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		pub, err := ssh.NewPublicKey(publicKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		privateKeyPEM, err := ssh.MarshalPrivateKey(privateKey, "")
+		if err != nil {
+			return nil, nil, err
+		}
+		return pem.EncodeToMemory(privateKeyPEM), pub, nil
+	}
+	return nil, nil, fmt.Errorf("unknown key type %q, expected %s or %s", keyType, KeyTypeRSA, KeyTypeEd25519)
+}
+
+// MakeKeyPair generates a new key pair of keyType and writes the public key to pubKeyPath and the private key to privateKeyPath
+func MakeKeyPair(keyPath, keyName, userReference, keyType string) error {
+	slog.Debug(fmt.Sprintf("Generating %s key pair", keyType))
 	pubKeyPath := fmt.Sprintf("%s/%s.pub", keyPath, keyName)
 	privateKeyPath := fmt.Sprintf("%s/%s", keyPath, keyName)
-	privateKey, err := rsa.GenerateKey(rand.Reader, keySize)
+	privateKeyPEM, pub, err := generateKey(keyType)
 	if err != nil {
 		return err
 	}
-	slog.Debug("Generating and writing private key as PEM")
-	privateKeyFile, err := os.Create(privateKeyPath)
+	slog.Debug("Writing private key as PEM")
+	err = system.Files().WriteFile(privateKeyPath, privateKeyPEM, 0600)
 	if err != nil {
-		privateKeyFile.Close()
 		return err
 	}
-	privateKeyPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
-	if err := pem.Encode(privateKeyFile, privateKeyPEM); err != nil {
-		return err
-	}
-	privateKeyFile.Close()
-	err = os.Chmod(privateKeyPath, 0600)
+	err = system.Files().Chmod(privateKeyPath, 0600)
 	if err != nil {
 		return err
 	}
 
-	slog.Debug("Generating and writing public key")
-	pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
-	if err != nil {
-		return err
-	}
+	slog.Debug("Writing public key")
 	pubKeyStr := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
 	pubKeyWithComment := fmt.Sprintf("%s %s", pubKeyStr, userReference)
-	return os.WriteFile(pubKeyPath, []byte(pubKeyWithComment), 0644)
+	return system.Files().WriteFile(pubKeyPath, []byte(pubKeyWithComment), 0644)
+}
+
+// KeyPairExists checks if both the private key at privateKeyPath and its public key exist
+func KeyPairExists(privateKeyPath string) bool {
+	for _, path := range []string{privateKeyPath, fmt.Sprintf("%s.pub", privateKeyPath)} {
+		if _, err := system.Files().Stat(path); err != nil {
+			return false
+		}
+	}
+	return true
 }
 
 func PrepareKeyDirectory(keyPath string) error {
-	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+	if _, err := system.Files().Stat(keyPath); os.IsNotExist(err) {
 		slog.Debug(fmt.Sprintf("Creating directory: %s", keyPath))
-		err := os.MkdirAll(keyPath, 0755)
+		err := system.Files().MkdirAll(keyPath, 0755)
 		if err != nil {
 			return err
 		}
@@ -64,14 +107,28 @@ func PrepareKeyDirectory(keyPath string) error {
 	return nil
 }
 
+// The authentication methods of RemoteAuth.Methods, named like in sshd's AuthenticationMethods
+const (
+	MethodPublicKey           = "publickey"
+	MethodPassword            = "password"
+	MethodKeyboardInteractive = "keyboard-interactive"
+)
+
 type RemoteAuth struct {
-	User           string
-	Password       string
-	KeyPath        string
+	User     string
+	Password secret.Secret
+	KeyPath  string
+	// Signers provides the keys to authenticate with instead of the key file KeyPath
+	Signers SignerProvider
+	// Challenge answers keyboard-interactive questions, see TerminalChallenge
+	Challenge ssh.KeyboardInteractiveChallenge
+	// Methods are the authentication methods tried in order, a server requiring several methods gets all of them
+	// If it is empty every method the credentials allow is tried, the key first
+	Methods        []string
 	TrustedHostKey string
 }
 
-func NewRemoteAuth(user, password, keyPath, trustedHostKey string) RemoteAuth {
+func NewRemoteAuth(user string, password secret.Secret, keyPath, trustedHostKey string) RemoteAuth {
 	return RemoteAuth{
 		User:           user,
 		Password:       password,
@@ -80,70 +137,117 @@ func NewRemoteAuth(user, password, keyPath, trustedHostKey string) RemoteAuth {
 	}
 }
 
-// authMethods returns a slice of ssh.AuthMethod based on the provided RemoteAuth
-// KeyPath is preferred over Password
-func (ra RemoteAuth) authMethods() ([]ssh.AuthMethod, error) {
+// Provider returns the provider of the keys of ra, the one registered for KeyPath unless Signers is set
+// It is nil without key
+func (ra RemoteAuth) Provider() SignerProvider {
+	if ra.Signers != nil {
+		return ra.Signers
+	}
 	if ra.KeyPath != "" {
-		key, err := os.ReadFile(ra.KeyPath)
-		if err != nil {
-			return nil, err
-		}
-		signer, err := ssh.ParsePrivateKey(key)
-		if err != nil {
-			return nil, err
-		}
-		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil
+		return signersOf(ra.KeyPath)
+	}
+	return nil
+}
+
+// methods returns Methods or, if it is empty, the methods the credentials of ra allow
+func (ra RemoteAuth) methods() []string {
+	if len(ra.Methods) > 0 {
+		return ra.Methods
+	}
+	var methods []string
+	if ra.Provider() != nil {
+		methods = append(methods, MethodPublicKey)
 	}
-	if ra.Password != "" {
-		return []ssh.AuthMethod{ssh.Password(ra.Password)}, nil
+	if !ra.Password.Empty() {
+		methods = append(methods, MethodPassword)
 	}
-	return nil, fmt.Errorf("no password or key provided")
+	if ra.Challenge != nil {
+		methods = append(methods, MethodKeyboardInteractive)
+	}
+	return methods
 }
 
-func (ra RemoteAuth) test(remote string) error {
-	slog.Debug("Testing remote authentication")
-	authMethods, err := ra.authMethods()
-	if err != nil {
-		return err
+// authMethods returns the ssh.AuthMethod of each method of ra in order, the certificate of the key is used if there is one
+// The provider of the keys has to be closed once the connection is authenticated
+func (ra RemoteAuth) authMethods() ([]ssh.AuthMethod, error) {
+	var authMethods []ssh.AuthMethod
+	for _, method := range ra.methods() {
+		switch method {
+		case MethodPublicKey:
+			provider := ra.Provider()
+			if provider == nil {
+				return nil, fmt.Errorf("no key provided for %s authentication", method)
+			}
+			signers, err := provider.Signers()
+			if err != nil {
+				return nil, err
+			}
+			authMethods = append(authMethods, ssh.PublicKeys(signers...))
+		case MethodPassword:
+			if ra.Password.Empty() {
+				return nil, fmt.Errorf("no password provided for %s authentication", method)
+			}
+			// the string is only created when the server asks for the password
+			authMethods = append(authMethods, ssh.PasswordCallback(func() (string, error) {
+				return string(ra.Password), nil
+			}))
+		case MethodKeyboardInteractive:
+			challenge := ra.Challenge
+			if challenge == nil {
+				// without a terminal only password questions are answered
+				challenge = passwordChallenge(ra.Password, nil)
+			}
+			authMethods = append(authMethods, ssh.KeyboardInteractive(challenge))
+		default:
+			return nil, fmt.Errorf("unknown authentication method %q", method)
+		}
 	}
-	client, err := ssh.Dial("tcp", remote, &ssh.ClientConfig{
-		User:            ra.User,
-		Auth:            authMethods,
-		HostKeyCallback: trustedHostKeyCallback(ra.TrustedHostKey),
-	})
-	if err != nil {
-		return err
+	if len(authMethods) == 0 {
+		return nil, fmt.Errorf("no password or key provided")
 	}
-	defer client.Close()
-	return nil
+	return authMethods, nil
+}
+
+func (ra RemoteAuth) test(remote string) error {
+	return remoteRunner.Test(remote, ra)
 }
 
 // AuthorizePublicKeyOnRemote appends the public key at pubKeyPath to the remote's authorized_keys file
 func AuthorizePublicKeyOnRemote(privateKeyPath, remote, remoteUser string, ra RemoteAuth) error {
 	slog.Debug("Authorizing public key on remote")
-	publicKey, err := os.ReadFile(fmt.Sprintf("%s.pub", privateKeyPath))
+	publicKey, err := system.Files().ReadFile(fmt.Sprintf("%s.pub", privateKeyPath))
 	if err != nil {
 		return err
 	}
-	authMethods, err := ra.authMethods()
+	command := fmt.Sprintf(`echo "%s" >> /home/%s/.ssh/authorized_keys`, string(publicKey), remoteUser)
+	return authorizeOnRemote(privateKeyPath, remote, remoteUser, ra, command)
+}
+
+// authorizePublicKeyLike authorizes the public key at privateKeyPath.pub with the options and comment of the
+// authorized_keys line of the key at oldKeyPath.pub, so the restrictions of e.g. an enrolled key are kept
+// Without a line of the old key, the public key is appended like AuthorizePublicKeyOnRemote does
+func authorizePublicKeyLike(privateKeyPath, oldKeyPath, remote, remoteUser string, ra RemoteAuth) error {
+	slog.Debug("Authorizing public key on remote like the old key")
+	line, err := system.Files().ReadFile(fmt.Sprintf("%s.pub", privateKeyPath))
 	if err != nil {
 		return err
 	}
-	client, err := ssh.Dial("tcp", remote, &ssh.ClientConfig{
-		User:            ra.User,
-		Auth:            authMethods,
-		HostKeyCallback: trustedHostKeyCallback(ra.TrustedHostKey),
-	})
+	publicKey, err := ReadPublicKey(fmt.Sprintf("%s.pub", privateKeyPath))
 	if err != nil {
 		return err
 	}
-	session, err := client.NewSession()
+	oldKey, err := ReadPublicKey(fmt.Sprintf("%s.pub", oldKeyPath))
 	if err != nil {
 		return err
 	}
-	defer session.Close()
-	command := fmt.Sprintf(`echo "%s" >> /home/%s/.ssh/authorized_keys`, string(publicKey), remoteUser)
-	err = session.Run(command)
+	path := fmt.Sprintf("/home/%s/.ssh/authorized_keys", remoteUser)
+	command := fmt.Sprintf(`line=$(sed -n 's#%s#%s#p' %s | head -n 1); echo "${line:-%s}" >> %s`, keyString(oldKey), keyString(publicKey), path, strings.TrimSpace(string(line)), path)
+	return authorizeOnRemote(privateKeyPath, remote, remoteUser, ra, command)
+}
+
+// authorizeOnRemote runs command, which authorizes the key at privateKeyPath, and tests the login with the key
+func authorizeOnRemote(privateKeyPath, remote, remoteUser string, ra RemoteAuth, command string) error {
+	err := remoteRunner.Run(remote, ra, command)
 	if err != nil {
 		slog.Error("Error authorizing public key on remote")
 		return err
@@ -165,30 +269,11 @@ func AuthorizePublicKeyOnRemote(privateKeyPath, remote, remoteUser string, ra Re
 
 func UnauthorizedPublicKeyOnRemote(privateKeyPath, remote, remoteUser string, auth RemoteAuth) error {
 	slog.Debug("Unauthorizing public key on remote")
-	publicKey, err := os.ReadFile(fmt.Sprintf("%s.pub", privateKeyPath))
-	if err != nil {
-		return err
-	}
-	authMethods, err := auth.authMethods()
+	publicKey, err := ReadPublicKey(fmt.Sprintf("%s.pub", privateKeyPath))
 	if err != nil {
 		return err
 	}
-	client, err := ssh.Dial("tcp", remote, &ssh.ClientConfig{
-		User:            auth.User,
-		Auth:            authMethods,
-		HostKeyCallback: trustedHostKeyCallback(auth.TrustedHostKey),
-	})
-	if err != nil {
-		return err
-	}
-	session, err := client.NewSession()
-	if err != nil {
-		return err
-	}
-	defer session.Close()
-	escapedPublicKey := strings.ReplaceAll(string(publicKey), "/", "\\/")
-	command := fmt.Sprintf(`sed -i '/%s/d' /home/%s/.ssh/authorized_keys`, escapedPublicKey, remoteUser)
-	err = session.Run(command)
+	err = remoteRunner.Run(remote, auth, revokeKeyCommand(publicKey, remoteUser))
 	if err != nil {
 		slog.Error("Error unauthorizing public key on remote")
 		return err
@@ -203,76 +288,129 @@ func UnauthorizedPublicKeyOnRemote(privateKeyPath, remote, remoteUser string, au
 	return nil
 }
 
-func keyString(k ssh.PublicKey) string {
-	return k.Type() + " " + base64.StdEncoding.EncodeToString(k.Marshal())
+// revokeKeyCommand removes the lines containing publicKey from the authorized_keys file of remoteUser
+// The key is matched as fixed string on its type and base64 fields, so lines with options or another comment match,
+// grep exits with 1 if it keeps no line
+func revokeKeyCommand(publicKey ssh.PublicKey, remoteUser string) string {
+	path := fmt.Sprintf("/home/%s/.ssh/authorized_keys", remoteUser)
+	return fmt.Sprintf(`grep -vF -- '%s' %s > %s.tmp; [ $? -le 1 ] && cat %s.tmp > %s; status=$?; rm -f %s.tmp; exit $status`, keyString(publicKey), path, path, path, path, path)
 }
 
-func trustedHostKeyCallback(trustedHostKey string) ssh.HostKeyCallback {
-	if trustedHostKey == "" {
-		return func(_ string, _ net.Addr, k ssh.PublicKey) error {
-			slog.Warn(fmt.Sprintf("SSH-key verification is *NOT* in effect: to fix, add this trusted-host-key: %q", keyString(k)))
-			return nil
-		}
+// RevokePublicKeyOnRemote removes the public key at privateKeyPath.pub from the remote's authorized_keys file
+// It authenticates with the key itself, so the key is not usable for remoteUser afterwards
+func RevokePublicKeyOnRemote(privateKeyPath, remote, remoteUser, trustedHostKey string) error {
+	slog.Debug("Revoking public key on remote")
+	publicKey, err := ReadPublicKey(fmt.Sprintf("%s.pub", privateKeyPath))
+	if err != nil {
+		return err
 	}
-
-	return func(_ string, _ net.Addr, k ssh.PublicKey) error {
-		ks := keyString(k)
-		if trustedHostKey != ks {
-			return fmt.Errorf("SSH-key verification: expected %q but got %q", trustedHostKey, ks)
-		}
-		return nil
+	ra := NewRemoteAuth(remoteUser, nil, privateKeyPath, trustedHostKey)
+	err = remoteRunner.Run(remote, ra, revokeKeyCommand(publicKey, remoteUser))
+	if err != nil {
+		slog.Error("Error revoking public key on remote")
+		return err
 	}
+	return nil
 }
 
-// RotateKeyPair generates a new key pair, authorizes the public key on the remote, and removes the old key pair
-func RotateKeyPair(user, remote, keyPath, keyName, keyUser, trustedHostKey string) error {
-	newPubKeyPath := fmt.Sprintf("%s/%s%s.pub", keyPath, keyName, newSuffix)
-	newPrivateKeyPath := fmt.Sprintf("%s/%s%s", keyPath, keyName, newSuffix)
-	pubKeyPath := fmt.Sprintf("%s/%s.pub", keyPath, keyName)
-	privateKeyPath := fmt.Sprintf("%s/%s", keyPath, keyName)
+// The commands the enroll account of the relay understands
+const (
+	// enrollRequest redeems a token: enroll <token> [name]
+	enrollRequest = "enroll"
+	// renewRequest signs a new key for the holder of a valid certificate: renew <key-type> <key>
+	renewRequest = "renew"
+	// revokeRequest revokes the key of the certificate the client logs in with: revoke
+	revokeRequest = "revoke"
+)
 
-	slog.Debug("Generating new key pair")
-	if err := MakeKeyPair(keyPath, keyName+newSuffix, keyUser); err != nil {
-		slog.Error("Error making new key pair")
-		return err
+// EnrollPublicKey authorizes the public key of privateKeyPath for remoteUser by redeeming token on the enroll account of remote
+// It logs in to enrollUser with the key itself, the relay only allows the key to run the enrollment
+func EnrollPublicKey(privateKeyPath, remote, enrollUser, remoteUser string, token secret.Secret, name, trustedHostKey string) error {
+	slog.Debug(fmt.Sprintf("Enrolling public key with %s on remote", enrollUser))
+	ra := NewRemoteAuth(enrollUser, nil, privateKeyPath, trustedHostKey)
+	command := fmt.Sprintf("%s %s %s", enrollRequest, string(token), name)
+	response, err := remoteRunner.Output(remote, ra, command)
+	if err != nil {
+		slog.Error("Error enrolling public key on remote")
+		return fmt.Errorf("failed to enroll public key: %v", err)
 	}
-
-	slog.Debug("Authorizing new public key on remote")
-	ra := NewRemoteAuth(user, "", privateKeyPath, trustedHostKey)
-	if err := AuthorizePublicKeyOnRemote(newPrivateKeyPath, remote, user, ra); err != nil {
-		slog.Error("Error authorizing new public key on remote")
-		removeKeyPair(newPubKeyPath, newPrivateKeyPath)
-		return err
+	// a relay acting as certificate authority responds with the certificate of the key
+	if len(bytes.TrimSpace(response)) > 0 {
+		if err := writeCertificate(privateKeyPath, response); err != nil {
+			return err
+		}
 	}
 
-	slog.Debug("Unauthorizing old public key on remote")
-	ra = NewRemoteAuth(user, "", newPrivateKeyPath, trustedHostKey)
-	if err := UnauthorizedPublicKeyOnRemote(privateKeyPath, remote, user, ra); err != nil {
-		slog.Error("Error unauthorizing old public key on remote")
-		removeKeyPair(newPubKeyPath, newPrivateKeyPath)
+	slog.Debug("Testing enrolled key on remote")
+	if err := NewRemoteAuth(remoteUser, nil, privateKeyPath, trustedHostKey).test(remote); err != nil {
+		slog.Error("Error testing public key on remote")
 		return err
 	}
+	return nil
+}
 
-	slog.Debug("Replacing old key pair with new key pair")
-	if err := os.Rename(newPubKeyPath, pubKeyPath); err != nil {
-		slog.Error("Error replacing old public key with new public key")
-		return err
-	}
-	if err := os.Rename(newPrivateKeyPath, privateKeyPath); err != nil {
-		slog.Error("Error replacing old private key with new private key")
-		return err
+// RemoveKeyPair removes the private key at privateKeyPath, its public key and its certificate, missing files are ignored
+func RemoveKeyPair(privateKeyPath string) error {
+	slog.Debug("Removing key pair")
+	for _, path := range []string{CertificatePath(privateKeyPath), fmt.Sprintf("%s.pub", privateKeyPath), privateKeyPath} {
+		if err := system.Files().Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
-
 	return nil
 }
 
-func removeKeyPair(pubKeyPath, privateKeyPath string) error {
-	slog.Debug("Removing key pair")
-	if err := os.Remove(pubKeyPath); err != nil {
-		slog.Error(fmt.Sprintf("Error removing public key %s, please remove manually", pubKeyPath))
+func keyString(k ssh.PublicKey) string {
+	return k.Type() + " " + base64.StdEncoding.EncodeToString(k.Marshal())
+}
+
+// certAuthorityMarker starts the lines of trusted-host-key naming a host certificate authority, like in known_hosts
+const certAuthorityMarker = "@cert-authority "
+
+// trustedHostKeyCallback accepts the host keys in trustedHostKey, one per line
+// Lines starting with @cert-authority name a certificate authority, its host certificates are accepted for the host names they list
+func trustedHostKeyCallback(trustedHostKey string) ssh.HostKeyCallback {
+	if strings.TrimSpace(trustedHostKey) == "" {
+		return func(_ string, _ net.Addr, k ssh.PublicKey) error {
+			slog.Warn(fmt.Sprintf("SSH-key verification is *NOT* in effect: to fix, add this trusted-host-key: %q", keyString(k)))
+			return nil
+		}
 	}
-	if err := os.Remove(privateKeyPath); err != nil {
-		slog.Error(fmt.Sprintf("Error removing private key %s, please remove manually", privateKeyPath))
+
+	keys, authorities := []string{}, []string{}
+	for _, line := range strings.Split(trustedHostKey, "\n") {
+		line = strings.TrimSpace(line)
+		if ca, ok := strings.CutPrefix(line, certAuthorityMarker); ok {
+			authorities = append(authorities, strings.TrimSpace(ca))
+		} else if line != "" {
+			keys = append(keys, line)
+		}
 	}
-	return nil
+	checkKey := func(_ string, _ net.Addr, k ssh.PublicKey) error {
+		ks := keyString(k)
+		for _, key := range keys {
+			if key == ks {
+				return nil
+			}
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("SSH-key verification: host key %q is not signed by the trusted host certificate authority", ks)
+		}
+		return fmt.Errorf("SSH-key verification: expected %q but got %q", strings.Join(keys, " or "), ks)
+	}
+	if len(authorities) == 0 {
+		return checkKey
+	}
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, _ string) bool {
+			for _, ca := range authorities {
+				if keyString(auth) == ca || strings.HasPrefix(ca, keyString(auth)+" ") {
+					return true
+				}
+			}
+			return false
+		},
+		HostKeyFallback: checkKey,
+	}
+	return checker.CheckHostKey
 }
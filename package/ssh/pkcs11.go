@@ -0,0 +1,33 @@
+//go:build cgo
+
+package ssh
+
+import (
+	"fmt"
+
+	"github.com/ThalesIgnite/crypto11"
+	"golang.org/x/crypto/ssh"
+)
+
+// PKCS11Supported is true with cgo, the PKCS #11 library is loaded through crypto11, which needs cgo
+const PKCS11Supported = true
+
+func (p *PKCS11Signers) Signers() ([]ssh.Signer, error) {
+	ctx, err := crypto11.Configure(&crypto11.Config{Path: p.Module, TokenLabel: p.Token, Pin: string(p.PIN)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open token %s: %v", p.Token, err)
+	}
+	p.session = ctx
+	key, err := ctx.FindKeyPair(nil, []byte(p.KeyLabel))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find key %s on token %s: %v", p.KeyLabel, p.Token, err)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("token %s has no key %s", p.Token, p.KeyLabel)
+	}
+	signer, err := ssh.NewSignerFromSigner(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use key %s of token %s: %v", p.KeyLabel, p.Token, err)
+	}
+	return selectSigner([]ssh.Signer{signer}, p.KeyPath, "token "+p.Token)
+}
@@ -0,0 +1,14 @@
+//go:build !cgo
+
+package ssh
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+// PKCS11Supported is false without cgo, the PKCS #11 library is loaded through crypto11, which needs cgo
+const PKCS11Supported = false
+
+func (p *PKCS11Signers) Signers() ([]ssh.Signer, error) {
+	return nil, ErrPKCS11Unsupported
+}
@@ -0,0 +1,296 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/secret"
+	"golang.org/x/net/proxy"
+)
+
+// ProxySchemes are the supported schemes of proxy URLs
+var ProxySchemes = []string{"http", "https", "socks5", "socks5h"}
+
+var (
+	proxyMu sync.Mutex
+	// proxySetting is the configured proxy URL, the proxy of the environment is used if it is empty
+	proxySetting string
+	// proxyPassword replaces the password of the proxy URL if it is set
+	proxyPassword secret.Secret
+)
+
+// SetProxy makes all connections to the relay go through the proxy at proxyURL, with password if it is set
+// Without proxyURL the proxy of HTTPS_PROXY or ALL_PROXY is used, NO_PROXY is honored in both cases
+func SetProxy(proxyURL string, password secret.Secret) error {
+	if proxyURL != "" {
+		if _, err := parseProxyURL(proxyURL); err != nil {
+			return err
+		}
+	}
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	proxySetting = proxyURL
+	proxyPassword = password
+	return nil
+}
+
+// parseProxyURL parses a proxy URL in the format scheme://[user[:password]@]host:port
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil || u.Host == "" {
+		// like curl, a proxy without scheme is an HTTP proxy
+		u, err = url.Parse("http://" + proxyURL)
+	}
+	if err != nil || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy %q, expected scheme://[user[:password]@]host:port", proxyURL)
+	}
+	if !slices.Contains(ProxySchemes, u.Scheme) {
+		return nil, fmt.Errorf("unsupported proxy scheme %q, supported are %s", u.Scheme, strings.Join(ProxySchemes, ", "))
+	}
+	if u.Port() == "" {
+		port := "1080"
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// ProxyFor returns the proxy connections to address go through, nil if address is connected to directly
+// The password is left out unless withPassword is set
+func ProxyFor(address string, withPassword bool) (*url.URL, error) {
+	proxyMu.Lock()
+	setting, password := proxySetting, proxyPassword
+	proxyMu.Unlock()
+
+	source := "proxy setting"
+	if setting == "" {
+		for _, name := range []string{"HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy"} {
+			if value := os.Getenv(name); value != "" {
+				setting, source = value, name
+				break
+			}
+		}
+	}
+	if setting == "" || noProxy(address, firstEnv("NO_PROXY", "no_proxy")) {
+		return nil, nil
+	}
+	u, err := parseProxyURL(setting)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", source, err)
+	}
+	if !password.Empty() {
+		u.User = url.UserPassword(u.User.Username(), string(password))
+	}
+	if !withPassword && u.User != nil {
+		u.User = url.User(u.User.Username())
+	}
+	return u, nil
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// noProxy checks if address is excluded from proxying by noProxyList, in the format of NO_PROXY:
+// comma separated hosts with optional port, domains (a leading dot is optional), IP addresses, CIDR ranges or *
+func noProxy(address, noProxyList string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(noProxyList, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			return true
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		entryHost, entryPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			entryHost, entryPort = strings.Trim(entry, "[]"), ""
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		if entryIP := net.ParseIP(entryHost); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		domain := strings.TrimPrefix(entryHost, "*")
+		domain = strings.TrimPrefix(domain, ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialTCP connects to address, through the proxy if there is one for it, within timeout unless it is zero
+func dialTCP(address string, timeout time.Duration) (net.Conn, error) {
+	proxyURL, err := ProxyFor(address, true)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	if proxyURL == nil {
+		return dialer.Dial("tcp", address)
+	}
+	slog.Debug(fmt.Sprintf("Connecting to %s through proxy %s", address, proxyURL.Redacted()))
+	ctx := context.Background()
+	if timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var conn net.Conn
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		conn, err = dialSOCKS5(ctx, dialer, proxyURL, address)
+	default:
+		conn, err = dialHTTPConnect(ctx, dialer, proxyURL, address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s through proxy %s: %v", address, proxyURL.Redacted(), err)
+	}
+	return conn, nil
+}
+
+// dialSOCKS5 connects to address through the SOCKS5 proxy at proxyURL
+// Like curl and ssh, socks5h lets the proxy resolve the host name and socks5 resolves it locally and passes the IP address
+func dialSOCKS5(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, address string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+	}
+	socks, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, dialer)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(address)
+	if proxyURL.Scheme == "socks5h" || err != nil || net.ParseIP(host) != nil {
+		return socks.(proxy.ContextDialer).DialContext(ctx, "tcp", address)
+	}
+	addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s, use socks5h to let the proxy resolve it: %v", host, err)
+	}
+	for _, ip := range addresses {
+		var conn net.Conn
+		conn, err = socks.(proxy.ContextDialer).DialContext(ctx, "tcp", net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		slog.Debug(fmt.Sprintf("Connecting to %s (%s) through proxy failed: %v", host, ip, err))
+	}
+	return nil, err
+}
+
+// dialHTTPConnect connects to address with a CONNECT request to the HTTP proxy at proxyURL, with basic authentication if it has a user
+func dialHTTPConnect(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, address string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused the connection: %s", response.Status)
+	}
+	if reader.Buffered() > 0 {
+		// the server may have sent its banner along with the response
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were already read into reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// ProxyConnect connects to address, through the gateway and the proxy if there are any, and copies between the connection and stdin and stdout
+// It serves as ProxyCommand of the tunnel's ssh, it returns once the connection is closed
+func ProxyConnect(address string, stdin io.Reader, stdout io.Writer) error {
+	conn, err := dialFirst(address, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		io.Copy(conn, stdin)
+		if tcp, ok := conn.(interface{ CloseWrite() error }); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	_, err = io.Copy(stdout, conn)
+	return err
+}
@@ -0,0 +1,109 @@
+package ssh
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+	"golang.org/x/crypto/ssh"
+)
+
+// RemoteRunner executes operations on the relay server
+type RemoteRunner interface {
+	// Run executes command on remote, authenticated by auth
+	Run(remote string, auth RemoteAuth, command string) error
+	// Output executes command on remote, authenticated by auth, and returns its output
+	Output(remote string, auth RemoteAuth, command string) ([]byte, error)
+	// Test checks that auth is able to log in on remote
+	Test(remote string, auth RemoteAuth) error
+}
+
+var remoteRunner RemoteRunner = SSHRemoteRunner{}
+
+// SetRemoteRunner replaces the runner used for all remote operations
+func SetRemoteRunner(runner RemoteRunner) {
+	remoteRunner = runner
+}
+
+// SSHRemoteRunner executes remote operations over an SSH connection
+type SSHRemoteRunner struct{}
+
+func (SSHRemoteRunner) dial(remote string, auth RemoteAuth) (*ssh.Client, error) {
+	if provider := auth.Provider(); provider != nil {
+		// the keys are only used for the handshakes with the jump hosts and the relay
+		keys := &onceSigners{provider: provider}
+		auth.Signers = keys
+		defer keys.Close()
+	}
+	authMethods, err := auth.authMethods()
+	if err != nil {
+		return nil, err
+	}
+	return dialChain(remote, auth, &ssh.ClientConfig{
+		User:            auth.User,
+		Auth:            authMethods,
+		HostKeyCallback: trustedHostKeyCallback(auth.TrustedHostKey),
+	})
+}
+
+func (r SSHRemoteRunner) Run(remote string, auth RemoteAuth, command string) error {
+	_, err := r.Output(remote, auth, command)
+	return err
+}
+
+func (r SSHRemoteRunner) Output(remote string, auth RemoteAuth, command string) ([]byte, error) {
+	client, err := r.dial(remote, auth)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	output, err := session.CombinedOutput(command)
+	if err != nil && len(output) > 0 {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return output, err
+}
+
+func (r SSHRemoteRunner) Test(remote string, auth RemoteAuth) error {
+	slog.Debug("Testing remote authentication")
+	client, err := r.dial(remote, auth)
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
+
+// PlannedRemoteRunner records remote operations in a dry run plan instead of executing them
+type PlannedRemoteRunner struct {
+	Plan *system.Plan
+}
+
+func (r PlannedRemoteRunner) Run(remote string, auth RemoteAuth, command string) error {
+	if fields := strings.Fields(command); len(fields) > 1 && fields[0] == enrollRequest {
+		// the enrollment token is a credential
+		fields[1] = "********"
+		command = strings.Join(fields, " ")
+	}
+	r.Plan.RecordRemote(fmt.Sprintf("%s@%s: %s", auth.User, remote, command))
+	return nil
+}
+
+func (r PlannedRemoteRunner) Output(remote string, auth RemoteAuth, command string) ([]byte, error) {
+	return nil, r.Run(remote, auth, command)
+}
+
+func (r PlannedRemoteRunner) Test(remote string, auth RemoteAuth) error {
+	r.Plan.RecordRemote(fmt.Sprintf("%s@%s: test login", auth.User, remote))
+	return nil
+}
+
+// CheckLogin checks that auth is able to log in on remote
+func CheckLogin(remote string, auth RemoteAuth) error {
+	return remoteRunner.Test(remote, auth)
+}
@@ -0,0 +1,386 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+)
+
+const journalSuffix = ".rotation"
+const backupSuffix = ".old"
+
+// rotationPhase is the last completed phase of a rotation
+type rotationPhase string
+
+const (
+	// phaseBackedUp: the old key pair is copied to <key>.old, it stays authorized until the new key pair is installed
+	phaseBackedUp rotationPhase = "backed-up"
+	// phaseGenerated: the new key pair is at <key>.new, generated or restored from the archive
+	phaseGenerated rotationPhase = "generated"
+	// phaseAuthorized: the new key pair logs in on the remote, authorized by the old key or certified by the relay
+	phaseAuthorized rotationPhase = "authorized"
+	// phaseInstalled: the new key pair replaced the old one, only the old key is left to revoke and archive
+	phaseInstalled rotationPhase = "installed"
+)
+
+// rotationJournal records the progress of a rotation next to the key, so an interrupted rotation can be resumed
+type rotationJournal struct {
+	Phase rotationPhase `json:"phase"`
+	// EnrollUser renews the certificate of the key pair, without it the new key is authorized for RemoteUser
+	EnrollUser string `json:"enroll-user,omitempty"`
+	RemoteUser string `json:"remote-user"`
+	Remote     string `json:"remote"`
+	KeyPath    string `json:"key-path"`
+	KeyUser    string `json:"key-user"`
+	KeyType    string `json:"key-type,omitempty"`
+	// Source is the archived key pair restored as new key pair, without it a key pair is generated
+	Source  string    `json:"source,omitempty"`
+	Started time.Time `json:"started"`
+}
+
+// JournalPath returns the path of the rotation journal of the private key at privateKeyPath
+func JournalPath(privateKeyPath string) string {
+	return privateKeyPath + journalSuffix
+}
+
+// RotationPending checks if a rotation of the private key at privateKeyPath was interrupted
+func RotationPending(privateKeyPath string) bool {
+	_, err := system.Files().Stat(JournalPath(privateKeyPath))
+	return err == nil
+}
+
+func (j *rotationJournal) save() error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := system.Files().WriteFile(JournalPath(j.KeyPath), append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write rotation journal: %v", err)
+	}
+	return nil
+}
+
+func (j *rotationJournal) advance(phase rotationPhase) error {
+	slog.Debug(fmt.Sprintf("Rotation of %s %s", j.KeyPath, phase))
+	j.Phase = phase
+	return j.save()
+}
+
+func loadJournal(privateKeyPath string) (*rotationJournal, error) {
+	data, err := system.Files().ReadFile(JournalPath(privateKeyPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no interrupted rotation of %s", privateKeyPath)
+		}
+		return nil, fmt.Errorf("failed to read rotation journal: %v", err)
+	}
+	j := &rotationJournal{}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("failed to parse rotation journal %s: %v", JournalPath(privateKeyPath), err)
+	}
+	return j, nil
+}
+
+// keyFiles returns the private key at privateKeyPath, its public key and its certificate
+func keyFiles(privateKeyPath string) []string {
+	return []string{privateKeyPath, privateKeyPath + ".pub", CertificatePath(privateKeyPath)}
+}
+
+// copyKeyPair copies the key pair at from, with its certificate if there is one, to to
+func copyKeyPair(from, to string) error {
+	targets := keyFiles(to)
+	for i, path := range keyFiles(from) {
+		data, err := system.Files().ReadFile(path)
+		if os.IsNotExist(err) && path == CertificatePath(from) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		info, err := system.Files().Stat(path)
+		if err != nil {
+			return err
+		}
+		if err := system.Files().WriteFile(targets[i], data, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeKeyFiles removes the key pair at privateKeyPath and its certificate, errors are only logged
+func removeKeyFiles(privateKeyPath string) {
+	if err := RemoveKeyPair(privateKeyPath); err != nil {
+		slog.Error(fmt.Sprintf("Error removing %s, please remove manually: %s", privateKeyPath, err))
+	}
+}
+
+// RotateKeyPair generates a new key pair of keyType, authorizes the public key on the remote, and moves the old key pair to archive
+// The phases are recorded in a journal, an interrupted rotation is completed by ResumeRotation
+func RotateKeyPair(user, remote, keyPath, keyName, keyUser, keyType, trustedHostKey string, archive KeyArchive) error {
+	return startRotation(&rotationJournal{
+		RemoteUser: user,
+		Remote:     remote,
+		KeyPath:    fmt.Sprintf("%s/%s", keyPath, keyName),
+		KeyUser:    keyUser,
+		KeyType:    keyType,
+	}, trustedHostKey, archive)
+}
+
+// RenewKeyPair generates a new key pair of keyType and has the relay sign it, authenticated by the certificate of the old key pair
+// Nothing changes on the relay, the certificate of the old key pair expires
+func RenewKeyPair(enrollUser, remoteUser, remote, keyPath, keyName, keyUser, keyType, trustedHostKey string, archive KeyArchive) error {
+	return startRotation(&rotationJournal{
+		EnrollUser: enrollUser,
+		RemoteUser: remoteUser,
+		Remote:     remote,
+		KeyPath:    fmt.Sprintf("%s/%s", keyPath, keyName),
+		KeyUser:    keyUser,
+		KeyType:    keyType,
+	}, trustedHostKey, archive)
+}
+
+// RollbackKeyPair replaces the key pair by the archived key pair id, like a rotation
+// The archived key is authorized on the remote, or certified by the relay with enrollUser, before it is restored
+func RollbackKeyPair(id, enrollUser, remoteUser, remote, keyPath, keyName, trustedHostKey string, archive KeyArchive) error {
+	if archive.Directory == "" {
+		return fmt.Errorf("no key archive")
+	}
+	return startRotation(&rotationJournal{
+		EnrollUser: enrollUser,
+		RemoteUser: remoteUser,
+		Remote:     remote,
+		KeyPath:    fmt.Sprintf("%s/%s", keyPath, keyName),
+		Source:     id,
+	}, trustedHostKey, archive)
+}
+
+func startRotation(j *rotationJournal, trustedHostKey string, archive KeyArchive) error {
+	if RotationPending(j.KeyPath) {
+		return fmt.Errorf("rotation of %s was interrupted, resume it first", j.KeyPath)
+	}
+	slog.Debug("Backing up old key pair")
+	if err := copyKeyPair(j.KeyPath, j.KeyPath+backupSuffix); err != nil {
+		removeKeyFiles(j.KeyPath + backupSuffix)
+		return fmt.Errorf("failed to back up old key pair: %v", err)
+	}
+	j.Started = time.Now().UTC()
+	if err := j.advance(phaseBackedUp); err != nil {
+		removeKeyFiles(j.KeyPath + backupSuffix)
+		return err
+	}
+	return j.run(trustedHostKey, archive, false)
+}
+
+// ResumeRotation completes the interrupted rotation of the private key at privateKeyPath from its last completed phase
+func ResumeRotation(privateKeyPath, trustedHostKey string, archive KeyArchive) error {
+	j, err := loadJournal(privateKeyPath)
+	if err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("Resuming rotation of %s, started %s, after phase %s", j.KeyPath, j.Started.Format(time.RFC3339), j.Phase))
+	return j.run(trustedHostKey, archive, true)
+}
+
+// run performs the phases following the last completed one
+// Until the new key pair is installed, a failure restores the old key pair, afterwards the journal is kept for a resume
+func (j *rotationJournal) run(trustedHostKey string, archive KeyArchive, resumed bool) error {
+	newPath := j.KeyPath + newSuffix
+	backupPath := j.KeyPath + backupSuffix
+	for {
+		var err error
+		switch j.Phase {
+		case phaseBackedUp:
+			if j.Source != "" {
+				slog.Debug(fmt.Sprintf("Restoring archived key pair %s", j.Source))
+				err = archive.restore(j.Source, newPath)
+			} else {
+				slog.Debug("Generating new key pair")
+				err = MakeKeyPair(filepath.Dir(j.KeyPath), filepath.Base(newPath), j.KeyUser, j.KeyType)
+			}
+			if err == nil {
+				err = j.advance(phaseGenerated)
+			}
+		case phaseGenerated:
+			if err = j.authorize(trustedHostKey, resumed); err == nil {
+				err = j.advance(phaseAuthorized)
+			}
+		case phaseAuthorized:
+			slog.Debug("Replacing old key pair with new key pair")
+			if err = installKeyPair(newPath, j.KeyPath); err == nil {
+				err = j.advance(phaseInstalled)
+			}
+		case phaseInstalled:
+			if j.EnrollUser == "" {
+				slog.Debug("Unauthorizing old public key on remote")
+				ra := NewRemoteAuth(j.RemoteUser, nil, j.KeyPath, trustedHostKey)
+				if err := UnauthorizedPublicKeyOnRemote(backupPath, j.Remote, j.RemoteUser, ra); err != nil {
+					return fmt.Errorf("failed to revoke old key, the new key is installed, resume the rotation to retry: %v", err)
+				}
+			}
+			if err := j.archive(archive); err != nil {
+				return err
+			}
+			if err := system.Files().Remove(JournalPath(j.KeyPath)); err != nil {
+				return fmt.Errorf("failed to remove rotation journal: %v", err)
+			}
+			return nil
+		default:
+			return fmt.Errorf("unknown phase %q in rotation journal %s", j.Phase, JournalPath(j.KeyPath))
+		}
+		if err != nil {
+			j.rollback(trustedHostKey)
+			return err
+		}
+	}
+}
+
+// revokeNewKey removes the new public key the failed authorization may have appended on the remote, with the old key,
+// or revokes the certificate the relay may have signed for it, with the new key pair
+func (j *rotationJournal) revokeNewKey(trustedHostKey string) {
+	newPath := j.KeyPath + newSuffix
+	backupPath := j.KeyPath + backupSuffix
+	newKey, err := ReadPublicKey(newPath + ".pub")
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error reading new public key: %s", err))
+		return
+	}
+	if oldKey, err := ReadPublicKey(backupPath + ".pub"); err == nil && keyString(oldKey) == keyString(newKey) {
+		// revoking the new key would revoke the old one
+		return
+	}
+	if j.EnrollUser != "" {
+		if !CertificateExists(newPath) {
+			return
+		}
+		slog.Debug("Revoking certificate of new public key")
+		ra := NewRemoteAuth(j.EnrollUser, nil, newPath, trustedHostKey)
+		if err := remoteRunner.Run(j.Remote, ra, revokeRequest); err != nil {
+			slog.Error(fmt.Sprintf("Error revoking certificate of new public key, please add %s to the revoked keys of the relay: %s", keyString(newKey), err))
+		}
+		return
+	}
+	slog.Debug("Revoking new public key on remote")
+	ra := NewRemoteAuth(j.RemoteUser, nil, backupPath, trustedHostKey)
+	if err := remoteRunner.Run(j.Remote, ra, revokeKeyCommand(newKey, j.RemoteUser)); err != nil {
+		slog.Error(fmt.Sprintf("Error revoking new public key on remote, please remove it from the authorized keys of %s: %s", j.RemoteUser, err))
+	}
+}
+
+// archive moves the backup of the old key pair into archive, a restored key pair leaves the archive
+func (j *rotationJournal) archive(archive KeyArchive) error {
+	backupPath := j.KeyPath + backupSuffix
+	if archive.Directory != "" {
+		id, err := archive.store(backupPath, filepath.Base(j.KeyPath))
+		if err != nil {
+			return fmt.Errorf("failed to archive old key pair, it is kept at %s, resume the rotation to retry: %v", backupPath, err)
+		}
+		slog.Info(fmt.Sprintf("Archived old key pair as %s", id))
+	}
+	if j.Source != "" {
+		if err := archive.remove(j.Source); err != nil {
+			slog.Warn(fmt.Sprintf("Error removing restored key pair %s from the archive: %s", j.Source, err))
+		}
+	}
+	removeKeyFiles(backupPath)
+	return nil
+}
+
+// authorize makes the new key pair log in on the remote, authenticated by the backup of the old key pair
+// A resumed rotation skips it if the new key pair already logs in
+func (j *rotationJournal) authorize(trustedHostKey string, resumed bool) error {
+	newPath := j.KeyPath + newSuffix
+	backupPath := j.KeyPath + backupSuffix
+	if resumed && NewRemoteAuth(j.RemoteUser, nil, newPath, trustedHostKey).test(j.Remote) == nil {
+		slog.Debug("New key pair already logs in on remote")
+		return nil
+	}
+	if j.EnrollUser == "" {
+		slog.Debug("Authorizing new public key on remote")
+		ra := NewRemoteAuth(j.RemoteUser, nil, backupPath, trustedHostKey)
+		return authorizePublicKeyLike(newPath, backupPath, j.Remote, j.RemoteUser, ra)
+	}
+
+	newPublicKey, err := ReadPublicKey(newPath + ".pub")
+	if err != nil {
+		return err
+	}
+	slog.Debug("Requesting certificate of new public key")
+	ra := NewRemoteAuth(j.EnrollUser, nil, backupPath, trustedHostKey)
+	command := fmt.Sprintf("%s %s", renewRequest, keyString(newPublicKey))
+	response, err := remoteRunner.Output(j.Remote, ra, command)
+	if err == nil {
+		err = writeCertificate(newPath, response)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to renew certificate: %v", err)
+	}
+
+	slog.Debug("Testing new certificate on remote")
+	return NewRemoteAuth(j.RemoteUser, nil, newPath, trustedHostKey).test(j.Remote)
+}
+
+// installKeyPair renames the key pair at newPath to privateKeyPath, files already renamed are skipped
+func installKeyPair(newPath, privateKeyPath string) error {
+	targets := keyFiles(privateKeyPath)
+	for i, path := range keyFiles(newPath) {
+		if _, err := system.Files().Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		if err := system.Files().Rename(path, targets[i]); err != nil {
+			slog.Error(fmt.Sprintf("Error replacing %s with %s", targets[i], path))
+			return err
+		}
+	}
+	return nil
+}
+
+// uninstallKeyPair moves the files installKeyPair already renamed to privateKeyPath back to newPath
+func uninstallKeyPair(newPath, privateKeyPath string) {
+	sources := keyFiles(privateKeyPath)
+	for i, path := range keyFiles(newPath) {
+		if _, err := system.Files().Stat(path); !os.IsNotExist(err) {
+			continue
+		}
+		if _, err := system.Files().Stat(sources[i]); os.IsNotExist(err) {
+			continue
+		}
+		if err := system.Files().Rename(sources[i], path); err != nil {
+			slog.Error(fmt.Sprintf("Error moving %s back to %s: %s", sources[i], path, err))
+		}
+	}
+}
+
+// rollback restores the backup of the old key pair and removes the new key pair, the backup and the journal
+func (j *rotationJournal) rollback(trustedHostKey string) {
+	slog.Warn(fmt.Sprintf("Rotation of %s failed after phase %s, keeping the old key pair", j.KeyPath, j.Phase))
+	backupPath := j.KeyPath + backupSuffix
+	if j.Phase == phaseAuthorized {
+		// the installation may have replaced some of the files, they are moved back to revoke the new key pair
+		uninstallKeyPair(j.KeyPath+newSuffix, j.KeyPath)
+	}
+	if j.Phase == phaseGenerated || j.Phase == phaseAuthorized {
+		j.revokeNewKey(trustedHostKey)
+	}
+	if j.Phase == phaseAuthorized {
+		if !CertificateExists(backupPath) {
+			if err := system.Files().Remove(CertificatePath(j.KeyPath)); err != nil && !os.IsNotExist(err) {
+				slog.Error(fmt.Sprintf("Error removing certificate of new key pair: %s", err))
+			}
+		}
+		if err := copyKeyPair(backupPath, j.KeyPath); err != nil {
+			slog.Error(fmt.Sprintf("Error restoring old key pair, it is kept at %s: %s", backupPath, err))
+			return
+		}
+	}
+	removeKeyFiles(j.KeyPath + newSuffix)
+	removeKeyFiles(backupPath)
+	if err := system.Files().Remove(JournalPath(j.KeyPath)); err != nil {
+		slog.Error(fmt.Sprintf("Error removing rotation journal %s, please remove manually", JournalPath(j.KeyPath)))
+	}
+}
@@ -0,0 +1,206 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/secret"
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SignerProvider provides the keys a connection authenticates with, wherever they are kept
+type SignerProvider interface {
+	// Signers returns the signers to authenticate with
+	Signers() ([]ssh.Signer, error)
+	// Close releases what the signers hold, like the agent connection or the token session
+	Close() error
+}
+
+// FileSigners provides the private key in the file KeyPath, with its certificate if there is one
+type FileSigners struct {
+	KeyPath string
+}
+
+func (p FileSigners) Signers() ([]ssh.Signer, error) {
+	s, err := signer(p.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return []ssh.Signer{s}, nil
+}
+
+func (FileSigners) Close() error {
+	return nil
+}
+
+// onceSigners provides the keys of provider, which is only asked for them once
+type onceSigners struct {
+	provider SignerProvider
+	once     sync.Once
+	signers  []ssh.Signer
+	err      error
+}
+
+func (p *onceSigners) Signers() ([]ssh.Signer, error) {
+	p.once.Do(func() {
+		p.signers, p.err = p.provider.Signers()
+	})
+	return p.signers, p.err
+}
+
+func (p *onceSigners) Close() error {
+	return p.provider.Close()
+}
+
+// AgentSigners provides the keys of the ssh-agent listening on Socket, SSH_AUTH_SOCK if it is empty
+// With KeyPath.pub only its key is provided, with the certificate of KeyPath if there is one
+type AgentSigners struct {
+	Socket  string
+	KeyPath string
+	conn    net.Conn
+}
+
+func (p *AgentSigners) Signers() ([]ssh.Signer, error) {
+	socket := p.Socket
+	if socket == "" {
+		socket = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if socket == "" {
+		return nil, fmt.Errorf("no ssh-agent, SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ssh-agent: %v", err)
+	}
+	p.conn = conn
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys of ssh-agent: %v", err)
+	}
+	return selectSigner(signers, p.KeyPath, "ssh-agent")
+}
+
+func (p *AgentSigners) Close() error {
+	if p.conn == nil {
+		return nil
+	}
+	return p.conn.Close()
+}
+
+// ErrPKCS11Unsupported is returned for PKCS #11 tokens by binaries without PKCS11Supported
+var ErrPKCS11Unsupported = errors.New("PKCS #11 tokens are not supported by this binary, the PKCS #11 support has build tag cgo and it was built with CGO_ENABLED=0, e.g. cross-compiled by scripts/build.sh; build it with CGO_ENABLED=1 on the target platform")
+
+// PKCS11Signers provides the key labelled KeyLabel on the token labelled Token, through the PKCS #11 library Module
+// The token is logged in to with PIN, KeyPath.pub and the certificate of KeyPath are used like with AgentSigners
+type PKCS11Signers struct {
+	Module   string
+	Token    string
+	KeyLabel string
+	PIN      secret.Secret
+	KeyPath  string
+	session  pkcs11Session
+}
+
+// pkcs11Session is the open token of PKCS11Signers
+type pkcs11Session interface {
+	Close() error
+}
+
+func (p *PKCS11Signers) Close() error {
+	if p.session == nil {
+		return nil
+	}
+	return p.session.Close()
+}
+
+// selectSigner returns the signer of signers whose public key is at keyPath.pub, certified by the certificate of keyPath if there is one
+// Without keyPath.pub, before the public key is exported, all signers are returned
+func selectSigner(signers []ssh.Signer, keyPath, source string) ([]ssh.Signer, error) {
+	if keyPath == "" || !exists(keyPath+".pub") {
+		return signers, nil
+	}
+	publicKey, err := ReadPublicKey(keyPath + ".pub")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key %s.pub: %v", keyPath, err)
+	}
+	for _, s := range signers {
+		if !bytes.Equal(s.PublicKey().Marshal(), publicKey.Marshal()) {
+			continue
+		}
+		if !CertificateExists(keyPath) {
+			return []ssh.Signer{s}, nil
+		}
+		certPublicKey, err := ReadPublicKey(CertificatePath(keyPath))
+		if err != nil {
+			return nil, err
+		}
+		cert, ok := certPublicKey.(*ssh.Certificate)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a certificate", CertificatePath(keyPath))
+		}
+		certSigner, err := ssh.NewCertSigner(cert, s)
+		if err != nil {
+			return nil, err
+		}
+		return []ssh.Signer{certSigner}, nil
+	}
+	return nil, fmt.Errorf("%s has no key %s", source, ssh.FingerprintSHA256(publicKey))
+}
+
+var (
+	keySignersMu sync.Mutex
+	// keySigners holds the providers of keys that are not kept in their key file
+	keySigners = map[string]SignerProvider{}
+)
+
+// RegisterSigners makes every authentication with the key at privateKeyPath use provider instead of the key file
+// The public key and the certificate stay next to privateKeyPath, a nil provider returns to the key file
+func RegisterSigners(privateKeyPath string, provider SignerProvider) {
+	keySignersMu.Lock()
+	defer keySignersMu.Unlock()
+	if provider == nil {
+		delete(keySigners, privateKeyPath)
+		return
+	}
+	keySigners[privateKeyPath] = provider
+}
+
+// signersOf returns the provider registered for the key at keyPath, the key file if there is none
+func signersOf(keyPath string) SignerProvider {
+	keySignersMu.Lock()
+	defer keySignersMu.Unlock()
+	if provider, ok := keySigners[keyPath]; ok {
+		return provider
+	}
+	return FileSigners{KeyPath: keyPath}
+}
+
+// ExportPublicKey writes the public key of the first signer of provider to privateKeyPath.pub with userReference as comment
+// It stands in for the key pair of keys kept outside of key files, e.g. to authorize them on the relay
+func ExportPublicKey(provider SignerProvider, privateKeyPath, userReference string) error {
+	defer provider.Close()
+	signers, err := provider.Signers()
+	if err != nil {
+		return err
+	}
+	if len(signers) == 0 {
+		return errors.New("no key provided")
+	}
+	if len(signers) > 1 {
+		slog.Warn(fmt.Sprintf("%d keys provided, using %s", len(signers), ssh.FingerprintSHA256(signers[0].PublicKey())))
+	}
+	publicKey := signers[0].PublicKey()
+	if cert, ok := publicKey.(*ssh.Certificate); ok {
+		publicKey = cert.Key
+	}
+	pubKeyStr := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey)))
+	return system.Files().WriteFile(privateKeyPath+".pub", []byte(fmt.Sprintf("%s %s", pubKeyStr, userReference)), 0644)
+}
@@ -0,0 +1,245 @@
+package sshtest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Proxy is an in-process HTTP CONNECT or SOCKS5 proxy listening on the loopback interface
+// With a user it requires basic authentication, respectively username/password authentication
+type Proxy struct {
+	scheme   string
+	user     string
+	password string
+	listener net.Listener
+
+	mu        sync.Mutex
+	connected []string
+	conns     map[net.Conn]bool
+	wg        sync.WaitGroup
+}
+
+// NewHTTPProxy starts an HTTP CONNECT proxy, it requires user and password unless user is empty
+func NewHTTPProxy(t testing.TB, user, password string) *Proxy {
+	return newProxy(t, "http", user, password)
+}
+
+// NewSOCKS5Proxy starts a SOCKS5 proxy, it requires user and password unless user is empty
+func NewSOCKS5Proxy(t testing.TB, user, password string) *Proxy {
+	return newProxy(t, "socks5", user, password)
+}
+
+func newProxy(t testing.TB, scheme, user, password string) *Proxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	p := &Proxy{scheme: scheme, user: user, password: password, listener: listener, conns: map[net.Conn]bool{}}
+	p.wg.Add(1)
+	go p.serve()
+	t.Cleanup(p.Close)
+	return p
+}
+
+// URL returns the URL of the proxy without credentials, e.g. http://127.0.0.1:3128
+func (p *Proxy) URL() string {
+	return p.scheme + "://" + p.listener.Addr().String()
+}
+
+// Connected returns the addresses clients connected to through the proxy
+func (p *Proxy) Connected() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.connected...)
+}
+
+// Close stops the proxy and closes its connections
+func (p *Proxy) Close() {
+	p.listener.Close()
+	p.mu.Lock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+func (p *Proxy) serve() {
+	defer p.wg.Done()
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		p.conns[conn] = true
+		p.mu.Unlock()
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer func() {
+				conn.Close()
+				p.mu.Lock()
+				delete(p.conns, conn)
+				p.mu.Unlock()
+			}()
+			reader := bufio.NewReader(conn)
+			var address string
+			var err error
+			if p.scheme == "socks5" {
+				address, err = p.socks5Handshake(reader, conn)
+			} else {
+				address, err = p.connectHandshake(reader, conn)
+			}
+			if err != nil {
+				return
+			}
+			target, err := net.Dial("tcp", address)
+			if err != nil {
+				return
+			}
+			defer target.Close()
+			p.mu.Lock()
+			p.connected = append(p.connected, address)
+			p.mu.Unlock()
+			if p.scheme == "socks5" {
+				// succeeded, bound to 0.0.0.0:0
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			} else {
+				fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			}
+			done := make(chan struct{}, 2)
+			go func() {
+				io.Copy(target, reader)
+				done <- struct{}{}
+			}()
+			go func() {
+				io.Copy(conn, target)
+				done <- struct{}{}
+			}()
+			<-done
+		}()
+	}
+}
+
+// connectHandshake reads a CONNECT request and returns the address to connect to
+func (p *Proxy) connectHandshake(reader *bufio.Reader, conn net.Conn) (string, error) {
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return "", err
+	}
+	if request.Method != http.MethodConnect {
+		fmt.Fprint(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return "", fmt.Errorf("method %s", request.Method)
+	}
+	if p.user != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.user + ":" + p.password))
+		if request.Header.Get("Proxy-Authorization") != "Basic "+credentials {
+			fmt.Fprint(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic\r\n\r\n")
+			return "", fmt.Errorf("not authenticated")
+		}
+	}
+	return request.Host, nil
+}
+
+// socks5Handshake negotiates the authentication, reads a CONNECT command and returns the address to connect to
+func (p *Proxy) socks5Handshake(reader *bufio.Reader, conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil || header[0] != 5 {
+		return "", fmt.Errorf("not a SOCKS5 greeting")
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", err
+	}
+	method := byte(0)
+	if p.user != "" {
+		method = 2
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		conn.Write([]byte{5, 0xff})
+		return "", fmt.Errorf("authentication method not offered")
+	}
+	conn.Write([]byte{5, method})
+	if method == 2 {
+		user, password, err := readSOCKS5Credentials(reader)
+		if err != nil {
+			return "", err
+		}
+		if user != p.user || password != p.password {
+			conn.Write([]byte{1, 1})
+			return "", fmt.Errorf("not authenticated")
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil || request[1] != 1 {
+		return "", fmt.Errorf("not a CONNECT command")
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	case 4:
+		ip := make([]byte, 16)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	default:
+		return "", fmt.Errorf("unknown address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// readSOCKS5Credentials reads a username/password authentication request, RFC 1929
+func readSOCKS5Credentials(reader *bufio.Reader) (string, string, error) {
+	fields := make([]string, 2)
+	if version, err := reader.ReadByte(); err != nil || version != 1 {
+		return "", "", fmt.Errorf("not a username/password request")
+	}
+	for i := range fields {
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", "", err
+		}
+		field := make([]byte, length)
+		if _, err := io.ReadFull(reader, field); err != nil {
+			return "", "", err
+		}
+		fields[i] = string(field)
+	}
+	return fields[0], fields[1], nil
+}
@@ -0,0 +1,199 @@
+// Package sshtest provides fakes of the remote side of package ssh
+package sshtest
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	tunnelssh "github.com/fbufler/ssh-tunnel-setup/package/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	appendKeyCommand = regexp.MustCompile(`^echo "(.*)" >> /home/([^/]+)/\.ssh/authorized_keys$`)
+	removeKeyCommand = regexp.MustCompile(`^grep -vF -- '(.*)' /home/([^/]+)/\.ssh/authorized_keys > `)
+	// copyKeyCommand appends the first line of the old key with the new key, or the default line without one
+	copyKeyCommand = regexp.MustCompile(`^line=\$\(sed -n 's#(.*)#(.*)#p' /home/([^/]+)/\.ssh/authorized_keys \| head -n 1\); echo "\$\{line:-(.*)\}" >> /home/[^/]+/\.ssh/authorized_keys$`)
+)
+
+// Remote is an in-memory relay server implementing tunnelssh.RemoteRunner
+// It understands the authorized_keys commands package ssh sends and authenticates
+// against Passwords and AuthorizedKeys, keys are taken from the provider of the RemoteAuth
+type Remote struct {
+	Passwords map[string]string
+	// AuthorizedKeys maps users to the lines of their authorized_keys file
+	AuthorizedKeys map[string][]string
+	// Operations holds every operation performed, prefixed by user@remote
+	Operations []string
+	// Fail fails the operations it returns an error for, like a dropped connection
+	Fail func(operation string) error
+}
+
+// Install replaces the remote runner of package ssh with a fresh Remote for the duration of the test
+func Install(t testing.TB) *Remote {
+	t.Helper()
+	remote := &Remote{Passwords: map[string]string{}, AuthorizedKeys: map[string][]string{}}
+	tunnelssh.SetRemoteRunner(remote)
+	t.Cleanup(func() { tunnelssh.SetRemoteRunner(tunnelssh.SSHRemoteRunner{}) })
+	return remote
+}
+
+func (r *Remote) Run(remote string, auth tunnelssh.RemoteAuth, command string) error {
+	if err := r.record(fmt.Sprintf("%s@%s: %s", auth.User, remote, command)); err != nil {
+		return err
+	}
+	if err := r.authenticate(auth); err != nil {
+		return err
+	}
+
+	return runAuthorizedKeysCommand(r.AuthorizedKeys, command)
+}
+
+func (r *Remote) Output(remote string, auth tunnelssh.RemoteAuth, command string) ([]byte, error) {
+	return nil, r.Run(remote, auth, command)
+}
+
+func (r *Remote) Test(remote string, auth tunnelssh.RemoteAuth) error {
+	if err := r.record(fmt.Sprintf("%s@%s: test login", auth.User, remote)); err != nil {
+		return err
+	}
+	return r.authenticate(auth)
+}
+
+func (r *Remote) record(operation string) error {
+	r.Operations = append(r.Operations, operation)
+	if r.Fail != nil {
+		return r.Fail(operation)
+	}
+	return nil
+}
+
+func (r *Remote) authenticate(auth tunnelssh.RemoteAuth) error {
+	if provider := auth.Provider(); provider != nil {
+		defer provider.Close()
+		signers, err := provider.Signers()
+		if err != nil {
+			return err
+		}
+		for _, signer := range signers {
+			publicKey := signer.PublicKey()
+			if cert, ok := publicKey.(*ssh.Certificate); ok && !r.Authorized(auth.User, cert) {
+				publicKey = cert.Key
+			}
+			if r.Authorized(auth.User, publicKey) {
+				return nil
+			}
+		}
+		// like the SSH client, the password is tried after the key
+		if auth.Password.Empty() {
+			return fmt.Errorf("ssh: unable to authenticate %s with key %s", auth.User, auth.KeyPath)
+		}
+	}
+	if password, ok := r.Passwords[auth.User]; ok && password == string(auth.Password) {
+		return nil
+	}
+	return fmt.Errorf("ssh: unable to authenticate %s with password", auth.User)
+}
+
+// Authorized checks if the public key is in the authorized_keys of the user
+func (r *Remote) Authorized(user string, publicKey ssh.PublicKey) bool {
+	return authorized(r.AuthorizedKeys[user], publicKey)
+}
+
+// runAuthorizedKeysCommand applies the authorized_keys commands package ssh sends to keys
+func runAuthorizedKeysCommand(keys map[string][]string, command string) error {
+	if match := appendKeyCommand.FindStringSubmatch(command); match != nil {
+		keys[match[2]] = append(keys[match[2]], match[1])
+		return nil
+	}
+	if match := copyKeyCommand.FindStringSubmatch(command); match != nil {
+		line := match[4]
+		for _, existing := range keys[match[3]] {
+			if strings.Contains(existing, match[1]) {
+				line = strings.Replace(existing, match[1], match[2], 1)
+				break
+			}
+		}
+		keys[match[3]] = append(keys[match[3]], line)
+		return nil
+	}
+	if match := removeKeyCommand.FindStringSubmatch(command); match != nil {
+		pattern := strings.ReplaceAll(match[1], `'\''`, "'")
+		kept := []string{}
+		for _, line := range keys[match[2]] {
+			if !strings.Contains(line, pattern) {
+				kept = append(kept, line)
+			}
+		}
+		keys[match[2]] = kept
+		return nil
+	}
+	return fmt.Errorf("unsupported command: %s", command)
+}
+
+func authorized(lines []string, publicKey ssh.PublicKey) bool {
+	_, ok := authorizedOptions(lines, publicKey)
+	return ok
+}
+
+// authorizedOptions returns the options of the first of lines authorizing publicKey
+// Certificates are authorized by cert-authority lines of their CA with a principals="..." option listing one of their principals
+func authorizedOptions(lines []string, publicKey ssh.PublicKey) ([]string, bool) {
+	cert, isCert := publicKey.(*ssh.Certificate)
+	for _, line := range lines {
+		authorized, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			continue
+		}
+		if !isCert && bytes.Equal(authorized.Marshal(), publicKey.Marshal()) {
+			return options, true
+		}
+		if isCert && slices.Contains(options, "cert-authority") && certificateValid(authorized, cert, principals(options)) {
+			return options, true
+		}
+	}
+	return nil, false
+}
+
+// certificateValid checks that cert is a valid user certificate of ca for one of principals
+func certificateValid(ca ssh.PublicKey, cert *ssh.Certificate, principals []string) bool {
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool { return bytes.Equal(auth.Marshal(), ca.Marshal()) },
+	}
+	if cert.CertType != ssh.UserCert || !checker.IsUserAuthority(cert.SignatureKey) {
+		return false
+	}
+	for _, principal := range principals {
+		if checker.CheckCert(principal, cert) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// principals returns the principals="..." option of options
+func principals(options []string) []string {
+	for _, option := range options {
+		if list, ok := strings.CutPrefix(option, `principals="`); ok {
+			return strings.Split(strings.TrimSuffix(list, `"`), ",")
+		}
+	}
+	return nil
+}
+
+// forceCommand is the critical option the forced command of a key is passed to the session in
+const forceCommand = "force-command"
+
+// forcedCommand returns the command="..." option of options
+func forcedCommand(options []string) string {
+	for _, option := range options {
+		if command, ok := strings.CutPrefix(option, `command="`); ok {
+			return strings.TrimSuffix(command, `"`)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,589 @@
+package sshtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Server is an in-process SSH server listening on the loopback interface
+// It supports password, publickey and keyboard-interactive authentication, also combined, exec sessions, the sftp subsystem
+// remote port forwarding (tcpip-forward), forwarded ports are always bound to the loopback interface,
+// and local port forwarding (direct-tcpip) as used by jump hosts
+// Exec sessions understand the authorized_keys commands package ssh sends, see Exec for others
+type Server struct {
+	// Exec, if set, handles exec requests the authorized_keys interpreter does not understand
+	// It returns the output and exit status of the command
+	Exec func(user, command string) (string, int)
+	// AuthorizedKeysCommand, if set, returns further authorized_keys lines of user for key, like sshd's AuthorizedKeysCommand
+	AuthorizedKeysCommand func(user string, key ssh.PublicKey) []string
+	// ForcedCommand, if set, handles exec requests of keys with a command="..." option
+	// It returns the output and exit status of command, originalCommand is the command the client requested
+	ForcedCommand func(user, command, originalCommand string) (string, int)
+
+	hostKey  ssh.Signer
+	hostCert ssh.Signer
+	listener net.Listener
+	sftp     sftp.Handlers
+
+	mu             sync.Mutex
+	passwords      map[string]string
+	codes          map[string]string
+	methods        map[string][]string
+	userCAs        []ssh.PublicKey
+	authorizedKeys map[string][]string
+	commands       []string
+	dialed         []string
+	forwards       map[string]forward
+	conns          map[net.Conn]bool
+	wg             sync.WaitGroup
+}
+
+// NewServer starts a server on a random loopback port, it is stopped when the test ends
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating host key: %v", err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("creating host key signer: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+
+	s := &Server{
+		hostKey:        hostKey,
+		listener:       listener,
+		sftp:           sftp.InMemHandler(),
+		passwords:      map[string]string{},
+		codes:          map[string]string{},
+		methods:        map[string][]string{},
+		authorizedKeys: map[string][]string{},
+		forwards:       map[string]forward{},
+		conns:          map[net.Conn]bool{},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Addr returns the host:port the server listens on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// TrustedHostKey returns the host key in the format of the trusted-host-key setting
+func (s *Server) TrustedHostKey() string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(s.hostKey.PublicKey())))
+}
+
+// HostKey returns the public host key of the server
+func (s *Server) HostKey() ssh.PublicKey {
+	return s.hostKey.PublicKey()
+}
+
+// SetHostCertificate offers cert, a certificate of the host key, besides the plain host key to new connections
+func (s *Server) SetHostCertificate(cert *ssh.Certificate) error {
+	signer, err := ssh.NewCertSigner(cert, s.hostKey)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hostCert = signer
+	return nil
+}
+
+// SetPassword allows user to log in with password
+func (s *Server) SetPassword(user, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.passwords[user] = password
+}
+
+// SetVerificationCode allows user to log in with keyboard-interactive, answering the password of the user if there is one and code
+func (s *Server) SetVerificationCode(user, code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes[user] = code
+}
+
+// RequireMethods makes user pass all of methods in order to log in, like sshd's AuthenticationMethods
+// The methods are password, publickey and keyboard-interactive
+func (s *Server) RequireMethods(user string, methods ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methods[user] = methods
+}
+
+// TrustUserCA accepts the user certificates of ca for the users they list as principal, like sshd's TrustedUserCAKeys
+func (s *Server) TrustUserCA(ca ssh.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.userCAs = append(s.userCAs, ca)
+}
+
+// AuthorizedKeys returns the lines of the authorized_keys file of user
+func (s *Server) AuthorizedKeys(user string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.authorizedKeys[user]...)
+}
+
+// Authorize appends line to the authorized_keys file of user
+func (s *Server) Authorize(user, line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authorizedKeys[user] = append(s.authorizedKeys[user], line)
+}
+
+// Commands returns the executed commands, prefixed by the user
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+// Dialed returns the addresses clients connected to through the server, like through a jump host
+func (s *Server) Dialed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.dialed...)
+}
+
+// Close stops the server, open connections and forwarded ports
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// verificationQuestion is the keyboard-interactive question for the verification code
+const verificationQuestion = "Verification code: "
+
+func (s *Server) checkPassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expected, ok := s.passwords[conn.User()]; ok && expected == string(password) {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("password rejected for %s", conn.User())
+}
+
+func (s *Server) checkPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	var commandLines []string
+	if s.AuthorizedKeysCommand != nil {
+		commandLines = s.AuthorizedKeysCommand(conn.User(), key)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cert, ok := key.(*ssh.Certificate); ok {
+		for _, ca := range s.userCAs {
+			if certificateValid(ca, cert, []string{conn.User()}) {
+				return nil, nil
+			}
+		}
+	}
+	if options, ok := authorizedOptions(append(commandLines, s.authorizedKeys[conn.User()]...), key); ok {
+		if command := forcedCommand(options); command != "" {
+			return &ssh.Permissions{CriticalOptions: map[string]string{forceCommand: command}}, nil
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown public key for %s", conn.User())
+}
+
+// checkVerificationCode asks for the verification code of the user, a password is asked for first if the user has one,
+// like PAM does for keyboard-interactive logins
+func (s *Server) checkVerificationCode(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	s.mu.Lock()
+	code, hasCode := s.codes[conn.User()]
+	password, hasPassword := s.passwords[conn.User()]
+	s.mu.Unlock()
+	if !hasCode {
+		return nil, fmt.Errorf("no verification code for %s", conn.User())
+	}
+	questions, echos, expected := []string{verificationQuestion}, []bool{false}, []string{code}
+	if hasPassword {
+		questions, echos, expected = append([]string{"Password: "}, questions...), append([]bool{false}, echos...), append([]string{password}, expected...)
+	}
+	answers, err := challenge(conn.User(), "", questions, echos)
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != len(expected) {
+		return nil, fmt.Errorf("expected %d answers from %s", len(expected), conn.User())
+	}
+	for i := range expected {
+		if answers[i] != expected[i] {
+			return nil, fmt.Errorf("keyboard-interactive rejected for %s", conn.User())
+		}
+	}
+	return nil, nil
+}
+
+// config returns the config of a new connection, it tracks the methods of RequireMethods the connection passed
+func (s *Server) config() *ssh.ServerConfig {
+	var passed []string
+	var keyPermissions *ssh.Permissions
+	var callbacks ssh.ServerAuthCallbacks
+	// complete accepts method as next of the required methods of the user, the login succeeds once all passed
+	complete := func(conn ssh.ConnMetadata, method string, permissions *ssh.Permissions, err error) (*ssh.Permissions, error) {
+		if err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		required := s.methods[conn.User()]
+		s.mu.Unlock()
+		if len(required) == 0 {
+			return permissions, nil
+		}
+		if len(passed) >= len(required) || required[len(passed)] != method {
+			return nil, fmt.Errorf("%s not allowed for %s after %v", method, conn.User(), passed)
+		}
+		passed = append(passed, method)
+		if permissions != nil {
+			keyPermissions = permissions
+		}
+		if len(passed) < len(required) {
+			return nil, &ssh.PartialSuccessError{Next: callbacks}
+		}
+		return keyPermissions, nil
+	}
+	callbacks = ssh.ServerAuthCallbacks{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			permissions, err := s.checkPassword(conn, password)
+			return complete(conn, "password", permissions, err)
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			permissions, err := s.checkPublicKey(conn, key)
+			return complete(conn, "publickey", permissions, err)
+		},
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			permissions, err := s.checkVerificationCode(conn, challenge)
+			return complete(conn, "keyboard-interactive", permissions, err)
+		},
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback:            callbacks.PasswordCallback,
+		PublicKeyCallback:           callbacks.PublicKeyCallback,
+		KeyboardInteractiveCallback: callbacks.KeyboardInteractiveCallback,
+	}
+	config.AddHostKey(s.hostKey)
+	s.mu.Lock()
+	if s.hostCert != nil {
+		config.AddHostKey(s.hostCert)
+	}
+	s.mu.Unlock()
+	return config
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn, s.config())
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+	defer s.cancelForwards(serverConn)
+
+	go func() {
+		for request := range requests {
+			switch request.Type {
+			case "tcpip-forward":
+				port, err := s.startForward(serverConn, request.Payload)
+				if err != nil {
+					request.Reply(false, nil)
+					continue
+				}
+				request.Reply(true, ssh.Marshal(struct{ Port uint32 }{uint32(port)}))
+			case "cancel-tcpip-forward":
+				s.cancelForward(request.Payload)
+				request.Reply(true, nil)
+			default:
+				if request.WantReply {
+					request.Reply(false, nil)
+				}
+			}
+		}
+	}()
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() == "direct-tcpip" {
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.directTCPIP(newChannel)
+			}()
+			continue
+		}
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			forced := ""
+			if serverConn.Permissions != nil {
+				forced = serverConn.Permissions.CriticalOptions[forceCommand]
+			}
+			s.session(serverConn.User(), forced, channel, channelRequests)
+		}()
+	}
+}
+
+// directTCPIP connects the channel to the address the client asked for
+func (s *Server) directTCPIP(newChannel ssh.NewChannel) {
+	// the payload of direct-tcpip is laid out like the one of forwarded-tcpip
+	var request forwardedChannel
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &request); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "invalid direct-tcpip request")
+		return
+	}
+	address := net.JoinHostPort(request.Addr, strconv.Itoa(int(request.Port)))
+	s.mu.Lock()
+	s.dialed = append(s.dialed, address)
+	s.mu.Unlock()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer conn.Close()
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(conn, channel)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(channel, conn)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+type forward struct {
+	listener net.Listener
+	conn     *ssh.ServerConn
+}
+
+type forwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+type forwardedChannel struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// startForward listens on the loopback interface and forwards accepted connections to the client
+// It returns the bound port
+func (s *Server) startForward(conn *ssh.ServerConn, payload []byte) (int, error) {
+	var request forwardRequest
+	if err := ssh.Unmarshal(payload, &request); err != nil {
+		return 0, err
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(request.BindPort))))
+	if err != nil {
+		return 0, err
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	address := net.JoinHostPort(request.BindAddr, strconv.Itoa(port))
+	s.mu.Lock()
+	s.forwards[address] = forward{listener: listener, conn: conn}
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			remoteConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			origin := remoteConn.RemoteAddr().(*net.TCPAddr)
+			channel, requests, err := conn.OpenChannel("forwarded-tcpip", ssh.Marshal(forwardedChannel{
+				Addr:       request.BindAddr,
+				Port:       uint32(port),
+				OriginAddr: origin.IP.String(),
+				OriginPort: uint32(origin.Port),
+			}))
+			if err != nil {
+				remoteConn.Close()
+				continue
+			}
+			go ssh.DiscardRequests(requests)
+			go pipe(channel, remoteConn)
+		}
+	}()
+	return port, nil
+}
+
+func (s *Server) cancelForward(payload []byte) {
+	var request forwardRequest
+	if err := ssh.Unmarshal(payload, &request); err != nil {
+		return
+	}
+	address := net.JoinHostPort(request.BindAddr, strconv.Itoa(int(request.BindPort)))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if forward, ok := s.forwards[address]; ok {
+		forward.listener.Close()
+		delete(s.forwards, address)
+	}
+}
+
+// cancelForwards closes the forwarded ports of conn
+func (s *Server) cancelForwards(conn *ssh.ServerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for address, forward := range s.forwards {
+		if forward.conn == conn {
+			forward.listener.Close()
+			delete(s.forwards, address)
+		}
+	}
+}
+
+func pipe(channel ssh.Channel, conn net.Conn) {
+	defer channel.Close()
+	defer conn.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(channel, conn)
+		channel.CloseWrite()
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, channel)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// session serves a session channel, forced is the command="..." option of the key user logged in with
+func (s *Server) session(user, forced string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for request := range requests {
+		switch request.Type {
+		case "exec":
+			var exec struct{ Command string }
+			if err := ssh.Unmarshal(request.Payload, &exec); err != nil {
+				request.Reply(false, nil)
+				continue
+			}
+			request.Reply(true, nil)
+			var output string
+			var status int
+			if forced != "" {
+				output, status = s.forcedExec(user, forced, exec.Command)
+			} else {
+				output, status = s.exec(user, exec.Command)
+			}
+			io.WriteString(channel, output)
+			sendExitStatus(channel, status)
+			return
+		case "subsystem":
+			var subsystem struct{ Name string }
+			if err := ssh.Unmarshal(request.Payload, &subsystem); err != nil || subsystem.Name != "sftp" {
+				request.Reply(false, nil)
+				continue
+			}
+			request.Reply(true, nil)
+			server := sftp.NewRequestServer(channel, s.sftp)
+			server.Serve()
+			server.Close()
+			sendExitStatus(channel, 0)
+			return
+		default:
+			if request.WantReply {
+				request.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (s *Server) exec(user, command string) (string, int) {
+	s.mu.Lock()
+	s.commands = append(s.commands, fmt.Sprintf("%s: %s", user, command))
+	err := runAuthorizedKeysCommand(s.authorizedKeys, command)
+	s.mu.Unlock()
+	if err == nil {
+		return "", 0
+	}
+	if s.Exec != nil {
+		return s.Exec(user, command)
+	}
+	return err.Error() + "\n", 127
+}
+
+func (s *Server) forcedExec(user, command, originalCommand string) (string, int) {
+	s.mu.Lock()
+	s.commands = append(s.commands, fmt.Sprintf("%s: %s", user, originalCommand))
+	s.mu.Unlock()
+	if s.ForcedCommand == nil {
+		return fmt.Sprintf("unsupported forced command: %s\n", command), 127
+	}
+	return s.ForcedCommand(user, command, originalCommand)
+}
+
+func sendExitStatus(channel ssh.Channel, status int) {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(status))
+	channel.SendRequest("exit-status", false, payload)
+}
@@ -0,0 +1,107 @@
+package sshtest
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func dial(t *testing.T, s *Server, user, password string) *ssh.Client {
+	t.Helper()
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s.TrustedHostKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ssh.Dial("tcp", s.Addr(), &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+	})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestServerExec(t *testing.T) {
+	s := NewServer(t)
+	s.SetPassword("admin", "secret")
+	s.Exec = func(user, command string) (string, int) {
+		if command == "hostname" {
+			return "relay\n", 0
+		}
+		return "", 127
+	}
+	client := dial(t, s, "admin", "secret")
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Run(`echo "ssh-ed25519 AAAA test" >> /home/tunneluser/.ssh/authorized_keys`); err != nil {
+		t.Fatalf("authorizing key: %v", err)
+	}
+	if keys := s.AuthorizedKeys("tunneluser"); len(keys) != 1 || keys[0] != "ssh-ed25519 AAAA test" {
+		t.Errorf("unexpected authorized keys %v", keys)
+	}
+
+	session, _ = client.NewSession()
+	output, err := session.Output("hostname")
+	if err != nil || string(output) != "relay\n" {
+		t.Errorf("hostname returned %q (%v)", output, err)
+	}
+
+	session, _ = client.NewSession()
+	if err := session.Run("reboot"); err == nil {
+		t.Error("unknown command succeeded")
+	}
+}
+
+func TestServerRejectsWrongPassword(t *testing.T) {
+	s := NewServer(t)
+	s.SetPassword("admin", "secret")
+	_, err := ssh.Dial("tcp", s.Addr(), &ssh.ClientConfig{
+		User:            "admin",
+		Auth:            []ssh.AuthMethod{ssh.Password("wrong")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		t.Fatal("login with wrong password succeeded")
+	}
+}
+
+func TestServerSFTP(t *testing.T) {
+	s := NewServer(t)
+	s.SetPassword("admin", "secret")
+
+	client, err := sftp.NewClient(dial(t, s, "admin", "secret"))
+	if err != nil {
+		t.Fatalf("sftp: %v", err)
+	}
+	defer client.Close()
+	file, err := client.Create("/authorized_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("key\n"))
+	file.Close()
+
+	// files persist across sessions
+	other, err := sftp.NewClient(dial(t, s, "admin", "secret"))
+	if err != nil {
+		t.Fatalf("sftp: %v", err)
+	}
+	defer other.Close()
+	file, err = other.Open("/authorized_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(file)
+	if !bytes.Equal(data, []byte("key\n")) {
+		t.Errorf("read %q", data)
+	}
+}
@@ -0,0 +1,68 @@
+package ssh
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/gateway"
+)
+
+var (
+	gatewayMu sync.Mutex
+	// gatewayURL is the gateway the first host of every connection is reached through, nil to connect directly
+	gatewayURL *url.URL
+	// gatewayCA is the file of the certificates gatewayRoots is read from
+	gatewayCA    string
+	gatewayRoots *x509.CertPool
+)
+
+// SetGateway makes all connections go through the TLS or WebSocket gateway at rawURL, see gateway.ParseURL
+// The gateway certificate is verified with the certificates in caPath, the system roots if it is empty
+func SetGateway(rawURL, caPath string) error {
+	var u *url.URL
+	var roots *x509.CertPool
+	if rawURL != "" {
+		var err error
+		if u, err = gateway.ParseURL(rawURL); err != nil {
+			return err
+		}
+		if caPath != "" {
+			if roots, err = gateway.LoadCA(caPath); err != nil {
+				return err
+			}
+		}
+	}
+	gatewayMu.Lock()
+	defer gatewayMu.Unlock()
+	gatewayURL, gatewayCA, gatewayRoots = u, caPath, roots
+	return nil
+}
+
+// Gateway returns the gateway connections go through and the file its certificate is verified with, the URL is nil without gateway
+func Gateway() (*url.URL, string) {
+	gatewayMu.Lock()
+	defer gatewayMu.Unlock()
+	return gatewayURL, gatewayCA
+}
+
+// dialFirst connects to address, the first host of a connection, through the gateway and the proxy if they are set
+// The gateway forwards to the sshd next to it, whatever address is
+func dialFirst(address string, timeout time.Duration) (net.Conn, error) {
+	gatewayMu.Lock()
+	u, roots := gatewayURL, gatewayRoots
+	gatewayMu.Unlock()
+	if u == nil {
+		return dialTCP(address, timeout)
+	}
+	slog.Debug(fmt.Sprintf("Connecting to %s through gateway %s", address, u))
+	conn, err := dialTCP(u.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return gateway.Wrap(conn, u, roots)
+}
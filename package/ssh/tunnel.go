@@ -0,0 +1,90 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Tunnel is a remote port forward: connections to a port on the relay server are forwarded to a local address
+// It is the equivalent of `ssh -N -R remotePort:localAddress`
+type Tunnel struct {
+	client   *ssh.Client
+	listener net.Listener
+	local    string
+	wg       sync.WaitGroup
+}
+
+// OpenTunnel connects to remote and requests the forward of remotePort to local
+// remotePort 0 lets the server choose the port, see Addr
+func OpenTunnel(remote string, auth RemoteAuth, remotePort int, local string) (*Tunnel, error) {
+	slog.Debug(fmt.Sprintf("Opening tunnel from %s port %d to %s", remote, remotePort, local))
+	client, err := SSHRemoteRunner{}.dial(remote, auth)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := client.Listen("tcp", net.JoinHostPort("0.0.0.0", strconv.Itoa(remotePort)))
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to request remote forward: %v", err)
+	}
+	t := &Tunnel{client: client, listener: listener, local: local}
+	t.wg.Add(1)
+	go t.serve()
+	return t, nil
+}
+
+// Addr returns the address the relay server listens on
+func (t *Tunnel) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// Wait blocks until the connection to the relay server is lost or closed
+func (t *Tunnel) Wait() error {
+	return t.client.Wait()
+}
+
+// Close cancels the forward and disconnects from the relay server
+func (t *Tunnel) Close() error {
+	t.listener.Close()
+	err := t.client.Close()
+	t.wg.Wait()
+	return err
+}
+
+func (t *Tunnel) serve() {
+	defer t.wg.Done()
+	for {
+		remoteConn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		go t.forward(remoteConn)
+	}
+}
+
+func (t *Tunnel) forward(remoteConn net.Conn) {
+	defer remoteConn.Close()
+	localConn, err := net.Dial("tcp", t.local)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error connecting to %s: %v", t.local, err))
+		return
+	}
+	defer localConn.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(localConn, remoteConn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(remoteConn, localConn)
+		done <- struct{}{}
+	}()
+	<-done
+}
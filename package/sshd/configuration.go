@@ -1,6 +1,7 @@
 package sshd
 
 import (
+	"fmt"
 	"log/slog"
 	"regexp"
 )
@@ -29,3 +30,133 @@ func AllowTcpForwarding(sshdConfig *[]byte) {
 		*sshdConfig = allowTcpForwardingPattern.ReplaceAll(*sshdConfig, []byte("AllowTcpForwarding yes"))
 	}
 }
+
+// blockPattern matches the block name managed by the tool, between marker comments
+func blockPattern(name string) *regexp.Regexp {
+	begin := regexp.QuoteMeta("# BEGIN ssh-tunnel-setup " + name)
+	end := regexp.QuoteMeta("# END ssh-tunnel-setup " + name)
+	return regexp.MustCompile(`(?s)\n?` + begin + `.*?` + end + `\n?`)
+}
+
+// replaceBlock replaces the block name with lines, without lines the block is removed
+func replaceBlock(sshdConfig *[]byte, name, lines string) {
+	pattern := blockPattern(name)
+	if pattern.Match(*sshdConfig) {
+		slog.Debug(fmt.Sprintf("Removing %s block from sshd_config", name))
+		*sshdConfig = pattern.ReplaceAll(*sshdConfig, nil)
+	}
+	if lines == "" {
+		return
+	}
+	slog.Debug(fmt.Sprintf("Adding %s block to sshd_config", name))
+	block := fmt.Sprintf("\n# BEGIN ssh-tunnel-setup %s\n%s# END ssh-tunnel-setup %s\n", name, lines, name)
+	*sshdConfig = append(*sshdConfig, []byte(block)...)
+}
+
+var matchPattern = regexp.MustCompile(`(?m)^[ \t]*Match\s`)
+
+// replaceGlobalBlock replaces the block name with lines before the first Match block, for keywords not allowed in Match blocks
+func replaceGlobalBlock(sshdConfig *[]byte, name, lines string) {
+	replaceBlock(sshdConfig, name, "")
+	if lines == "" {
+		return
+	}
+	location := matchPattern.FindIndex(*sshdConfig)
+	if location == nil {
+		replaceBlock(sshdConfig, name, lines)
+		return
+	}
+	slog.Debug(fmt.Sprintf("Adding %s block before the first Match block of sshd_config", name))
+	block := fmt.Sprintf("# BEGIN ssh-tunnel-setup %s\n%s# END ssh-tunnel-setup %s\n\n", name, lines, name)
+	updated := append([]byte{}, (*sshdConfig)[:location[0]]...)
+	updated = append(updated, block...)
+	*sshdConfig = append(updated, (*sshdConfig)[location[0]:]...)
+}
+
+var matchUserPattern = regexp.MustCompile(`(?m)^Match User (\S+)$`)
+
+// blockUser returns the user the block name matches, it is empty if there is no block
+func blockUser(sshdConfig []byte, name string) string {
+	block := blockPattern(name).Find(sshdConfig)
+	if match := matchUserPattern.FindSubmatch(block); match != nil {
+		return string(match[1])
+	}
+	return ""
+}
+
+const (
+	enrollBlock = "enrollment"
+	userCABlock = "user-ca"
+	hostCABlock = "host-ca"
+)
+
+// EnrollAccount replaces the Match block of the enroll account user in the sshd_config file
+// Every key of user is passed to keysCommand, no other login is possible, without user the block is removed
+func EnrollAccount(user, keysCommand string) func(sshdConfig *[]byte) {
+	return func(sshdConfig *[]byte) {
+		if user == "" {
+			replaceBlock(sshdConfig, enrollBlock, "")
+			return
+		}
+		// Match all ends the block, so settings appended later stay global
+		replaceBlock(sshdConfig, enrollBlock, fmt.Sprintf(`Match User %s
+    AuthorizedKeysFile none
+    AuthorizedKeysCommand %s
+    AuthorizedKeysCommandUser nobody
+    PasswordAuthentication no
+    KbdInteractiveAuthentication no
+    DisableForwarding yes
+    PermitTTY no
+Match all
+`, user, keysCommand))
+	}
+}
+
+// EnrolledUser returns the enroll account configured by EnrollAccount, it is empty if there is none
+func EnrolledUser(sshdConfig []byte) string {
+	return blockUser(sshdConfig, enrollBlock)
+}
+
+// TrustUserCA replaces the Match block trusting the user certificate authority at caKeysPath for user
+// Certificates log in as user if they list user as principal and their key is not in revokedKeysPath,
+// without user the block is removed
+func TrustUserCA(user, caKeysPath, revokedKeysPath string) func(sshdConfig *[]byte) {
+	return func(sshdConfig *[]byte) {
+		if user == "" {
+			replaceBlock(sshdConfig, userCABlock, "")
+			return
+		}
+		replaceBlock(sshdConfig, userCABlock, fmt.Sprintf(`Match User %s
+    TrustedUserCAKeys %s
+    RevokedKeys %s
+Match all
+`, user, caKeysPath, revokedKeysPath))
+	}
+}
+
+// TrustedUser returns the user TrustUserCA trusts the user certificate authority for, it is empty if there is none
+func TrustedUser(sshdConfig []byte) string {
+	return blockUser(sshdConfig, userCABlock)
+}
+
+var hostCertificatePattern = regexp.MustCompile(`(?m)^HostCertificate (\S+)$`)
+
+// HostCertificates replaces the HostCertificate lines of the host certificates at paths, without paths they are removed
+func HostCertificates(paths []string) func(sshdConfig *[]byte) {
+	return func(sshdConfig *[]byte) {
+		lines := ""
+		for _, path := range paths {
+			lines += fmt.Sprintf("HostCertificate %s\n", path)
+		}
+		replaceGlobalBlock(sshdConfig, hostCABlock, lines)
+	}
+}
+
+// ConfiguredHostCertificates returns the host certificates configured by HostCertificates
+func ConfiguredHostCertificates(sshdConfig []byte) []string {
+	paths := []string{}
+	for _, match := range hostCertificatePattern.FindAllSubmatch(blockPattern(hostCABlock).Find(sshdConfig), -1) {
+		paths = append(paths, string(match[1]))
+	}
+	return paths
+}
@@ -0,0 +1,81 @@
+package sshd
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+)
+
+// Backup copies the sshd config at path to backupPath
+func Backup(path, backupPath string) error {
+	slog.Debug("Backing up sshd configuration")
+	sshdConfig, err := system.Files().ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read sshd config: %v", err)
+	}
+	err = system.Files().WriteFile(backupPath, sshdConfig, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to back up sshd config: %v", err)
+	}
+	return nil
+}
+
+// Restore replaces the sshd config at path with the backup at backupPath
+func Restore(path, backupPath string) error {
+	slog.Debug("Restoring sshd configuration")
+	sshdConfig, err := system.Files().ReadFile(backupPath)
+	if err != nil {
+		return fmt.Errorf("failed to read sshd config backup: %v", err)
+	}
+	err = system.Files().WriteFile(path, sshdConfig, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to restore sshd config: %v", err)
+	}
+	return nil
+}
+
+// Update applies the edits to the sshd config at path
+// If sshd rejects the edited config, the previous one is restored
+func Update(path string, edits ...func(sshdConfig *[]byte)) error {
+	previous, err := system.Files().ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read sshd config: %v", err)
+	}
+	sshdConfig := append([]byte{}, previous...)
+	for _, edit := range edits {
+		edit(&sshdConfig)
+	}
+	if err := system.Files().WriteFile(path, sshdConfig, 0644); err != nil {
+		return err
+	}
+	if err := Validate(path); err != nil {
+		if restoreErr := system.Files().WriteFile(path, previous, 0644); restoreErr != nil {
+			return fmt.Errorf("%v, failed to restore previous sshd config: %v", err, restoreErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Validate checks the sshd config at path with sshd -t
+func Validate(path string) error {
+	slog.Debug("Validating sshd configuration")
+	output, err := system.Commands().Run(nil, "sudo", "sshd", "-t", "-f", path)
+	if err != nil {
+		return fmt.Errorf("invalid sshd config %s: %v: %s", path, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Restart restarts the sshd service, configs written without Update have to be validated first
+func Restart() error {
+	slog.Debug("Restarting sshd")
+	_, err := system.Commands().Run(nil, "sudo", "systemctl", "restart", "sshd")
+	if err != nil {
+		return fmt.Errorf("failed to restart sshd: %v", err)
+	}
+	slog.Debug("sshd restarted")
+	return nil
+}
@@ -0,0 +1,283 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+)
+
+// Role identifies the machine role a manifest belongs to
+type Role string
+
+const (
+	RoleServer Role = "server"
+	RoleClient Role = "client"
+	RoleTarget Role = "target"
+)
+
+// ParseRole validates the provided role name
+func ParseRole(role string) (Role, error) {
+	switch Role(role) {
+	case RoleServer, RoleClient, RoleTarget:
+		return Role(role), nil
+	}
+	return "", fmt.Errorf("unknown role %q, expected one of %s, %s, %s", role, RoleServer, RoleClient, RoleTarget)
+}
+
+// Kind identifies the type of an artifact created during setup
+type Kind string
+
+const (
+	// KindFile is a file written by the tool, Path is removed on uninstall
+	KindFile Kind = "file"
+	// KindKeyPair is a generated key pair, Path is the private key, the public key is Path.pub
+	KindKeyPair Kind = "key-pair"
+	// KindAuthorizedKey is the public key of the private key at Path authorized for RemoteUser on Remote
+	KindAuthorizedKey Kind = "authorized-key"
+	// KindSSHConfigHost is the Host block Name added to the ssh config at Path
+	KindSSHConfigHost Kind = "ssh-config-host"
+	// KindSystemdUnit is the systemd unit Name installed at Path
+	KindSystemdUnit Kind = "systemd-unit"
+	// KindUser is the system user Name
+	KindUser Kind = "user"
+	// KindGroupMember is the membership of user Name in Group
+	KindGroupMember Kind = "group-member"
+	// KindSSHDConfig is the sshd config at Path that was edited, the original is kept at Backup
+	KindSSHDConfig Kind = "sshd-config"
+	// KindCronEntry is the line Name added to the crontab at Path
+	KindCronEntry Kind = "cron-entry"
+	// KindKnownHostCA is the @cert-authority line for the host patterns Name added to the known_hosts file at Path
+	KindKnownHostCA Kind = "known-host-ca"
+)
+
+// Artifact is a single change the tool made to the system
+type Artifact struct {
+	Kind       Kind      `json:"kind"`
+	Path       string    `json:"path,omitempty"`
+	Name       string    `json:"name,omitempty"`
+	Group      string    `json:"group,omitempty"`
+	Backup     string    `json:"backup,omitempty"`
+	Remote     string    `json:"remote,omitempty"`
+	RemoteUser string    `json:"remote-user,omitempty"`
+	Created    time.Time `json:"created"`
+}
+
+func (a Artifact) String() string {
+	switch a.Kind {
+	case KindUser:
+		return fmt.Sprintf("%s %s", a.Kind, a.Name)
+	case KindGroupMember:
+		return fmt.Sprintf("%s %s in %s", a.Kind, a.Name, a.Group)
+	case KindSSHConfigHost, KindKnownHostCA, KindCronEntry:
+		return fmt.Sprintf("%s %s in %s", a.Kind, a.Name, a.Path)
+	case KindAuthorizedKey:
+		return fmt.Sprintf("%s %s for %s@%s", a.Kind, a.Path, a.RemoteUser, a.Remote)
+	}
+	return fmt.Sprintf("%s %s", a.Kind, a.Path)
+}
+
+func (a Artifact) same(other Artifact) bool {
+	return a.Kind == other.Kind && a.Path == other.Path && a.Name == other.Name && a.Group == other.Group && a.Remote == other.Remote && a.RemoteUser == other.RemoteUser
+}
+
+// Step is a completed setup step, Checksums holds the sha256 of every file the step produced
+type Step struct {
+	Name      string            `json:"name"`
+	Checksums map[string]string `json:"checksums,omitempty"`
+	Completed time.Time         `json:"completed"`
+}
+
+// Drifted returns the files of the step that changed or vanished since the step was completed
+func (s Step) Drifted() []string {
+	drifted := []string{}
+	for path, checksum := range s.Checksums {
+		current, err := Checksum(path)
+		if err != nil || current != checksum {
+			drifted = append(drifted, path)
+		}
+	}
+	sort.Strings(drifted)
+	return drifted
+}
+
+// Checksum returns the hex encoded sha256 of the file at path
+func Checksum(path string) (string, error) {
+	data, err := system.Files().ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Manifest records the artifacts created for a role so they can be reverted later
+// and the completed setup steps so a setup can be resumed or re-run
+type Manifest struct {
+	Role      Role       `json:"role"`
+	Artifacts []Artifact `json:"artifacts"`
+	Steps     []Step     `json:"steps,omitempty"`
+
+	path string
+}
+
+const stateDirName = "ssh-tunnel-setup"
+const systemStateDir = "/var/lib/" + stateDirName
+
+// Dir returns the directory manifests are stored in
+// root uses the system state directory, other users their XDG state directory
+func Dir() (string, error) {
+	if os.Geteuid() == 0 {
+		return systemStateDir, nil
+	}
+	if xdgState := os.Getenv("XDG_STATE_HOME"); xdgState != "" {
+		return filepath.Join(xdgState, stateDirName), nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".local", "state", stateDirName), nil
+}
+
+// Load reads the manifest for the provided role, a missing manifest results in an empty one
+func Load(role Role) (*Manifest, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine state directory: %v", err)
+	}
+	return LoadFile(filepath.Join(dir, string(role)+".json"), role)
+}
+
+// LoadFile reads the manifest at path, a missing manifest results in an empty one
+func LoadFile(path string, role Role) (*Manifest, error) {
+	m := &Manifest{Role: role, path: path}
+	data, err := system.Files().ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Debug(fmt.Sprintf("No manifest found at %s", path))
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %v", path, err)
+	}
+	if m.Role != role {
+		return nil, fmt.Errorf("manifest %s belongs to role %s, not %s", path, m.Role, role)
+	}
+	return m, nil
+}
+
+// Path returns the location of the manifest file
+func (m *Manifest) Path() string {
+	return m.path
+}
+
+// Contains checks if the artifact is already recorded
+func (m *Manifest) Contains(a Artifact) bool {
+	for _, existing := range m.Artifacts {
+		if existing.same(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// Record adds the artifact to the manifest and persists it immediately,
+// so an interrupted setup can still be reverted
+func (m *Manifest) Record(a Artifact) error {
+	if m.Contains(a) {
+		slog.Debug(fmt.Sprintf("Artifact already recorded: %s", a))
+		return nil
+	}
+	if a.Created.IsZero() {
+		a.Created = time.Now().UTC()
+	}
+	slog.Debug(fmt.Sprintf("Recording artifact: %s", a))
+	m.Artifacts = append(m.Artifacts, a)
+	return m.Save()
+}
+
+// Forget removes the artifact from the manifest and persists it
+func (m *Manifest) Forget(a Artifact) error {
+	kept := m.Artifacts[:0]
+	for _, existing := range m.Artifacts {
+		if !existing.same(a) {
+			kept = append(kept, existing)
+		}
+	}
+	m.Artifacts = kept
+	return m.Save()
+}
+
+// Step returns the completed step with the provided name
+func (m *Manifest) Step(name string) (Step, bool) {
+	for _, step := range m.Steps {
+		if step.Name == name {
+			return step, true
+		}
+	}
+	return Step{}, false
+}
+
+// CompleteStep marks the step as completed, checksumming the files it produced, and persists the manifest
+func (m *Manifest) CompleteStep(name string, paths ...string) error {
+	step := Step{Name: name, Completed: time.Now().UTC()}
+	if len(paths) > 0 {
+		step.Checksums = map[string]string{}
+	}
+	for _, path := range paths {
+		checksum, err := Checksum(path)
+		if err != nil {
+			return fmt.Errorf("failed to checksum %s: %v", path, err)
+		}
+		step.Checksums[path] = checksum
+	}
+
+	slog.Debug(fmt.Sprintf("Completed step: %s", name))
+	for i, existing := range m.Steps {
+		if existing.Name == name {
+			m.Steps[i] = step
+			return m.Save()
+		}
+	}
+	m.Steps = append(m.Steps, step)
+	return m.Save()
+}
+
+// ResetSteps forgets all completed steps, so the next setup runs every step again
+func (m *Manifest) ResetSteps() error {
+	m.Steps = nil
+	return m.Save()
+}
+
+// Save writes the manifest to disk, an empty manifest removes the file
+func (m *Manifest) Save() error {
+	if len(m.Artifacts) == 0 && len(m.Steps) == 0 {
+		err := system.Files().Remove(m.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove manifest: %v", err)
+		}
+		return nil
+	}
+	if err := system.Files().MkdirAll(filepath.Dir(m.path), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	if err := system.Files().WriteFile(m.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
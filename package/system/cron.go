@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -34,7 +35,30 @@ import (
 	    /5 *
 */
 const crontabDir = "/var/spool/cron/crontabs"
+const cronJobDir = "/etc/cron.d"
+const monitorScriptDir = "/usr/local/bin"
 
+// CronPath returns the path of the crontab of the provided user
+func CronPath(user string) string {
+	return fmt.Sprintf("%s/%s", crontabDir, user)
+}
+
+// MonitorScriptPath returns the path of the monitor script for the provided service
+func MonitorScriptPath(serviceName string) string {
+	return monitorScriptPath(serviceName, monitorScriptDir)
+}
+
+func monitorScriptPath(serviceName, scriptDir string) string {
+	return fmt.Sprintf("%s/%s-monitor.sh", scriptDir, serviceName)
+}
+
+// CronMonitorEntry returns the crontab line of the monitor of the provided service
+func CronMonitorEntry(serviceName string, interval time.Duration) string {
+	return fmt.Sprintf("*/%d * * * * %s", int(interval.Minutes()), MonitorScriptPath(serviceName))
+}
+
+// CreateCronMonitor writes the monitor script of the service and adds its line to the crontab of user
+// Other lines of the crontab are kept
 func CreateCronMonitor(serviceName, user string, localPort int, interval time.Duration) error {
 	slog.Debug("Creating cron monitor")
 
@@ -43,29 +67,20 @@ func CreateCronMonitor(serviceName, user string, localPort int, interval time.Du
 		return fmt.Errorf("failed to ensure crontab directory: %v", err)
 	}
 
-	cronPath := fmt.Sprintf("%s/%s", crontabDir, user)
-	slog.Debug("Creating cron file")
-	cronFile, err := os.Create(cronPath)
-	if err != nil {
-		return fmt.Errorf("failed to create cron file: %v", err)
-	}
-
-	defer cronFile.Close()
-
-	scriptPath := createServiceMonitor(serviceName, user, localPort, "/usr/local/bin")
+	scriptPath := createServiceMonitor(serviceName, user, localPort, monitorScriptDir)
 	if scriptPath == "" {
 		return fmt.Errorf("failed to create monitor script")
 	}
 
 	slog.Debug("Writing cron configuration")
-	cronConfig := fmt.Sprintf("*/%d * * * * %s\n", interval, scriptPath)
-	_, err = cronFile.WriteString(cronConfig)
+	cronPath := CronPath(user)
+	err = AddCronEntry(cronPath, CronMonitorEntry(serviceName, interval))
 	if err != nil {
 		return fmt.Errorf("failed to write cron configuration: %v", err)
 	}
 
 	slog.Debug("Setting cron file permissions")
-	err = os.Chmod(cronPath, 0600)
+	err = files.Chmod(cronPath, 0600)
 	if err != nil {
 		return fmt.Errorf("failed to chmod cron file: %v", err)
 	}
@@ -73,9 +88,95 @@ func CreateCronMonitor(serviceName, user string, localPort int, interval time.Du
 	return nil
 }
 
+// CronEntryExists checks if the crontab at path contains line
+func CronEntryExists(path, line string) bool {
+	crontab, err := files.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	for _, l := range strings.Split(string(crontab), "\n") {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+// AddCronEntry appends line to the crontab at path unless it is there already
+func AddCronEntry(path, line string) error {
+	if CronEntryExists(path, line) {
+		return nil
+	}
+	crontab, err := files.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(crontab) > 0 && !strings.HasSuffix(string(crontab), "\n") {
+		crontab = append(crontab, '\n')
+	}
+	crontab = append(crontab, line+"\n"...)
+	return files.WriteFile(path, crontab, 0600)
+}
+
+// RemoveCronEntry removes line from the crontab at path, the other lines are kept
+func RemoveCronEntry(path, line string) error {
+	crontab, err := files.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	kept := []string{}
+	for _, l := range strings.SplitAfter(string(crontab), "\n") {
+		if strings.TrimSuffix(l, "\n") != line {
+			kept = append(kept, l)
+		}
+	}
+	return files.WriteFile(path, []byte(strings.Join(kept, "")), 0600)
+}
+
+// CronJobPath returns the path of the system cron job name
+func CronJobPath(name string) string {
+	return fmt.Sprintf("%s/%s", cronJobDir, name)
+}
+
+// CreateCronJob writes the system cron job name running command as user every interval
+func CreateCronJob(name, user string, interval time.Duration, command string) error {
+	slog.Debug("Creating cron job")
+
+	schedule, err := cronSchedule(interval)
+	if err != nil {
+		return err
+	}
+	err = files.MkdirAll(cronJobDir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create cron job directory: %v", err)
+	}
+	cronConfig := fmt.Sprintf("%s %s %s\n", schedule, user, command)
+	err = files.WriteFile(CronJobPath(name), []byte(cronConfig), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write cron job: %v", err)
+	}
+	return nil
+}
+
+// cronSchedule returns the schedule of interval, cron only repeats whole hours within a day or whole days
+func cronSchedule(interval time.Duration) (string, error) {
+	switch {
+	case interval < time.Hour || interval%time.Hour != 0:
+		return "", fmt.Errorf("interval %s is not a whole number of hours", interval)
+	case interval < 24*time.Hour:
+		return fmt.Sprintf("0 */%d * * *", int(interval.Hours())), nil
+	case interval%(24*time.Hour) == 0 && interval <= 31*24*time.Hour:
+		return fmt.Sprintf("0 0 */%d * *", int(interval.Hours()/24)), nil
+	}
+	return "", fmt.Errorf("interval %s is not a whole number of days up to 31", interval)
+}
+
 func ensureCrontabDir(user string) error {
 	slog.Debug("Ensuring crontab directory in user space")
-	err := os.MkdirAll("/var/spool/cron/crontabs", 0700)
+	err := files.MkdirAll(crontabDir, 0700)
 	if err != nil {
 		return fmt.Errorf("failed to create crontab directory: %v", err)
 	}
@@ -84,14 +185,14 @@ func ensureCrontabDir(user string) error {
 }
 
 func createServiceMonitor(serviceName, user string, localPort int, scriptDir string) string {
-	scriptPath := fmt.Sprintf("%s/%s-monitor.sh", scriptDir, serviceName)
+	scriptPath := monitorScriptPath(serviceName, scriptDir)
 	script := fmt.Sprintf(`#!/bin/bash
 if ! nc -z localhost %d; then
 	systemctl restart %s
 fi
 `, localPort, serviceName)
 
-	err := os.WriteFile(scriptPath, []byte(script), 0700)
+	err := files.WriteFile(scriptPath, []byte(script), 0700)
 	if err != nil {
 		return ""
 	}
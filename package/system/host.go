@@ -0,0 +1,207 @@
+package system
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+)
+
+// FS abstracts the filesystem operations of the setup steps
+type FS interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	MkdirAll(path string, perm os.FileMode) error
+	Stat(name string) (os.FileInfo, error)
+	Chmod(name string, mode os.FileMode) error
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	// ReadDir returns the names of the entries of the directory name in lexical order
+	ReadDir(name string) ([]string, error)
+	// AppendLine appends line to the existing file name, on a new line if the file does not end with one
+	// The append is a single write under an exclusive lock of the file, so concurrent appends are not lost
+	AppendLine(name string, line []byte) error
+}
+
+// Runner abstracts the execution of external commands
+// stdin may be nil, the combined output of the command is returned
+type Runner interface {
+	Run(stdin io.Reader, name string, args ...string) ([]byte, error)
+}
+
+// Accounts abstracts the lookup of system users and groups
+type Accounts interface {
+	// IsPrivileged checks if the current user may manage users, groups and services
+	IsPrivileged() bool
+	UserExists(username string) bool
+	GroupExists(group string) bool
+	UserInGroup(username, group string) bool
+}
+
+var (
+	files    FS       = OSFS{}
+	commands Runner   = ExecRunner{}
+	accounts Accounts = OSAccounts{}
+)
+
+// Files returns the filesystem used for all setup steps
+func Files() FS {
+	return files
+}
+
+// SetFS replaces the filesystem used for all setup steps
+func SetFS(fs FS) {
+	files = fs
+}
+
+// Commands returns the runner used for all external commands
+func Commands() Runner {
+	return commands
+}
+
+// SetRunner replaces the runner used for all external commands
+func SetRunner(runner Runner) {
+	commands = runner
+}
+
+// Users returns the lookup of system users and groups
+func Users() Accounts {
+	return accounts
+}
+
+// SetAccounts replaces the lookup of system users and groups
+func SetAccounts(a Accounts) {
+	accounts = a
+}
+
+// OSFS is the FS of the local machine
+type OSFS struct{}
+
+func (OSFS) ReadFile(name string) ([]byte, error) { return os.ReadFile(name) }
+func (OSFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+func (OSFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (OSFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (OSFS) Chmod(name string, mode os.FileMode) error    { return os.Chmod(name, mode) }
+func (OSFS) Remove(name string) error                     { return os.Remove(name) }
+func (OSFS) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (OSFS) ReadDir(name string) ([]string, error) {
+	entries, err := os.ReadDir(name)
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names, err
+}
+
+func (OSFS) AppendLine(name string, line []byte) error {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	unlock, err := lockFile(f)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	last := []byte{'\n'}
+	if info.Size() > 0 {
+		if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+			return err
+		}
+	}
+	_, err = f.Write(appendedLine(last[0], line))
+	return err
+}
+
+// appendedLine returns line as it is appended after the byte last, starting and ending with a newline as needed
+func appendedLine(last byte, line []byte) []byte {
+	data := make([]byte, 0, len(line)+2)
+	if last != '\n' {
+		data = append(data, '\n')
+	}
+	data = append(data, line...)
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	return data
+}
+
+// ExecRunner runs commands on the local machine
+type ExecRunner struct{}
+
+func (ExecRunner) Run(stdin io.Reader, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = stdin
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	return output.Bytes(), err
+}
+
+// OSAccounts looks up users and groups of the local machine
+type OSAccounts struct{}
+
+func (OSAccounts) IsPrivileged() bool {
+	if os.Geteuid() == 0 {
+		return true
+	}
+	currentUser, err := user.Current()
+	if err != nil {
+		return false
+	}
+
+	currentUserGroups, err := currentUser.GroupIds()
+	if err != nil {
+		return false
+	}
+	for _, groupID := range currentUserGroups {
+		systemGroup, err := user.LookupGroupId(groupID)
+		if err != nil {
+			continue
+		}
+		if systemGroup.Name == "sudo" {
+			return true
+		}
+	}
+	return false
+}
+
+func (OSAccounts) UserExists(username string) bool {
+	_, err := user.Lookup(username)
+	return err == nil
+}
+
+func (OSAccounts) GroupExists(group string) bool {
+	_, err := user.LookupGroup(group)
+	return err == nil
+}
+
+func (OSAccounts) UserInGroup(username, group string) bool {
+	usr, err := user.Lookup(username)
+	if err != nil {
+		return false
+	}
+	systemGroup, err := user.LookupGroup(group)
+	if err != nil {
+		return false
+	}
+	groupIDs, err := usr.GroupIds()
+	if err != nil {
+		return false
+	}
+	for _, groupID := range groupIDs {
+		if groupID == systemGroup.Gid {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAppendLineConcurrently(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := os.WriteFile(path, []byte("ssh-ed25519 AAAA existing"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := (OSFS{}).AppendLine(path, []byte(fmt.Sprintf("ssh-ed25519 AAAA key-%d", i))); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 21 || lines[0] != "ssh-ed25519 AAAA existing" {
+		t.Errorf("expected the existing line and 20 appended lines, got:\n%s", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %04o", info.Mode().Perm())
+	}
+	if err := (OSFS{}).AppendLine(filepath.Join(t.TempDir(), "missing"), []byte("line")); err == nil {
+		t.Error("appended to a missing file")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package system
+
+import "os"
+
+// lockFile does not lock without flock, appends stay single writes
+func lockFile(f *os.File) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,368 @@
+package system
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Plan records the changes of a dry run instead of applying them
+// It implements FS, Runner and Accounts on top of the real system:
+// reads see the planned changes, writes, commands and remote operations are only recorded
+type Plan struct {
+	base     FS
+	accounts Accounts
+
+	files    map[string]*plannedFile
+	order    []string
+	dirs     map[string]bool
+	commands []string
+	remote   []string
+
+	users       map[string]bool
+	memberships map[string]bool
+	// needsRoot is set when a change needs root access the current user does not have
+	needsRoot bool
+}
+
+type plannedFile struct {
+	existed      bool
+	original     []byte
+	originalMode os.FileMode
+	data         []byte
+	mode         os.FileMode
+	removed      bool
+}
+
+// NewPlan creates a plan on top of the provided filesystem and accounts
+func NewPlan(base FS, accounts Accounts) *Plan {
+	return &Plan{
+		base:        base,
+		accounts:    accounts,
+		files:       map[string]*plannedFile{},
+		dirs:        map[string]bool{},
+		users:       map[string]bool{},
+		memberships: map[string]bool{},
+	}
+}
+
+// Activate makes the plan the filesystem, runner and account lookup of this package
+func (p *Plan) Activate() {
+	SetFS(p)
+	SetRunner(p)
+	SetAccounts(p)
+}
+
+// RecordRemote records an operation on a remote host
+func (p *Plan) RecordRemote(operation string) {
+	p.remote = append(p.remote, operation)
+}
+
+func (p *Plan) file(name string) (*plannedFile, error) {
+	name = filepath.Clean(name)
+	if f, ok := p.files[name]; ok {
+		return f, nil
+	}
+	f := &plannedFile{}
+	info, err := p.base.Stat(name)
+	if err == nil {
+		data, err := p.base.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		f.existed = true
+		f.original = data
+		f.originalMode = info.Mode().Perm()
+		f.data = data
+		f.mode = f.originalMode
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	} else {
+		f.removed = true
+	}
+	p.files[name] = f
+	p.order = append(p.order, name)
+	return f, nil
+}
+
+func (p *Plan) ReadFile(name string) ([]byte, error) {
+	if f, ok := p.files[filepath.Clean(name)]; ok {
+		if f.removed {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		return append([]byte{}, f.data...), nil
+	}
+	return p.base.ReadFile(name)
+}
+
+func (p *Plan) WriteFile(name string, data []byte, perm os.FileMode) error {
+	f, err := p.file(name)
+	if err != nil {
+		return err
+	}
+	if f.removed {
+		f.mode = perm
+	}
+	f.removed = false
+	f.data = append([]byte{}, data...)
+	return nil
+}
+
+func (p *Plan) MkdirAll(path string, perm os.FileMode) error {
+	for dir := filepath.Clean(path); dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		p.dirs[dir] = true
+	}
+	return nil
+}
+
+func (p *Plan) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	if f, ok := p.files[name]; ok {
+		if f.removed {
+			return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+		}
+		return plannedInfo{name: filepath.Base(name), size: int64(len(f.data)), mode: f.mode}, nil
+	}
+	info, err := p.base.Stat(name)
+	if err != nil && p.dirs[name] {
+		return plannedInfo{name: filepath.Base(name), mode: fs.ModeDir | 0755}, nil
+	}
+	return info, err
+}
+
+func (p *Plan) Chmod(name string, mode os.FileMode) error {
+	if p.dirs[filepath.Clean(name)] {
+		return nil
+	}
+	if info, err := p.base.Stat(name); err == nil && info.IsDir() {
+		return nil
+	}
+	f, err := p.file(name)
+	if err != nil {
+		return err
+	}
+	if f.removed {
+		return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrNotExist}
+	}
+	f.mode = mode.Perm()
+	return nil
+}
+
+func (p *Plan) Remove(name string) error {
+	f, err := p.file(name)
+	if err != nil {
+		return err
+	}
+	if f.removed {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	f.removed = true
+	f.data = nil
+	return nil
+}
+
+func (p *Plan) Rename(oldpath, newpath string) error {
+	data, err := p.ReadFile(oldpath)
+	if err != nil {
+		return err
+	}
+	info, err := p.Stat(oldpath)
+	if err != nil {
+		return err
+	}
+	if err := p.WriteFile(newpath, data, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := p.Chmod(newpath, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return p.Remove(oldpath)
+}
+
+func (p *Plan) AppendLine(name string, line []byte) error {
+	data, err := p.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	last := byte('\n')
+	if len(data) > 0 {
+		last = data[len(data)-1]
+	}
+	f, err := p.file(name)
+	if err != nil {
+		return err
+	}
+	f.data = append(data, appendedLine(last, line)...)
+	return nil
+}
+
+func (p *Plan) ReadDir(name string) ([]string, error) {
+	name = filepath.Clean(name)
+	entries := map[string]bool{}
+	names, err := p.base.ReadDir(name)
+	if err != nil && !(os.IsNotExist(err) && p.dirs[name]) {
+		return nil, err
+	}
+	for _, entry := range names {
+		entries[entry] = true
+	}
+	for path, f := range p.files {
+		if filepath.Dir(path) == name {
+			entries[filepath.Base(path)] = !f.removed
+		}
+	}
+	for dir := range p.dirs {
+		if filepath.Dir(dir) == name {
+			entries[filepath.Base(dir)] = true
+		}
+	}
+	names = []string{}
+	for entry, exists := range entries {
+		if exists {
+			names = append(names, entry)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Run records the command, without its stdin, which carries the passwords, and simulates its effect on users and groups
+func (p *Plan) Run(stdin io.Reader, name string, args ...string) ([]byte, error) {
+	command := strings.Join(append([]string{name}, args...), " ")
+	if stdin != nil {
+		command += " < (stdin)"
+	}
+	p.commands = append(p.commands, command)
+
+	if name == "sudo" && len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	switch {
+	case name == "useradd" && len(args) > 0:
+		p.users[args[len(args)-1]] = true
+	case name == "userdel" && len(args) > 0:
+		p.users[args[len(args)-1]] = false
+	case name == "usermod" && len(args) == 3 && args[0] == "-aG":
+		p.memberships[args[2]+":"+args[1]] = true
+	case name == "gpasswd" && len(args) == 3 && args[0] == "-d":
+		p.memberships[args[1]+":"+args[2]] = false
+	}
+	return nil, nil
+}
+
+// IsPrivileged lets the dry run continue without root access, the plan reports that applying it needs root
+func (p *Plan) IsPrivileged() bool {
+	if !p.accounts.IsPrivileged() {
+		p.needsRoot = true
+	}
+	return true
+}
+
+func (p *Plan) UserExists(username string) bool {
+	if exists, ok := p.users[username]; ok {
+		return exists
+	}
+	return p.accounts.UserExists(username)
+}
+
+func (p *Plan) GroupExists(group string) bool {
+	return p.accounts.GroupExists(group)
+}
+
+func (p *Plan) UserInGroup(username, group string) bool {
+	if member, ok := p.memberships[username+":"+group]; ok {
+		return member
+	}
+	if exists, ok := p.users[username]; ok && !exists {
+		return false
+	}
+	return p.accounts.UserInGroup(username, group)
+}
+
+// Write prints the plan: files with their diffs, commands and remote operations
+func (p *Plan) Write(w io.Writer) error {
+	var out bytes.Buffer
+	out.WriteString("Files:\n")
+	changed := 0
+	for _, name := range p.order {
+		f := p.files[name]
+		switch {
+		case !f.existed && f.removed:
+			continue
+		case f.existed && f.removed:
+			fmt.Fprintf(&out, "  remove %s\n", name)
+		case !f.existed:
+			fmt.Fprintf(&out, "  create %s (%04o)\n", name, f.mode)
+		case !bytes.Equal(f.original, f.data) || f.mode != f.originalMode:
+			fmt.Fprintf(&out, "  modify %s", name)
+			if f.mode != f.originalMode {
+				fmt.Fprintf(&out, " (%04o -> %04o)", f.originalMode, f.mode)
+			}
+			out.WriteString("\n")
+		default:
+			continue
+		}
+		changed++
+		if f.removed {
+			continue
+		}
+		if bytes.Contains(f.data, []byte("PRIVATE KEY")) {
+			fmt.Fprintf(&out, "    (private key, %d bytes)\n", len(f.data))
+			continue
+		}
+		before := "/dev/null"
+		if f.existed {
+			before = name
+		}
+		diff := UnifiedDiff(before, name+" (planned)", f.original, f.data)
+		for _, line := range strings.SplitAfter(diff, "\n") {
+			if line != "" {
+				out.WriteString("    " + line)
+			}
+		}
+	}
+	if changed == 0 {
+		out.WriteString("  (none)\n")
+	}
+
+	out.WriteString("Commands:\n")
+	for _, command := range p.commands {
+		fmt.Fprintf(&out, "  $ %s\n", command)
+	}
+	if len(p.commands) == 0 {
+		out.WriteString("  (none)\n")
+	}
+
+	out.WriteString("Remote operations:\n")
+	for _, operation := range p.remote {
+		fmt.Fprintf(&out, "  %s\n", operation)
+	}
+	if len(p.remote) == 0 {
+		out.WriteString("  (none)\n")
+	}
+	if p.needsRoot {
+		out.WriteString("Applying the plan requires root access\n")
+	}
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+type plannedInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+}
+
+func (i plannedInfo) Name() string       { return i.name }
+func (i plannedInfo) Size() int64        { return i.size }
+func (i plannedInfo) Mode() os.FileMode  { return i.mode }
+func (i plannedInfo) ModTime() time.Time { return time.Time{} }
+func (i plannedInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i plannedInfo) Sys() any           { return nil }
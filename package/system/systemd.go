@@ -4,29 +4,44 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 const systemdDir = "/etc/systemd/system/"
 
+// SystemdServicePath returns the path of the unit file for the provided service
+// Names with a unit type suffix, like name.timer, are the path of that unit
+func SystemdServicePath(serviceName string) string {
+	if strings.HasSuffix(serviceName, timerSuffix) {
+		return systemdDir + serviceName
+	}
+	return systemdDir + serviceName + ".service"
+}
+
+const timerSuffix = ".timer"
+
+// SystemdTimerPath returns the path of the timer unit file for the provided service
+func SystemdTimerPath(serviceName string) string {
+	return systemdDir + serviceName + timerSuffix
+}
+
+// SystemdDropInPath returns the path of the drop-in name extending the provided service
+func SystemdDropInPath(serviceName, name string) string {
+	return fmt.Sprintf("%s%s.service.d/%s.conf", systemdDir, serviceName, name)
+}
+
 func CreateSystemdService(serviceName, description, execStart, user string) error {
 	slog.Debug("Creating systemd service")
 
 	slog.Debug("Verifying systemd directory")
-	_, err := os.Stat(systemdDir)
+	_, err := files.Stat(systemdDir)
 	if err != nil {
 		return fmt.Errorf("failed to check systemd directory: %v", err)
 	}
 
-	servicePath := systemdDir + serviceName + ".service"
-	slog.Debug("Creating service file")
-	serviceFile, err := os.Create(servicePath)
-	if err != nil {
-		return fmt.Errorf("failed to create service file: %v", err)
-	}
-
-	defer serviceFile.Close()
-
+	servicePath := SystemdServicePath(serviceName)
 	slog.Debug("Writing service configuration")
 	serviceConfig := fmt.Sprintf(`[Unit]
 Description=%s
@@ -41,19 +56,19 @@ User=%s
 WantedBy=multi-user.target
 `, description, execStart, user)
 
-	_, err = serviceFile.WriteString(serviceConfig)
+	err = files.WriteFile(servicePath, []byte(serviceConfig), 0644)
 	if err != nil {
 		return fmt.Errorf("failed to write service configuration: %v", err)
 	}
 
 	slog.Debug("Setting service file permissions")
-	err = os.Chmod(servicePath, 0644)
+	err = files.Chmod(servicePath, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to chmod service file: %v", err)
 	}
 
 	slog.Debug("Setting service user")
-	err = exec.Command("chown", user, servicePath).Run()
+	_, err = commands.Run(nil, "chown", user, servicePath)
 	if err != nil {
 		return fmt.Errorf("failed to set service user: %v", err)
 	}
@@ -61,20 +76,197 @@ WantedBy=multi-user.target
 	return nil
 }
 
+// CreateSystemdDaemon writes the unit of a service that runs execStart as the unprivileged user with only the capabilities
+// Unlike CreateSystemdService the unit stays owned by root, so user can't change what it runs as
+func CreateSystemdDaemon(serviceName, description, execStart, user string, capabilities ...string) error {
+	slog.Debug("Creating systemd daemon service")
+
+	_, err := files.Stat(systemdDir)
+	if err != nil {
+		return fmt.Errorf("failed to check systemd directory: %v", err)
+	}
+
+	serviceConfig := fmt.Sprintf(`[Unit]
+Description=%s
+After=network.target
+
+[Service]
+ExecStart=%s
+Restart=always
+User=%s
+Group=%s
+AmbientCapabilities=%s
+CapabilityBoundingSet=%s
+NoNewPrivileges=yes
+
+[Install]
+WantedBy=multi-user.target
+`, description, execStart, user, user, strings.Join(capabilities, " "), strings.Join(capabilities, " "))
+
+	err = files.WriteFile(SystemdServicePath(serviceName), []byte(serviceConfig), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write service configuration: %v", err)
+	}
+	return nil
+}
+
+// CreateSystemdOneshot writes the unit of a service that runs execStart as user once per start, like a timer job
+func CreateSystemdOneshot(serviceName, description, execStart, user string) error {
+	slog.Debug("Creating systemd oneshot service")
+
+	_, err := files.Stat(systemdDir)
+	if err != nil {
+		return fmt.Errorf("failed to check systemd directory: %v", err)
+	}
+
+	serviceConfig := fmt.Sprintf(`[Unit]
+Description=%s
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart=%s
+User=%s
+`, description, execStart, user)
+
+	err = files.WriteFile(SystemdServicePath(serviceName), []byte(serviceConfig), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write service configuration: %v", err)
+	}
+	return nil
+}
+
+// CreateSystemdTimer writes the timer unit starting the provided service every interval, the first time a while after boot
+func CreateSystemdTimer(serviceName, description string, interval time.Duration) error {
+	slog.Debug("Creating systemd timer")
+
+	_, err := files.Stat(systemdDir)
+	if err != nil {
+		return fmt.Errorf("failed to check systemd directory: %v", err)
+	}
+
+	timerConfig := fmt.Sprintf(`[Unit]
+Description=%s
+
+[Timer]
+OnBootSec=15min
+OnUnitActiveSec=%ds
+RandomizedDelaySec=15min
+
+[Install]
+WantedBy=timers.target
+`, description, int64(interval.Seconds()))
+
+	err = files.WriteFile(SystemdTimerPath(serviceName), []byte(timerConfig), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write timer configuration: %v", err)
+	}
+	return nil
+}
+
+// CreateSystemdDropIn writes the drop-in name with the settings of the [Service] section of the provided service
+func CreateSystemdDropIn(serviceName, name, settings string) error {
+	slog.Debug(fmt.Sprintf("Creating systemd drop-in %s for %s", name, serviceName))
+
+	path := SystemdDropInPath(serviceName, name)
+	err := files.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create drop-in directory: %v", err)
+	}
+	err = files.WriteFile(path, []byte("[Service]\n"+settings), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write drop-in: %v", err)
+	}
+
+	slog.Debug("Reloading systemd")
+	_, err = commands.Run(nil, "systemctl", "daemon-reload")
+	if err != nil {
+		return fmt.Errorf("failed to reload systemd: %v", err)
+	}
+	return nil
+}
+
+// EnableSystemdTimer enables and starts the timer of the provided service
+func EnableSystemdTimer(serviceName string) error {
+	slog.Debug("Enabling systemd timer")
+
+	_, err := commands.Run(nil, "systemctl", "daemon-reload")
+	if err != nil {
+		return fmt.Errorf("failed to reload systemd: %v", err)
+	}
+
+	_, err = commands.Run(nil, "systemctl", "enable", "--now", serviceName+timerSuffix)
+	if err != nil {
+		return fmt.Errorf("failed to enable timer: %v", err)
+	}
+	return nil
+}
+
+// RestartSystemdService restarts the provided service if it is running
+func RestartSystemdService(serviceName string) error {
+	slog.Debug(fmt.Sprintf("Restarting %s", serviceName))
+	_, err := commands.Run(nil, "systemctl", "try-restart", serviceName)
+	if err != nil {
+		return fmt.Errorf("failed to restart service: %v", err)
+	}
+	return nil
+}
+
+// SystemdServiceInstalled checks if the unit file of the provided service exists
+func SystemdServiceInstalled(serviceName string) bool {
+	_, err := files.Stat(SystemdServicePath(serviceName))
+	return err == nil
+}
+
+// SystemdAvailable checks if units can be installed
+func SystemdAvailable() bool {
+	_, err := files.Stat(systemdDir)
+	return err == nil
+}
+
 func EnableSystemdService(serviceName string) error {
 	slog.Debug("Enabling systemd service")
 
 	slog.Debug("Reloading systemd")
-	err := exec.Command("systemctl", "daemon-reload").Run()
+	_, err := commands.Run(nil, "systemctl", "daemon-reload")
 	if err != nil {
 		return fmt.Errorf("failed to reload systemd: %v", err)
 	}
 
 	slog.Debug("Enabling service")
-	err = exec.Command("systemctl", "enable", serviceName).Run()
+	_, err = commands.Run(nil, "systemctl", "enable", serviceName)
 	if err != nil {
 		return fmt.Errorf("failed to enable service: %v", err)
 	}
 
 	return nil
 }
+
+// RemoveSystemdService stops and disables the service and removes its unit file
+func RemoveSystemdService(serviceName string) error {
+	slog.Debug("Removing systemd service")
+
+	slog.Debug("Disabling service")
+	_, err := commands.Run(nil, "systemctl", "disable", "--now", serviceName)
+	if _, statErr := files.Stat(SystemdServicePath(serviceName)); err != nil && os.IsNotExist(statErr) {
+		// the unit is already gone, there is nothing left to disable
+		slog.Debug(fmt.Sprintf("Service %s already removed: %v", serviceName, err))
+	} else if err != nil {
+		return fmt.Errorf("failed to disable service: %v", err)
+	}
+
+	slog.Debug("Removing service file")
+	err = files.Remove(SystemdServicePath(serviceName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove service file: %v", err)
+	}
+
+	slog.Debug("Reloading systemd")
+	_, err = commands.Run(nil, "systemctl", "daemon-reload")
+	if err != nil {
+		return fmt.Errorf("failed to reload systemd: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,299 @@
+// Package systemtest provides in-memory fakes of the filesystem, command runner and accounts of package system
+package systemtest
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fbufler/ssh-tunnel-setup/package/system"
+)
+
+// Host bundles the fakes replacing the local machine
+type Host struct {
+	FS       *FS
+	Runner   *Runner
+	Accounts *Accounts
+}
+
+// Install replaces the filesystem, runner and accounts of package system with fresh fakes
+// for the duration of the test
+func Install(t testing.TB) *Host {
+	t.Helper()
+	files, commands, accounts := system.Files(), system.Commands(), system.Users()
+	t.Cleanup(func() {
+		system.SetFS(files)
+		system.SetRunner(commands)
+		system.SetAccounts(accounts)
+	})
+
+	host := &Host{FS: NewFS(), Accounts: NewAccounts()}
+	host.Runner = &Runner{Accounts: host.Accounts}
+	system.SetFS(host.FS)
+	system.SetRunner(host.Runner)
+	system.SetAccounts(host.Accounts)
+	return host
+}
+
+type file struct {
+	data []byte
+	mode os.FileMode
+}
+
+// FS is an in-memory system.FS, parent directories have to exist like on a real filesystem
+type FS struct {
+	files map[string]*file
+	dirs  map[string]os.FileMode
+}
+
+func NewFS() *FS {
+	return &FS{files: map[string]*file{}, dirs: map[string]os.FileMode{"/": 0755}}
+}
+
+// Seed writes the file and creates its parent directories
+func (f *FS) Seed(name string, data []byte, perm os.FileMode) {
+	f.MkdirAll(filepath.Dir(name), 0755)
+	f.files[filepath.Clean(name)] = &file{data: append([]byte{}, data...), mode: perm}
+}
+
+// Paths returns the paths of all files in lexical order
+func (f *FS) Paths() []string {
+	paths := make([]string, 0, len(f.files))
+	for path := range f.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+func (f *FS) ReadFile(name string) ([]byte, error) {
+	file, ok := f.files[filepath.Clean(name)]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	return append([]byte{}, file.data...), nil
+}
+
+func (f *FS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	name = filepath.Clean(name)
+	if _, ok := f.dirs[filepath.Dir(name)]; !ok {
+		return notExist("open", name)
+	}
+	if _, ok := f.dirs[name]; ok {
+		return &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if existing, ok := f.files[name]; ok {
+		existing.data = append([]byte{}, data...)
+		return nil
+	}
+	f.files[name] = &file{data: append([]byte{}, data...), mode: perm.Perm()}
+	return nil
+}
+
+func (f *FS) MkdirAll(path string, perm os.FileMode) error {
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if _, ok := f.files[dir]; ok {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: fs.ErrExist}
+		}
+		if _, ok := f.dirs[dir]; !ok {
+			f.dirs[dir] = perm.Perm()
+		}
+		if dir == "/" || dir == "." {
+			return nil
+		}
+	}
+}
+
+func (f *FS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	if file, ok := f.files[name]; ok {
+		return fileInfo{name: filepath.Base(name), size: int64(len(file.data)), mode: file.mode}, nil
+	}
+	if mode, ok := f.dirs[name]; ok {
+		return fileInfo{name: filepath.Base(name), mode: fs.ModeDir | mode}, nil
+	}
+	return nil, notExist("stat", name)
+}
+
+func (f *FS) Chmod(name string, mode os.FileMode) error {
+	name = filepath.Clean(name)
+	if file, ok := f.files[name]; ok {
+		file.mode = mode.Perm()
+		return nil
+	}
+	if _, ok := f.dirs[name]; ok {
+		f.dirs[name] = mode.Perm()
+		return nil
+	}
+	return notExist("chmod", name)
+}
+
+func (f *FS) Remove(name string) error {
+	name = filepath.Clean(name)
+	if _, ok := f.files[name]; ok {
+		delete(f.files, name)
+		return nil
+	}
+	if _, ok := f.dirs[name]; ok {
+		prefix := name + "/"
+		for path := range f.files {
+			if strings.HasPrefix(path, prefix) {
+				return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+			}
+		}
+		delete(f.dirs, name)
+		return nil
+	}
+	return notExist("remove", name)
+}
+
+func (f *FS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	file, ok := f.files[oldpath]
+	if !ok {
+		return notExist("rename", oldpath)
+	}
+	if _, ok := f.dirs[filepath.Dir(newpath)]; !ok {
+		return notExist("rename", newpath)
+	}
+	delete(f.files, oldpath)
+	f.files[newpath] = file
+	return nil
+}
+
+func (f *FS) AppendLine(name string, line []byte) error {
+	file, ok := f.files[filepath.Clean(name)]
+	if !ok {
+		return notExist("open", name)
+	}
+	if len(file.data) > 0 && !bytes.HasSuffix(file.data, []byte("\n")) {
+		file.data = append(file.data, '\n')
+	}
+	file.data = append(file.data, line...)
+	if !bytes.HasSuffix(file.data, []byte("\n")) {
+		file.data = append(file.data, '\n')
+	}
+	return nil
+}
+
+func (f *FS) ReadDir(name string) ([]string, error) {
+	name = filepath.Clean(name)
+	if _, ok := f.dirs[name]; !ok {
+		return nil, notExist("open", name)
+	}
+	names := []string{}
+	for path := range f.files {
+		if filepath.Dir(path) == name {
+			names = append(names, filepath.Base(path))
+		}
+	}
+	for dir := range f.dirs {
+		if dir != name && filepath.Dir(dir) == name {
+			names = append(names, filepath.Base(dir))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+type fileInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+}
+
+func (i fileInfo) Name() string       { return i.name }
+func (i fileInfo) Size() int64        { return i.size }
+func (i fileInfo) Mode() os.FileMode  { return i.mode }
+func (i fileInfo) ModTime() time.Time { return time.Time{} }
+func (i fileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i fileInfo) Sys() any           { return nil }
+
+// Runner records commands instead of executing them
+// useradd, userdel, usermod -aG and gpasswd -d are applied to Accounts
+type Runner struct {
+	Accounts *Accounts
+	// Commands holds every command run, stdin is appended as `< "input"`
+	Commands []string
+	// Handle, if set, provides the output and error of a command
+	Handle func(name string, args ...string) ([]byte, error)
+}
+
+func (r *Runner) Run(stdin io.Reader, name string, args ...string) ([]byte, error) {
+	command := strings.Join(append([]string{name}, args...), " ")
+	if stdin != nil {
+		input, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, err
+		}
+		command += ` < "` + strings.TrimSpace(string(input)) + `"`
+	}
+	r.Commands = append(r.Commands, command)
+
+	var output []byte
+	if r.Handle != nil {
+		var err error
+		output, err = r.Handle(name, args...)
+		if err != nil {
+			return output, err
+		}
+	}
+
+	if name == "sudo" && len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	switch {
+	case name == "useradd" && len(args) > 0:
+		r.Accounts.Users[args[len(args)-1]] = true
+	case name == "userdel" && len(args) > 0:
+		delete(r.Accounts.Users, args[len(args)-1])
+	case name == "usermod" && len(args) == 3 && args[0] == "-aG":
+		r.Accounts.AddMember(args[2], args[1])
+	case name == "gpasswd" && len(args) == 3 && args[0] == "-d":
+		delete(r.Accounts.Groups[args[2]], args[1])
+	}
+	return output, nil
+}
+
+// Accounts is an in-memory user and group database
+type Accounts struct {
+	Privileged bool
+	Users      map[string]bool
+	// Groups maps group names to their members
+	Groups map[string]map[string]bool
+}
+
+func NewAccounts() *Accounts {
+	return &Accounts{Privileged: true, Users: map[string]bool{}, Groups: map[string]map[string]bool{}}
+}
+
+// AddMember adds the user to the group, creating the group if needed
+func (a *Accounts) AddMember(username, group string) {
+	if a.Groups[group] == nil {
+		a.Groups[group] = map[string]bool{}
+	}
+	a.Groups[group][username] = true
+}
+
+func (a *Accounts) IsPrivileged() bool { return a.Privileged }
+
+func (a *Accounts) UserExists(username string) bool { return a.Users[username] }
+
+func (a *Accounts) GroupExists(group string) bool {
+	_, ok := a.Groups[group]
+	return ok
+}
+
+func (a *Accounts) UserInGroup(username, group string) bool {
+	return a.Users[username] && a.Groups[group][username]
+}
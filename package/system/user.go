@@ -1,11 +1,10 @@
 package system
 
 import (
+	"bytes"
 	"fmt"
-	"os/exec"
 	"os/user"
 	"runtime"
-	"strings"
 )
 
 func checkOS(assumed string) bool {
@@ -13,40 +12,18 @@ func checkOS(assumed string) bool {
 	return currentOS == assumed
 }
 
-func checkSudo() bool {
-	currentUser, err := user.Current()
-	if err != nil {
-		return false
-	}
-
-	currentUserGroups, err := currentUser.GroupIds()
-	if err != nil {
-		return false
-	}
-	for _, groupID := range currentUserGroups {
-		systemGroup, err := user.LookupGroupId(groupID)
-		if err != nil {
-			continue
-		}
-		if systemGroup.Name == "sudo" {
-			return true
-		}
-	}
-	return false
-}
-
 func UserExists(username string) bool {
-	_, err := user.Lookup(username)
-	return err == nil
+	return accounts.UserExists(username)
 }
 
-// CreateUser creates a new user with the provided username and password
-func CreateUser(username, password string) error {
+// CreateUser creates the user with a home directory
+// The password is only passed to chpasswd on stdin, without a password the account is locked for password logins
+func CreateUser(username string, password []byte) error {
 	if !checkOS("linux") {
 		return fmt.Errorf("only supported on Linux")
 	}
 
-	if !checkSudo() {
+	if !accounts.IsPrivileged() {
 		return fmt.Errorf("root access is required for user creation")
 	}
 
@@ -54,15 +31,28 @@ func CreateUser(username, password string) error {
 		return fmt.Errorf("user %s already exists", username)
 	}
 
-	cmd := exec.Command("sudo", "useradd", "-m", "-p", password, username)
-	err := cmd.Run()
+	_, err := commands.Run(nil, "sudo", "useradd", "-m", username)
 	if err != nil {
 		return fmt.Errorf("failed to create user: %v", err)
 	}
 
-	cmd = exec.Command("sudo", "chpasswd")
-	cmd.Stdin = strings.NewReader(fmt.Sprintf("%s:%s", username, password))
-	err = cmd.Run()
+	if len(password) == 0 {
+		_, err = commands.Run(nil, "sudo", "passwd", "-l", username)
+		if err != nil {
+			return fmt.Errorf("failed to lock user password: %v", err)
+		}
+		return nil
+	}
+
+	input := make([]byte, 0, len(username)+len(password)+2)
+	input = append(append(append(input, username...), ':'), password...)
+	input = append(input, '\n')
+	defer func() {
+		for i := range input {
+			input[i] = 0
+		}
+	}()
+	_, err = commands.Run(bytes.NewReader(input), "sudo", "chpasswd")
 	if err != nil {
 		return fmt.Errorf("failed to set user password: %v", err)
 	}
@@ -71,8 +61,12 @@ func CreateUser(username, password string) error {
 }
 
 func groupExists(group string) bool {
-	_, err := user.LookupGroup(group)
-	return err == nil
+	return accounts.GroupExists(group)
+}
+
+// UserInGroup checks if the user is a member of the group
+func UserInGroup(username, group string) bool {
+	return accounts.UserInGroup(username, group)
 }
 
 func AddUserToGroup(username, group string) error {
@@ -80,7 +74,7 @@ func AddUserToGroup(username, group string) error {
 		return fmt.Errorf("only supported on Linux")
 	}
 
-	if !checkSudo() {
+	if !accounts.IsPrivileged() {
 		return fmt.Errorf("root access is required for user management")
 	}
 
@@ -92,8 +86,7 @@ func AddUserToGroup(username, group string) error {
 		return fmt.Errorf("group %s does not exist", group)
 	}
 
-	cmd := exec.Command("sudo", "usermod", "-aG", group, username)
-	err := cmd.Run()
+	_, err := commands.Run(nil, "sudo", "usermod", "-aG", group, username)
 	if err != nil {
 		return fmt.Errorf("failed to add user to group: %v", err)
 	}
@@ -101,6 +94,49 @@ func AddUserToGroup(username, group string) error {
 	return nil
 }
 
+// RemoveUser deletes the user including its home directory
+func RemoveUser(username string) error {
+	if !checkOS("linux") {
+		return fmt.Errorf("only supported on Linux")
+	}
+
+	if !accounts.IsPrivileged() {
+		return fmt.Errorf("root access is required for user removal")
+	}
+
+	if !UserExists(username) {
+		return nil
+	}
+
+	_, err := commands.Run(nil, "sudo", "userdel", "-r", username)
+	if err != nil {
+		return fmt.Errorf("failed to remove user: %v", err)
+	}
+
+	return nil
+}
+
+func RemoveUserFromGroup(username, group string) error {
+	if !checkOS("linux") {
+		return fmt.Errorf("only supported on Linux")
+	}
+
+	if !accounts.IsPrivileged() {
+		return fmt.Errorf("root access is required for user management")
+	}
+
+	if !UserExists(username) || !groupExists(group) {
+		return nil
+	}
+
+	_, err := commands.Run(nil, "sudo", "gpasswd", "-d", username, group)
+	if err != nil {
+		return fmt.Errorf("failed to remove user from group: %v", err)
+	}
+
+	return nil
+}
+
 func HomeDir() (string, error) {
 	usr, err := user.Current()
 	if err != nil {
@@ -1,6 +1,7 @@
 #!/bin/bash
 
 # Build the go binary based on the architecture argument passed
+# Cross-compiled binaries are built without cgo and do not support PKCS #11 tokens (--key-source pkcs11)
 
 arch=$1
 os=$2